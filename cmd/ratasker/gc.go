@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"time"
+)
+
+// runGCCommand removes files without rows and rows without files once
+func runGCCommand(ctx context.Context, args []string, db database.Database) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	grace := flags.Duration("grace", core.OrphanGracePeriod, "skip files and rows newer than this")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("flags.Parse(args). %w", err)
+	}
+
+	fileHandler, err := io.MakeBlossomIOFromOsEnv(os.Getenv(core.SEED))
+	if err != nil {
+		return fmt.Errorf("io.MakeBlossomIOFromOsEnv(seed). %w", err)
+	}
+
+	report, err := core.CollectGarbage(ctx, db, fileHandler, core.GCOptions{DryRun: *dryRun, GracePeriod: *grace}, time.Now())
+	if err != nil {
+		return fmt.Errorf("core.CollectGarbage(ctx, db, fileHandler, options, now). %w", err)
+	}
+
+	slog.InfoContext(ctx, "gc finished", "orphan_files", report.OrphanFiles, "stale_rows", report.StaleRows, "dry_run", *dryRun)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"time"
+)
+
+const ledgerUsage = "usage: ratasker ledger report [-format json|csv] [-since 2006-01-02] [-until 2006-01-02]"
+
+// runLedgerCommand prints the revenue per day, blob and mint
+func runLedgerCommand(ctx context.Context, args []string, db database.Database) error {
+	if len(args) == 0 || args[0] != "report" {
+		return fmt.Errorf(ledgerUsage)
+	}
+
+	flags := flag.NewFlagSet("ledger report", flag.ContinueOnError)
+	format := flags.String("format", core.ReportFormatCSV, "json or csv")
+	since := flags.String("since", "", "first day of the report")
+	until := flags.String("until", "", "last day of the report, today by default")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("flags.Parse(args). %w", err)
+	}
+
+	start, end, err := core.ParseReportPeriod(*since, *until, time.Now())
+	if err != nil {
+		return fmt.Errorf("core.ParseReportPeriod(since, until, now). %w", err)
+	}
+
+	report, err := core.LoadRevenueReport(ctx, db, start, end)
+	if err != nil {
+		return fmt.Errorf("core.LoadRevenueReport(ctx, db, start, end). %w", err)
+	}
+
+	switch *format {
+	case core.ReportFormatCSV:
+		return core.WriteRevenueReportCSV(os.Stdout, report)
+	case core.ReportFormatJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	default:
+		return core.ErrUnknownReportFormat
+	}
+}
@@ -2,23 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
-	"ratasker/external/nostr"
+	"os/signal"
 	"ratasker/internal/cashu"
 	"ratasker/internal/core"
 	"ratasker/internal/database"
+	"ratasker/internal/health"
 	"ratasker/internal/io"
+	"ratasker/internal/jobs"
+	"ratasker/internal/logging"
+	"ratasker/internal/metrics"
 	"ratasker/internal/routes"
 	"ratasker/internal/utils"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
@@ -26,6 +34,10 @@ var (
 	DOCKER_ENV = "DOCKER"
 )
 
+// ShutdownTimeout is how long requests and jobs have to finish after SIGTERM. A key rotation that
+// already started can always finish
+const ShutdownTimeout = core.KeyRotationTimeout
+
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -38,31 +50,57 @@ func CORSMiddleware() gin.HandlerFunc {
 }
 
 func main() {
-	ctx := context.Background()
+	// SIGTERM from systemd stops the server and the background jobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	_ = godotenv.Load()
 
-	homeDir, err := utils.GetRastaskerHomeDirectory()
+	err := logging.Setup(os.Getenv(logging.LOG_LEVEL))
 	if err != nil {
-		log.Panicf(`utils.GetRastaskerHomeDirectory(). %+v`, err)
+		log.Panicf(`logging.Setup(os.Getenv(logging.LOG_LEVEL)). %+v`, err)
 	}
 
-	log.Println("Current home dir: ", homeDir)
-
-	sqlite, err := database.DatabaseSetup(ctx, homeDir, database.EmbedMigrations)
-	defer sqlite.Db.Close()
-
+	homeDir, err := utils.GetRastaskerHomeDirectory()
 	if err != nil {
-		log.Panicf(`database.DatabaseSetup(ctx, "migrations"). %+v`, err)
+		log.Panicf(`utils.GetRastaskerHomeDirectory(). %+v`, err)
 	}
 
-	r := gin.Default()
+	slog.InfoContext(ctx, "Current home dir", "path", homeDir)
 
-	fileHandler, err := io.MakeFileSystemHandler()
+	// SQLite in the home directory unless DATABASE_URL points to Postgres
+	db, err := database.SetupFromDSN(ctx, os.Getenv(database.DATABASE_URL), homeDir)
 	if err != nil {
-		log.Panicf(`io.MakeFileSystemHandler(). %+v`, err)
+		log.Panicf(`database.SetupFromDSN(ctx, os.Getenv(database.DATABASE_URL), homeDir). %+v`, err)
+	}
+	defer db.Close()
+
+	// maintenance commands run once and exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "storage":
+			err = runStorageCommand(ctx, os.Args[2:], db)
+		case "scrub":
+			err = runScrubCommand(ctx, os.Args[2:], db)
+		case "gc":
+			err = runGCCommand(ctx, os.Args[2:], db)
+		case "ledger":
+			err = runLedgerCommand(ctx, os.Args[2:], db)
+		case "moderation":
+			err = runModerationCommand(ctx, os.Args[2:], db)
+		default:
+			err = fmt.Errorf("unknown command %v", os.Args[1])
+		}
+		if err != nil {
+			log.Fatalf("%v. %+v", os.Args[1], err)
+		}
+		return
 	}
 
+	// gin's logger is replaced by the JSON request log
+	r := gin.New()
+	r.Use(gin.Recovery(), logging.GinMiddleware(), metrics.GinMiddleware())
+
 	domain := os.Getenv(utils.DOMAIN)
 	if domain == "" {
 		log.Panicf("\n Domain needs to be set\n")
@@ -72,10 +110,15 @@ func main() {
 		log.Panicf("\n No seed phrase set \n")
 	}
 
+	fileHandler, err := io.MakeBlossomIOFromOsEnv(seed)
+	if err != nil {
+		log.Panicf(`io.MakeBlossomIOFromOsEnv(seed). %+v`, err)
+	}
+
 	// try to load new wallet for test
-	wallet, err := cashu.NewDBLocalWallet(seed, sqlite)
+	wallet, err := cashu.NewDBLocalWallet(ctx, seed, db)
 	if err != nil {
-		log.Panicf(`cashu.NewDBLocalWallet(os.Getenv("SEED"), sqlite) %+va`, err)
+		log.Panicf(`cashu.NewDBLocalWallet(ctx, seed, db) %+v`, err)
 	}
 
 	r.Use(cors.New(cors.Config{
@@ -119,96 +162,348 @@ func main() {
 		log.Panicf(`Could not convert upload cost %+v`, err)
 	}
 
-	routes.UploadRoutes(r, &wallet, sqlite, fileHandler, uploadCost)
-	routes.RootRoutes(r, &wallet, sqlite, fileHandler, downloadCost)
+	grantDownloads := uint64(core.DefaultAccessGrantDownloads)
+	grantDownloadsStr := os.Getenv(core.ACCESS_GRANT_DOWNLOADS)
+	if grantDownloadsStr != "" {
+		grantDownloads, err = strconv.ParseUint(grantDownloadsStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert access grant downloads %+v`, err)
+		}
+	}
+	grantMinutes := uint64(core.DefaultAccessGrantMinutes)
+	grantMinutesStr := os.Getenv(core.ACCESS_GRANT_MINUTES)
+	if grantMinutesStr != "" {
+		grantMinutes, err = strconv.ParseUint(grantMinutesStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert access grant minutes %+v`, err)
+		}
+	}
 
-	// rotate keys when expiration happens
-	go func() {
-		for {
-			// Check if expiration of pubkey already happened
-			now := time.Now().Add(1 * time.Minute).Unix()
-			if now > int64(wallet.PubkeyVersion.Expiration) {
-				func() {
-					log.Println("begining key rotation")
-					// rotate keys up
-					tx, err := sqlite.BeginTransaction()
-					if err != nil {
-						log.Panicf("Could not get a lock on the db. %+v", err)
-					}
-					beforeRotation := wallet.PubkeyVersion
-					// Ensure that the transaction is rolled back in case of a panic or error
-					defer func() {
-						if p := recover(); p != nil {
-							log.Printf("\n Rolling back  because of failure %+v\n", p)
-							wallet.PubkeyVersion = beforeRotation
-							tx.Rollback()
-						} else if err != nil {
-							log.Println("Rolling back  because of error")
-							wallet.PubkeyVersion = beforeRotation
-							tx.Rollback()
-						} else {
-							err = tx.Commit()
-							if err != nil {
-								log.Printf("\n Failed to commit transaction: %v\n", err)
-							}
-							fmt.Println("Key rotation finished successfully")
-						}
-					}()
-
-					// move locked proofs to valid swap
-					err = core.RotateLockedProofs(&wallet, sqlite, tx)
-					if err != nil {
-						log.Panicf("core.RotateLockedProofs(&wallet, sqlite, tx). %+v", err)
-					}
-
-					err = wallet.RotatePubkey(tx, sqlite)
-					if err != nil {
-						log.Panicf("wallet.RotatePubkey(tx, sqlite). %+v", err)
-					}
-
-					log.Println("Finished key rotation")
-				}()
-				err := core.SpendSwappedProofs(&wallet, sqlite)
-				if err != nil {
-					log.Printf("core.SpendSwappedProofs(&wallet, sqlite). %+v ", err)
-				}
+	grantSigner, err := core.NewAccessGrantSigner(seed, grantDownloads, time.Duration(grantMinutes)*time.Minute)
+	if err != nil {
+		log.Panicf(`core.NewAccessGrantSigner(seed, grantDownloads, grantMinutes) %+v`, err)
+	}
 
-			}
+	freeMonthlyBytes := uint64(0)
+	freeMonthlyBytesStr := os.Getenv(core.FREE_MONTHLY_BYTES)
+	if freeMonthlyBytesStr != "" {
+		freeMonthlyBytes, err = strconv.ParseUint(freeMonthlyBytesStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert free monthly bytes %+v`, err)
+		}
+	}
 
-			time.Sleep(10 * time.Second)
+	maxStorageBytes := uint64(0)
+	maxStorageBytesStr := os.Getenv(core.MAX_STORAGE_BYTES)
+	if maxStorageBytesStr != "" {
+		maxStorageBytes, err = strconv.ParseUint(maxStorageBytesStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert max storage bytes %+v`, err)
 		}
+	}
 
-	}()
+	policy, err := core.NewPaymentPolicy(os.Getenv(core.AUTHORIZED_KEYS), freeMonthlyBytes, maxStorageBytes)
+	if err != nil {
+		log.Panicf(`core.NewPaymentPolicy(os.Getenv(core.AUTHORIZED_KEYS), freeMonthlyBytes, maxStorageBytes) %+v`, err)
+	}
+	maxBlobBytesStr := os.Getenv(core.MAX_BLOB_BYTES)
+	if maxBlobBytesStr != "" {
+		policy.MaxBlobBytes, err = strconv.ParseUint(maxBlobBytesStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert max blob bytes %+v`, err)
+		}
+	}
 
-	log.Println("ratasker started in port 8070")
-	r.Run("0.0.0.0:8070")
-}
+	// the server signs announcements and NIP-94 events with a key from the seed
+	announceKey, err := core.AnnouncementKeyFromSeed(seed)
+	if err != nil {
+		log.Panicf(`core.AnnouncementKeyFromSeed(seed) %+v`, err)
+	}
+	announceRelays := core.ParseRelayList(os.Getenv(core.ANNOUNCE_RELAYS))
+	nip94Relays := core.ParseRelayList(os.Getenv(core.NIP94_RELAYS))
+	if len(nip94Relays) == 0 {
+		nip94Relays = announceRelays
+	}
+	nip94Publisher := core.NewNIP94Publisher(ctx, nip94Relays, announceKey)
 
-func NostrAutMiddleware() gin.HandlerFunc {
-	authorizedKeys := os.Getenv("AUTHORIZED_KEYS")
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
+	hotStorageBytes := uint64(0)
+	hotStorageBytesStr := os.Getenv(io.HOT_STORAGE_BYTES)
+	if hotStorageBytesStr != "" {
+		hotStorageBytes, err = strconv.ParseUint(hotStorageBytesStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert hot storage bytes %+v`, err)
+		}
+	}
+	hotMinDownloads := uint64(core.DefaultHotTierMinDownloads)
+	hotMinDownloadsStr := os.Getenv(core.HOT_TIER_MIN_DOWNLOADS)
+	if hotMinDownloadsStr != "" {
+		hotMinDownloads, err = strconv.ParseUint(hotMinDownloadsStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert hot tier min downloads %+v`, err)
+		}
+	}
+	tierMinutes := uint64(core.DefaultTierIntervalMinutes)
+	tierMinutesStr := os.Getenv(core.TIER_INTERVAL_MINUTES)
+	if tierMinutesStr != "" {
+		tierMinutes, err = strconv.ParseUint(tierMinutesStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert tier interval %+v`, err)
+		}
+	}
+
+	// downloads are only counted when there are tiers to move blobs between
+	var downloads *core.DownloadCounter
+	if hotStorageBytes > 0 && tierMinutes > 0 {
+		downloads = core.NewDownloadCounter()
+	}
 
-		event, err := nostr.ParseNostrHeader(authHeader)
+	routes.UploadRoutes(r, &wallet, db, fileHandler, uploadCost, policy, nip94Publisher)
+	routes.RootRoutes(r, &wallet, db, fileHandler, downloadCost, grantSigner, policy, downloads)
+	routes.LedgerRoutes(r, db, domain, pubkey.(string))
+	routes.ModerationRoutes(r, db, fileHandler, domain, pubkey.(string))
+	routes.InfoRoutes(r, &wallet, uploadCost, downloadCost, policy)
+
+	err = metrics.RegisterStorageCollector(db)
+	if err != nil {
+		log.Panicf(`metrics.RegisterStorageCollector(db) %+v`, err)
+	}
+	metricsServer := metrics.ServerFromOsEnv()
+
+	supervisor := jobs.NewSupervisor()
+
+	minFreeStorageBytes := uint64(health.DefaultMinFreeStorageBytes)
+	minFreeStorageBytesStr := os.Getenv(health.MIN_FREE_STORAGE_BYTES)
+	if minFreeStorageBytesStr != "" {
+		minFreeStorageBytes, err = strconv.ParseUint(minFreeStorageBytesStr, 10, 64)
 		if err != nil {
-			c.JSON(401, nostr.NotifMessage{Message: "Missing auth event"})
-			return
+			log.Panicf(`Could not convert min free storage bytes %+v`, err)
 		}
+	}
+	trustedMint, err := cashu.GetTrustedMintFromOsEnv()
+	if err != nil {
+		log.Panicf(`cashu.GetTrustedMintFromOsEnv() %+v`, err)
+	}
 
-		if authorizedKeys != "" {
-			if strings.Contains(authHeader, event.PubKey) {
-				c.JSON(401, nostr.NotifMessage{Message: "unauthorized"})
+	checker := health.NewChecker(health.CacheDuration)
+	checker.Add("database", health.DatabaseCheck(db))
+	checker.Add("storage", health.StorageCheck(fileHandler, minFreeStorageBytes))
+	checker.Add("mint "+trustedMint, health.MintCheck(trustedMint))
+	checker.Add("key rotation", health.KeyRotationCheck(db))
+	checker.Add("jobs", health.JobsCheck(supervisor))
+	routes.HealthRoutes(r, checker)
+
+	// rotate keys when expiration happens. A swap with the mint is never cut by a shutdown
+	addJob(supervisor, jobs.Job{
+		Name:             "key rotation",
+		Interval:         core.RotationCheckInterval,
+		RunAtStart:       true,
+		FinishOnShutdown: true,
+		Run: func(ctx context.Context) error {
+			_, err := core.RotateExpiredKeys(ctx, &wallet, db, time.Now())
+			return err
+		},
+	})
+
+	// hand the swapped proofs to the owner
+	addJob(supervisor, jobs.Job{
+		Name:             "payout",
+		Interval:         core.PayoutInterval,
+		RunAtStart:       true,
+		FinishOnShutdown: true,
+		Run: func(ctx context.Context) error {
+			return core.SpendSwappedProofs(ctx, &wallet, db)
+		},
+	})
+
+	addJob(supervisor, jobs.Job{
+		Name:     "access grants",
+		Interval: core.AccessGrantCleanupInterval,
+		Run: func(ctx context.Context) error {
+			grantSigner.RemoveExpired(time.Now())
+			return nil
+		},
+	})
+
+	scrubHours := uint64(core.DefaultScrubIntervalHours)
+	scrubHoursStr := os.Getenv(core.SCRUB_INTERVAL_HOURS)
+	if scrubHoursStr != "" {
+		scrubHours, err = strconv.ParseUint(scrubHoursStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert scrub interval %+v`, err)
+		}
+	}
+	scrubBytesPerSecond := uint64(core.DefaultScrubBytesPerSecond)
+	scrubBytesPerSecondStr := os.Getenv(core.SCRUB_BYTES_PER_SECOND)
+	if scrubBytesPerSecondStr != "" {
+		scrubBytesPerSecond, err = strconv.ParseUint(scrubBytesPerSecondStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert scrub bytes per second %+v`, err)
+		}
+	}
 
-			}
+	// check stored blobs in the background. Scheduled runs only report
+	if scrubHours > 0 {
+		addJob(supervisor, jobs.Job{
+			Name:     "scrub",
+			Interval: time.Duration(scrubHours) * time.Hour,
+			Run: func(ctx context.Context) error {
+				report, err := core.ScrubBlobs(ctx, db, fileHandler, core.ScrubOptions{BytesPerSecond: scrubBytesPerSecond})
+				if err != nil {
+					return fmt.Errorf("core.ScrubBlobs(ctx, db, fileHandler, options). %w", err)
+				}
+				core.LogScrubReport(ctx, report)
+				return nil
+			},
+		})
+	}
+
+	gcHours := uint64(core.DefaultGCIntervalHours)
+	gcHoursStr := os.Getenv(core.GC_INTERVAL_HOURS)
+	if gcHoursStr != "" {
+		gcHours, err = strconv.ParseUint(gcHoursStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert gc interval %+v`, err)
+		}
+	}
+	gcGrace := core.OrphanGracePeriod
+	gcGraceStr := os.Getenv(core.GC_GRACE_MINUTES)
+	if gcGraceStr != "" {
+		gcGraceMinutes, err := strconv.ParseUint(gcGraceStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert gc grace minutes %+v`, err)
+		}
+		gcGrace = time.Duration(gcGraceMinutes) * time.Minute
+	}
+	gcDelete := false
+	gcDeleteStr := os.Getenv(core.GC_DELETE)
+	if gcDeleteStr != "" {
+		gcDelete, err = strconv.ParseBool(gcDeleteStr)
+		if err != nil {
+			log.Panicf(`Could not convert gc delete %+v`, err)
+		}
+	}
+
+	// find what failed uploads and deletes leave behind. It is only removed when GC_DELETE is on
+	if gcHours > 0 {
+		addJob(supervisor, jobs.Job{
+			Name:     "gc",
+			Interval: time.Duration(gcHours) * time.Hour,
+			Run: func(ctx context.Context) error {
+				report, err := core.CollectGarbage(ctx, db, fileHandler, core.GCOptions{DryRun: !gcDelete, GracePeriod: gcGrace}, time.Now())
+				if err != nil {
+					return fmt.Errorf("core.CollectGarbage(ctx, db, fileHandler, options, now). %w", err)
+				}
+				slog.InfoContext(ctx, "gc finished", "orphan_files", report.OrphanFiles, "stale_rows", report.StaleRows, "dry_run", !gcDelete)
+				return nil
+			},
+		})
+	}
+
+	// move blobs between the hot and cold storage
+	if downloads != nil {
+		addJob(supervisor, jobs.Job{
+			Name:     "storage tiers",
+			Interval: time.Duration(tierMinutes) * time.Minute,
+			Run: func(ctx context.Context) error {
+				err := downloads.Flush(ctx, db)
+				if err != nil {
+					return fmt.Errorf("downloads.Flush(ctx, db). %w", err)
+				}
+				report, err := core.RebalanceTiers(ctx, db, fileHandler, hotStorageBytes, hotMinDownloads, time.Now())
+				if err != nil {
+					return fmt.Errorf("core.RebalanceTiers(ctx, db, fileHandler, hotStorageBytes, hotMinDownloads). %w", err)
+				}
+				if report.Promoted > 0 || report.Demoted > 0 {
+					slog.InfoContext(ctx, "Storage tiers rebalanced", "promoted", report.Promoted, "demoted", report.Demoted, "hot_bytes", report.HotBytes)
+				}
+				return nil
+			},
+		})
+	}
+
+	announceHours := uint64(core.DefaultAnnounceIntervalHours)
+	announceHoursStr := os.Getenv(core.ANNOUNCE_INTERVAL_HOURS)
+	if announceHoursStr != "" {
+		announceHours, err = strconv.ParseUint(announceHoursStr, 10, 64)
+		if err != nil {
+			log.Panicf(`Could not convert announce interval %+v`, err)
 		}
+	}
+
+	// publish the server and its prices so clients can find it on nostr
+	if len(announceRelays) > 0 && announceHours > 0 {
+		announcePool := nostr.NewSimplePool(ctx)
+		addJob(supervisor, jobs.Job{
+			Name:       "announce",
+			Interval:   time.Duration(announceHours) * time.Hour,
+			RunAtStart: true,
+			Run: func(ctx context.Context) error {
+				return core.AnnounceServer(ctx, announcePool, announceRelays, announceKey, domain, &wallet, uploadCost, downloadCost, policy)
+			},
+		})
+	}
+
+	supervisor.Start(ctx)
+
+	server := &http.Server{Addr: "0.0.0.0:8070", Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	slog.InfoContext(ctx, "ratasker started", "port", 8070)
+
+	if metricsServer != nil {
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.ErrorContext(ctx, "metricsServer.ListenAndServe()", "error", err)
+			}
+		}()
+		slog.InfoContext(ctx, "Serving metrics", "addr", metricsServer.Addr)
+	}
+
+	select {
+	case <-ctx.Done():
+		slog.InfoContext(ctx, "Shutting down")
+	case err := <-serverErr:
+		slog.ErrorContext(ctx, "server.ListenAndServe()", "error", err)
+		stop()
+	}
+
+	// in flight requests and key rotations get some time to finish
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ShutdownTimeout)
+	defer cancel()
 
-		err = nostr.ValidateAuthEvent(event)
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.ErrorContext(shutdownCtx, "server.Shutdown(shutdownCtx)", "error", err)
+	}
+	if metricsServer != nil {
+		err = metricsServer.Shutdown(shutdownCtx)
 		if err != nil {
-			c.JSON(401, nostr.NotifMessage{Message: "Invalid nostr event"})
-			return
+			slog.ErrorContext(shutdownCtx, "metricsServer.Shutdown(shutdownCtx)", "error", err)
 		}
+	}
+	err = supervisor.Wait(shutdownCtx)
+	if err != nil {
+		slog.ErrorContext(shutdownCtx, "supervisor.Wait(shutdownCtx)", "error", err)
+	}
+	if downloads != nil {
+		err = downloads.Flush(shutdownCtx, db)
+		if err != nil {
+			slog.ErrorContext(shutdownCtx, "downloads.Flush(shutdownCtx, db)", "error", err)
+		}
+	}
+	err = nip94Publisher.Wait(shutdownCtx)
+	if err != nil {
+		slog.ErrorContext(shutdownCtx, "nip94Publisher.Wait(shutdownCtx)", "error", err)
+	}
+	slog.InfoContext(shutdownCtx, "ratasker stopped")
+}
 
-		c.Set(utils.NOSTRAUTH, event)
-		c.Next()
+func addJob(supervisor *jobs.Supervisor, job jobs.Job) {
+	err := supervisor.Add(job)
+	if err != nil {
+		log.Panicf(`supervisor.Add(job) %+v`, err)
 	}
 }
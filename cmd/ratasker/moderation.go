@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"time"
+)
+
+const moderationUsage = "usage: ratasker moderation reports [-status pending|dismissed|blocked|all] | blocked | block <sha256> [-reason text] | dismiss <sha256> | unblock <sha256>" +
+	" | blocked-pubkeys | block-pubkey <pubkey> [-reason text] | unblock-pubkey <pubkey> | import <file> | audit [-limit n]"
+
+// moderationActor is the actor of the blocklist changes made from the command line
+const moderationActor = "cli"
+
+// runModerationCommand reviews the reports and manages the blocklist without going through the admin endpoints
+func runModerationCommand(ctx context.Context, args []string, db database.Database) error {
+	if len(args) == 0 {
+		return fmt.Errorf(moderationUsage)
+	}
+	now := uint64(time.Now().Unix())
+
+	switch args[0] {
+	case "reports":
+		flags := flag.NewFlagSet("moderation reports", flag.ContinueOnError)
+		status := flags.String("status", database.ReportPending, "pending, dismissed, blocked or all")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("flags.Parse(args). %w", err)
+		}
+		if *status == "all" {
+			*status = ""
+		}
+
+		var reports []database.BlobReport
+		err = database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			reports, err = db.GetBlobReports(ctx, tx, *status)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("db.GetBlobReports(ctx, tx, status). %w", err)
+		}
+		return printJSON(reports)
+
+	case "blocked":
+		var blocked []database.BlockedBlob
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			blocked, err = db.GetBlockedBlobs(ctx, tx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("db.GetBlockedBlobs(ctx, tx). %w", err)
+		}
+		return printJSON(blocked)
+
+	case "block":
+		flags := flag.NewFlagSet("moderation block", flag.ContinueOnError)
+		reason := flags.String("reason", "", "why the blob is blocked")
+		if len(args) < 2 {
+			return fmt.Errorf(moderationUsage)
+		}
+		err := flags.Parse(args[2:])
+		if err != nil {
+			return fmt.Errorf("flags.Parse(args). %w", err)
+		}
+
+		fileHandler, err := io.MakeBlossomIOFromOsEnv(os.Getenv(core.SEED))
+		if err != nil {
+			return fmt.Errorf("io.MakeBlossomIOFromOsEnv(seed). %w", err)
+		}
+		deleted, err := core.BlockBlob(ctx, db, fileHandler, args[1], *reason, moderationActor, now)
+		if err != nil {
+			return fmt.Errorf("core.BlockBlob(ctx, db, fileHandler, sha, reason, actor, now). %w", err)
+		}
+		slog.InfoContext(ctx, "Blob blocked", "sha256", args[1], "deleted", deleted)
+		return nil
+
+	case "dismiss":
+		if len(args) < 2 {
+			return fmt.Errorf(moderationUsage)
+		}
+		err := core.DismissReports(ctx, db, args[1], now)
+		if err != nil {
+			return fmt.Errorf("core.DismissReports(ctx, db, sha, now). %w", err)
+		}
+		slog.InfoContext(ctx, "Reports dismissed", "sha256", args[1])
+		return nil
+
+	case "unblock":
+		if len(args) < 2 {
+			return fmt.Errorf(moderationUsage)
+		}
+		err := core.UnblockBlob(ctx, db, args[1], moderationActor, now)
+		if err != nil {
+			return fmt.Errorf("core.UnblockBlob(ctx, db, sha, actor, now). %w", err)
+		}
+		slog.InfoContext(ctx, "Blob unblocked", "sha256", args[1])
+		return nil
+
+	case "blocked-pubkeys":
+		var blocked []database.BlockedPubkey
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			blocked, err = db.GetBlockedPubkeys(ctx, tx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("db.GetBlockedPubkeys(ctx, tx). %w", err)
+		}
+		return printJSON(blocked)
+
+	case "block-pubkey":
+		flags := flag.NewFlagSet("moderation block-pubkey", flag.ContinueOnError)
+		reason := flags.String("reason", "", "why the pubkey is blocked")
+		if len(args) < 2 {
+			return fmt.Errorf(moderationUsage)
+		}
+		err := flags.Parse(args[2:])
+		if err != nil {
+			return fmt.Errorf("flags.Parse(args). %w", err)
+		}
+
+		err = core.BlockPubkey(ctx, db, args[1], *reason, moderationActor, now)
+		if err != nil {
+			return fmt.Errorf("core.BlockPubkey(ctx, db, pubkey, reason, actor, now). %w", err)
+		}
+		slog.InfoContext(ctx, "Pubkey blocked", "pubkey", args[1])
+		return nil
+
+	case "unblock-pubkey":
+		if len(args) < 2 {
+			return fmt.Errorf(moderationUsage)
+		}
+		err := core.UnblockPubkey(ctx, db, args[1], moderationActor, now)
+		if err != nil {
+			return fmt.Errorf("core.UnblockPubkey(ctx, db, pubkey, actor, now). %w", err)
+		}
+		slog.InfoContext(ctx, "Pubkey unblocked", "pubkey", args[1])
+		return nil
+
+	case "import":
+		if len(args) < 2 {
+			return fmt.Errorf(moderationUsage)
+		}
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return fmt.Errorf("os.ReadFile(%v). %w", args[1], err)
+		}
+		entries, err := core.ParseBlocklist(data)
+		if err != nil {
+			return fmt.Errorf("core.ParseBlocklist(data). %w", err)
+		}
+
+		fileHandler, err := io.MakeBlossomIOFromOsEnv(os.Getenv(core.SEED))
+		if err != nil {
+			return fmt.Errorf("io.MakeBlossomIOFromOsEnv(seed). %w", err)
+		}
+		// the file name is kept so the audit shows where the entries came from
+		actor := moderationActor + " import " + filepath.Base(args[1])
+		result, err := core.ImportBlocklist(ctx, db, fileHandler, entries, actor, now)
+		if err != nil {
+			return fmt.Errorf("core.ImportBlocklist(ctx, db, fileHandler, entries, actor, now). %w", err)
+		}
+		slog.InfoContext(ctx, "Blocklist imported", "file", args[1], "hashes", result.Hashes, "pubkeys", result.Pubkeys, "deleted", result.Deleted)
+		return nil
+
+	case "audit":
+		flags := flag.NewFlagSet("moderation audit", flag.ContinueOnError)
+		limit := flags.Uint64("limit", 100, "how many changes to show, newest first")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("flags.Parse(args). %w", err)
+		}
+
+		var audits []database.BlocklistAudit
+		err = database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			audits, err = db.GetBlocklistAudit(ctx, tx, *limit)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("db.GetBlocklistAudit(ctx, tx, limit). %w", err)
+		}
+		return printJSON(audits)
+	}
+	return fmt.Errorf(moderationUsage)
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
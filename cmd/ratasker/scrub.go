@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+)
+
+// runScrubCommand checks every blob once. With -report it only prints the problems found by the last scrub
+func runScrubCommand(ctx context.Context, args []string, db database.Database) error {
+	flags := flag.NewFlagSet("scrub", flag.ContinueOnError)
+	repair := flags.String("repair", "", "quarantine or delete the problems found")
+	reportOnly := flags.Bool("report", false, "print the results of the last scrub without checking again")
+	bytesPerSecond := flags.Uint64("bytes-per-second", core.DefaultScrubBytesPerSecond, "read limit, 0 means no limit")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("flags.Parse(args). %w", err)
+	}
+
+	if *reportOnly {
+		tx, err := db.BeginTransaction(ctx)
+		if err != nil {
+			return fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+		}
+		defer tx.Rollback()
+
+		problems, err := db.GetBlobHealthProblems(ctx, tx)
+		if err != nil {
+			return fmt.Errorf("db.GetBlobHealthProblems(ctx, tx). %w", err)
+		}
+		for _, problem := range problems {
+			fmt.Printf("%v\t%v\t%v\n", problem.Key, problem.Status, problem.Detail)
+		}
+		return nil
+	}
+
+	fileHandler, err := io.MakeBlossomIOFromOsEnv(os.Getenv(core.SEED))
+	if err != nil {
+		return fmt.Errorf("io.MakeBlossomIOFromOsEnv(seed). %w", err)
+	}
+
+	slog.InfoContext(ctx, "Scrubbing blobs", "path", fileHandler.GetStoragePath())
+	report, err := core.ScrubBlobs(ctx, db, fileHandler, core.ScrubOptions{BytesPerSecond: *bytesPerSecond, Repair: *repair})
+	if err != nil {
+		return fmt.Errorf("core.ScrubBlobs(ctx, db, fileHandler, options). %w", err)
+	}
+
+	core.LogScrubReport(ctx, report)
+	return nil
+}
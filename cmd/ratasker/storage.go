@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+)
+
+const storageUsage = "usage: ratasker storage migrate"
+
+// runStorageCommand runs the storage maintenance subcommands. Only the local filesystem has a layout to migrate
+func runStorageCommand(ctx context.Context, args []string, db database.Database) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		return fmt.Errorf(storageUsage)
+	}
+
+	handler, err := io.MakeFileSystemHandler()
+	if err != nil {
+		return fmt.Errorf("io.MakeFileSystemHandler(). %w", err)
+	}
+
+	slog.InfoContext(ctx, "Migrating blobs to the sharded layout", "path", handler.DataPath)
+	report, err := core.MigrateStorageLayout(ctx, db, handler)
+	if err != nil {
+		return fmt.Errorf("core.MigrateStorageLayout(ctx, db, handler). %w", err)
+	}
+
+	slog.InfoContext(ctx, "Storage migration finished", "migrated", report.Migrated, "already_migrated", report.Skipped, "missing_files", report.Missing)
+	return nil
+}
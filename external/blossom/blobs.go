@@ -18,6 +18,7 @@ type DBBlobData struct {
 	CreatedAt uint64 `db:"created_at"`
 	Data      Blob
 	Pubkey    string
+	PaidSats  uint64 `db:"paid_sats"`
 }
 
 type BlobDescriptor struct {
@@ -26,4 +27,6 @@ type BlobDescriptor struct {
 	Size     uint64 `json:"size"`
 	Type     string `json:"type"`
 	Uploaded string `json:"uploaded"`
+	// BUD-08 file metadata tags
+	NIP94 [][]string `json:"nip94,omitempty"`
 }
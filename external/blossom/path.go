@@ -0,0 +1,87 @@
+package blossom
+
+import (
+	"encoding/hex"
+	"errors"
+	"mime"
+	"strings"
+)
+
+var (
+	ErrInvalidBlobHash = errors.New("Invalid blob hash")
+)
+
+// most common extensions, used before asking the mime package because it can return more than one per type
+var extensionsByMimeType = map[string]string{
+	"application/json": ".json",
+	"application/pdf":  ".pdf",
+	"application/zip":  ".zip",
+	"audio/mpeg":       ".mp3",
+	"audio/ogg":        ".ogg",
+	"audio/wav":        ".wav",
+	"image/avif":       ".avif",
+	"image/gif":        ".gif",
+	"image/jpeg":       ".jpg",
+	"image/png":        ".png",
+	"image/svg+xml":    ".svg",
+	"image/webp":       ".webp",
+	"text/html":        ".html",
+	"text/plain":       ".txt",
+	"video/mp4":        ".mp4",
+	"video/quicktime":  ".mov",
+	"video/webm":       ".webm",
+}
+
+// ParseBlobPath splits a BUD-01 path param like "<sha256>.pdf" into the hash and the extension.
+func ParseBlobPath(param string) (string, string, error) {
+	sha, ext, _ := strings.Cut(param, ".")
+	if len(sha) != 64 {
+		return "", "", ErrInvalidBlobHash
+	}
+
+	_, err := hex.DecodeString(sha)
+	if err != nil {
+		return "", "", ErrInvalidBlobHash
+	}
+
+	if ext != "" {
+		ext = "." + strings.ToLower(ext)
+	}
+
+	return strings.ToLower(sha), ext, nil
+}
+
+// MimeTypeFromExtension returns an empty string if the extension is not known
+func MimeTypeFromExtension(ext string) string {
+	if ext == "" {
+		return ""
+	}
+	for mimeType, knownExt := range extensionsByMimeType {
+		if knownExt == ext {
+			return mimeType
+		}
+	}
+
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(ext), ";")
+	return mimeType
+}
+
+// ExtensionFromMimeType returns an empty string if the mime type is not known
+func ExtensionFromMimeType(mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		return ""
+	}
+
+	ext, ok := extensionsByMimeType[mimeType]
+	if ok {
+		return ext
+	}
+
+	extensions, err := mime.ExtensionsByType(mimeType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
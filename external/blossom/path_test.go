@@ -0,0 +1,52 @@
+package blossom
+
+import (
+	"errors"
+	"testing"
+)
+
+const testSha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+func TestParseBlobPath(t *testing.T) {
+	sha, ext, err := ParseBlobPath(testSha)
+	if err != nil {
+		t.Fatalf("ParseBlobPath(testSha) %+v", err)
+	}
+	if sha != testSha || ext != "" {
+		t.Errorf("wrong parse. sha: %v, ext: %v", sha, ext)
+	}
+
+	sha, ext, err = ParseBlobPath(testSha + ".PDF")
+	if err != nil {
+		t.Fatalf(`ParseBlobPath(testSha + ".PDF") %+v`, err)
+	}
+	if sha != testSha || ext != ".pdf" {
+		t.Errorf("wrong parse. sha: %v, ext: %v", sha, ext)
+	}
+
+	_, _, err = ParseBlobPath("nothex.pdf")
+	if !errors.Is(err, ErrInvalidBlobHash) {
+		t.Errorf("should be invalid hash. %+v", err)
+	}
+}
+
+func TestMimeTypeExtensions(t *testing.T) {
+	if ExtensionFromMimeType("image/jpeg") != ".jpg" {
+		t.Errorf("wrong extension for jpeg. got: %v", ExtensionFromMimeType("image/jpeg"))
+	}
+	if ExtensionFromMimeType("text/plain; charset=utf-8") != ".txt" {
+		t.Errorf("parameters should be ignored. got: %v", ExtensionFromMimeType("text/plain; charset=utf-8"))
+	}
+	if ExtensionFromMimeType("") != "" || ExtensionFromMimeType("application/octet-stream") != "" {
+		t.Error("unknown types should not get an extension")
+	}
+	if MimeTypeFromExtension(".pdf") != "application/pdf" {
+		t.Errorf("wrong mime type for pdf. got: %v", MimeTypeFromExtension(".pdf"))
+	}
+	if MimeTypeFromExtension(".jpeg") != "image/jpeg" {
+		t.Errorf("wrong mime type for jpeg. got: %v", MimeTypeFromExtension(".jpeg"))
+	}
+	if MimeTypeFromExtension(".notreal") != "" {
+		t.Error("unknown extension should not have a mime type")
+	}
+}
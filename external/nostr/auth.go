@@ -27,6 +27,15 @@ const (
 	UPLOAD = "upload"
 	LIST   = "list"
 	DELETE = "delete"
+	// admin events also need the method and url tags of the request, see ValidateAdminRequest
+	ADMIN = "admin"
+)
+
+const (
+	MethodTag = "method"
+	URLTag    = "u"
+	// sha256 of the request body
+	PayloadTag = "payload"
 )
 
 // Errors parsing event
@@ -37,6 +46,10 @@ var (
 	ErrNoExpiration         = errors.New("No expiration tag")
 	ErrEventExpired         = errors.New("Event expired")
 	ErrInvalidSignature     = errors.New("Invalid Signature")
+	ErrNoNostrScheme        = errors.New("Authorization header is not a Nostr event")
+	ErrWrongBlossomAction   = errors.New("Auth event is not for this action")
+	ErrHashNotAuthorized    = errors.New("Auth event does not include this hash")
+	ErrRequestNotAuthorized = errors.New("Auth event is not for this request")
 )
 
 func ExpirationTagIsValid(tags n.Tags, now int64) (bool, error) {
@@ -68,9 +81,17 @@ func ParseNostrHeader(authHeader string) (n.Event, error) {
 
 	var nostrEvent n.Event
 
+	if len(separation) != 2 || separation[0] != HeaderScheme {
+		return nostrEvent, ErrNoNostrScheme
+	}
+
 	jsonBytes, err := base64.URLEncoding.DecodeString(separation[1])
 	if err != nil {
-		return nostrEvent, fmt.Errorf(" Header %v. \n base64.URLEncoding.DecodeString(separation[1]). %w", separation[1], err)
+		// most clients use btoa() that encodes with the standard alphabet
+		jsonBytes, err = base64.StdEncoding.DecodeString(separation[1])
+		if err != nil {
+			return nostrEvent, fmt.Errorf(" Header %v. \n base64.URLEncoding.DecodeString(separation[1]). %w", separation[1], err)
+		}
 	}
 
 	err = json.Unmarshal(jsonBytes, &nostrEvent)
@@ -102,7 +123,7 @@ func ValidateAuthEvent(event n.Event) error {
 	switch {
 	case event.Kind != AuthKind:
 		return ErrIncorrectKind
-	case !event.Tags.ContainsAny(BlossomAction, []string{GET, UPLOAD, LIST, DELETE}):
+	case !event.Tags.ContainsAny(BlossomAction, []string{GET, UPLOAD, LIST, DELETE, ADMIN}):
 		return ErrNoBlossomAction
 	case event.CreatedAt.Time().Unix() > now:
 		return ErrCreatedAtInTheFuture
@@ -113,6 +134,41 @@ func ValidateAuthEvent(event n.Event) error {
 	return nil
 }
 
+// ValidateAuthEventFor validates the event and checks that it was made for the action and blob hash.
+// If the event has no x tags it is valid for every hash, except deletes that always need the x tag of the blob
+func ValidateAuthEventFor(event n.Event, action string, sha string) error {
+	err := ValidateAuthEvent(event)
+	if err != nil {
+		return fmt.Errorf("ValidateAuthEvent(event). %w", err)
+	}
+
+	if !event.Tags.ContainsAny(BlossomAction, []string{action}) {
+		return ErrWrongBlossomAction
+	}
+
+	if action == DELETE && (sha == "" || !event.Tags.ContainsAny("x", []string{sha})) {
+		return ErrHashNotAuthorized
+	}
+
+	if sha != "" && len(event.Tags.GetAll([]string{"x"})) > 0 && !event.Tags.ContainsAny("x", []string{sha}) {
+		return ErrHashNotAuthorized
+	}
+
+	return nil
+}
+
+// ValidateAdminRequest checks that a validated event is an admin event made for this method and absolute url,
+// so it can't be replayed against other admin routes or other servers
+func ValidateAdminRequest(event n.Event, method string, url string) error {
+	if !event.Tags.ContainsAny(BlossomAction, []string{ADMIN}) {
+		return ErrWrongBlossomAction
+	}
+	if !event.Tags.ContainsAny(MethodTag, []string{method}) || !event.Tags.ContainsAny(URLTag, []string{url}) {
+		return ErrRequestNotAuthorized
+	}
+	return nil
+}
+
 type NotifMessage struct {
 	Message string `json:"message"`
 }
@@ -2,7 +2,11 @@ package nostr
 
 import (
 	"errors"
+	"strconv"
 	"testing"
+	"time"
+
+	n "github.com/nbd-wtf/go-nostr"
 )
 
 func TestParsingHeaderSuccessful(t *testing.T) {
@@ -22,3 +26,61 @@ func TestParsingHeaderSuccessful(t *testing.T) {
 	}
 
 }
+
+func TestValidateAdminRequest(t *testing.T) {
+	url := "https://example.com/admin/blocked/abc?reason=spam"
+	event := n.Event{Tags: n.Tags{{BlossomAction, ADMIN}, {MethodTag, "PUT"}, {URLTag, url}}}
+
+	err := ValidateAdminRequest(event, "PUT", url)
+	if err != nil {
+		t.Errorf("ValidateAdminRequest(event, PUT, url) %+v", err)
+	}
+	err = ValidateAdminRequest(event, "DELETE", url)
+	if !errors.Is(err, ErrRequestNotAuthorized) {
+		t.Errorf("expected ErrRequestNotAuthorized for another method, got %v", err)
+	}
+	err = ValidateAdminRequest(event, "PUT", "https://other.example/admin/blocked/abc?reason=spam")
+	if !errors.Is(err, ErrRequestNotAuthorized) {
+		t.Errorf("expected ErrRequestNotAuthorized for another server, got %v", err)
+	}
+
+	// a delete event of the owner is not an admin event
+	event.Tags = n.Tags{{BlossomAction, DELETE}, {MethodTag, "PUT"}, {URLTag, url}}
+	err = ValidateAdminRequest(event, "PUT", url)
+	if !errors.Is(err, ErrWrongBlossomAction) {
+		t.Errorf("expected ErrWrongBlossomAction without the admin action, got %v", err)
+	}
+}
+
+func TestValidateAuthEventForDeleteNeedsHash(t *testing.T) {
+	sha := "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	event := n.Event{
+		Kind:      AuthKind,
+		CreatedAt: n.Now(),
+		Tags:      n.Tags{{BlossomAction, DELETE}, {Expiration, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}},
+	}
+	err := event.Sign(n.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("event.Sign(sk) %+v", err)
+	}
+
+	err = ValidateAuthEventFor(event, DELETE, sha)
+	if !errors.Is(err, ErrHashNotAuthorized) {
+		t.Errorf("expected ErrHashNotAuthorized for a delete without x tag, got %v", err)
+	}
+
+	sk := n.GeneratePrivateKey()
+	event.Tags = append(event.Tags, n.Tag{"x", sha})
+	err = event.Sign(sk)
+	if err != nil {
+		t.Fatalf("event.Sign(sk) %+v", err)
+	}
+	err = ValidateAuthEventFor(event, DELETE, sha)
+	if err != nil {
+		t.Errorf("ValidateAuthEventFor(event, DELETE, sha) %+v", err)
+	}
+	err = ValidateAuthEventFor(event, DELETE, "")
+	if !errors.Is(err, ErrHashNotAuthorized) {
+		t.Errorf("expected ErrHashNotAuthorized without a blob hash, got %v", err)
+	}
+}
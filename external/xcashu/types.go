@@ -23,11 +23,15 @@ type PaymentQuoteResponse struct {
 }
 
 var (
-	ErrNotEnoughtSats = errors.New("Not enough sats")
+	ErrNotEnoughtSats  = errors.New("Not enough sats")
+	ErrPaymentRequired = errors.New("Payment required")
 )
 
-// charges per
+// charges per. A cost of 0 is free, nothing has to be paid
 func QuoteAmountToPay(Blength uint64, satPerMB uint64) uint64 {
+	if satPerMB == 0 {
+		return 0
+	}
 	if Blength < 1024 {
 		return 1
 	}
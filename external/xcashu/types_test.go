@@ -0,0 +1,19 @@
+package xcashu
+
+import "testing"
+
+func TestQuoteAmountToPay(t *testing.T) {
+	if amount := QuoteAmountToPay(100, 2); amount != 1 {
+		t.Errorf("small blobs should cost 1. got %v", amount)
+	}
+	if amount := QuoteAmountToPay(8*1024*1024, 1); amount != 2 {
+		t.Errorf("wrong amount for 8 MiB. got %v", amount)
+	}
+
+	// a cost of 0 is free for every size
+	for _, size := range []uint64{0, 100, 1024, 8 * 1024 * 1024} {
+		if amount := QuoteAmountToPay(size, 0); amount != 0 {
+			t.Errorf("a cost of 0 should quote 0 for %v bytes. got %v", size, amount)
+		}
+	}
+}
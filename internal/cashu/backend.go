@@ -1,11 +1,12 @@
 package cashu
 
 import (
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"ratasker/internal/database"
 
 	// "slices"
@@ -23,7 +24,6 @@ import (
 	"github.com/elnosh/gonuts/cashu/nuts/nut11"
 	"github.com/elnosh/gonuts/cashu/nuts/nut13"
 	"github.com/elnosh/gonuts/crypto"
-	"github.com/elnosh/gonuts/wallet/client"
 	"github.com/tyler-smith/go-bip39"
 )
 
@@ -42,16 +42,18 @@ var (
 )
 
 type CashuWallet interface {
-	RotatePubkey(tx *sql.Tx, db database.Database) error
+	RotatePubkey(ctx context.Context, tx *sql.Tx, db database.Database) error
 	GetActivePubkey() string
+	// unix time after which the active pubkey gets rotated
+	GetActivePubkeyExpiration() uint64
 
-	StoreEcash(token cashu.Token, tx *sql.Tx, db database.Database) error
+	StoreEcash(ctx context.Context, token cashu.Token, tx *sql.Tx, db database.Database) error
 	// This follows deterministic secrets for recovery purposes
-	SwapProofs(blindMessages cashu.BlindedMessages, proofs []database.ProofToSwap, mint string) (cashu.BlindedSignatures, error)
+	SwapProofs(ctx context.Context, blindMessages cashu.BlindedMessages, proofs []database.ProofToSwap, mint string) (cashu.BlindedSignatures, error)
 
-	VerifyToken(token cashu.Token, tx *sql.Tx, db database.Database) (cashu.Proofs, error)
+	VerifyToken(ctx context.Context, token cashu.Token, tx *sql.Tx, db database.Database) (cashu.Proofs, error)
 	MakeBlindMessages(amount uint64, mint string, counter *database.KeysetCounter) (cashu.BlindedMessages, []string, []*secp256k1.PrivateKey, error)
-	GetActiveKeyset(mint_url string) (nut01.Keyset, error)
+	GetActiveKeyset(ctx context.Context, mint_url string) (nut01.Keyset, error)
 	CalculateFeesFromProofs(proofs []database.ProofToSwap, keysets *nut02.GetKeysetsResponse) (uint, error)
 }
 
@@ -63,7 +65,7 @@ type DBNativeWallet struct {
 	filter        *bloom.BloomFilter
 }
 
-func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, error) {
+func NewDBLocalWallet(ctx context.Context, seedWords string, db database.Database) (DBNativeWallet, error) {
 	var wallet DBNativeWallet
 	wallet.activeKeys = make(map[string]nut01.Keyset)
 
@@ -77,9 +79,9 @@ func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, e
 		return wallet, fmt.Errorf("hdkeychain.NewMaster(. %w", err)
 	}
 
-	tx, err := db.BeginTransaction()
+	tx, err := db.BeginTransaction(ctx)
 	if err != nil {
-		return wallet, fmt.Errorf("db.BeginTransaction() %w", err)
+		return wallet, fmt.Errorf("db.BeginTransaction(ctx) %w", err)
 
 	}
 	// Ensure that the transaction is rolled back in case of a panic or error
@@ -91,9 +93,8 @@ func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, e
 		} else {
 			err = tx.Commit()
 			if err != nil {
-				log.Printf("\n Failed to commit transaction: %v\n", err)
+				slog.ErrorContext(ctx, "tx.Commit()", "error", err)
 			}
-			fmt.Println("Transaction committed successfully.")
 		}
 	}()
 
@@ -103,7 +104,7 @@ func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, e
 	}
 
 	// Get all active keys form mints
-	err = wallet.getActiveKeysFromTrustedMints([]string{mints})
+	err = wallet.getActiveKeysFromTrustedMints(ctx, []string{mints})
 	if err != nil {
 		return wallet, fmt.Errorf("wallet.getActiveKeysFromTrustedMints() %w", err)
 	}
@@ -112,16 +113,16 @@ func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, e
 	wallet.filter = bloom.NewWithEstimates(1_000_000, 0.01)
 
 	// Get proofsPerMint that are not redeemed
-	proofsPerMint, err := db.GetLockedProofsByRedeemed(tx, false)
+	proofsPerMint, err := db.GetLockedProofsByRedeemed(ctx, tx, false)
 	if err != nil {
-		return wallet, fmt.Errorf("db.GetProofsByRedeemed(tx, false) %w", err)
+		return wallet, fmt.Errorf("db.GetProofsByRedeemed(ctx, tx, false) %w", err)
 	}
 
 	for _, proofs := range proofsPerMint {
 		for i := 0; i < len(proofs); i++ {
 			bytes, err := hex.DecodeString(proofs[i].Proof.C)
 			if err != nil {
-				return wallet, fmt.Errorf("db.GetProofsByRedeemed(tx, false) %w", err)
+				return wallet, fmt.Errorf("db.GetProofsByRedeemed(ctx, tx, false) %w", err)
 			}
 			wallet.filter.Add(bytes)
 		}
@@ -131,15 +132,15 @@ func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, e
 	wallet.privKey = privekey
 
 	// Get pubkey from privkey
-	currentPubkey, err := db.GetActivePubkey(tx)
+	currentPubkey, err := db.GetActivePubkey(ctx, tx)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			err := wallet.RotatePubkey(tx, db)
+			err := wallet.RotatePubkey(ctx, tx, db)
 			if err != nil {
-				return wallet, fmt.Errorf("wallet.RotatePubkey(tx, db) %w", err)
+				return wallet, fmt.Errorf("wallet.RotatePubkey(ctx, tx, db) %w", err)
 			}
 		} else {
-			return wallet, fmt.Errorf("db.GetActivePubkey(tx) %w", err)
+			return wallet, fmt.Errorf("db.GetActivePubkey(ctx, tx) %w", err)
 		}
 
 	}
@@ -155,11 +156,11 @@ func NewDBLocalWallet(seedWords string, db database.Database) (DBNativeWallet, e
 	return wallet, nil
 }
 
-func (l *DBNativeWallet) getActiveKeysFromTrustedMints(mints []string) error {
+func (l *DBNativeWallet) getActiveKeysFromTrustedMints(ctx context.Context, mints []string) error {
 	for _, mintUrl := range mints {
-		_, err := l.GetActiveKeyset(mintUrl)
+		_, err := l.GetActiveKeyset(ctx, mintUrl)
 		if err != nil {
-			return fmt.Errorf("l.GetActiveKeyset(mintUrl) %w", err)
+			return fmt.Errorf("l.GetActiveKeyset(ctx, mintUrl) %w", err)
 		}
 
 	}
@@ -185,11 +186,11 @@ func (l *DBNativeWallet) derivePrivateKey(version uint) (*secp256k1.PrivateKey,
 	return derivedKey, nil
 }
 
-func (l *DBNativeWallet) RotatePubkey(tx *sql.Tx, db database.Database) error {
+func (l *DBNativeWallet) RotatePubkey(ctx context.Context, tx *sql.Tx, db database.Database) error {
 	expiration := time.Now().Add(ExpirationOfPubkeyMin * time.Minute)
-	version, err := db.RotateNewPubkey(tx, expiration.Unix())
+	version, err := db.RotateNewPubkey(ctx, tx, expiration.Unix())
 	if err != nil {
-		return fmt.Errorf("db.RotateNewPubkey(tx, expiration.Unix()). %w", err)
+		return fmt.Errorf("db.RotateNewPubkey(ctx, tx, expiration.Unix()). %w", err)
 	}
 	privKey, err := l.derivePrivateKey(version.VersionNum)
 
@@ -206,9 +207,16 @@ func (l *DBNativeWallet) GetActivePubkey() string {
 	return hex.EncodeToString(l.CurrentPubkey.SerializeCompressed())
 }
 
-func (l *DBNativeWallet) StoreEcash(token cashu.Token, tx *sql.Tx, db database.Database) error {
+func (l *DBNativeWallet) GetActivePubkeyExpiration() uint64 {
+	return l.PubkeyVersion.Expiration
+}
+
+func (l *DBNativeWallet) StoreEcash(ctx context.Context, token cashu.Token, tx *sql.Tx, db database.Database) error {
 	now := time.Now().Unix()
-	err := db.AddLockedProofs(tx, token, l.PubkeyVersion.VersionNum, false, uint64(now))
+	err := db.AddLockedProofs(ctx, tx, token, l.PubkeyVersion.VersionNum, false, uint64(now))
+	if errors.Is(err, database.ErrProofAlreadyStored) {
+		return fmt.Errorf("db.AddProofs(proofs, false, now) %w. %w", err, ErrProofAlreadySeen)
+	}
 	if err != nil {
 		return fmt.Errorf("db.AddProofs(proofs, false, now) %w", err)
 	}
@@ -235,7 +243,7 @@ func checkMapOfPubkeys(keys nut01.KeysMap, amount uint64) (*secp256k1.PublicKey,
 
 }
 
-func FindKeysetPubkey(tx *sql.Tx, proof cashu.Proof, mintUrl string, activeKeyset nut01.Keyset, tmpKeys map[string]nut01.Keyset) (*secp256k1.PublicKey, error) {
+func FindKeysetPubkey(ctx context.Context, tx *sql.Tx, proof cashu.Proof, mintUrl string, activeKeyset nut01.Keyset, tmpKeys map[string]nut01.Keyset) (*secp256k1.PublicKey, error) {
 	// See if keyset is available  in activeKeyset
 	if activeKeyset.Id == proof.Id {
 		pubkey, err := checkMapOfPubkeys(activeKeyset.Keys, proof.Amount)
@@ -257,9 +265,9 @@ func FindKeysetPubkey(tx *sql.Tx, proof cashu.Proof, mintUrl string, activeKeyse
 
 	// Call the mint and ask for the keyset if found store it
 
-	keys, err := client.GetKeysetById(mintUrl, proof.Id)
+	keys, err := GetKeysetById(ctx, mintUrl, proof.Id)
 	if err != nil {
-		return nil, fmt.Errorf("wallet.GetKeysetById(mintUrl, proof.Id). %w", err)
+		return nil, fmt.Errorf("GetKeysetById(ctx, mintUrl, proof.Id). %w", err)
 	}
 
 	if len(keys.Keysets) > 0 {
@@ -276,7 +284,7 @@ func FindKeysetPubkey(tx *sql.Tx, proof cashu.Proof, mintUrl string, activeKeyse
 	return nil, ErrCouldNotFindMintPubkey
 }
 
-func (l *DBNativeWallet) VerifyToken(token cashu.Token, tx *sql.Tx, db database.Database) (cashu.Proofs, error) {
+func (l *DBNativeWallet) VerifyToken(ctx context.Context, token cashu.Token, tx *sql.Tx, db database.Database) (cashu.Proofs, error) {
 
 	mint, err := GetTrustedMintFromOsEnv()
 	if err != nil {
@@ -321,12 +329,12 @@ func (l *DBNativeWallet) VerifyToken(token cashu.Token, tx *sql.Tx, db database.
 
 		// Verify that it is a P2PK
 		if spendCondition.Kind != nut10.P2PK {
-			return token.Proofs(), fmt.Errorf("proof: %+v, %w, %w", p, ErrProofIsNotP2PK, err)
+			return token.Proofs(), fmt.Errorf("proof id: %v, amount: %v, %w, %w", p.Id, p.Amount, ErrProofIsNotP2PK, err)
 		}
 
 		// Verify that is lock to a private key that I control
 		if !nut11.CanSign(spendCondition, lockedEcashPrivateKey) {
-			return token.Proofs(), fmt.Errorf("CanSign(spendCondition, lockedEcashPrivateKey) %w. %w. Proof: %+v ", err, ErrNotLockedToPubkey, p)
+			return token.Proofs(), fmt.Errorf("CanSign(spendCondition, lockedEcashPrivateKey) %w. %w. proof id: %v, amount: %v", err, ErrNotLockedToPubkey, p.Id, p.Amount)
 		}
 
 		// TODO  unlock when cashu-ts has the ability to lock for timing and send dleq
@@ -357,16 +365,16 @@ func (l *DBNativeWallet) VerifyToken(token cashu.Token, tx *sql.Tx, db database.
 
 		// if conflict check if C already Exists
 		if l.filter.TestOrAdd(bytesC) {
-			proofs, err := db.GetLockedProofsByC(tx, []string{p.C})
+			proofs, err := db.GetLockedProofsByC(ctx, tx, []string{p.C})
 			if len(proofs) > 0 {
-				return token.Proofs(), fmt.Errorf("proof: %+v, %w", p, ErrProofAlreadySeen)
+				return token.Proofs(), fmt.Errorf("proof id: %v, amount: %v, %w", p.Id, p.Amount, ErrProofAlreadySeen)
 			}
 			if err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
 					continue
 				}
 
-				return token.Proofs(), fmt.Errorf("db.GetProofsByC(tx, []string{p.C}) %w.", err)
+				return token.Proofs(), fmt.Errorf("db.GetProofsByC(ctx, tx, []string{p.C}) %w.", err)
 			}
 		}
 
@@ -419,7 +427,7 @@ func (l *DBNativeWallet) MakeBlindMessages(amount uint64, mint string, counter *
 
 	return blindMessages, secrets, blindingFactors, nil
 }
-func (l *DBNativeWallet) SwapProofs(blindMessages cashu.BlindedMessages, proofs []database.ProofToSwap, mint string) (cashu.BlindedSignatures, error) {
+func (l *DBNativeWallet) SwapProofs(ctx context.Context, blindMessages cashu.BlindedMessages, proofs []database.ProofToSwap, mint string) (cashu.BlindedSignatures, error) {
 
 	// signproofs
 	var sigs cashu.BlindedSignatures
@@ -458,19 +466,19 @@ func (l *DBNativeWallet) SwapProofs(blindMessages cashu.BlindedMessages, proofs
 		Outputs: blindMessages,
 	}
 
-	response, err := client.PostSwap(mint, request)
+	response, err := PostSwap(ctx, mint, request)
 	if err != nil {
-		return response.Signatures, fmt.Errorf("wallet.PostSwap(mint, request) %w", err)
+		return sigs, fmt.Errorf("PostSwap(ctx, mint, request) %w", err)
 	}
 
 	return response.Signatures, nil
 }
 
-func (l *DBNativeWallet) GetActiveKeyset(mint_url string) (nut01.Keyset, error) {
+func (l *DBNativeWallet) GetActiveKeyset(ctx context.Context, mint_url string) (nut01.Keyset, error) {
 	var endKeyset nut01.Keyset
-	keys, err := client.GetActiveKeysets(mint_url)
+	keys, err := GetActiveKeysets(ctx, mint_url)
 	if err != nil {
-		return endKeyset, fmt.Errorf("wallet.GetAllKeysets(mintUrl) %w", err)
+		return endKeyset, fmt.Errorf("GetActiveKeysets(ctx, mint_url) %w", err)
 	}
 
 	for _, keyset := range keys.Keysets {
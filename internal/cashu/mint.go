@@ -0,0 +1,104 @@
+package cashu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/elnosh/gonuts/cashu/nuts/nut01"
+	"github.com/elnosh/gonuts/cashu/nuts/nut02"
+	"github.com/elnosh/gonuts/cashu/nuts/nut03"
+)
+
+// MintRequestTimeout bounds every call to a mint, even when the caller's context has no deadline
+const MintRequestTimeout = 30 * time.Second
+
+var mintClient = &http.Client{Timeout: MintRequestTimeout}
+
+// Mint calls mirror gonuts' wallet/client but can be cancelled with a context
+
+func GetActiveKeysets(ctx context.Context, mintURL string) (*nut01.GetKeysResponse, error) {
+	var response nut01.GetKeysResponse
+	err := mintRequest(ctx, http.MethodGet, mintURL+"/v1/keys", nil, &response)
+	if err != nil {
+		return nil, fmt.Errorf(`mintRequest(ctx, "/v1/keys"). %w`, err)
+	}
+	return &response, nil
+}
+
+func GetAllKeysets(ctx context.Context, mintURL string) (*nut02.GetKeysetsResponse, error) {
+	var response nut02.GetKeysetsResponse
+	err := mintRequest(ctx, http.MethodGet, mintURL+"/v1/keysets", nil, &response)
+	if err != nil {
+		return nil, fmt.Errorf(`mintRequest(ctx, "/v1/keysets"). %w`, err)
+	}
+	return &response, nil
+}
+
+func GetKeysetById(ctx context.Context, mintURL string, id string) (*nut01.GetKeysResponse, error) {
+	var response nut01.GetKeysResponse
+	err := mintRequest(ctx, http.MethodGet, mintURL+"/v1/keys/"+id, nil, &response)
+	if err != nil {
+		return nil, fmt.Errorf(`mintRequest(ctx, "/v1/keys/"+id). %w`, err)
+	}
+	return &response, nil
+}
+
+func PostSwap(ctx context.Context, mintURL string, request nut03.PostSwapRequest) (*nut03.PostSwapResponse, error) {
+	var response nut03.PostSwapResponse
+	err := mintRequest(ctx, http.MethodPost, mintURL+"/v1/swap", request, &response)
+	if err != nil {
+		return nil, fmt.Errorf(`mintRequest(ctx, "/v1/swap"). %w`, err)
+	}
+	return &response, nil
+}
+
+func mintRequest(ctx context.Context, method string, url string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		requestBody, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("json.Marshal(request). %w", err)
+		}
+		body = bytes.NewReader(requestBody)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(ctx, method, url, body). %w", err)
+	}
+	if request != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := mintClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("mintClient.Do(httpRequest). %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the mint explains failed requests with a cashu error
+	if resp.StatusCode == http.StatusBadRequest {
+		var mintErr cashu.Error
+		err := json.NewDecoder(resp.Body).Decode(&mintErr)
+		if err != nil {
+			return fmt.Errorf("json.NewDecoder(resp.Body).Decode(&mintErr). %w", err)
+		}
+		return mintErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("mint answered %v: %s", resp.StatusCode, message)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return fmt.Errorf("json.NewDecoder(resp.Body).Decode(response). %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package cashu
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/elnosh/gonuts/cashu/nuts/nut03"
+)
+
+func TestMintRequestStopsWhenContextIsCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := GetActiveKeysets(ctx, server.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded. got %+v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("request was not cancelled in time")
+	}
+}
+
+func TestMintRequestReturnsMintError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/swap" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"detail": "proofs already spent", "code": 11001}`))
+	}))
+	defer server.Close()
+
+	_, err := PostSwap(context.Background(), server.URL, nut03.PostSwapRequest{})
+	var mintErr cashu.Error
+	if !errors.As(err, &mintErr) {
+		t.Fatalf("expected a cashu.Error. got %+v", err)
+	}
+	if mintErr.Detail != "proofs already spent" {
+		t.Errorf("wrong detail %v", mintErr.Detail)
+	}
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ratasker/internal/cashu"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip06"
+)
+
+const (
+	// comma separated relay urls. Empty turns the announcement off
+	ANNOUNCE_RELAYS         = "ANNOUNCE_RELAYS"
+	ANNOUNCE_INTERVAL_HOURS = "ANNOUNCE_INTERVAL_HOURS"
+)
+
+const DefaultAnnounceIntervalHours = 6
+
+// KindServerAnnouncement is addressable, the d tag is the server url so every server keeps one announcement
+const KindServerAnnouncement = 36363
+
+// AnnouncePublishTimeout bounds the publishing to every relay
+const AnnouncePublishTimeout = 30 * time.Second
+
+var (
+	ErrNoAnnounceRelays = errors.New("No relay took the announcement")
+)
+
+// ServerAnnouncement is the content of the announcement event
+type ServerAnnouncement struct {
+	URL string `json:"url"`
+	ServerInfo
+}
+
+// AnnouncementKeyFromSeed derives the nostr key of the server from the SEED words with NIP-06
+func AnnouncementKeyFromSeed(seedWords string) (string, error) {
+	if !nip06.ValidateWords(seedWords) {
+		return "", fmt.Errorf("seed words are not a valid mnemonic")
+	}
+	privKey, err := nip06.PrivateKeyFromSeed(nip06.SeedFromWords(seedWords))
+	if err != nil {
+		return "", fmt.Errorf("nip06.PrivateKeyFromSeed(seed). %w", err)
+	}
+	return privKey, nil
+}
+
+// ParseRelayList splits ANNOUNCE_RELAYS
+func ParseRelayList(relays string) []string {
+	urls := []string{}
+	for _, url := range strings.Split(relays, ",") {
+		url = strings.TrimSpace(url)
+		if url != "" {
+			urls = append(urls, nostr.NormalizeURL(url))
+		}
+	}
+	return urls
+}
+
+// NewServerAnnouncement signs the announcement. The P2PK pubkey is left out, it rotates faster than the
+// announcement is published and clients get it from the x-cashu header or GET /
+func NewServerAnnouncement(privKey string, url string, info ServerInfo, now nostr.Timestamp) (nostr.Event, error) {
+	info.Pubkey = ""
+	info.PubkeyExpiration = 0
+
+	content, err := json.Marshal(ServerAnnouncement{URL: url, ServerInfo: info})
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("json.Marshal(announcement). %w", err)
+	}
+
+	tags := nostr.Tags{{"d", url}, {"r", url}}
+	for _, mint := range info.Mints {
+		tags = append(tags, nostr.Tag{"mint", mint})
+	}
+	for _, bud := range info.BUDs {
+		tags = append(tags, nostr.Tag{"bud", bud})
+	}
+	for _, unit := range info.Units {
+		tags = append(tags,
+			nostr.Tag{"price", "upload", fmt.Sprint(info.Upload.Cost), string(unit)},
+			nostr.Tag{"price", "download", fmt.Sprint(info.Download.Cost), string(unit)},
+		)
+	}
+
+	ev := nostr.Event{
+		CreatedAt: now,
+		Kind:      KindServerAnnouncement,
+		Tags:      tags,
+		Content:   string(content),
+	}
+	err = ev.Sign(privKey)
+	if err != nil {
+		return ev, fmt.Errorf("ev.Sign(privKey). %w", err)
+	}
+	return ev, nil
+}
+
+// PublishToRelays sends the event through the pool. It only fails when no relay took it
+func PublishToRelays(ctx context.Context, pool *nostr.SimplePool, relays []string, ev nostr.Event) error {
+	var errs []error
+	published := 0
+	for _, url := range relays {
+		relay, err := pool.EnsureRelay(url)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool.EnsureRelay(%v). %w", url, err))
+			continue
+		}
+		err = relay.Publish(ctx, ev)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("relay.Publish(ctx, ev) %v. %w", url, err))
+			continue
+		}
+		published++
+	}
+
+	if published == 0 {
+		return fmt.Errorf("%w. %w", ErrNoAnnounceRelays, errors.Join(errs...))
+	}
+	return nil
+}
+
+// AnnounceServer publishes the current server information. Relays that failed are only an error when all of them did
+func AnnounceServer(ctx context.Context, pool *nostr.SimplePool, relays []string, privKey string, url string, wallet cashu.CashuWallet, uploadCost uint64, downloadCost uint64, policy PaymentPolicy) error {
+	info, err := NewServerInfo(wallet, uploadCost, downloadCost, policy)
+	if err != nil {
+		return fmt.Errorf("NewServerInfo(wallet, uploadCost, downloadCost, policy). %w", err)
+	}
+
+	ev, err := NewServerAnnouncement(privKey, url, info, nostr.Now())
+	if err != nil {
+		return fmt.Errorf("NewServerAnnouncement(privKey, url, info, now). %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, AnnouncePublishTimeout)
+	defer cancel()
+	err = PublishToRelays(ctx, pool, relays, ev)
+	if err != nil {
+		return fmt.Errorf("PublishToRelays(ctx, pool, relays, ev). %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"ratasker/internal/cashu"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const announceSeed = "leader monkey parrot ring guide accident before fence cannon height naive bean"
+
+// fakeRelay answers every EVENT with an OK and keeps the events
+type fakeRelay struct {
+	mu     sync.Mutex
+	events []nostr.Event
+	accept bool
+}
+
+func (f *fakeRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		msg, err := wsutil.ReadClientText(conn)
+		if err != nil {
+			return
+		}
+		var envelope []json.RawMessage
+		if json.Unmarshal(msg, &envelope) != nil || len(envelope) < 2 || string(envelope[0]) != `"EVENT"` {
+			continue
+		}
+		var ev nostr.Event
+		if json.Unmarshal(envelope[1], &ev) != nil {
+			continue
+		}
+
+		f.mu.Lock()
+		if f.accept {
+			f.events = append(f.events, ev)
+		}
+		f.mu.Unlock()
+
+		ok, _ := json.Marshal([]any{"OK", ev.ID, f.accept, ""})
+		err = wsutil.WriteServerText(conn, ok)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestAnnounceServer(t *testing.T) {
+	t.Setenv(cashu.TRUSTED_MINT, "https://mint.example")
+	ctx := context.Background()
+
+	relay := &fakeRelay{accept: true}
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	relayURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	privKey, err := AnnouncementKeyFromSeed(announceSeed)
+	if err != nil {
+		t.Fatalf("AnnouncementKeyFromSeed(seed) %+v", err)
+	}
+	again, _ := AnnouncementKeyFromSeed(announceSeed)
+	if privKey != again {
+		t.Errorf("the key should be the same for the same seed")
+	}
+
+	pool := nostr.NewSimplePool(ctx)
+	err = AnnounceServer(ctx, pool, ParseRelayList(relayURL+", "), privKey, "https://blossom.example", infoWallet{}, 2, 1, PaymentPolicy{})
+	if err != nil {
+		t.Fatalf("AnnounceServer(ctx, pool, relays, privKey, url, wallet) %+v", err)
+	}
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if len(relay.events) != 1 {
+		t.Fatalf("the relay should get one event. got %v", len(relay.events))
+	}
+	ev := relay.events[0]
+	if ok, err := ev.CheckSignature(); !ok || err != nil {
+		t.Errorf("invalid signature %v", err)
+	}
+	pubkey, _ := nostr.GetPublicKey(privKey)
+	if ev.Kind != KindServerAnnouncement || ev.PubKey != pubkey || ev.Tags.GetD() != "https://blossom.example" {
+		t.Errorf("wrong announcement %+v", ev)
+	}
+	if ev.Tags.GetFirst([]string{"mint", "https://mint.example"}) == nil {
+		t.Errorf("the mint should be tagged. got %+v", ev.Tags)
+	}
+
+	var announcement ServerAnnouncement
+	err = json.Unmarshal([]byte(ev.Content), &announcement)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(content) %+v", err)
+	}
+	if announcement.URL != "https://blossom.example" || announcement.Upload.Cost != 2 || announcement.Pubkey != "" {
+		t.Errorf("wrong content %+v", announcement)
+	}
+}
+
+func TestAnnounceServerFailsWithoutRelays(t *testing.T) {
+	t.Setenv(cashu.TRUSTED_MINT, "https://mint.example")
+	ctx := context.Background()
+
+	relay := &fakeRelay{accept: false}
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	privKey, err := AnnouncementKeyFromSeed(announceSeed)
+	if err != nil {
+		t.Fatalf("AnnouncementKeyFromSeed(seed) %+v", err)
+	}
+
+	pool := nostr.NewSimplePool(ctx)
+	relays := []string{"ws" + strings.TrimPrefix(server.URL, "http")}
+	err = AnnounceServer(ctx, pool, relays, privKey, "https://blossom.example", infoWallet{}, 2, 1, PaymentPolicy{})
+	if !errors.Is(err, ErrNoAnnounceRelays) {
+		t.Errorf("expected ErrNoAnnounceRelays. got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ratasker/external/blossom"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"ratasker/internal/utils"
+	"strings"
+)
+
+// MaxBlocklistBytes limits the body of POST /admin/blocklist
+const MaxBlocklistBytes = 10 << 20
+
+const (
+	ReasonBlobBlocked   = "Blob is blocked"
+	ReasonPubkeyBlocked = "Pubkey is blocked"
+)
+
+var (
+	ErrBlobBlocked          = errors.New("Blob is blocked")
+	ErrPubkeyBlocked        = errors.New("Pubkey is blocked")
+	ErrInvalidBlocklistLine = errors.New("Invalid blocklist line")
+)
+
+type BlocklistEntry struct {
+	// database.BlocklistSha256 or database.BlocklistPubkey
+	Type   string
+	Value  string
+	Reason string
+}
+
+// BlocklistImport counts what an import changed. Deleted are the blocked blobs that were stored
+type BlocklistImport struct {
+	Hashes  int `json:"hashes"`
+	Pubkeys int `json:"pubkeys"`
+	Deleted int `json:"deleted"`
+}
+
+// ParseBlocklist reads one entry per line: "sha256 <hash> [reason]" or "pubkey <hex or npub> [reason]".
+// Empty lines and lines starting with # are skipped
+func ParseBlocklist(data []byte) ([]BlocklistEntry, error) {
+	entries := []BlocklistEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%w. line %v", ErrInvalidBlocklistLine, lineNum)
+		}
+		entry := BlocklistEntry{Type: strings.ToLower(fields[0]), Reason: strings.Join(fields[2:], " ")}
+
+		switch entry.Type {
+		case database.BlocklistSha256:
+			sha, _, err := blossom.ParseBlobPath(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%w. line %v. %w", ErrInvalidBlocklistLine, lineNum, err)
+			}
+			entry.Value = sha
+		case database.BlocklistPubkey:
+			pubkey, err := PubkeyToHex(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%w. line %v. %w", ErrInvalidBlocklistLine, lineNum, err)
+			}
+			entry.Value = pubkey
+		default:
+			return nil, fmt.Errorf("%w. line %v. unknown type %v", ErrInvalidBlocklistLine, lineNum, fields[0])
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err(). %w", err)
+	}
+	return entries, nil
+}
+
+// ImportBlocklist blocks every entry in one transaction, so a failed import changes nothing.
+// Blocked hashes that are stored here are deleted like with BlockBlob
+func ImportBlocklist(ctx context.Context, db database.Database, fileHandler io.BlossomIO, entries []BlocklistEntry, actor string, now uint64) (BlocklistImport, error) {
+	hashes := make([][]byte, len(entries))
+	for i, entry := range entries {
+		if entry.Type != database.BlocklistSha256 {
+			continue
+		}
+		hash, err := hex.DecodeString(entry.Value)
+		if err != nil || len(hash) != 32 {
+			return BlocklistImport{}, fmt.Errorf("%w. %v", blossom.ErrInvalidBlobHash, entry.Value)
+		}
+		hashes[i] = hash
+	}
+
+	var result BlocklistImport
+	removed := map[string]string{}
+	err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		result = BlocklistImport{}
+		removed = map[string]string{}
+		for i, entry := range entries {
+			switch entry.Type {
+			case database.BlocklistSha256:
+				path, err := blockBlobInTx(ctx, db, tx, entry.Value, hashes[i], entry.Reason, actor, now)
+				if err != nil {
+					return fmt.Errorf("blockBlobInTx(ctx, db, tx, %v, hash, reason, actor, now). %w", entry.Value, err)
+				}
+				result.Hashes++
+				if path != "" {
+					removed[entry.Value] = path
+				}
+			case database.BlocklistPubkey:
+				err := blockPubkeyInTx(ctx, db, tx, entry.Value, entry.Reason, actor, now)
+				if err != nil {
+					return fmt.Errorf("blockPubkeyInTx(ctx, db, tx, %v, reason, actor, now). %w", entry.Value, err)
+				}
+				result.Pubkeys++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return BlocklistImport{}, err
+	}
+
+	for sha, path := range removed {
+		removeBlockedFile(ctx, fileHandler, sha, path)
+	}
+	result.Deleted = len(removed)
+	return result, nil
+}
+
+// BlockPubkey stops the pubkey from uploading and downloading. Its blobs are kept
+func BlockPubkey(ctx context.Context, db database.Database, pubkey string, reason string, actor string, now uint64) error {
+	pubkey, err := PubkeyToHex(pubkey)
+	if err != nil {
+		return fmt.Errorf("PubkeyToHex(pubkey). %w", err)
+	}
+
+	return database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		return blockPubkeyInTx(ctx, db, tx, pubkey, reason, actor, now)
+	})
+}
+
+func blockPubkeyInTx(ctx context.Context, db database.Database, tx *sql.Tx, pubkey string, reason string, actor string, now uint64) error {
+	err := db.BlockPubkey(ctx, tx, database.BlockedPubkey{Pubkey: pubkey, Reason: reason, CreatedAt: now})
+	if err != nil {
+		return fmt.Errorf("db.BlockPubkey(ctx, tx, blocked). %w", err)
+	}
+	err = db.AddBlocklistAudit(ctx, tx, database.BlocklistAudit{Action: database.AuditBlock, TargetType: database.BlocklistPubkey, Target: pubkey, Reason: reason, Actor: actor, CreatedAt: now})
+	if err != nil {
+		return fmt.Errorf("db.AddBlocklistAudit(ctx, tx, audit). %w", err)
+	}
+	return nil
+}
+
+func UnblockPubkey(ctx context.Context, db database.Database, pubkey string, actor string, now uint64) error {
+	pubkey, err := PubkeyToHex(pubkey)
+	if err != nil {
+		return fmt.Errorf("PubkeyToHex(pubkey). %w", err)
+	}
+
+	return database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		err := db.UnblockPubkey(ctx, tx, pubkey)
+		if err != nil {
+			return fmt.Errorf("db.UnblockPubkey(ctx, tx, pubkey). %w", err)
+		}
+		err = db.AddBlocklistAudit(ctx, tx, database.BlocklistAudit{Action: database.AuditUnblock, TargetType: database.BlocklistPubkey, Target: pubkey, Actor: actor, CreatedAt: now})
+		if err != nil {
+			return fmt.Errorf("db.AddBlocklistAudit(ctx, tx, audit). %w", err)
+		}
+		return nil
+	})
+}
+
+// UnblockBlob lets the hash be uploaded again. The deleted blob is not restored
+func UnblockBlob(ctx context.Context, db database.Database, sha string, actor string, now uint64) error {
+	sha = strings.ToLower(sha)
+	return database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		err := db.UnblockBlob(ctx, tx, sha)
+		if err != nil {
+			return fmt.Errorf("db.UnblockBlob(ctx, tx, sha). %w", err)
+		}
+		err = db.AddBlocklistAudit(ctx, tx, database.BlocklistAudit{Action: database.AuditUnblock, TargetType: database.BlocklistSha256, Target: sha, Actor: actor, CreatedAt: now})
+		if err != nil {
+			return fmt.Errorf("db.AddBlocklistAudit(ctx, tx, audit). %w", err)
+		}
+		return nil
+	})
+}
+
+// CheckUploadAuth is a 401 HTTPError for anonymous uploads while a storage limit is set or any pubkey is blocked,
+// both only work when the uploader is known. Downloads stay anonymous, blocked pubkeys can still download without auth
+func CheckUploadAuth(ctx context.Context, db database.Database, policy PaymentPolicy, pubkey string) error {
+	if pubkey != "" {
+		return nil
+	}
+	if policy.RequiresUploadAuth() {
+		return utils.NewHTTPError(401, "Missing auth event", ErrUploadAuthRequired)
+	}
+
+	var blocked bool
+	err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		blocked, err = db.HasBlockedPubkeys(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("db.HasBlockedPubkeys(ctx, tx). %w", err)
+	}
+	if blocked {
+		return utils.NewHTTPError(401, "Missing auth event", ErrUploadAuthRequired)
+	}
+	return nil
+}
+
+// CheckNotBlocked is a 403 HTTPError for blocked hashes and pubkeys. Empty values are not checked.
+// Handlers call it before quoting so blocked requests are never asked to pay
+func CheckNotBlocked(ctx context.Context, db database.Database, sha string, pubkey string) error {
+	var blobBlocked, pubkeyBlocked bool
+	err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		blobBlocked, pubkeyBlocked = false, false
+		if sha != "" {
+			blobBlocked, err = db.IsBlobBlocked(ctx, tx, strings.ToLower(sha))
+			if err != nil {
+				return fmt.Errorf("db.IsBlobBlocked(ctx, tx, sha). %w", err)
+			}
+		}
+		if pubkey != "" {
+			pubkeyBlocked, err = db.IsPubkeyBlocked(ctx, tx, pubkey)
+			if err != nil {
+				return fmt.Errorf("db.IsPubkeyBlocked(ctx, tx, pubkey). %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if pubkeyBlocked {
+		return utils.NewHTTPError(403, ReasonPubkeyBlocked, ErrPubkeyBlocked)
+	}
+	if blobBlocked {
+		return utils.NewHTTPError(403, ReasonBlobBlocked, ErrBlobBlocked)
+	}
+	return nil
+}
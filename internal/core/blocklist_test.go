@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"ratasker/internal/utils"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func testPubkey(t *testing.T) string {
+	pubkey, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("nostr.GetPublicKey(key) %+v", err)
+	}
+	return pubkey
+}
+
+func TestParseBlocklist(t *testing.T) {
+	sha := "B1674191A88EC5CDD733E4240A81803105DC412D6C6708D53AB94FC248F4F553"
+	pubkey := testPubkey(t)
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		t.Fatalf("nip19.EncodePublicKey(pubkey) %+v", err)
+	}
+
+	list := "# community list\n\nsha256 " + sha + " known malware\npubkey " + npub + "\n  PUBKEY " + pubkey + " spam bot\n"
+	entries, err := ParseBlocklist([]byte(list))
+	if err != nil {
+		t.Fatalf("ParseBlocklist(list) %+v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+	if entries[0].Type != database.BlocklistSha256 || entries[0].Value != "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553" || entries[0].Reason != "known malware" {
+		t.Errorf("unexpected hash entry %+v", entries[0])
+	}
+	if entries[1].Type != database.BlocklistPubkey || entries[1].Value != pubkey || entries[1].Reason != "" {
+		t.Errorf("the npub should be stored as hex %+v", entries[1])
+	}
+	if entries[2].Value != pubkey || entries[2].Reason != "spam bot" {
+		t.Errorf("unexpected pubkey entry %+v", entries[2])
+	}
+
+	for _, line := range []string{"sha256", "sha256 abc", "pubkey npub1nope", "email someone@example.com"} {
+		_, err = ParseBlocklist([]byte(line))
+		if !errors.Is(err, ErrInvalidBlocklistLine) {
+			t.Errorf("expected ErrInvalidBlocklistLine for %q, got %v", line, err)
+		}
+	}
+}
+
+func TestImportBlocklist(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	stored := addScrubTestBlob(t, sqlite, handler, []byte("known bad"), []byte("known bad"))
+	missing := "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	abuser := testPubkey(t)
+	other := testPubkey(t)
+
+	entries, err := ParseBlocklist([]byte("sha256 " + stored + " csam\nsha256 " + missing + "\npubkey " + abuser + " spam\n"))
+	if err != nil {
+		t.Fatalf("ParseBlocklist(list) %+v", err)
+	}
+	result, err := ImportBlocklist(ctx, sqlite, handler, entries, "cli import list.txt", 100)
+	if err != nil {
+		t.Fatalf("ImportBlocklist(ctx, sqlite, handler, entries) %+v", err)
+	}
+	if result != (BlocklistImport{Hashes: 2, Pubkeys: 1, Deleted: 1}) {
+		t.Errorf("unexpected import result %+v", result)
+	}
+
+	var httpErr *utils.HTTPError
+	err = CheckNotBlocked(ctx, sqlite, "", abuser)
+	if !errors.As(err, &httpErr) || httpErr.Status != 403 || !errors.Is(err, ErrPubkeyBlocked) {
+		t.Errorf("expected a 403 for the blocked pubkey, got %v", err)
+	}
+	err = CheckNotBlocked(ctx, sqlite, missing, other)
+	if !errors.Is(err, ErrBlobBlocked) {
+		t.Errorf("expected ErrBlobBlocked for the imported hash, got %v", err)
+	}
+	err = CheckNotBlocked(ctx, sqlite, "", other)
+	if err != nil {
+		t.Errorf("CheckNotBlocked(ctx, sqlite, other) %+v", err)
+	}
+
+	err = UnblockPubkey(ctx, sqlite, abuser, "owner", 200)
+	if err != nil {
+		t.Fatalf("UnblockPubkey(ctx, sqlite, abuser) %+v", err)
+	}
+	err = UnblockBlob(ctx, sqlite, missing, "owner", 200)
+	if err != nil {
+		t.Fatalf("UnblockBlob(ctx, sqlite, missing) %+v", err)
+	}
+	err = CheckNotBlocked(ctx, sqlite, missing, abuser)
+	if err != nil {
+		t.Errorf("expected nothing blocked after unblocking, got %v", err)
+	}
+
+	var audits []database.BlocklistAudit
+	err = database.WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		var err error
+		audits, err = sqlite.GetBlocklistAudit(ctx, tx, 100)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("sqlite.GetBlocklistAudit(ctx, tx, 100) %+v", err)
+	}
+	if len(audits) != 5 {
+		t.Fatalf("expected every change in the audit, got %+v", audits)
+	}
+	if audits[0].Action != database.AuditUnblock || audits[0].Target != missing || audits[0].Actor != "owner" {
+		t.Errorf("unexpected newest audit entry %+v", audits[0])
+	}
+	if audits[4].Action != database.AuditBlock || audits[4].Target != stored || audits[4].Reason != "csam" || audits[4].Actor != "cli import list.txt" {
+		t.Errorf("unexpected oldest audit entry %+v", audits[4])
+	}
+}
+
+// failingBlockDB fails to block one pubkey after the entries before it were written
+type failingBlockDB struct {
+	database.Database
+	failOn string
+}
+
+func (f failingBlockDB) BlockPubkey(ctx context.Context, tx *sql.Tx, blocked database.BlockedPubkey) error {
+	if blocked.Pubkey == f.failOn {
+		return errors.New("write failed")
+	}
+	return f.Database.BlockPubkey(ctx, tx, blocked)
+}
+
+func TestImportBlocklistIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	stored := addScrubTestBlob(t, sqlite, handler, []byte("kept"), []byte("kept"))
+	abuser := testPubkey(t)
+	failing := testPubkey(t)
+
+	entries := []BlocklistEntry{
+		{Type: database.BlocklistPubkey, Value: abuser},
+		{Type: database.BlocklistSha256, Value: stored},
+		{Type: database.BlocklistPubkey, Value: failing},
+	}
+	_, err = ImportBlocklist(ctx, failingBlockDB{Database: sqlite, failOn: failing}, handler, entries, "owner", 100)
+	if err == nil {
+		t.Fatalf("expected the import to fail on the last entry")
+	}
+
+	err = CheckNotBlocked(ctx, sqlite, stored, abuser)
+	if err != nil {
+		t.Errorf("a failed import should block nothing, got %v", err)
+	}
+	if _, err := os.Stat(handler.ShardedPath(stored)); err != nil {
+		t.Errorf("a failed import should delete nothing. %+v", err)
+	}
+
+	_, err = ImportBlocklist(ctx, sqlite, handler, []BlocklistEntry{{Type: database.BlocklistSha256, Value: "abc"}}, "owner", 100)
+	if err == nil {
+		t.Errorf("expected an error for a bad hash")
+	}
+}
+
+func TestCheckUploadAuth(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	uploader := testPubkey(t)
+
+	err = CheckUploadAuth(ctx, sqlite, PaymentPolicy{}, "")
+	if err != nil {
+		t.Errorf("anonymous uploads should be allowed without limits or blocks, got %v", err)
+	}
+
+	err = BlockPubkey(ctx, sqlite, testPubkey(t), "spam", "owner", 100)
+	if err != nil {
+		t.Fatalf("BlockPubkey(ctx, sqlite, pubkey) %+v", err)
+	}
+	var httpErr *utils.HTTPError
+	err = CheckUploadAuth(ctx, sqlite, PaymentPolicy{}, "")
+	if !errors.As(err, &httpErr) || httpErr.Status != 401 || !errors.Is(err, ErrUploadAuthRequired) {
+		t.Errorf("expected a 401 for an anonymous upload while a pubkey is blocked, got %v", err)
+	}
+	err = CheckUploadAuth(ctx, sqlite, PaymentPolicy{}, uploader)
+	if err != nil {
+		t.Errorf("authenticated uploads should be allowed, got %v", err)
+	}
+}
@@ -2,23 +2,30 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"github.com/gin-gonic/gin"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"ratasker/external/blossom"
+	n "ratasker/external/nostr"
 	"ratasker/external/xcashu"
 	"ratasker/internal/cashu"
 	"ratasker/internal/database"
 	"ratasker/internal/io"
+	"ratasker/internal/metrics"
 	"ratasker/internal/utils"
 	"strconv"
 	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 const (
@@ -28,108 +35,105 @@ const (
 	SEED              = "SEED"
 )
 
-func WriteBlobAndCharge(c *gin.Context, wallet cashu.CashuWallet, db database.Database, fileHandler io.BlossomIO, cost uint64) error {
-	quoteReq := c.GetHeader("content-length")
-	buf := new(bytes.Buffer)
-
-	_, err := buf.ReadFrom(c.Request.Body)
-	if err != nil {
-		log.Printf("buf.ReadFrom(c.Request.Body) %+v", err)
-		c.JSON(500, "Somethig went wrong")
-		return err
-	}
+// ErrBlobAlreadyStored is returned when a concurrent upload of the same blob stored its row first
+var ErrBlobAlreadyStored = errors.New("Blob is already stored")
 
-	hash := sha256.Sum256(buf.Bytes())
-
-	// check if hash already exists
-	_, err = db.GetBlobLength(hash[:])
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		log.Printf("Chunk already exists %x", hash[:])
-		type Error struct {
-			Error string
-		}
-		c.JSON(201, Error{Error: "chuck exists"})
-		return err
+// respondBlobExists answers uploads of blobs that are already stored. Nothing is charged for them
+func respondBlobExists(c *gin.Context, hashHex string) {
+	slog.InfoContext(c.Request.Context(), "Chunk already exists", "sha256", hashHex)
+	type Error struct {
+		Error string
 	}
+	c.JSON(201, Error{Error: "chuck exists"})
+}
 
-	// Start DB transaction
+// blobFileExists reports if the storage already has a file for the key. A failed read counts as missing
+func blobFileExists(ctx context.Context, fileHandler io.BlossomIO, path string) bool {
+	_, err := fileHandler.GetBlobRange(ctx, path, 0, 1)
+	return err == nil
+}
 
-	tx, err := db.BeginTransaction()
+// WriteBlobAndCharge stores the blob after taking the payment and answers with the descriptor.
+// Errors are returned without writing a response, utils.AbortWithError does it.
+// A kind 1063 event is published when the uploader asks for it and publisher is enabled
+func WriteBlobAndCharge(c *gin.Context, wallet cashu.CashuWallet, db database.Database, fileHandler io.BlossomIO, cost uint64, policy PaymentPolicy, publisher *NIP94Publisher) error {
+	ctx := c.Request.Context()
+	quoteReq := c.GetHeader("content-length")
+	pubkey := utils.GetNostrAuthPubkey(c)
+	err := CheckUploadAuth(ctx, db, policy, pubkey)
 	if err != nil {
-		log.Fatalf("Failed to begin transaction: %v\n", err)
+		return fmt.Errorf("CheckUploadAuth(ctx, db, policy, pubkey). %w", err)
 	}
 
-	// Ensure that the transaction is rolled back in case of a panic or error
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback()
-			log.Fatalf("Panic occurred: %v\n", p)
-		} else if err != nil {
-			log.Println(" Rolling back transaction due to error. ", err)
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				log.Fatalf("\nFailed to write blossom: %v\n", err)
-			}
-			log.Println("Blossom blob written successfuly")
-		}
-	}()
-
-	// Check ecash amount correct
-	contentLenght, err := strconv.ParseInt(quoteReq, 10, 64)
+	// blocked pubkeys are refused before reading the blob
+	err = CheckNotBlocked(ctx, db, "", pubkey)
 	if err != nil {
-		c.JSON(400, "Malformed request")
-		return err
+		return fmt.Errorf("CheckNotBlocked(ctx, db, \"\", pubkey). %w", err)
 	}
 
-	mints, err := cashu.GetTrustedMintFromOsEnv()
-	if err != nil {
-		c.JSON(400, "Malformed request")
-		return err
+	body := c.Request.Body
+	if policy.MaxBlobBytes > 0 {
+		body = http.MaxBytesReader(c.Writer, body, int64(policy.MaxBlobBytes))
 	}
-
-	amountToPay := xcashu.QuoteAmountToPay(uint64(contentLenght), cost)
-	paymentResponse := xcashu.PaymentQuoteResponse{
-		Amount: amountToPay,
-		Unit:   xcashu.Sat,
-		Mints:  []string{mints},
-		Pubkey: wallet.GetActivePubkey(),
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return utils.NewHTTPError(413, "Blob is too large", fmt.Errorf("buf.ReadFrom(body). %w. %w", err, ErrBlobTooLarge))
 	}
-
-	jsonBytes, err := json.Marshal(paymentResponse)
 	if err != nil {
-		c.JSON(500, "Error request")
-		return err
+		return utils.NewHTTPError(400, "Could not read the blob", fmt.Errorf("buf.ReadFrom(body). %w", err))
+	}
+	// the smallest quote is 1 sat, an empty blob would be charged for bytes it does not store
+	if buf.Len() == 0 {
+		return utils.NewHTTPError(400, "Blob is empty", ErrEmptyBlob)
 	}
 
-	// In case you need to 402
-	encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
-
-	cashu_header := c.GetHeader(xcashu.Xcashu)
+	hash := sha256.Sum256(buf.Bytes())
+	hashHex := hex.EncodeToString(hash[:])
 
-	token, err := xcashu.ParseTokenHeader(cashu_header, amountToPay)
+	err = CheckNotBlocked(ctx, db, hashHex, "")
 	if err != nil {
-		log.Printf(`xcashu.ParseTokenHeader(cashu_header, amountToPay) %+v`, err)
-		c.JSON(402, encodedPayReq)
-		return err
+		return fmt.Errorf("CheckNotBlocked(ctx, db, hashHex, \"\"). %w", err)
 	}
 
-	// Check Token is valid
-	_, err = wallet.VerifyToken(token, tx, db)
-	if err != nil {
-		log.Printf(`wallet.VerifyToken(token, tx, db) %+v`, err)
-		return err
+	// the middleware can't see the hash of the body. Without this an upload event with no x tag
+	// could be replayed to upload anything on the quota of its pubkey
+	authEvent, authenticated := utils.GetNostrAuthEvent(c)
+	if authenticated && !authEvent.Tags.ContainsAny("x", []string{hashHex}) {
+		return utils.NewHTTPError(401, "Auth event does not include this hash", n.ErrHashNotAuthorized)
+	}
+
+	// check if hash already exists
+	_, err = db.GetBlobLength(ctx, hash[:])
+	if err == nil {
+		respondBlobExists(c, hashHex)
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("db.GetBlobLength(ctx, hash[:]). %w", err)
 	}
 
-	err = wallet.StoreEcash(token, tx, db)
+	// Check ecash amount correct
+	contentLenght, err := strconv.ParseInt(quoteReq, 10, 64)
 	if err != nil {
-		log.Printf(`wallet.StoreEcash(proofs, tx, db) %+v`, err)
-		return err
+		return utils.NewHTTPError(400, "Malformed request", fmt.Errorf("strconv.ParseInt(quoteReq, 10, 64). %w", err))
 	}
 
-	// check for upload payment
-	hashHex := hex.EncodeToString(hash[:])
+	// the event is checked before taking the payment
+	var clientEvent *nostr.Event
+	serverSigned := c.GetHeader(XNIP94Publish) == "server"
+	eventHeader := c.GetHeader(XNIP94Event)
+	if (serverSigned || eventHeader != "") && !publisher.Enabled() {
+		return utils.NewHTTPError(400, "NIP-94 publishing is not enabled", ErrNIP94Disabled)
+	}
+	if eventHeader != "" {
+		ev, err := ParseNIP94Event(eventHeader, hashHex, pubkey)
+		if err != nil {
+			return utils.NewHTTPError(400, "Invalid NIP-94 event", fmt.Errorf("ParseNIP94Event(eventHeader, hashHex, pubkey). %w", err))
+		}
+		clientEvent = &ev
+	}
 
 	blob := blossom.Blob{
 		Data: buf.Bytes(),
@@ -139,34 +143,154 @@ func WriteBlobAndCharge(c *gin.Context, wallet cashu.CashuWallet, db database.Da
 	}
 
 	storedBlob := blossom.DBBlobData{
-		Path:      fileHandler.GetStoragePath() + "/" + hashHex,
+		Path:      hashHex,
 		Sha256:    hash[:],
 		CreatedAt: uint64(time.Now().Unix()),
 		Data:      blob,
-		Pubkey:    "",
+		Pubkey:    pubkey,
 	}
 
-	err = fileHandler.WriteBlob(hashHex, buf.Bytes())
+	// the file is written before the transaction so the storage is not called while it holds the database.
+	// The body was hashed above, so the file matches its key. Remove it if the row never gets stored,
+	// unless the file was there before this request, another upload of the same blob may own it
+	fileExisted := blobFileExists(ctx, fileHandler, hashHex)
+	err = fileHandler.WriteBlob(ctx, hashHex, buf.Bytes())
 	if err != nil {
-		log.Printf(`fileHandler.WriteBlob(buf.Bytes()) %+v`, err)
-		c.JSON(500, "Opss something went wrong")
-		return err
+		return fmt.Errorf("fileHandler.WriteBlob(ctx, hashHex, buf.Bytes()). %w", err)
 	}
 
-	err = db.AddBlob(tx, storedBlob)
+	var paidMint string
+
+	err = database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		storedBlob.PaidSats = 0
+		paidMint = ""
+
+		// check storage limit before taking the payment
+		err := policy.CheckStorageQuota(ctx, tx, db, pubkey, uint64(buf.Len()))
+		if err != nil {
+			if errors.Is(err, ErrStorageQuotaExceeded) {
+				return utils.NewHTTPError(413, "Storage quota exceeded", err)
+			}
+			return fmt.Errorf("policy.CheckStorageQuota(ctx, tx, db, pubkey, size). %w", err)
+		}
+
+		// a cost of 0 is free for everyone and does not use the free quota
+		amountToPay := xcashu.QuoteAmountToPay(uint64(contentLenght), cost)
+		free := amountToPay == 0
+
+		// allowlisted pubkeys and free quota don't need to pay
+		if !free {
+			free, err = policy.CoversRequest(ctx, tx, db, pubkey, uint64(buf.Len()), time.Now())
+			if err != nil {
+				return fmt.Errorf("policy.CoversRequest(ctx, tx, db, pubkey, uint64(buf.Len()), time.Now()). %w", err)
+			}
+		}
+
+		if !free {
+			paymentResponse, err := NewPaymentQuote(wallet, amountToPay)
+			if err != nil {
+				return fmt.Errorf("NewPaymentQuote(wallet, amountToPay). %w", err)
+			}
+
+			jsonBytes, err := json.Marshal(paymentResponse)
+			if err != nil {
+				return fmt.Errorf("json.Marshal(paymentResponse). %w", err)
+			}
+
+			// In case you need to 402
+			encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
+
+			cashu_header := c.GetHeader(xcashu.Xcashu)
+
+			token, err := xcashu.ParseTokenHeader(cashu_header, amountToPay)
+			if err != nil {
+				c.Header(xcashu.Xcashu, encodedPayReq)
+				return utils.NewHTTPError(402, "Payment required", fmt.Errorf("xcashu.ParseTokenHeader(cashu_header, amountToPay). %w", err))
+			}
+
+			// Check Token is valid
+			_, err = wallet.VerifyToken(ctx, token, tx, db)
+			if err != nil {
+				metrics.CountVerificationFailure(err)
+				c.Header(xcashu.Xcashu, encodedPayReq)
+				return utils.NewHTTPError(400, "Invalid token", fmt.Errorf("wallet.VerifyToken(ctx, token, tx, db). %w", err))
+			}
+
+			err = wallet.StoreEcash(ctx, token, tx, db)
+			if errors.Is(err, cashu.ErrProofAlreadySeen) {
+				return utils.NewHTTPError(400, "Invalid token", fmt.Errorf("wallet.StoreEcash(ctx, proofs, tx, db). %w", err))
+			}
+			if err != nil {
+				return fmt.Errorf("wallet.StoreEcash(ctx, proofs, tx, db). %w", err)
+			}
+
+			err = RecordPayment(ctx, db, tx, database.LedgerUpload, hashHex, pubkey, token)
+			if err != nil {
+				return fmt.Errorf("RecordPayment(ctx, db, tx, database.LedgerUpload, hash, pubkey, token). %w", err)
+			}
+			storedBlob.PaidSats = token.Amount()
+			paidMint = token.Mint()
+		}
+
+		err = db.AddBlob(ctx, tx, storedBlob)
+		// a concurrent upload stored the row first. Rolling back returns the payment
+		if database.IsUniqueViolation(err) {
+			return fmt.Errorf("db.AddBlob(ctx, tx, storedBlob). %w. %w", err, ErrBlobAlreadyStored)
+		}
+		if err != nil {
+			return fmt.Errorf("db.AddBlob(ctx, tx, storedBlob). %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrBlobAlreadyStored) {
+		respondBlobExists(c, hashHex)
+		return nil
+	}
 	if err != nil {
-		log.Printf(`db.AddBlob(storedBlob) %+v`, err)
-		c.JSON(500, "Opss something went wrong")
+		if !fileExisted {
+			// the cleanup has to happen even if the client went away
+			cleanupCtx := context.WithoutCancel(ctx)
+			// a concurrent upload may have stored the row after the file was checked
+			_, lengthErr := db.GetBlobLength(cleanupCtx, hash[:])
+			if errors.Is(lengthErr, sql.ErrNoRows) {
+				removeErr := fileHandler.RemoveBlob(cleanupCtx, hashHex)
+				if removeErr != nil {
+					slog.ErrorContext(ctx, "fileHandler.RemoveBlob(cleanupCtx, hashHex)", "error", removeErr)
+				}
+			}
+		}
 		return err
 	}
 
+	paid := storedBlob.PaidSats
+	slog.InfoContext(ctx, "Blossom blob written successfuly", "sha256", hashHex, "size", buf.Len(), "paid_sats", paid)
+	metrics.BytesUploaded.Add(float64(buf.Len()))
+	if paid > 0 {
+		metrics.SatsReceived.WithLabelValues(paidMint, database.LedgerUpload).Add(float64(paid))
+	}
+
 	blobDescriptor := blossom.BlobDescriptor{
-		Url:      os.Getenv(utils.DOMAIN) + "/" + hashHex,
+		Url:      os.Getenv(utils.DOMAIN) + "/" + hashHex + blossom.ExtensionFromMimeType(blob.Type),
 		Sha256:   hashHex,
 		Size:     storedBlob.Data.Size,
 		Uploaded: storedBlob.Pubkey,
 		Type:     blob.Type,
 	}
+	blobDescriptor.NIP94 = NIP94Tags(blobDescriptor, buf.Bytes())
+
+	switch {
+	case clientEvent != nil:
+		publisher.Publish(ctx, *clientEvent)
+	case serverSigned:
+		ev, err := publisher.SignForUploader(blobDescriptor.NIP94, pubkey)
+		if err != nil {
+			// the blob is stored and paid, the missing event is not worth failing the upload
+			slog.ErrorContext(ctx, "publisher.SignForUploader(blobDescriptor.NIP94, pubkey)", "error", err)
+		} else {
+			publisher.Publish(ctx, ev)
+		}
+	}
+
 	c.JSON(200, blobDescriptor)
 
 	return nil
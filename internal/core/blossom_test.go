@@ -0,0 +1,251 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"ratasker/external/blossom"
+	n "ratasker/external/nostr"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"ratasker/internal/utils"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestWriteBlobAndChargeNeedsHashInAuthEvent(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	// an upload event without x tags is valid for the middleware, it can't see the body
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      n.AuthKind,
+		Tags:      nostr.Tags{{n.BlossomAction, n.UPLOAD}, {n.Expiration, fmt.Sprint(time.Now().Add(time.Minute).Unix())}},
+	}
+	err = event.Sign(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("event.Sign(key) %+v", err)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader([]byte("replayed upload")))
+	c.Set(utils.NOSTRAUTH, event)
+
+	err = WriteBlobAndCharge(c, nil, sqlite, handler, 1, PaymentPolicy{}, nil)
+	var httpErr *utils.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != 401 || !errors.Is(err, n.ErrHashNotAuthorized) {
+		t.Errorf("expected a 401 for an auth event without the hash, got %v", err)
+	}
+}
+
+func TestWriteBlobAndChargeNeedsAuthWithStorageLimit(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader([]byte("anonymous upload")))
+
+	err = WriteBlobAndCharge(c, nil, sqlite, handler, 1, PaymentPolicy{MaxStorageBytes: 100}, nil)
+	var httpErr *utils.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != 401 || !errors.Is(err, ErrUploadAuthRequired) {
+		t.Errorf("expected a 401 for an anonymous upload with a storage limit, got %v", err)
+	}
+}
+
+func TestWriteBlobAndChargeRefusesLargeBlobs(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader([]byte("a blob over the limit")))
+
+	err = WriteBlobAndCharge(c, nil, sqlite, handler, 1, PaymentPolicy{MaxBlobBytes: 10}, nil)
+	var httpErr *utils.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != 413 || !errors.Is(err, ErrBlobTooLarge) {
+		t.Errorf("expected a 413 for a blob over the limit, got %v", err)
+	}
+}
+
+func TestWriteBlobAndChargeRefusesEmptyBlobs(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader(nil))
+
+	err = WriteBlobAndCharge(c, nil, sqlite, handler, 1, PaymentPolicy{}, nil)
+	var httpErr *utils.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != 400 || !errors.Is(err, ErrEmptyBlob) {
+		t.Errorf("expected a 400 for an empty blob, got %v", err)
+	}
+}
+
+// racingBlobDB misses the row of a concurrent upload in the first check, like an upload that started before it committed
+type racingBlobDB struct {
+	database.Database
+}
+
+func (r racingBlobDB) GetBlobLength(ctx context.Context, hash []byte) (uint64, error) {
+	return 0, sql.ErrNoRows
+}
+
+func TestWriteBlobAndChargeConcurrentUploadIsNotCharged(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	data := []byte("uploaded twice at the same time")
+	hash := sha256.Sum256(data)
+	hashHex := hex.EncodeToString(hash[:])
+
+	// the other upload already stored its file and row
+	err = handler.WriteBlob(ctx, hashHex, data)
+	if err != nil {
+		t.Fatalf("handler.WriteBlob(ctx, hashHex, data) %+v", err)
+	}
+	err = database.WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		return sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: hashHex, Sha256: hash[:], Pubkey: "winner", Data: blossom.Blob{Size: uint64(len(data))}})
+	})
+	if err != nil {
+		t.Fatalf("sqlite.AddBlob(ctx, tx, blob) %+v", err)
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatalf("nostr.GetPublicKey(sk) %+v", err)
+	}
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      n.AuthKind,
+		Tags:      nostr.Tags{{n.BlossomAction, n.UPLOAD}, {"x", hashHex}, {n.Expiration, fmt.Sprint(time.Now().Add(time.Minute).Unix())}},
+	}
+	err = event.Sign(sk)
+	if err != nil {
+		t.Fatalf("event.Sign(key) %+v", err)
+	}
+	policy, err := NewPaymentPolicy(pubkey, 0, 0)
+	if err != nil {
+		t.Fatalf("NewPaymentPolicy(pubkey, 0, 0) %+v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader(data))
+	c.Request.Header.Set("content-length", fmt.Sprint(len(data)))
+	c.Set(utils.NOSTRAUTH, event)
+
+	err = WriteBlobAndCharge(c, nil, racingBlobDB{Database: sqlite}, handler, 1, policy, nil)
+	if err != nil {
+		t.Fatalf("WriteBlobAndCharge(c, ...) %+v", err)
+	}
+	if recorder.Code != 201 {
+		t.Errorf("expected the blob to already exist, got %v", recorder.Code)
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	defer tx.Rollback()
+	usage, err := sqlite.GetUsage(ctx, tx, pubkey)
+	if err != nil {
+		t.Fatalf("sqlite.GetUsage(ctx, tx, pubkey) %+v", err)
+	}
+	if usage.BlobCount != 0 || usage.TotalBytes != 0 {
+		t.Errorf("the second upload should not be counted. got: %+v", usage)
+	}
+	if _, err := os.Stat(handler.ShardedPath(hashHex)); err != nil {
+		t.Errorf("the file of the first upload should be kept. %+v", err)
+	}
+}
+
+func TestWriteBlobAndChargeRemovesFileWhenRefused(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	data := []byte("a blob over the storage quota")
+	hash := sha256.Sum256(data)
+	hashHex := hex.EncodeToString(hash[:])
+
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      n.AuthKind,
+		Tags:      nostr.Tags{{n.BlossomAction, n.UPLOAD}, {"x", hashHex}, {n.Expiration, fmt.Sprint(time.Now().Add(time.Minute).Unix())}},
+	}
+	err = event.Sign(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("event.Sign(key) %+v", err)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader(data))
+	c.Request.Header.Set("content-length", fmt.Sprint(len(data)))
+	c.Set(utils.NOSTRAUTH, event)
+
+	// the file is written before the quota is checked in the transaction
+	err = WriteBlobAndCharge(c, nil, sqlite, handler, 1, PaymentPolicy{MaxStorageBytes: 10}, nil)
+	if !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Fatalf("expected ErrStorageQuotaExceeded, got %v", err)
+	}
+	if _, err := os.Stat(handler.ShardedPath(hashHex)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the file of a refused upload should be removed. got: %v", err)
+	}
+}
+
+func TestWriteBlobAndChargeWithoutCost(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	// over 1 KiB, where the quote divides by the cost
+	data := bytes.Repeat([]byte("free"), 1024)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("PUT", "/upload", bytes.NewReader(data))
+	c.Request.Header.Set("content-length", fmt.Sprint(len(data)))
+
+	err = WriteBlobAndCharge(c, nil, sqlite, handler, 0, PaymentPolicy{}, nil)
+	if err != nil {
+		t.Fatalf("WriteBlobAndCharge(c, nil, sqlite, handler, 0, policy, nil) %+v", err)
+	}
+	if recorder.Code != 200 {
+		t.Errorf("a cost of 0 should store the blob without paying. got %v", recorder.Code)
+	}
+}
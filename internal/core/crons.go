@@ -6,10 +6,11 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"ratasker/internal/cashu"
 	"ratasker/internal/database"
+	"ratasker/internal/metrics"
 	"ratasker/internal/utils"
 	"time"
 
@@ -17,13 +18,21 @@ import (
 	c "github.com/elnosh/gonuts/cashu"
 	"github.com/elnosh/gonuts/cashu/nuts/nut12"
 	"github.com/elnosh/gonuts/crypto"
-	"github.com/elnosh/gonuts/wallet/client"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip44"
 )
 
 const discoveryRelay = "wss://purplepag.es"
 
+// KeyRotationTimeout bounds the transaction that swaps the locked proofs and rotates the pubkey
+const KeyRotationTimeout = 5 * time.Minute
+
+// RotationCheckInterval is how often the pubkey expiration is checked
+const RotationCheckInterval = 10 * time.Second
+
+// PayoutInterval is how often the swapped proofs are handed to the owner
+const PayoutInterval = 10 * time.Minute
+
 var (
 	ErrNoRelayMetadataForMessaging = errors.New("No relay metadata for messaging")
 )
@@ -43,19 +52,19 @@ func StringToPubkey(pubkey string) (*secp256k1.PublicKey, error) {
 
 }
 
-func GetRelaysFromNIP65Pubkey(pubkey string, relayUrl string, pool *nostr.SimplePool) error {
+func GetRelaysFromNIP65Pubkey(ctx context.Context, pubkey string, relayUrl string, pool *nostr.SimplePool) error {
 
-	relay, err := nostr.RelayConnect(context.Background(), relayUrl)
+	relay, err := nostr.RelayConnect(ctx, relayUrl)
 	if err != nil {
-		return fmt.Errorf("nostr.RelayConnect(context.Background(),discoveryRelay ). %w", err)
+		return fmt.Errorf("nostr.RelayConnect(ctx, relayUrl). %w", err)
 	}
 	filter := nostr.Filter{
 		Authors: []string{pubkey},
 		Kinds:   []int{10002},
 	}
-	events, err := relay.QuerySync(context.Background(), filter)
+	events, err := relay.QuerySync(ctx, filter)
 	if err != nil {
-		return fmt.Errorf("relay.QuerySync(context.Background(), filter). %w", err)
+		return fmt.Errorf("relay.QuerySync(ctx, filter). %w", err)
 	}
 
 	if len(events) == 0 {
@@ -65,7 +74,7 @@ func GetRelaysFromNIP65Pubkey(pubkey string, relayUrl string, pool *nostr.Simple
 	for _, v := range events {
 		for _, tag := range v.Tags {
 
-			relay, err := nostr.RelayConnect(context.Background(), tag.Value())
+			relay, err := nostr.RelayConnect(ctx, tag.Value())
 			if err != nil {
 				continue
 			}
@@ -76,7 +85,7 @@ func GetRelaysFromNIP65Pubkey(pubkey string, relayUrl string, pool *nostr.Simple
 	return nil
 }
 
-func SendEncryptedProofsToPubkey(privKey string, encryptedToken string, pubkey string, pool *nostr.SimplePool) error {
+func SendEncryptedProofsToPubkey(ctx context.Context, privKey string, encryptedToken string, pubkey string, pool *nostr.SimplePool) error {
 	tag := nostr.Tag{"r", pubkey}
 	// make event
 	ev := nostr.Event{
@@ -92,7 +101,7 @@ func SendEncryptedProofsToPubkey(privKey string, encryptedToken string, pubkey s
 	}
 	// send event to relays
 	pool.Relays.Range(func(key string, value *nostr.Relay) bool {
-		if err := value.Publish(context.Background(), ev); err != nil {
+		if err := value.Publish(ctx, ev); err != nil {
 			return true
 		}
 
@@ -102,11 +111,11 @@ func SendEncryptedProofsToPubkey(privKey string, encryptedToken string, pubkey s
 	return nil
 }
 
-func GetUnspentProofsToTokens(wallet cashu.CashuWallet, db database.Database, tx *sql.Tx) ([]c.TokenV4, error) {
+func GetUnspentProofsToTokens(ctx context.Context, wallet cashu.CashuWallet, db database.Database, tx *sql.Tx) ([]c.TokenV4, error) {
 	var tokens []c.TokenV4
-	mintsProofs, err := db.GetBySpentProofs(tx, false)
+	mintsProofs, err := db.GetBySpentProofs(ctx, tx, false)
 	if err != nil {
-		return tokens, fmt.Errorf("db.GetBySpentProofs(tx, false ). %w", err)
+		return tokens, fmt.Errorf("db.GetBySpentProofs(ctx, tx, false ). %w", err)
 	}
 
 	for key, val := range mintsProofs {
@@ -121,56 +130,91 @@ func GetUnspentProofsToTokens(wallet cashu.CashuWallet, db database.Database, tx
 	return tokens, nil
 }
 
-func SpendSwappedProofs(wallet cashu.CashuWallet, db database.Database) error {
-
-	// rotate keys up
-	tx, err := db.BeginTransaction()
-	if err != nil {
-		log.Panicf("Could not get a lock on the db. %+v", err)
-	}
-	// Ensure that the transaction is rolled back in case of a panic or error
-	defer func() {
-		if p := recover(); p != nil {
-			log.Printf("\n Rolling back  because of failure %+v\n", p)
-			tx.Rollback()
-		} else if err != nil {
-			log.Println("Rolling back  because of error")
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-			if err != nil {
-				log.Printf("\n Failed to write ecash token to file: %v\n", err)
-			}
-			fmt.Println("Ecash token written to file successfully")
+// SpendSwappedProofs writes the swapped proofs as tokens for the owner and marks them spent.
+// Nothing is marked if the tokens could not be written
+func SpendSwappedProofs(ctx context.Context, wallet cashu.CashuWallet, db database.Database) error {
+	var written int
+	// the tokens file is appended, so the transaction is not repeated
+	err := database.RunTx(ctx, db, func(tx *sql.Tx) error {
+		tokens, err := GetUnspentProofsToTokens(ctx, wallet, db, tx)
+		if err != nil {
+			return fmt.Errorf("GetUnspentProofsToTokens(ctx, wallet, db, tx). %w", err)
+		}
+		if len(tokens) == 0 {
+			return nil
 		}
-	}()
-
-	tokens, err := GetUnspentProofsToTokens(wallet, db, tx)
-	if err != nil {
-		log.Printf("\n GetUnspentProofsToTokens(wallet, db, tx) %v\n", err)
-	}
 
-	if len(tokens) > 0 {
 		err = WriteTokenToLocalFile(tokens)
 		if err != nil {
-			log.Printf("\n GetUnspentProofsToTokens(wallet, db, tx) %v\n", err)
+			return fmt.Errorf("WriteTokenToLocalFile(tokens). %w", err)
 		}
 
 		var proofs c.Proofs
 		for _, v := range tokens {
-
 			proofs = append(proofs, v.Proofs()...)
 		}
 
-		err = db.ChangeSwappedProofsSpent(tx, proofs, true)
+		err = db.ChangeSwappedProofsSpent(ctx, tx, proofs, true)
 		if err != nil {
-			log.Printf("\n db.ChangeSwappedProofsSpent() %v\n", err)
+			return fmt.Errorf("db.ChangeSwappedProofsSpent(ctx, tx, proofs, true). %w", err)
 		}
+		written = len(tokens)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
+	if written > 0 {
+		slog.InfoContext(ctx, "Ecash token written to file successfully", "tokens", written)
 	}
 	return nil
 }
 
+// RotateExpiredKeys swaps the locked proofs and moves the wallet to a new pubkey a minute before the current one expires.
+// It returns false when the pubkey is still valid
+func RotateExpiredKeys(ctx context.Context, wallet *cashu.DBNativeWallet, db database.Database, now time.Time) (bool, error) {
+	if now.Add(1*time.Minute).Unix() <= int64(wallet.PubkeyVersion.Expiration) {
+		return false, nil
+	}
+
+	slog.InfoContext(ctx, "begining key rotation")
+	// a mint that does not answer must not hold the write transaction forever
+	rotationCtx, cancel := context.WithTimeout(ctx, KeyRotationTimeout)
+	defer cancel()
+
+	beforeRotation := wallet.PubkeyVersion
+	rotationStart := time.Now()
+
+	// the proofs are swapped with the mint inside, so a failed rotation is not repeated right away
+	err := database.RunTx(rotationCtx, db, func(tx *sql.Tx) error {
+		// move locked proofs to valid swap
+		err := RotateLockedProofs(rotationCtx, wallet, db, tx)
+		if err != nil {
+			return fmt.Errorf("RotateLockedProofs(rotationCtx, wallet, db, tx). %w", err)
+		}
+
+		err = wallet.RotatePubkey(rotationCtx, tx, db)
+		if err != nil {
+			return fmt.Errorf("wallet.RotatePubkey(rotationCtx, tx, db). %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		wallet.PubkeyVersion = beforeRotation
+		outcome := metrics.RotationError
+		if errors.Is(err, database.ErrTxPanic) {
+			outcome = metrics.RotationPanic
+		}
+		metrics.ObserveKeyRotation(outcome, time.Since(rotationStart))
+		return true, err
+	}
+
+	metrics.ObserveKeyRotation(metrics.RotationSuccess, time.Since(rotationStart))
+	slog.InfoContext(ctx, "Key rotation finished successfully")
+	return true, nil
+}
+
 const tokenFile = "tokens.txt"
 
 func WriteTokenToLocalFile(tokens []c.TokenV4) error {
@@ -215,18 +259,16 @@ func WriteTokenToLocalFile(tokens []c.TokenV4) error {
 }
 
 // take the redeem proofs and send them to a nostr user
-func SendProofsToOwner(db database.Database, tx *sql.Tx, tokens []c.Token, pubkey string) error {
-
-	ctx := context.Background()
+func SendProofsToOwner(ctx context.Context, db database.Database, tx *sql.Tx, tokens []c.Token, pubkey string) error {
 
 	// generate key to send proofs
 	privKey := nostr.GeneratePrivateKey()
 	pool := nostr.NewSimplePool(ctx)
 
 	// get relays of the nostr user
-	err := GetRelaysFromNIP65Pubkey(pubkey, discoveryRelay, pool)
+	err := GetRelaysFromNIP65Pubkey(ctx, pubkey, discoveryRelay, pool)
 	if err != nil {
-		return fmt.Errorf("GetRelaysFromNIP65Pubkey(pubkey, pool). %w", err)
+		return fmt.Errorf("GetRelaysFromNIP65Pubkey(ctx, pubkey, discoveryRelay, pool). %w", err)
 	}
 
 	_, err = nip44.GenerateConversationKey(pubkey, privKey)
@@ -235,12 +277,12 @@ func SendProofsToOwner(db database.Database, tx *sql.Tx, tokens []c.Token, pubke
 	}
 
 	for _, token := range tokens {
-		tokenString, err := token.Serialize()
+		_, err := token.Serialize()
 		if err != nil {
 			return fmt.Errorf("token.Serialize(). %w", err)
 		}
 
-		log.Println("tokenString: ", tokenString)
+		slog.DebugContext(ctx, "Token ready to send", "amount", token.Amount(), "mint", token.Mint())
 		// encryptedString, err := nip44.Encrypt(tokenString, conversationKey, nil)
 		// if err != nil {
 		// 	return fmt.Errorf("nip44.Encrypt(tokenString, conversationKey). %w", err)
@@ -250,43 +292,43 @@ func SendProofsToOwner(db database.Database, tx *sql.Tx, tokens []c.Token, pubke
 		// 	return fmt.Errorf("SendEncryptedProofsToPubkey(privKey, encryptedString, pubkey,pool). %w", err)
 		// }
 		//
-		err = db.ChangeSwappedProofsSpent(tx, token.Proofs(), true)
+		err = db.ChangeSwappedProofsSpent(ctx, tx, token.Proofs(), true)
 		if err != nil {
-			return fmt.Errorf("db.ChangeSwappedProofsSpent(tx, val, true). %w", err)
+			return fmt.Errorf("db.ChangeSwappedProofsSpent(ctx, tx, val, true). %w", err)
 		}
 	}
 
 	return nil
 }
 
-func RotateLockedProofs(wallet cashu.CashuWallet, db database.Database, tx *sql.Tx) error {
+func RotateLockedProofs(ctx context.Context, wallet cashu.CashuWallet, db database.Database, tx *sql.Tx) error {
 
-	proofsPerMint, err := db.GetLockedProofsByRedeemed(tx, false)
+	proofsPerMint, err := db.GetLockedProofsByRedeemed(ctx, tx, false)
 	if err != nil {
-		return fmt.Errorf("db.GetLockedProofsByRedeemed(tx, false). %w", err)
+		return fmt.Errorf("db.GetLockedProofsByRedeemed(ctx, tx, false). %w", err)
 	}
 
 	for mint_url, proofsToSwap := range proofsPerMint {
-		keyset, err := wallet.GetActiveKeyset(mint_url)
+		keyset, err := wallet.GetActiveKeyset(ctx, mint_url)
 		if err != nil {
-			return fmt.Errorf("wallet.GetActiveKeyset(mint_url). %w", err)
+			return fmt.Errorf("wallet.GetActiveKeyset(ctx, mint_url). %w", err)
 		}
 
-		counter, err := db.GetKeysetCounter(tx, keyset.Id)
+		counter, err := db.GetKeysetCounter(ctx, tx, keyset.Id)
 
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				counter.Counter = 0
 				counter.KeysetId = keyset.Id
 			} else {
-				return fmt.Errorf("db.GetKeysetCounter(tx,keyset.Id ). %w", err)
+				return fmt.Errorf("db.GetKeysetCounter(ctx, tx,keyset.Id ). %w", err)
 			}
 		}
 
 		// TODO query fees of mint and keysets
-		keysets, err := client.GetAllKeysets(mint_url)
+		keysets, err := cashu.GetAllKeysets(ctx, mint_url)
 		if err != nil {
-			return fmt.Errorf("w.GetAllKeysets(mint_url). %w", err)
+			return fmt.Errorf("cashu.GetAllKeysets(ctx, mint_url). %w", err)
 
 		}
 
@@ -304,14 +346,14 @@ func RotateLockedProofs(wallet cashu.CashuWallet, db database.Database, tx *sql.
 		amountToAsk := valueOfProofs - uint64(fees)
 
 		if amountToAsk == 0 {
-			log.Println("Amount to swap after fees is 0 not making a swap")
+			slog.InfoContext(ctx, "Amount to swap after fees is 0 not making a swap", "mint", mint_url)
 			return nil
 		}
 
 		if counter.Counter == 0 {
-			err = db.SetKeysetCounter(tx, counter)
+			err = db.SetKeysetCounter(ctx, tx, counter)
 			if err != nil {
-				return fmt.Errorf("db.SetKeysetCounter(tx, counter). %w", err)
+				return fmt.Errorf("db.SetKeysetCounter(ctx, tx, counter). %w", err)
 
 			}
 		}
@@ -321,14 +363,19 @@ func RotateLockedProofs(wallet cashu.CashuWallet, db database.Database, tx *sql.
 			return fmt.Errorf("wallet.MakeBlindMessages(proofs, mint_url). %w", err)
 		}
 
-		blindSigs, err := wallet.SwapProofs(blindMessages, proofsToSwap, mint_url)
+		blindSigs, err := wallet.SwapProofs(ctx, blindMessages, proofsToSwap, mint_url)
+		if err != nil {
+			return fmt.Errorf("wallet.SwapProofs(ctx, blindMessages, proofs, mint_url). %w", err)
+		}
+
+		err = db.ModifyKeysetCounter(ctx, tx, counter)
 		if err != nil {
-			return fmt.Errorf("wallet.SwapProofs(blindMessages, proofs, mint_url). %w", err)
+			return fmt.Errorf("db.ModifyKeysetCounter(ctx, tx, counter). %w", err)
 		}
 
-		err = db.ModifyKeysetCounter(tx, counter)
+		err = recordSwapFees(ctx, db, tx, mint_url, uint64(fees))
 		if err != nil {
-			return fmt.Errorf("db.ModifyKeysetCounter(tx, counter). %w", err)
+			return fmt.Errorf("recordSwapFees(ctx, db, tx, mint_url, fees). %w", err)
 		}
 
 		var NewProofs c.Proofs
@@ -350,7 +397,7 @@ func RotateLockedProofs(wallet cashu.CashuWallet, db database.Database, tx *sql.
 			if blindSig.DLEQ != nil {
 				dleqRes := nut12.VerifyBlindSignatureDLEQ(*blindSig.DLEQ, mintPubkey, blindMessages[i].B_, blindSig.C_)
 				if !dleqRes {
-					log.Printf("\n ERROR: DLEQ has not passed. %+v", blindSig)
+					slog.ErrorContext(ctx, "DLEQ has not passed", "keyset_id", blindSig.Id, "amount", blindSig.Amount)
 				}
 			}
 
@@ -371,14 +418,14 @@ func RotateLockedProofs(wallet cashu.CashuWallet, db database.Database, tx *sql.
 			Cs = append(Cs, proofsToSwap[i].Proof.C)
 		}
 
-		err = db.ChangeLockedProofsRedeem(tx, Cs, true)
+		err = db.ChangeLockedProofsRedeem(ctx, tx, Cs, true)
 		if err != nil {
-			return fmt.Errorf("db.ChangeLockedProofsRedeem(tx, Cs, true) %w", err)
+			return fmt.Errorf("db.ChangeLockedProofsRedeem(ctx, tx, Cs, true) %w", err)
 		}
 
-		err = db.AddProofs(tx, NewProofs, mint_url)
+		err = db.AddProofs(ctx, tx, NewProofs, mint_url)
 		if err != nil {
-			return fmt.Errorf("db.AddProofs(tx, NewProofs, mint_url ) %w", err)
+			return fmt.Errorf("db.AddProofs(ctx, tx, NewProofs, mint_url ) %w", err)
 		}
 
 	}
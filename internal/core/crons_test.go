@@ -12,6 +12,7 @@ import (
 const npubTest = "npub1d7exvqfvxqyrq0j54e23gz6xj4lfj7qfssqamg60fkfp5f6mlzaskklrf3"
 
 func TestCheckForRelayExistence(t *testing.T) {
+	ctx := context.Background()
 	_, pubkey, err := nip19.Decode(npubTest)
 
 	if err != nil {
@@ -19,9 +20,9 @@ func TestCheckForRelayExistence(t *testing.T) {
 	}
 
 	pool := n.NewSimplePool(context.Background())
-	err = GetRelaysFromNIP65Pubkey(pubkey.(string), discoveryRelay, pool)
+	err = GetRelaysFromNIP65Pubkey(ctx, pubkey.(string), discoveryRelay, pool)
 	if err != nil {
-		t.Errorf("GetRelaysFromNIP65Pubkey(pubkeyTest, discoveryRelay, pool). %+v", err)
+		t.Errorf("GetRelaysFromNIP65Pubkey(ctx, pubkeyTest, discoveryRelay, pool). %+v", err)
 	}
 
 	if pool.Relays.Size() < 1 {
@@ -31,6 +32,7 @@ func TestCheckForRelayExistence(t *testing.T) {
 
 }
 func TestCheckSendingMessage(t *testing.T) {
+	ctx := context.Background()
 	_, pubkey, err := nip19.Decode(npubTest)
 
 	if err != nil {
@@ -38,9 +40,9 @@ func TestCheckSendingMessage(t *testing.T) {
 	}
 
 	pool := n.NewSimplePool(context.Background())
-	err = GetRelaysFromNIP65Pubkey(pubkey.(string), discoveryRelay, pool)
+	err = GetRelaysFromNIP65Pubkey(ctx, pubkey.(string), discoveryRelay, pool)
 	if err != nil {
-		t.Errorf("GetRelaysFromNIP65Pubkey(pubkeyTest, discoveryRelay, pool). %+v", err)
+		t.Errorf("GetRelaysFromNIP65Pubkey(ctx, pubkeyTest, discoveryRelay, pool). %+v", err)
 	}
 
 	if pool.Relays.Size() < 1 {
@@ -49,8 +51,8 @@ func TestCheckSendingMessage(t *testing.T) {
 	}
 
 	privkey := nostr.GeneratePrivateKey()
-	err = SendEncryptedProofsToPubkey(privkey, "test from sending to encrypted proofs", pubkey.(string), pool)
+	err = SendEncryptedProofsToPubkey(ctx, privkey, "test from sending to encrypted proofs", pubkey.(string), pool)
 	if err != nil {
-		t.Errorf(`SendEncryptedProofsToPubkey(privkey, "test", pubkey.(string), pool) %+v`, err)
+		t.Errorf(`SendEncryptedProofsToPubkey(ctx, privkey, "test", pubkey.(string), pool) %+v`, err)
 	}
 }
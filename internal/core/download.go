@@ -0,0 +1,211 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ratasker/external/blossom"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time a paid token keeps being accepted for follow up range requests of the same blob
+const RangePaymentWindow = 10 * time.Minute
+
+// time a pre-signed storage url is valid after a payment
+const PresignedURLExpiry = 5 * time.Minute
+
+var (
+	ErrRangeNotSatisfiable = errors.New("Range not satisfiable")
+	ErrMalformedRange      = errors.New("Malformed range header")
+)
+
+// ByteRange is an inclusive range of bytes inside a blob
+type ByteRange struct {
+	Start uint64
+	End   uint64
+}
+
+func (r ByteRange) Length() uint64 {
+	return r.End - r.Start + 1
+}
+
+func (r ByteRange) ContentRange(size uint64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+func FullRange(size uint64) ByteRange {
+	if size == 0 {
+		return ByteRange{}
+	}
+	return ByteRange{Start: 0, End: size - 1}
+}
+
+// ParseRangeHeader parses a "bytes=" Range header for a blob of the given size.
+// Only single ranges are supported, returns false if the header should be ignored and the whole blob served.
+func ParseRangeHeader(header string, size uint64) (ByteRange, bool, error) {
+	var rng ByteRange
+	if header == "" {
+		return rng, false, nil
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return rng, false, ErrMalformedRange
+	}
+
+	// multiple ranges are not supported, serve the whole blob
+	if strings.Contains(spec, ",") {
+		return rng, false, nil
+	}
+
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return rng, false, ErrMalformedRange
+	}
+
+	switch {
+	// suffix range. ex: bytes=-500
+	case startStr == "":
+		suffix, err := strconv.ParseUint(endStr, 10, 64)
+		if err != nil {
+			return rng, false, fmt.Errorf("strconv.ParseUint(endStr, 10, 64). %w. %w", err, ErrMalformedRange)
+		}
+		if suffix == 0 || size == 0 {
+			return rng, false, ErrRangeNotSatisfiable
+		}
+		if suffix > size {
+			suffix = size
+		}
+		rng.Start = size - suffix
+		rng.End = size - 1
+
+	default:
+		start, err := strconv.ParseUint(startStr, 10, 64)
+		if err != nil {
+			return rng, false, fmt.Errorf("strconv.ParseUint(startStr, 10, 64). %w. %w", err, ErrMalformedRange)
+		}
+		if start >= size {
+			return rng, false, ErrRangeNotSatisfiable
+		}
+		rng.Start = start
+		rng.End = size - 1
+
+		if endStr != "" {
+			end, err := strconv.ParseUint(endStr, 10, 64)
+			if err != nil {
+				return rng, false, fmt.Errorf("strconv.ParseUint(endStr, 10, 64). %w. %w", err, ErrMalformedRange)
+			}
+			if end < start {
+				return rng, false, ErrMalformedRange
+			}
+			if end < rng.End {
+				rng.End = end
+			}
+		}
+	}
+
+	return rng, true, nil
+}
+
+// the sha256 of a blob is used as a strong ETag
+func BlobETag(sha string) string {
+	return `"` + sha + `"`
+}
+
+// BlobContentType uses the stored type and falls back to the one of the extension in the url
+func BlobContentType(storedType string, ext string) string {
+	if storedType != "" {
+		return storedType
+	}
+	mimeType := blossom.MimeTypeFromExtension(ext)
+	if mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+// ETagMatches checks an If-None-Match or If-Range header against an ETag
+func ETagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+type paidRange struct {
+	sha     string
+	rng     ByteRange
+	expires time.Time
+}
+
+// RangeGrants remembers which byte ranges a token already paid for so players
+// can keep seeking inside a blob without paying again for every request.
+type RangeGrants struct {
+	mu     sync.Mutex
+	grants map[string]paidRange
+	window time.Duration
+}
+
+func NewRangeGrants(window time.Duration) *RangeGrants {
+	return &RangeGrants{
+		grants: make(map[string]paidRange),
+		window: window,
+	}
+}
+
+func rangeGrantKey(tokenHeader string) string {
+	hash := sha256.Sum256([]byte(tokenHeader))
+	return hex.EncodeToString(hash[:])
+}
+
+func (g *RangeGrants) Add(tokenHeader string, sha string, rng ByteRange) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for key, grant := range g.grants {
+		if now.After(grant.expires) {
+			delete(g.grants, key)
+		}
+	}
+
+	g.grants[rangeGrantKey(tokenHeader)] = paidRange{
+		sha:     sha,
+		rng:     rng,
+		expires: now.Add(g.window),
+	}
+}
+
+// Covers checks if the token already paid for a range that contains rng
+func (g *RangeGrants) Covers(tokenHeader string, sha string, rng ByteRange) bool {
+	if tokenHeader == "" {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	grant, ok := g.grants[rangeGrantKey(tokenHeader)]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(grant.expires) {
+		return false
+	}
+
+	return grant.sha == sha && grant.rng.Start <= rng.Start && rng.End <= grant.rng.End
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	var size uint64 = 1000
+
+	rng, ok, err := ParseRangeHeader("bytes=0-99", size)
+	if err != nil || !ok {
+		t.Fatalf(`ParseRangeHeader("bytes=0-99", size) %+v`, err)
+	}
+	if rng.Start != 0 || rng.End != 99 || rng.Length() != 100 {
+		t.Errorf("wrong range. got: %+v", rng)
+	}
+
+	rng, ok, err = ParseRangeHeader("bytes=900-", size)
+	if err != nil || !ok {
+		t.Fatalf(`ParseRangeHeader("bytes=900-", size) %+v`, err)
+	}
+	if rng.Start != 900 || rng.End != 999 {
+		t.Errorf("wrong range. got: %+v", rng)
+	}
+
+	rng, ok, err = ParseRangeHeader("bytes=-100", size)
+	if err != nil || !ok {
+		t.Fatalf(`ParseRangeHeader("bytes=-100", size) %+v`, err)
+	}
+	if rng.Start != 900 || rng.End != 999 {
+		t.Errorf("wrong suffix range. got: %+v", rng)
+	}
+
+	// end bigger than the blob gets clamped
+	rng, ok, err = ParseRangeHeader("bytes=500-5000", size)
+	if err != nil || !ok {
+		t.Fatalf(`ParseRangeHeader("bytes=500-5000", size) %+v`, err)
+	}
+	if rng.End != 999 {
+		t.Errorf("range should be clamped. got: %+v", rng)
+	}
+	if rng.ContentRange(size) != "bytes 500-999/1000" {
+		t.Errorf("wrong content range. got: %v", rng.ContentRange(size))
+	}
+
+	_, _, err = ParseRangeHeader("bytes=1000-", size)
+	if !errors.Is(err, ErrRangeNotSatisfiable) {
+		t.Errorf("should not be satisfiable. got: %+v", err)
+	}
+
+	_, ok, err = ParseRangeHeader("bytes=0-1,5-6", size)
+	if ok || err != nil {
+		t.Errorf("multiple ranges should be ignored. %+v", err)
+	}
+
+	_, ok, _ = ParseRangeHeader("", size)
+	if ok {
+		t.Error("empty header should not be a range")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := BlobETag("abcd")
+
+	if !ETagMatches(`"abcd"`, etag) {
+		t.Error("etag should match")
+	}
+	if !ETagMatches(`"other", W/"abcd"`, etag) {
+		t.Error("weak etag in list should match")
+	}
+	if !ETagMatches("*", etag) {
+		t.Error("wildcard should match")
+	}
+	if ETagMatches(`"other"`, etag) {
+		t.Error("etag should not match")
+	}
+}
+
+func TestRangeGrants(t *testing.T) {
+	grants := NewRangeGrants(time.Minute)
+	grants.Add("cashuBtoken", "abcd", ByteRange{Start: 0, End: 499})
+
+	if !grants.Covers("cashuBtoken", "abcd", ByteRange{Start: 100, End: 200}) {
+		t.Error("range inside the paid range should be covered")
+	}
+	if grants.Covers("cashuBtoken", "abcd", ByteRange{Start: 400, End: 600}) {
+		t.Error("range outside the paid range should not be covered")
+	}
+	if grants.Covers("cashuBtoken", "other", ByteRange{Start: 0, End: 10}) {
+		t.Error("grant should only cover the paid blob")
+	}
+	if grants.Covers("cashuBother", "abcd", ByteRange{Start: 0, End: 10}) {
+		t.Error("grant should only cover the paying token")
+	}
+
+	expired := NewRangeGrants(-time.Minute)
+	expired.Add("cashuBtoken", "abcd", ByteRange{Start: 0, End: 499})
+	if expired.Covers("cashuBtoken", "abcd", ByteRange{Start: 0, End: 10}) {
+		t.Error("expired grant should not cover")
+	}
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"time"
+)
+
+const (
+	GC_INTERVAL_HOURS = "GC_INTERVAL_HOURS"
+	GC_GRACE_MINUTES  = "GC_GRACE_MINUTES"
+	// scheduled runs only report what they would remove unless this is true
+	GC_DELETE = "GC_DELETE"
+
+	DefaultGCIntervalHours = 24
+)
+
+type GCOptions struct {
+	// only log what would be removed
+	DryRun bool
+	// files and rows newer than this can belong to an upload in flight
+	GracePeriod time.Duration
+}
+
+type GCReport struct {
+	OrphanFiles uint64
+	StaleRows   uint64
+}
+
+// CollectGarbage removes stored files without a blobs row and blobs rows without a file.
+// It only lists the storage, use the scrubber to check the content of the files.
+func CollectGarbage(ctx context.Context, db database.Database, fileHandler io.BlossomIO, options GCOptions, now time.Time) (GCReport, error) {
+	var report GCReport
+	cutoff := now.Add(-options.GracePeriod)
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return report, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	blobs, err := db.ListBlobs(ctx, tx)
+	tx.Rollback()
+	if err != nil {
+		return report, fmt.Errorf("db.ListBlobs(ctx, tx). %w", err)
+	}
+
+	known := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		// legacy rows have an absolute path that ends with the key
+		known[filepath.Base(blob.Path)] = true
+	}
+
+	stored := make(map[string]bool, len(blobs))
+	var orphans []string
+	err = fileHandler.WalkBlobs(ctx, func(info io.BlobInfo) error {
+		stored[info.Key] = true
+		if known[info.Key] || !info.ModTime.Before(cutoff) {
+			return nil
+		}
+		// only blob names are removed, anything else in the storage was not written by us
+		hash, err := hex.DecodeString(info.Key)
+		if err != nil || len(hash) != 32 {
+			slog.WarnContext(ctx, "gc: skipping file that is not a blob", "key", info.Key)
+			return nil
+		}
+		orphans = append(orphans, info.Key)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("fileHandler.WalkBlobs(ctx). %w", err)
+	}
+
+	for _, key := range orphans {
+		// the upload could have been committed after the rows were listed
+		hash, _ := hex.DecodeString(key)
+		_, err = db.GetBlobLength(ctx, hash)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return report, fmt.Errorf("db.GetBlobLength(ctx, hash). %w", err)
+		}
+
+		report.OrphanFiles++
+		if options.DryRun {
+			slog.InfoContext(ctx, "gc: would remove file without a blobs row", "key", key)
+			continue
+		}
+		slog.InfoContext(ctx, "gc: removing file without a blobs row", "key", key)
+		err = fileHandler.RemoveBlob(ctx, key)
+		if err != nil {
+			return report, fmt.Errorf("fileHandler.RemoveBlob(ctx, key). %w", err)
+		}
+	}
+
+	for _, blob := range blobs {
+		if stored[filepath.Base(blob.Path)] || time.Unix(int64(blob.CreatedAt), 0).After(cutoff) {
+			continue
+		}
+
+		report.StaleRows++
+		if options.DryRun {
+			slog.InfoContext(ctx, "gc: would remove blobs row without a file", "sha256", hex.EncodeToString(blob.Sha256))
+			continue
+		}
+		slog.InfoContext(ctx, "gc: removing blobs row without a file", "sha256", hex.EncodeToString(blob.Sha256))
+		err = removeBlobRow(ctx, db, blob.Sha256)
+		if err != nil {
+			return report, fmt.Errorf("removeBlobRow(ctx, db, blob.Sha256). %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+func removeBlobRow(ctx context.Context, db database.Database, hash []byte) error {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	_, err = db.RemoveBlob(ctx, tx, hash)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("db.RemoveBlob(ctx, tx, hash). %w", err)
+	}
+	return tx.Commit()
+}
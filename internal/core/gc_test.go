@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"ratasker/external/blossom"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	kept := addScrubTestBlob(t, sqlite, handler, []byte("kept"), []byte("kept"))
+
+	// failed upload: file written but the row never committed
+	orphanHash := sha256.Sum256([]byte("orphan"))
+	orphan := hex.EncodeToString(orphanHash[:])
+	err = handler.WriteBlob(ctx, orphan, []byte("orphan"))
+	if err != nil {
+		t.Fatalf("handler.WriteBlob(ctx, orphan) %+v", err)
+	}
+	err = os.Chtimes(handler.ShardedPath(orphan), old, old)
+	if err != nil {
+		t.Fatalf("os.Chtimes(orphan) %+v", err)
+	}
+
+	// something else sharing the storage
+	stray := filepath.Join(handler.DataPath, "README.txt")
+	err = os.WriteFile(stray, []byte("not a blob"), 0o644)
+	if err != nil {
+		t.Fatalf("os.WriteFile(stray) %+v", err)
+	}
+	err = os.Chtimes(stray, old, old)
+	if err != nil {
+		t.Fatalf("os.Chtimes(stray) %+v", err)
+	}
+
+	// upload in flight
+	inFlightHash := sha256.Sum256([]byte("in flight"))
+	inFlight := hex.EncodeToString(inFlightHash[:])
+	err = handler.WriteBlob(ctx, inFlight, []byte("in flight"))
+	if err != nil {
+		t.Fatalf("handler.WriteBlob(ctx, inFlight) %+v", err)
+	}
+
+	// row without a file
+	staleHash := sha256.Sum256([]byte("stale"))
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	err = sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: hex.EncodeToString(staleHash[:]), Sha256: staleHash[:], CreatedAt: uint64(old.Unix())})
+	if err != nil {
+		t.Fatalf("sqlite.AddBlob(ctx, tx, stale) %+v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	options := GCOptions{DryRun: true, GracePeriod: time.Hour}
+	report, err := CollectGarbage(ctx, sqlite, handler, options, now)
+	if err != nil {
+		t.Fatalf("CollectGarbage(ctx, sqlite, handler, dry run) %+v", err)
+	}
+	if report.OrphanFiles != 1 || report.StaleRows != 1 {
+		t.Errorf("should find one orphan and one stale row. got: %+v", report)
+	}
+	if _, err := os.Stat(handler.ShardedPath(orphan)); err != nil {
+		t.Errorf("dry run should not remove files. %+v", err)
+	}
+
+	options.DryRun = false
+	_, err = CollectGarbage(ctx, sqlite, handler, options, now)
+	if err != nil {
+		t.Fatalf("CollectGarbage(ctx, sqlite, handler, options) %+v", err)
+	}
+
+	if _, err := os.Stat(handler.ShardedPath(orphan)); !os.IsNotExist(err) {
+		t.Errorf("orphan file should be removed")
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("files that are not named as blobs should be kept. %+v", err)
+	}
+	if _, err := os.Stat(handler.ShardedPath(inFlight)); err != nil {
+		t.Errorf("files in the grace period should be kept. %+v", err)
+	}
+	if _, err := sqlite.GetBlob(ctx, staleHash[:]); err == nil {
+		t.Errorf("row without a file should be removed")
+	}
+	keptHash, _ := hex.DecodeString(kept)
+	if _, err := sqlite.GetBlob(ctx, keptHash); err != nil {
+		t.Errorf("valid blob should be kept. %+v", err)
+	}
+}
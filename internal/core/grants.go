@@ -0,0 +1,190 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_GRANT_DOWNLOADS = "ACCESS_GRANT_DOWNLOADS"
+	ACCESS_GRANT_MINUTES   = "ACCESS_GRANT_MINUTES"
+
+	AccessGrantHeader       = "X-Access-Grant"
+	AccessGrantCookiePrefix = "ratasker_grant_"
+
+	DefaultAccessGrantDownloads = 10
+	DefaultAccessGrantMinutes   = 30
+
+	// how often the usage of expired grants is forgotten
+	AccessGrantCleanupInterval = 10 * time.Minute
+)
+
+var (
+	ErrMalformedGrant   = errors.New("Malformed access grant")
+	ErrInvalidGrant     = errors.New("Invalid access grant signature")
+	ErrGrantExpired     = errors.New("Access grant expired")
+	ErrGrantWrongBlob   = errors.New("Access grant is for another blob")
+	ErrGrantExhausted   = errors.New("Access grant has no downloads left")
+	ErrNoGrantSignerKey = errors.New("No key for signing access grants")
+)
+
+// AccessGrant is given after a successful payment of the whole blob so it can be
+// downloaded again without paying. Downloads is counted in bytes, Downloads times the blob size,
+// so seeking inside the blob does not use a whole download.
+type AccessGrant struct {
+	Sha256     string `json:"x"`
+	Expiration int64  `json:"exp"`
+	Downloads  uint64 `json:"n"`
+	Nonce      string `json:"nonce"`
+}
+
+type grantUsage struct {
+	bytes   uint64
+	expires int64
+}
+
+// AccessGrantSigner signs grants with a key derived from the seed and the active P2PK pubkey.
+// Rotating the pubkey revokes every grant signed before it.
+// Grants are checked without the database, the bytes served with every grant are counted in memory.
+type AccessGrantSigner struct {
+	seed      []byte
+	downloads uint64
+	duration  time.Duration
+
+	mu    sync.Mutex
+	usage map[string]grantUsage
+}
+
+func NewAccessGrantSigner(seed string, downloads uint64, duration time.Duration) (*AccessGrantSigner, error) {
+	if seed == "" {
+		return nil, ErrNoGrantSignerKey
+	}
+	return &AccessGrantSigner{
+		seed:      []byte(seed),
+		downloads: downloads,
+		duration:  duration,
+		usage:     make(map[string]grantUsage),
+	}, nil
+}
+
+func (s *AccessGrantSigner) Duration() time.Duration {
+	return s.duration
+}
+
+func (s *AccessGrantSigner) signingKey(activePubkey string) []byte {
+	mac := hmac.New(sha256.New, s.seed)
+	mac.Write([]byte("ratasker access grant " + activePubkey))
+	return mac.Sum(nil)
+}
+
+func (s *AccessGrantSigner) sign(payload []byte, activePubkey string) []byte {
+	mac := hmac.New(sha256.New, s.signingKey(activePubkey))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Issue returns an encoded grant for a blob. Format: base64url(json).base64url(hmac)
+func (s *AccessGrantSigner) Issue(sha string, activePubkey string) (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("rand.Read(nonce). %w", err)
+	}
+
+	grant := AccessGrant{
+		Sha256:     sha,
+		Expiration: time.Now().Add(s.duration).Unix(),
+		Downloads:  s.downloads,
+		Nonce:      hex.EncodeToString(nonce),
+	}
+
+	payload, err := json.Marshal(grant)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal(grant). %w", err)
+	}
+
+	signature := s.sign(payload, activePubkey)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature and expiration of a grant without using one of its downloads
+func (s *AccessGrantSigner) Verify(encoded string, sha string, activePubkey string) (AccessGrant, error) {
+	var grant AccessGrant
+
+	payloadStr, signatureStr, found := strings.Cut(encoded, ".")
+	if !found {
+		return grant, ErrMalformedGrant
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(payloadStr)
+	if err != nil {
+		return grant, fmt.Errorf("base64.RawURLEncoding.DecodeString(payloadStr). %w. %w", err, ErrMalformedGrant)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(signatureStr)
+	if err != nil {
+		return grant, fmt.Errorf("base64.RawURLEncoding.DecodeString(signatureStr). %w. %w", err, ErrMalformedGrant)
+	}
+
+	if !hmac.Equal(signature, s.sign(payload, activePubkey)) {
+		return grant, ErrInvalidGrant
+	}
+
+	err = json.Unmarshal(payload, &grant)
+	if err != nil {
+		return grant, fmt.Errorf("json.Unmarshal(payload, &grant). %w. %w", err, ErrMalformedGrant)
+	}
+
+	if time.Now().Unix() > grant.Expiration {
+		return grant, ErrGrantExpired
+	}
+
+	if grant.Sha256 != sha {
+		return grant, ErrGrantWrongBlob
+	}
+
+	return grant, nil
+}
+
+// Redeem verifies the grant and uses the bytes that are going to be served
+func (s *AccessGrantSigner) Redeem(encoded string, sha string, activePubkey string, bytes uint64, blobSize uint64) error {
+	grant, err := s.Verify(encoded, sha, activePubkey)
+	if err != nil {
+		return fmt.Errorf("s.Verify(encoded, sha, activePubkey). %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.usage[grant.Nonce]
+	if usage.bytes+bytes > grant.Downloads*max(blobSize, 1) {
+		return ErrGrantExhausted
+	}
+	s.usage[grant.Nonce] = grantUsage{bytes: usage.bytes + bytes, expires: grant.Expiration}
+	return nil
+}
+
+// RemoveExpired forgets the usage of grants that can't be redeemed anymore
+func (s *AccessGrantSigner) RemoveExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nonce, usage := range s.usage {
+		if now.Unix() > usage.expires {
+			delete(s.usage, nonce)
+		}
+	}
+}
+
+func AccessGrantCookieName(sha string) string {
+	return AccessGrantCookiePrefix + sha
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const grantSha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+const grantPubkey = "02a9acc1e48c25eeeb9289b5031cc57da9fe72f3fe2861d264bdc074209b107ba2"
+
+func TestAccessGrantRedeem(t *testing.T) {
+	signer, err := NewAccessGrantSigner("test seed words", 2, time.Minute)
+	if err != nil {
+		t.Fatalf(`NewAccessGrantSigner("test seed words", 2, time.Minute) %+v`, err)
+	}
+
+	grant, err := signer.Issue(grantSha, grantPubkey)
+	if err != nil {
+		t.Fatalf("signer.Issue(grantSha, grantPubkey) %+v", err)
+	}
+
+	err = signer.Redeem(grant, grantSha, grantPubkey, 100, 100)
+	if err != nil {
+		t.Fatalf("first download should be valid. %+v", err)
+	}
+	// ranges use their bytes, wherever they start
+	for i := 0; i < 4; i++ {
+		err = signer.Redeem(grant, grantSha, grantPubkey, 25, 100)
+		if err != nil {
+			t.Fatalf("range %v should be valid. %+v", i, err)
+		}
+	}
+	err = signer.Redeem(grant, grantSha, grantPubkey, 1, 100)
+	if !errors.Is(err, ErrGrantExhausted) {
+		t.Errorf("the grant should be exhausted after 2 downloads of bytes. %+v", err)
+	}
+
+	// expired usage is forgotten, the grant can't be verified anymore by then
+	signer.RemoveExpired(time.Now().Add(2 * time.Minute))
+	if len(signer.usage) != 0 {
+		t.Errorf("expired grants should be removed. got: %+v", signer.usage)
+	}
+
+	// a verify does not use downloads
+	_, err = signer.Verify(grant, grantSha, grantPubkey)
+	if err != nil {
+		t.Errorf("signer.Verify(grant, grantSha, grantPubkey) %+v", err)
+	}
+}
+
+func TestAccessGrantInvalid(t *testing.T) {
+	signer, err := NewAccessGrantSigner("test seed words", 2, time.Minute)
+	if err != nil {
+		t.Fatalf(`NewAccessGrantSigner("test seed words", 2, time.Minute) %+v`, err)
+	}
+
+	grant, err := signer.Issue(grantSha, grantPubkey)
+	if err != nil {
+		t.Fatalf("signer.Issue(grantSha, grantPubkey) %+v", err)
+	}
+
+	err = signer.Redeem(grant, "00"+grantSha[2:], grantPubkey, 1, 1)
+	if !errors.Is(err, ErrGrantWrongBlob) {
+		t.Errorf("grant should be for another blob. %+v", err)
+	}
+
+	// rotating the pubkey revokes the grant
+	err = signer.Redeem(grant, grantSha, "03"+grantPubkey[2:], 1, 1)
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("grant should be revoked after rotation. %+v", err)
+	}
+
+	err = signer.Redeem("x"+grant, grantSha, grantPubkey, 1, 1)
+	if err == nil {
+		t.Error("tampered grant should not be valid")
+	}
+
+	otherSigner, err := NewAccessGrantSigner("other seed words", 2, time.Minute)
+	if err != nil {
+		t.Fatalf(`NewAccessGrantSigner("other seed words", 2, time.Minute) %+v`, err)
+	}
+	err = otherSigner.Redeem(grant, grantSha, grantPubkey, 1, 1)
+	if !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("grant from another seed should not be valid. %+v", err)
+	}
+
+	expiredSigner, err := NewAccessGrantSigner("test seed words", 2, -time.Minute)
+	if err != nil {
+		t.Fatalf(`NewAccessGrantSigner("test seed words", 2, -time.Minute) %+v`, err)
+	}
+	expired, err := expiredSigner.Issue(grantSha, grantPubkey)
+	if err != nil {
+		t.Fatalf("expiredSigner.Issue(grantSha, grantPubkey) %+v", err)
+	}
+	err = signer.Redeem(expired, grantSha, grantPubkey, 1, 1)
+	if !errors.Is(err, ErrGrantExpired) {
+		t.Errorf("grant should be expired. %+v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"fmt"
+	"ratasker/external/xcashu"
+	"ratasker/internal/cashu"
+)
+
+// SupportedBUDs are the blossom specs the routes implement
+var SupportedBUDs = []string{"01", "02", "06", "07", "08", "09"}
+
+// PriceQuoteSizes are the blob sizes quoted in the info document
+var PriceQuoteSizes = []uint64{1 << 20, 10 << 20, 100 << 20, 1 << 30}
+
+// NewPaymentQuote is what the x-cashu header asks for. The info document uses the same mints, unit and pubkey
+func NewPaymentQuote(wallet cashu.CashuWallet, amount uint64) (xcashu.PaymentQuoteResponse, error) {
+	mint, err := cashu.GetTrustedMintFromOsEnv()
+	if err != nil {
+		return xcashu.PaymentQuoteResponse{}, fmt.Errorf("cashu.GetTrustedMintFromOsEnv(). %w", err)
+	}
+
+	return xcashu.PaymentQuoteResponse{
+		Amount: amount,
+		Unit:   xcashu.Sat,
+		Mints:  []string{mint},
+		Pubkey: wallet.GetActivePubkey(),
+	}, nil
+}
+
+type PriceQuote struct {
+	Bytes  uint64 `json:"bytes"`
+	Amount uint64 `json:"amount"`
+}
+
+// Price is the configured cost and what xcashu.QuoteAmountToPay charges for some sizes. A cost of 0 quotes 0, it is free
+type Price struct {
+	Cost   uint64       `json:"cost_2mb"`
+	Quotes []PriceQuote `json:"quotes"`
+}
+
+type RetentionPolicy struct {
+	// 0 keeps blobs until the uploader deletes them
+	Days        uint64 `json:"days"`
+	Description string `json:"description"`
+}
+
+// ServerInfo is served at GET / so clients can see the prices before uploading.
+// Media is always nil because media optimization (BUD-05) is not supported
+type ServerInfo struct {
+	Mints            []string        `json:"mints"`
+	Units            []xcashu.Unit   `json:"units"`
+	Upload           Price           `json:"upload"`
+	Download         Price           `json:"download"`
+	Media            *Price          `json:"media"`
+	MaxBlobBytes     uint64          `json:"max_blob_bytes"`
+	MaxStorageBytes  uint64          `json:"max_storage_bytes"`
+	FreeMonthlyBytes uint64          `json:"free_monthly_bytes"`
+	MimeTypes        []string        `json:"mime_types"`
+	BUDs             []string        `json:"buds"`
+	Retention        RetentionPolicy `json:"retention"`
+	Pubkey           string          `json:"pubkey"`
+	PubkeyExpiration uint64          `json:"pubkey_expiration"`
+}
+
+// NewServerInfo reads the pubkey from the wallet on every call, it changes with every key rotation
+func NewServerInfo(wallet cashu.CashuWallet, uploadCost uint64, downloadCost uint64, policy PaymentPolicy) (ServerInfo, error) {
+	quote, err := NewPaymentQuote(wallet, 0)
+	if err != nil {
+		return ServerInfo{}, fmt.Errorf("NewPaymentQuote(wallet, 0). %w", err)
+	}
+
+	return ServerInfo{
+		Mints:            quote.Mints,
+		Units:            []xcashu.Unit{quote.Unit},
+		Upload:           newPrice(uploadCost),
+		Download:         newPrice(downloadCost),
+		Media:            nil,
+		MaxBlobBytes:     policy.MaxBlobBytes,
+		MaxStorageBytes:  policy.MaxStorageBytes,
+		FreeMonthlyBytes: policy.FreeMonthlyBytes,
+		MimeTypes:        []string{"*/*"},
+		BUDs:             SupportedBUDs,
+		Retention:        RetentionPolicy{Days: 0, Description: "Blobs are kept until the uploader deletes them"},
+		Pubkey:           quote.Pubkey,
+		PubkeyExpiration: wallet.GetActivePubkeyExpiration(),
+	}, nil
+}
+
+func newPrice(cost uint64) Price {
+	price := Price{Cost: cost, Quotes: []PriceQuote{}}
+	for _, size := range PriceQuoteSizes {
+		price.Quotes = append(price.Quotes, PriceQuote{Bytes: size, Amount: xcashu.QuoteAmountToPay(size, cost)})
+	}
+	return price
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"ratasker/external/xcashu"
+	"ratasker/internal/cashu"
+	"testing"
+)
+
+type infoWallet struct {
+	cashu.CashuWallet
+}
+
+func (infoWallet) GetActivePubkey() string           { return "02aa" }
+func (infoWallet) GetActivePubkeyExpiration() uint64 { return 1700000000 }
+
+func TestServerInfoMatchesPaymentQuote(t *testing.T) {
+	t.Setenv(cashu.TRUSTED_MINT, "https://mint.example")
+	wallet := infoWallet{}
+
+	info, err := NewServerInfo(wallet, 2, 0, PaymentPolicy{MaxStorageBytes: 100, MaxBlobBytes: 50, FreeMonthlyBytes: 10})
+	if err != nil {
+		t.Fatalf("NewServerInfo(wallet, 2, 0, policy) %+v", err)
+	}
+
+	size := PriceQuoteSizes[1]
+	quote, err := NewPaymentQuote(wallet, xcashu.QuoteAmountToPay(size, 2))
+	if err != nil {
+		t.Fatalf("NewPaymentQuote(wallet, amount) %+v", err)
+	}
+
+	if info.Mints[0] != quote.Mints[0] || info.Units[0] != quote.Unit || info.Pubkey != quote.Pubkey {
+		t.Errorf("info should match the payment quote. info %+v quote %+v", info, quote)
+	}
+	if info.Upload.Quotes[1].Bytes != size || info.Upload.Quotes[1].Amount != quote.Amount {
+		t.Errorf("upload price should match the payment quote. got %+v", info.Upload)
+	}
+	if len(info.Download.Quotes) != len(PriceQuoteSizes) {
+		t.Errorf("every size should be quoted. got %+v", info.Download)
+	}
+	for _, quote := range info.Download.Quotes {
+		if quote.Amount != 0 {
+			t.Errorf("a cost of 0 should quote 0. got %+v", info.Download)
+		}
+	}
+	if info.PubkeyExpiration != 1700000000 || info.MaxStorageBytes != 100 || info.MaxBlobBytes != 50 || info.FreeMonthlyBytes != 10 || info.Media != nil {
+		t.Errorf("wrong info %+v", info)
+	}
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"ratasker/internal/database"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	c "github.com/elnosh/gonuts/cashu"
+)
+
+const (
+	ReportFormatJSON = "json"
+	ReportFormatCSV  = "csv"
+)
+
+// LedgerDateFormat is the day format used in reports and to select their period
+const LedgerDateFormat = "2006-01-02"
+
+var (
+	ErrUnknownLedgerOperation = errors.New("Unknown ledger operation")
+	ErrUnknownReportFormat    = errors.New("Unknown report format. Use json or csv")
+)
+
+var incomeAccounts = map[string]string{
+	database.LedgerUpload:   database.AccountUploadIncome,
+	database.LedgerDownload: database.AccountDownloadIncome,
+}
+
+// RecordPayment writes the accepted token to the ledger. It runs in the payment transaction so
+// the entry only exists if the payment does
+func RecordPayment(ctx context.Context, db database.Database, tx *sql.Tx, operation string, sha string, pubkey string, token c.Token) error {
+	account, ok := incomeAccounts[operation]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnknownLedgerOperation, operation)
+	}
+
+	err := db.AddLedgerEntry(ctx, tx, database.LedgerEntry{
+		CreatedAt:     uint64(time.Now().Unix()),
+		Operation:     operation,
+		Sha256:        sha,
+		Pubkey:        pubkey,
+		Mint:          token.Mint(),
+		DebitAccount:  database.AccountEcash,
+		CreditAccount: account,
+		Amount:        token.Amount(),
+	})
+	if err != nil {
+		return fmt.Errorf("db.AddLedgerEntry(ctx, tx, entry). %w", err)
+	}
+	return nil
+}
+
+// recordSwapFees writes the sats the mint kept when swapping the locked proofs
+func recordSwapFees(ctx context.Context, db database.Database, tx *sql.Tx, mint string, fees uint64) error {
+	if fees == 0 {
+		return nil
+	}
+
+	err := db.AddLedgerEntry(ctx, tx, database.LedgerEntry{
+		CreatedAt:     uint64(time.Now().Unix()),
+		Operation:     database.LedgerSwap,
+		Mint:          mint,
+		DebitAccount:  database.AccountSwapFees,
+		CreditAccount: database.AccountEcash,
+		Amount:        fees,
+	})
+	if err != nil {
+		return fmt.Errorf("db.AddLedgerEntry(ctx, tx, entry). %w", err)
+	}
+	return nil
+}
+
+type RevenueRow struct {
+	Key         string `json:"key"`
+	Payments    uint64 `json:"payments"`
+	RevenueSats uint64 `json:"revenue_sats"`
+	FeesSats    uint64 `json:"fees_sats"`
+}
+
+// RevenueReport adds up the ledger of a period. Fees are not tied to a blob so by_blob has none
+type RevenueReport struct {
+	Since       uint64       `json:"since"`
+	Until       uint64       `json:"until"`
+	RevenueSats uint64       `json:"revenue_sats"`
+	FeesSats    uint64       `json:"fees_sats"`
+	ByDay       []RevenueRow `json:"by_day"`
+	ByBlob      []RevenueRow `json:"by_blob"`
+	ByMint      []RevenueRow `json:"by_mint"`
+}
+
+// LoadRevenueReport reads the entries created in [since, until) and builds the report
+func LoadRevenueReport(ctx context.Context, db database.Database, since time.Time, until time.Time) (RevenueReport, error) {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return RevenueReport{}, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	defer tx.Rollback()
+
+	entries, err := db.GetLedgerEntries(ctx, tx, uint64(since.Unix()), uint64(until.Unix()))
+	if err != nil {
+		return RevenueReport{}, fmt.Errorf("db.GetLedgerEntries(ctx, tx, since, until). %w", err)
+	}
+
+	return BuildRevenueReport(entries, uint64(since.Unix()), uint64(until.Unix())), nil
+}
+
+func BuildRevenueReport(entries []database.LedgerEntry, since uint64, until uint64) RevenueReport {
+	report := RevenueReport{Since: since, Until: until}
+	byDay := make(map[string]*RevenueRow)
+	byBlob := make(map[string]*RevenueRow)
+	byMint := make(map[string]*RevenueRow)
+
+	add := func(rows map[string]*RevenueRow, key string, entry database.LedgerEntry, revenue bool) {
+		row, ok := rows[key]
+		if !ok {
+			row = &RevenueRow{Key: key}
+			rows[key] = row
+		}
+		if revenue {
+			row.Payments += 1
+			row.RevenueSats += entry.Amount
+		} else {
+			row.FeesSats += entry.Amount
+		}
+	}
+
+	for _, entry := range entries {
+		revenue := strings.HasPrefix(entry.CreditAccount, "income:")
+		fee := entry.DebitAccount == database.AccountSwapFees
+		if !revenue && !fee {
+			continue
+		}
+
+		if revenue {
+			report.RevenueSats += entry.Amount
+		} else {
+			report.FeesSats += entry.Amount
+		}
+
+		day := time.Unix(int64(entry.CreatedAt), 0).UTC().Format(LedgerDateFormat)
+		add(byDay, day, entry, revenue)
+		add(byMint, entry.Mint, entry, revenue)
+		if entry.Sha256 != "" {
+			add(byBlob, entry.Sha256, entry, revenue)
+		}
+	}
+
+	report.ByDay = sortedRevenueRows(byDay)
+	report.ByMint = sortedRevenueRows(byMint)
+	report.ByBlob = sortedRevenueRows(byBlob)
+	// the blobs that earn the most are the interesting ones
+	sort.SliceStable(report.ByBlob, func(i, j int) bool {
+		return report.ByBlob[i].RevenueSats > report.ByBlob[j].RevenueSats
+	})
+	return report
+}
+
+func sortedRevenueRows(rows map[string]*RevenueRow) []RevenueRow {
+	sorted := []RevenueRow{}
+	for _, row := range rows {
+		sorted = append(sorted, *row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// WriteRevenueReportCSV writes one line per row. The group column says if the key is a day, a blob or a mint
+func WriteRevenueReportCSV(w io.Writer, report RevenueReport) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"group", "key", "payments", "revenue_sats", "fees_sats"})
+	if err != nil {
+		return fmt.Errorf("writer.Write(header). %w", err)
+	}
+
+	groups := []struct {
+		name string
+		rows []RevenueRow
+	}{{"day", report.ByDay}, {"blob", report.ByBlob}, {"mint", report.ByMint}}
+
+	for _, group := range groups {
+		for _, row := range group.rows {
+			err = writer.Write([]string{
+				group.name,
+				row.Key,
+				strconv.FormatUint(row.Payments, 10),
+				strconv.FormatUint(row.RevenueSats, 10),
+				strconv.FormatUint(row.FeesSats, 10),
+			})
+			if err != nil {
+				return fmt.Errorf("writer.Write(row). %w", err)
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// ParseReportPeriod reads the days of a report. until is inclusive, an empty until means today
+func ParseReportPeriod(since string, until string, now time.Time) (time.Time, time.Time, error) {
+	start := time.Unix(0, 0).UTC()
+	if since != "" {
+		day, err := time.Parse(LedgerDateFormat, since)
+		if err != nil {
+			return start, start, fmt.Errorf("time.Parse(LedgerDateFormat, since). %w", err)
+		}
+		start = day
+	}
+
+	end := now.UTC().Truncate(24 * time.Hour)
+	if until != "" {
+		day, err := time.Parse(LedgerDateFormat, until)
+		if err != nil {
+			return start, start, fmt.Errorf("time.Parse(LedgerDateFormat, until). %w", err)
+		}
+		end = day
+	}
+
+	return start, end.Add(24 * time.Hour), nil
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"ratasker/internal/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevenueReport(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	entries := []database.LedgerEntry{
+		{CreatedAt: uint64(day.Unix()), Operation: database.LedgerUpload, Sha256: "aa", Mint: "mint-a", DebitAccount: database.AccountEcash, CreditAccount: database.AccountUploadIncome, Amount: 10},
+		{CreatedAt: uint64(day.Unix()), Operation: database.LedgerDownload, Sha256: "bb", Mint: "mint-a", DebitAccount: database.AccountEcash, CreditAccount: database.AccountDownloadIncome, Amount: 30},
+		{CreatedAt: uint64(day.Add(24 * time.Hour).Unix()), Operation: database.LedgerDownload, Sha256: "aa", Mint: "mint-b", DebitAccount: database.AccountEcash, CreditAccount: database.AccountDownloadIncome, Amount: 5},
+		{CreatedAt: uint64(day.Add(24 * time.Hour).Unix()), Operation: database.LedgerSwap, Mint: "mint-a", DebitAccount: database.AccountSwapFees, CreditAccount: database.AccountEcash, Amount: 2},
+		// outside of the period
+		{CreatedAt: uint64(day.Add(72 * time.Hour).Unix()), Operation: database.LedgerUpload, Sha256: "cc", Mint: "mint-a", DebitAccount: database.AccountEcash, CreditAccount: database.AccountUploadIncome, Amount: 100},
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	for _, entry := range entries {
+		err = sqlite.AddLedgerEntry(ctx, tx, entry)
+		if err != nil {
+			t.Fatalf("sqlite.AddLedgerEntry(ctx, tx, entry) %+v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	since, until, err := ParseReportPeriod("2026-03-01", "2026-03-02", time.Now())
+	if err != nil {
+		t.Fatalf("ParseReportPeriod(since, until, now) %+v", err)
+	}
+
+	report, err := LoadRevenueReport(ctx, sqlite, since, until)
+	if err != nil {
+		t.Fatalf("LoadRevenueReport(ctx, sqlite, since, until) %+v", err)
+	}
+
+	if report.RevenueSats != 45 || report.FeesSats != 2 {
+		t.Errorf("wrong totals. got revenue %v fees %v", report.RevenueSats, report.FeesSats)
+	}
+	if len(report.ByDay) != 2 || report.ByDay[0] != (RevenueRow{Key: "2026-03-01", Payments: 2, RevenueSats: 40}) || report.ByDay[1] != (RevenueRow{Key: "2026-03-02", Payments: 1, RevenueSats: 5, FeesSats: 2}) {
+		t.Errorf("wrong revenue per day. got %+v", report.ByDay)
+	}
+	if len(report.ByBlob) != 2 || report.ByBlob[0].Key != "bb" || report.ByBlob[1] != (RevenueRow{Key: "aa", Payments: 2, RevenueSats: 15}) {
+		t.Errorf("wrong revenue per blob. got %+v", report.ByBlob)
+	}
+	if len(report.ByMint) != 2 || report.ByMint[0] != (RevenueRow{Key: "mint-a", Payments: 2, RevenueSats: 40, FeesSats: 2}) {
+		t.Errorf("wrong revenue per mint. got %+v", report.ByMint)
+	}
+
+	var out bytes.Buffer
+	err = WriteRevenueReportCSV(&out, report)
+	if err != nil {
+		t.Fatalf("WriteRevenueReportCSV(&out, report) %+v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 7 || lines[0] != "group,key,payments,revenue_sats,fees_sats" || lines[1] != "day,2026-03-01,2,40,0" {
+		t.Errorf("wrong csv. got %v", out.String())
+	}
+}
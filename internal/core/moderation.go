@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"ratasker/external/blossom"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindReport is the NIP-56 report event
+const KindReport = 1984
+
+// MaxReportBytes limits the body of PUT /report
+const MaxReportBytes = 64 * 1024
+
+var (
+	ErrInvalidReport        = errors.New("Invalid report event")
+	ErrReportWithoutBlobs   = errors.New("Report does not reference any blob")
+	ErrReportedBlobsNotHere = errors.New("None of the reported blobs are stored here")
+)
+
+// ParseReportEvent checks a NIP-56 kind 1984 event and returns one report per x tag. The report type is the third element of the tag
+func ParseReportEvent(body []byte) ([]database.BlobReport, error) {
+	var ev nostr.Event
+	err := json.Unmarshal(body, &ev)
+	if err != nil {
+		return nil, fmt.Errorf("%w. json.Unmarshal(body, &ev). %w", ErrInvalidReport, err)
+	}
+	if ev.Kind != KindReport {
+		return nil, fmt.Errorf("%w. kind %v", ErrInvalidReport, ev.Kind)
+	}
+	ok, err := ev.CheckSignature()
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%w. ev.CheckSignature(). %v", ErrInvalidReport, err)
+	}
+
+	reports := []database.BlobReport{}
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 || tag[0] != "x" {
+			continue
+		}
+		sha := strings.ToLower(tag[1])
+		hash, err := hex.DecodeString(sha)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("%w. x tag is not a sha256 %v", ErrInvalidReport, tag[1])
+		}
+
+		report := database.BlobReport{
+			EventId:   ev.ID,
+			Sha256:    sha,
+			Reporter:  ev.PubKey,
+			Content:   ev.Content,
+			CreatedAt: uint64(ev.CreatedAt),
+		}
+		if len(tag) > 2 {
+			report.ReportType = tag[2]
+		}
+		reports = append(reports, report)
+	}
+
+	if len(reports) == 0 {
+		return nil, ErrReportWithoutBlobs
+	}
+	return reports, nil
+}
+
+// StoreReports keeps the reports of blobs stored here and returns how many were stored
+func StoreReports(ctx context.Context, db database.Database, reports []database.BlobReport) (int, error) {
+	// GetBlobLength uses its own connection, so it runs before the transaction
+	stored := []database.BlobReport{}
+	for _, report := range reports {
+		hash, err := hex.DecodeString(report.Sha256)
+		if err != nil {
+			return 0, fmt.Errorf("hex.DecodeString(report.Sha256). %w", err)
+		}
+		_, err = db.GetBlobLength(ctx, hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("db.GetBlobLength(ctx, hash). %w", err)
+		}
+		stored = append(stored, report)
+	}
+	if len(stored) == 0 {
+		return 0, ErrReportedBlobsNotHere
+	}
+
+	err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		for _, report := range stored {
+			err := db.AddBlobReport(ctx, tx, report)
+			if err != nil {
+				return fmt.Errorf("db.AddBlobReport(ctx, tx, report). %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(stored), nil
+}
+
+// BlockBlob blocks the hash, deletes the blob and closes its reports. It returns false when the blob was not stored
+func BlockBlob(ctx context.Context, db database.Database, fileHandler io.BlossomIO, sha string, reason string, actor string, now uint64) (bool, error) {
+	sha = strings.ToLower(sha)
+	hash, err := hex.DecodeString(sha)
+	if err != nil || len(hash) != 32 {
+		return false, fmt.Errorf("%w. %v", blossom.ErrInvalidBlobHash, sha)
+	}
+
+	var path string
+	err = database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		path, err = blockBlobInTx(ctx, db, tx, sha, hash, reason, actor, now)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if path == "" {
+		return false, nil
+	}
+
+	removeBlockedFile(ctx, fileHandler, sha, path)
+	return true, nil
+}
+
+// blockBlobInTx returns the path of the stored blob it removed, empty when it was not stored
+func blockBlobInTx(ctx context.Context, db database.Database, tx *sql.Tx, sha string, hash []byte, reason string, actor string, now uint64) (string, error) {
+	err := db.BlockBlob(ctx, tx, database.BlockedBlob{Sha256: sha, Reason: reason, CreatedAt: now})
+	if err != nil {
+		return "", fmt.Errorf("db.BlockBlob(ctx, tx, blocked). %w", err)
+	}
+	err = db.AddBlocklistAudit(ctx, tx, database.BlocklistAudit{Action: database.AuditBlock, TargetType: database.BlocklistSha256, Target: sha, Reason: reason, Actor: actor, CreatedAt: now})
+	if err != nil {
+		return "", fmt.Errorf("db.AddBlocklistAudit(ctx, tx, audit). %w", err)
+	}
+	err = db.ReviewBlobReports(ctx, tx, sha, database.ReportBlocked, now)
+	if err != nil {
+		return "", fmt.Errorf("db.ReviewBlobReports(ctx, tx, sha, database.ReportBlocked, now). %w", err)
+	}
+
+	blob, err := db.RemoveBlob(ctx, tx, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("db.RemoveBlob(ctx, tx, hash). %w", err)
+	}
+	return blob.Path, nil
+}
+
+// removeBlockedFile runs after the commit. The row is gone, a file left behind is removed by the gc
+func removeBlockedFile(ctx context.Context, fileHandler io.BlossomIO, sha string, path string) {
+	err := fileHandler.RemoveBlob(ctx, path)
+	if err != nil {
+		slog.ErrorContext(ctx, "fileHandler.RemoveBlob(ctx, path)", "sha256", sha, "error", err)
+	}
+}
+
+// DismissReports closes the pending reports of a blob without touching it
+func DismissReports(ctx context.Context, db database.Database, sha string, now uint64) error {
+	return database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		err := db.ReviewBlobReports(ctx, tx, strings.ToLower(sha), database.ReportDismissed, now)
+		if err != nil {
+			return fmt.Errorf("db.ReviewBlobReports(ctx, tx, sha, database.ReportDismissed, now). %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"ratasker/internal/utils"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func signedReport(t *testing.T, kind int, tags nostr.Tags) []byte {
+	ev := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Tags: tags, Content: "spam"}
+	err := ev.Sign(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatalf("ev.Sign(key) %+v", err)
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("json.Marshal(ev) %+v", err)
+	}
+	return body
+}
+
+func TestParseReportEvent(t *testing.T) {
+	sha := "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+	reports, err := ParseReportEvent(signedReport(t, KindReport, nostr.Tags{{"x", sha, "malware"}, {"x", sha}, {"p", "02aa"}}))
+	if err != nil {
+		t.Fatalf("ParseReportEvent(report) %+v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %v", len(reports))
+	}
+	if reports[0].Sha256 != sha || reports[0].ReportType != "malware" || reports[0].Content != "spam" {
+		t.Errorf("unexpected report %+v", reports[0])
+	}
+	if reports[1].ReportType != "" {
+		t.Errorf("expected no report type, got %v", reports[1].ReportType)
+	}
+
+	_, err = ParseReportEvent(signedReport(t, 1, nostr.Tags{{"x", sha}}))
+	if !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("expected ErrInvalidReport for kind 1, got %v", err)
+	}
+	_, err = ParseReportEvent(signedReport(t, KindReport, nostr.Tags{{"x", "abc"}}))
+	if !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("expected ErrInvalidReport for a bad hash, got %v", err)
+	}
+	_, err = ParseReportEvent(signedReport(t, KindReport, nostr.Tags{{"p", "02aa"}}))
+	if !errors.Is(err, ErrReportWithoutBlobs) {
+		t.Errorf("expected ErrReportWithoutBlobs, got %v", err)
+	}
+
+	var ev nostr.Event
+	_ = json.Unmarshal(signedReport(t, KindReport, nostr.Tags{{"x", sha}}), &ev)
+	ev.Content = "changed"
+	forged, _ := json.Marshal(ev)
+	_, err = ParseReportEvent(forged)
+	if !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("expected ErrInvalidReport for a bad signature, got %v", err)
+	}
+}
+
+func TestBlockReportedBlob(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	reported := addScrubTestBlob(t, sqlite, handler, []byte("reported"), []byte("reported"))
+	kept := addScrubTestBlob(t, sqlite, handler, []byte("kept"), []byte("kept"))
+	missing := "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+	reports, err := ParseReportEvent(signedReport(t, KindReport, nostr.Tags{{"x", reported, "illegal"}, {"x", missing}}))
+	if err != nil {
+		t.Fatalf("ParseReportEvent(report) %+v", err)
+	}
+	stored, err := StoreReports(ctx, sqlite, reports)
+	if err != nil {
+		t.Fatalf("StoreReports(ctx, sqlite, reports) %+v", err)
+	}
+	if stored != 1 {
+		t.Errorf("expected 1 stored report, got %v", stored)
+	}
+
+	reports, err = ParseReportEvent(signedReport(t, KindReport, nostr.Tags{{"x", missing}}))
+	if err != nil {
+		t.Fatalf("ParseReportEvent(missing) %+v", err)
+	}
+	_, err = StoreReports(ctx, sqlite, reports)
+	if !errors.Is(err, ErrReportedBlobsNotHere) {
+		t.Errorf("expected ErrReportedBlobsNotHere, got %v", err)
+	}
+
+	deleted, err := BlockBlob(ctx, sqlite, handler, reported, "illegal", "owner", 100)
+	if err != nil {
+		t.Fatalf("BlockBlob(ctx, sqlite, handler, reported) %+v", err)
+	}
+	if !deleted {
+		t.Errorf("expected the reported blob to be deleted")
+	}
+	_, err = os.Stat(handler.ShardedPath(reported))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the reported file to be removed, got %v", err)
+	}
+	hash, _ := hex.DecodeString(reported)
+	_, err = sqlite.GetBlobLength(ctx, hash)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the reported row to be removed, got %v", err)
+	}
+
+	err = CheckNotBlocked(ctx, sqlite, reported, "")
+	var httpErr *utils.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != 403 {
+		t.Errorf("expected a 403 for the blocked blob, got %v", err)
+	}
+	err = CheckNotBlocked(ctx, sqlite, kept, "")
+	if err != nil {
+		t.Errorf("CheckNotBlocked(ctx, sqlite, kept) %+v", err)
+	}
+
+	deleted, err = BlockBlob(ctx, sqlite, handler, missing, "", "owner", 100)
+	if err != nil {
+		t.Fatalf("BlockBlob(ctx, sqlite, handler, missing) %+v", err)
+	}
+	if deleted {
+		t.Errorf("expected nothing to delete for a blob that is not stored")
+	}
+
+	var pending []database.BlobReport
+	err = database.WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		var err error
+		pending, err = sqlite.GetBlobReports(ctx, tx, database.ReportPending)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("sqlite.GetBlobReports(ctx, tx, pending) %+v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected the report to be closed, got %+v", pending)
+	}
+}
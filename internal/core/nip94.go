@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log/slog"
+	"ratasker/external/blossom"
+	"strings"
+	"sync"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// relays for the kind 1063 events. Empty uses ANNOUNCE_RELAYS
+	NIP94_RELAYS = "NIP94_RELAYS"
+)
+
+const (
+	// XNIP94Event carries a kind 1063 event signed by the uploader, base64 encoded
+	XNIP94Event = "X-NIP94-Event"
+	// XNIP94Publish set to "server" asks the server to sign the kind 1063 event
+	XNIP94Publish = "X-NIP94-Publish"
+)
+
+const (
+	// images with more pixels only get the size, decoding them takes too much memory
+	MaxBlurhashPixels = 50_000_000
+	// images are scaled down to this width before hashing
+	blurhashWidth = 64
+)
+
+var (
+	ErrInvalidNIP94Event    = errors.New("Invalid NIP-94 event")
+	ErrNIP94Disabled        = errors.New("NIP-94 publishing is not configured")
+	ErrNIP94EventWrongBlob  = errors.New("NIP-94 event is for another blob")
+	ErrNIP94EventWrongOwner = errors.New("NIP-94 event is not signed by the uploader")
+)
+
+// ImageMetadata returns the "WxH" dimension and the blurhash of an image. Anything that can't be decoded gives empty strings
+func ImageMetadata(data []byte, mimeType string) (string, string) {
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", ""
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", ""
+	}
+	dim := fmt.Sprintf("%vx%v", config.Width, config.Height)
+	if config.Width == 0 || config.Height == 0 || config.Width*config.Height > MaxBlurhashPixels {
+		return dim, ""
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return dim, ""
+	}
+
+	height := max(1, blurhashWidth*config.Height/config.Width)
+	small := image.NewRGBA(image.Rect(0, 0, blurhashWidth, height))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	hash, err := blurhash.Encode(4, 3, small)
+	if err != nil {
+		return dim, ""
+	}
+	return dim, hash
+}
+
+// NIP94Tags follows BUD-08. dim and blurhash are only added for images
+func NIP94Tags(descriptor blossom.BlobDescriptor, data []byte) [][]string {
+	tags := [][]string{
+		{"url", descriptor.Url},
+		{"x", descriptor.Sha256},
+		{"size", fmt.Sprint(descriptor.Size)},
+	}
+	if descriptor.Type != "" {
+		tags = append(tags, []string{"m", descriptor.Type})
+	}
+
+	dim, hash := ImageMetadata(data, descriptor.Type)
+	if dim != "" {
+		tags = append(tags, []string{"dim", dim})
+	}
+	if hash != "" {
+		tags = append(tags, []string{"blurhash", hash})
+	}
+	return tags
+}
+
+// ParseNIP94Event decodes and checks an event signed by the uploader. It has to be a kind 1063 for the uploaded blob
+func ParseNIP94Event(header string, sha256 string, uploader string) (nostr.Event, error) {
+	var ev nostr.Event
+	raw, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return ev, fmt.Errorf("%w. base64.StdEncoding.DecodeString(header). %w", ErrInvalidNIP94Event, err)
+	}
+	err = json.Unmarshal(raw, &ev)
+	if err != nil {
+		return ev, fmt.Errorf("%w. json.Unmarshal(raw, &ev). %w", ErrInvalidNIP94Event, err)
+	}
+
+	if ev.Kind != nostr.KindFileMetadata {
+		return ev, fmt.Errorf("%w. kind %v", ErrInvalidNIP94Event, ev.Kind)
+	}
+	ok, err := ev.CheckSignature()
+	if err != nil || !ok {
+		return ev, fmt.Errorf("%w. ev.CheckSignature(). %v", ErrInvalidNIP94Event, err)
+	}
+	if uploader == "" || ev.PubKey != uploader {
+		return ev, ErrNIP94EventWrongOwner
+	}
+	x := ev.Tags.GetFirst([]string{"x"})
+	if x == nil || strings.ToLower(x.Value()) != sha256 {
+		return ev, ErrNIP94EventWrongBlob
+	}
+	return ev, nil
+}
+
+// NIP94Publisher publishes kind 1063 events in the background so uploads don't wait for the relays
+type NIP94Publisher struct {
+	pool    *nostr.SimplePool
+	relays  []string
+	privKey string
+	wg      sync.WaitGroup
+}
+
+func NewNIP94Publisher(ctx context.Context, relays []string, privKey string) *NIP94Publisher {
+	return &NIP94Publisher{pool: nostr.NewSimplePool(ctx), relays: relays, privKey: privKey}
+}
+
+// Enabled is false for a nil publisher or without relays
+func (p *NIP94Publisher) Enabled() bool {
+	return p != nil && len(p.relays) > 0
+}
+
+// SignForUploader makes the server signed event. The uploader is tagged when known
+func (p *NIP94Publisher) SignForUploader(tags [][]string, uploader string) (nostr.Event, error) {
+	ev := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindFileMetadata,
+	}
+	for _, tag := range tags {
+		ev.Tags = append(ev.Tags, nostr.Tag(tag))
+	}
+	if uploader != "" {
+		ev.Tags = append(ev.Tags, nostr.Tag{"p", uploader})
+	}
+
+	err := ev.Sign(p.privKey)
+	if err != nil {
+		return ev, fmt.Errorf("ev.Sign(p.privKey). %w", err)
+	}
+	return ev, nil
+}
+
+// Publish returns right away. Failures are only logged
+func (p *NIP94Publisher) Publish(ctx context.Context, ev nostr.Event) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), AnnouncePublishTimeout)
+		defer cancel()
+
+		err := PublishToRelays(ctx, p.pool, p.relays, ev)
+		if err != nil {
+			slog.WarnContext(ctx, "PublishToRelays(ctx, p.pool, p.relays, ev)", "event", ev.ID, "error", err)
+		}
+	}()
+}
+
+// Wait blocks until the events being published are sent or ctx ends
+func (p *NIP94Publisher) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("events still publishing. %w", ctx.Err())
+	}
+}
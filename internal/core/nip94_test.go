@@ -0,0 +1,117 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"ratasker/external/blossom"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const nip94Sha = "b1674191a88ec5cdd733e4240a81803105dc412d6c6708d53ab94fc248f4f553"
+
+func testPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), G: uint8(y * 12), B: 100, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatalf("png.Encode(&buf, img) %+v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestNIP94Tags(t *testing.T) {
+	descriptor := blossom.BlobDescriptor{Url: "https://blossom.example/" + nip94Sha + ".png", Sha256: nip94Sha, Size: 10, Type: "image/png"}
+	tags := nostr.Tags{}
+	for _, tag := range NIP94Tags(descriptor, testPNG(t)) {
+		tags = append(tags, tag)
+	}
+
+	for _, expected := range [][]string{{"url", descriptor.Url}, {"x", nip94Sha}, {"size", "10"}, {"m", "image/png"}, {"dim", "40x20"}} {
+		if tags.GetFirst(expected) == nil {
+			t.Errorf("missing tag %v. got %v", expected, tags)
+		}
+	}
+	if blurhash := tags.GetFirst([]string{"blurhash"}); blurhash == nil || blurhash.Value() == "" {
+		t.Errorf("images should have a blurhash. got %v", tags)
+	}
+
+	descriptor.Type = "text/plain"
+	if len(NIP94Tags(descriptor, []byte("hello"))) != 4 {
+		t.Errorf("other files should only get url, x, size and m")
+	}
+}
+
+func TestParseNIP94Event(t *testing.T) {
+	privKey := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(privKey)
+
+	encode := func(kind int, sha string) string {
+		ev := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Tags: nostr.Tags{{"x", sha}}}
+		if err := ev.Sign(privKey); err != nil {
+			t.Fatalf("ev.Sign(privKey) %+v", err)
+		}
+		raw, _ := json.Marshal(ev)
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+
+	_, err := ParseNIP94Event(encode(nostr.KindFileMetadata, nip94Sha), nip94Sha, pubkey)
+	if err != nil {
+		t.Errorf("ParseNIP94Event(header, sha, pubkey) %+v", err)
+	}
+	_, err = ParseNIP94Event(encode(nostr.KindTextNote, nip94Sha), nip94Sha, pubkey)
+	if !errors.Is(err, ErrInvalidNIP94Event) {
+		t.Errorf("expected ErrInvalidNIP94Event. got %v", err)
+	}
+	_, err = ParseNIP94Event(encode(nostr.KindFileMetadata, strings.Repeat("0", 64)), nip94Sha, pubkey)
+	if !errors.Is(err, ErrNIP94EventWrongBlob) {
+		t.Errorf("expected ErrNIP94EventWrongBlob. got %v", err)
+	}
+	_, err = ParseNIP94Event(encode(nostr.KindFileMetadata, nip94Sha), nip94Sha, "")
+	if !errors.Is(err, ErrNIP94EventWrongOwner) {
+		t.Errorf("expected ErrNIP94EventWrongOwner. got %v", err)
+	}
+}
+
+func TestNIP94PublisherServerSigned(t *testing.T) {
+	ctx := context.Background()
+	relay := &fakeRelay{accept: true}
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	var disabled *NIP94Publisher
+	if disabled.Enabled() {
+		t.Errorf("a nil publisher should be disabled")
+	}
+
+	publisher := NewNIP94Publisher(ctx, []string{"ws" + strings.TrimPrefix(server.URL, "http")}, nostr.GeneratePrivateKey())
+	ev, err := publisher.SignForUploader([][]string{{"x", nip94Sha}}, otherPubkey)
+	if err != nil {
+		t.Fatalf("publisher.SignForUploader(tags, uploader) %+v", err)
+	}
+	publisher.Publish(ctx, ev)
+	err = publisher.Wait(ctx)
+	if err != nil {
+		t.Fatalf("publisher.Wait(ctx) %+v", err)
+	}
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if len(relay.events) != 1 || relay.events[0].Kind != nostr.KindFileMetadata || relay.events[0].Tags.GetFirst([]string{"p", otherPubkey}) == nil {
+		t.Errorf("the relay should get the event tagging the uploader. got %+v", relay.events)
+	}
+}
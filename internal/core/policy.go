@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ratasker/internal/database"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	AUTHORIZED_KEYS    = "AUTHORIZED_KEYS"
+	FREE_MONTHLY_BYTES = "FREE_MONTHLY_BYTES"
+	MAX_STORAGE_BYTES  = "MAX_STORAGE_BYTES"
+	MAX_BLOB_BYTES     = "MAX_BLOB_BYTES"
+)
+
+var (
+	ErrStorageQuotaExceeded = errors.New("Storage quota exceeded")
+	ErrUploadAuthRequired   = errors.New("Uploads need an auth event")
+	ErrBlobTooLarge         = errors.New("Blob is too large")
+	ErrEmptyBlob            = errors.New("Blob is empty")
+)
+
+// PaymentPolicy decides if an authenticated pubkey has to pay for a request.
+// Pubkeys in the allowlist never pay, the rest get a free amount of bytes every month.
+// MaxStorageBytes limits how much every authenticated pubkey can store and MaxBlobBytes the size of one upload, 0 means no limit.
+type PaymentPolicy struct {
+	allowedPubkeys   map[string]bool
+	FreeMonthlyBytes uint64
+	MaxStorageBytes  uint64
+	MaxBlobBytes     uint64
+}
+
+// NewPaymentPolicy takes a comma separated list of npubs or hex pubkeys
+func NewPaymentPolicy(authorizedKeys string, freeMonthlyBytes uint64, maxStorageBytes uint64) (PaymentPolicy, error) {
+	policy := PaymentPolicy{
+		allowedPubkeys:   make(map[string]bool),
+		FreeMonthlyBytes: freeMonthlyBytes,
+		MaxStorageBytes:  maxStorageBytes,
+	}
+
+	for _, key := range strings.Split(authorizedKeys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		pubkey, err := PubkeyToHex(key)
+		if err != nil {
+			return policy, fmt.Errorf("PubkeyToHex(key). %w", err)
+		}
+		policy.allowedPubkeys[pubkey] = true
+	}
+
+	return policy, nil
+}
+
+// PubkeyToHex accepts an npub or a hex pubkey
+func PubkeyToHex(key string) (string, error) {
+	if strings.HasPrefix(key, "npub") {
+		prefix, pubkey, err := nip19.Decode(key)
+		if err != nil {
+			return "", fmt.Errorf("nip19.Decode(key). %w", err)
+		}
+		if prefix != "npub" {
+			return "", fmt.Errorf("key is not an npub. %v", key)
+		}
+		return pubkey.(string), nil
+	}
+
+	bytes, err := hex.DecodeString(key)
+	if err != nil || len(bytes) != 32 {
+		return "", fmt.Errorf("key is not a valid hex pubkey. %v", key)
+	}
+	return strings.ToLower(key), nil
+}
+
+// RequiresUploadAuth is true with a storage limit. Anonymous uploads would not count against any pubkey.
+// CheckUploadAuth also needs auth while a pubkey is blocked
+func (p PaymentPolicy) RequiresUploadAuth() bool {
+	return p.MaxStorageBytes > 0
+}
+
+// CheckBlobSize errors if a blob of size bytes is over the upload limit
+func (p PaymentPolicy) CheckBlobSize(size uint64) error {
+	if p.MaxBlobBytes > 0 && size > p.MaxBlobBytes {
+		return ErrBlobTooLarge
+	}
+	return nil
+}
+
+func (p PaymentPolicy) IsAllowed(pubkey string) bool {
+	return pubkey != "" && p.allowedPubkeys[pubkey]
+}
+
+func usageMonth(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+// FreeBytesLeft returns how many bytes the pubkey can still use this month without paying
+func (p PaymentPolicy) FreeBytesLeft(ctx context.Context, tx *sql.Tx, db database.Database, pubkey string, now time.Time) (uint64, error) {
+	if pubkey == "" || p.FreeMonthlyBytes == 0 {
+		return 0, nil
+	}
+
+	used, err := db.GetFreeUsage(ctx, tx, pubkey, usageMonth(now))
+	if err != nil {
+		return 0, fmt.Errorf("db.GetFreeUsage(ctx, tx, pubkey, usageMonth(now)). %w", err)
+	}
+
+	if used >= p.FreeMonthlyBytes {
+		return 0, nil
+	}
+	return p.FreeMonthlyBytes - used, nil
+}
+
+// CoversRequest returns true if the request does not need a payment.
+// When the free quota is used the bytes are recorded in the transaction.
+func (p PaymentPolicy) CoversRequest(ctx context.Context, tx *sql.Tx, db database.Database, pubkey string, bytes uint64, now time.Time) (bool, error) {
+	if pubkey == "" {
+		return false, nil
+	}
+
+	if p.IsAllowed(pubkey) {
+		return true, nil
+	}
+
+	left, err := p.FreeBytesLeft(ctx, tx, db, pubkey, now)
+	if err != nil {
+		return false, fmt.Errorf("p.FreeBytesLeft(ctx, tx, db, pubkey, now). %w", err)
+	}
+
+	if left < bytes {
+		return false, nil
+	}
+
+	err = db.AddFreeUsage(ctx, tx, pubkey, usageMonth(now), bytes)
+	if err != nil {
+		return false, fmt.Errorf("db.AddFreeUsage(ctx, tx, pubkey, usageMonth(now), bytes). %w", err)
+	}
+
+	return true, nil
+}
+
+// CheckStorageQuota errors if storing bytes more would go over the storage limit of the pubkey
+func (p PaymentPolicy) CheckStorageQuota(ctx context.Context, tx *sql.Tx, db database.Database, pubkey string, bytes uint64) error {
+	if pubkey == "" || p.MaxStorageBytes == 0 || p.IsAllowed(pubkey) {
+		return nil
+	}
+
+	usage, err := db.GetUsage(ctx, tx, pubkey)
+	if err != nil {
+		return fmt.Errorf("db.GetUsage(ctx, tx, pubkey). %w", err)
+	}
+
+	if usage.TotalBytes+bytes > p.MaxStorageBytes {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"ratasker/external/blossom"
+	"ratasker/internal/database"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const otherPubkey = "9f0cc17023b2cf509e0f1d305793d20e7c72276928fd9bf85536887ac570a280"
+
+func TestPaymentPolicyAllowlist(t *testing.T) {
+	policy, err := NewPaymentPolicy(npubTest+", "+otherPubkey, 0, 0)
+	if err != nil {
+		t.Fatalf("NewPaymentPolicy(npubTest, 0, 0) %+v", err)
+	}
+
+	_, pubkey, err := nip19.Decode(npubTest)
+	if err != nil {
+		t.Fatalf("nip19.Decode(npubTest) %+v", err)
+	}
+
+	if !policy.IsAllowed(pubkey.(string)) {
+		t.Error("npub should be allowed")
+	}
+	if !policy.IsAllowed(otherPubkey) {
+		t.Error("hex pubkey should be allowed")
+	}
+	if policy.IsAllowed("") {
+		t.Error("anonymous requests should not be allowed")
+	}
+
+	_, err = NewPaymentPolicy("npub1notvalid", 0, 0)
+	if err == nil {
+		t.Error("invalid npub should fail")
+	}
+}
+
+func TestPaymentPolicyFreeQuota(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	policy, err := NewPaymentPolicy("", 1000, 0)
+	if err != nil {
+		t.Fatalf(`NewPaymentPolicy("", 1000, 0) %+v`, err)
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	defer tx.Commit()
+
+	now := time.Date(2024, 10, 5, 0, 0, 0, 0, time.UTC)
+
+	free, err := policy.CoversRequest(ctx, tx, sqlite, otherPubkey, 600, now)
+	if err != nil || !free {
+		t.Fatalf("first request should be free. %+v", err)
+	}
+
+	free, err = policy.CoversRequest(ctx, tx, sqlite, otherPubkey, 600, now)
+	if err != nil || free {
+		t.Fatalf("request over the quota should not be free. %+v", err)
+	}
+
+	left, err := policy.FreeBytesLeft(ctx, tx, sqlite, otherPubkey, now)
+	if err != nil {
+		t.Fatalf("policy.FreeBytesLeft(ctx, tx, sqlite, otherPubkey, now) %+v", err)
+	}
+	if left != 400 {
+		t.Errorf("should have 400 bytes left. got: %v", left)
+	}
+
+	// quota resets every month
+	free, err = policy.CoversRequest(ctx, tx, sqlite, otherPubkey, 600, now.AddDate(0, 1, 0))
+	if err != nil || !free {
+		t.Fatalf("request in the next month should be free. %+v", err)
+	}
+
+	free, err = policy.CoversRequest(ctx, tx, sqlite, "", 1, now)
+	if err != nil || free {
+		t.Fatalf("anonymous requests should never be free. %+v", err)
+	}
+}
+
+func TestPaymentPolicyStorageQuota(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	policy, err := NewPaymentPolicy(npubTest, 0, 1000)
+	if err != nil {
+		t.Fatalf(`NewPaymentPolicy(npubTest, 0, 1000) %+v`, err)
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	defer tx.Commit()
+
+	err = sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: "one", Sha256: []byte("one"), Pubkey: otherPubkey, Data: blossom.Blob{Size: 800}})
+	if err != nil {
+		t.Fatalf("sqlite.AddBlob(ctx, tx, blob) %+v", err)
+	}
+
+	err = policy.CheckStorageQuota(ctx, tx, sqlite, otherPubkey, 200)
+	if err != nil {
+		t.Errorf("blob that fills the quota should be accepted. %+v", err)
+	}
+
+	err = policy.CheckStorageQuota(ctx, tx, sqlite, otherPubkey, 201)
+	if !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Errorf("blob over the quota should be rejected. %+v", err)
+	}
+
+	_, allowedPubkey, err := nip19.Decode(npubTest)
+	if err != nil {
+		t.Fatalf("nip19.Decode(npubTest) %+v", err)
+	}
+	err = policy.CheckStorageQuota(ctx, tx, sqlite, allowedPubkey.(string), 5000)
+	if err != nil {
+		t.Errorf("allowlisted pubkeys should not have a quota. %+v", err)
+	}
+}
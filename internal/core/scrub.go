@@ -0,0 +1,272 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"time"
+)
+
+const (
+	SCRUB_INTERVAL_HOURS   = "SCRUB_INTERVAL_HOURS"
+	SCRUB_BYTES_PER_SECOND = "SCRUB_BYTES_PER_SECOND"
+
+	DefaultScrubIntervalHours  = 24
+	DefaultScrubBytesPerSecond = 8 * 1024 * 1024
+
+	ScrubRepairQuarantine = "quarantine"
+	ScrubRepairDelete     = "delete"
+
+	// files this new can be an upload that is not committed yet
+	OrphanGracePeriod = 1 * time.Hour
+)
+
+var (
+	ErrUnknownScrubRepair = errors.New("Unknown scrub repair mode")
+	ErrNoQuarantine       = errors.New("Storage can not quarantine blobs")
+)
+
+type ScrubOptions struct {
+	// 0 means no limit
+	BytesPerSecond uint64
+	// empty only reports. quarantine or delete repairs the problems found
+	Repair string
+}
+
+type ScrubReport struct {
+	Checked  uint64
+	Ok       uint64
+	Corrupt  uint64
+	Missing  uint64
+	Orphans  uint64
+	Repaired uint64
+	// repairs that failed. The error is saved in the detail of the blob
+	RepairFailed uint64
+	Problems     []database.BlobHealth
+}
+
+// ScrubBlobs re-hashes every stored blob and looks for files without a row.
+// Results are saved in blob_health. Rows without a valid file are removed on repair so the blob can be uploaded again.
+func ScrubBlobs(ctx context.Context, db database.Database, fileHandler io.BlossomIO, options ScrubOptions) (ScrubReport, error) {
+	var report ScrubReport
+	if options.Repair != "" && options.Repair != ScrubRepairQuarantine && options.Repair != ScrubRepairDelete {
+		return report, ErrUnknownScrubRepair
+	}
+	if _, ok := fileHandler.(io.QuarantineIO); options.Repair == ScrubRepairQuarantine && !ok {
+		return report, ErrNoQuarantine
+	}
+
+	started := time.Now()
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return report, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	blobs, err := db.ListBlobs(ctx, tx)
+	tx.Rollback()
+	if err != nil {
+		return report, fmt.Errorf("db.ListBlobs(ctx, tx). %w", err)
+	}
+
+	known := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		key := hex.EncodeToString(blob.Sha256)
+		known[key] = true
+		report.Checked++
+
+		readStart := time.Now()
+		fileBytes, err := fileHandler.GetBlob(ctx, blob.Path)
+		health := database.BlobHealth{Key: key, Status: database.BlobHealthOk, CheckedAt: uint64(time.Now().Unix())}
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			health.Status = database.BlobHealthMissing
+			report.Missing++
+		case errors.Is(err, io.ErrBlobCorrupt):
+			health.Status = database.BlobHealthCorrupt
+			health.Detail = "failed authentication"
+			report.Corrupt++
+		case err != nil:
+			return report, fmt.Errorf("fileHandler.GetBlob(ctx, blob.Path). %w", err)
+		default:
+			hash := sha256.Sum256(fileBytes)
+			if hex.EncodeToString(hash[:]) != key {
+				health.Status = database.BlobHealthCorrupt
+				health.Detail = "content hash " + hex.EncodeToString(hash[:])
+				report.Corrupt++
+			} else if uint64(len(fileBytes)) != blob.Data.Size {
+				health.Status = database.BlobHealthCorrupt
+				health.Detail = fmt.Sprintf("size %v instead of %v", len(fileBytes), blob.Data.Size)
+				report.Corrupt++
+			} else {
+				report.Ok++
+			}
+		}
+		err = throttle(ctx, uint64(len(fileBytes)), options.BytesPerSecond, readStart)
+		if err != nil {
+			return report, fmt.Errorf("throttle(ctx, size, options.BytesPerSecond, readStart). %w", err)
+		}
+
+		if health.Status != database.BlobHealthOk && options.Repair != "" {
+			// one blob that can't be repaired should not stop the scrub of the others
+			err = repairBlob(ctx, db, fileHandler, blob.Sha256, blob.Path, health.Status == database.BlobHealthCorrupt, options.Repair)
+			if err != nil {
+				recordRepairFailure(ctx, &health, &report, err)
+			} else {
+				health.Status = repairedStatus(options.Repair)
+				report.Repaired++
+			}
+		}
+
+		err = saveBlobHealth(ctx, db, health, &report)
+		if err != nil {
+			return report, fmt.Errorf("saveBlobHealth(ctx, db, health, &report). %w", err)
+		}
+	}
+
+	err = fileHandler.WalkBlobs(ctx, func(info io.BlobInfo) error {
+		if known[info.Key] || time.Since(info.ModTime) < OrphanGracePeriod {
+			return nil
+		}
+		// legacy rows can point to a file named differently than the hash
+		if known[filepath.Base(info.Key)] {
+			return nil
+		}
+		// only blob names are orphans, anything else in the storage was not written by us
+		hash, err := hex.DecodeString(info.Key)
+		if err != nil || len(hash) != sha256.Size {
+			slog.WarnContext(ctx, "scrub: skipping file that is not a blob", "key", info.Key)
+			return nil
+		}
+
+		health := database.BlobHealth{Key: info.Key, Status: database.BlobHealthOrphan, CheckedAt: uint64(time.Now().Unix())}
+		report.Orphans++
+
+		if options.Repair != "" {
+			err := repairOrphan(ctx, fileHandler, info.Key, options.Repair)
+			if err != nil {
+				recordRepairFailure(ctx, &health, &report, err)
+			} else {
+				health.Status = repairedStatus(options.Repair)
+				report.Repaired++
+			}
+		}
+
+		return saveBlobHealth(ctx, db, health, &report)
+	})
+	if err != nil {
+		return report, fmt.Errorf("fileHandler.WalkBlobs(ctx). %w", err)
+	}
+
+	// forget blobs that were removed since the last run
+	tx, err = db.BeginTransaction(ctx)
+	if err != nil {
+		return report, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	err = db.RemoveStaleBlobHealth(ctx, tx, uint64(started.Unix()))
+	if err != nil {
+		tx.Rollback()
+		return report, fmt.Errorf("db.RemoveStaleBlobHealth(ctx, tx, started). %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return report, fmt.Errorf("tx.Commit(). %w", err)
+	}
+
+	return report, nil
+}
+
+func saveBlobHealth(ctx context.Context, db database.Database, health database.BlobHealth, report *ScrubReport) error {
+	if health.Status != database.BlobHealthOk {
+		report.Problems = append(report.Problems, health)
+	}
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	err = db.SetBlobHealth(ctx, tx, health)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("db.SetBlobHealth(ctx, tx, health). %w", err)
+	}
+	return tx.Commit()
+}
+
+// recordRepairFailure keeps the problem status of the blob and saves why it could not be repaired
+func recordRepairFailure(ctx context.Context, health *database.BlobHealth, report *ScrubReport, err error) {
+	slog.ErrorContext(ctx, "scrub: could not repair blob", "key", health.Key, "status", health.Status, "error", err)
+	if health.Detail != "" {
+		health.Detail += ". "
+	}
+	health.Detail += "repair failed: " + err.Error()
+	report.RepairFailed++
+}
+
+func repairedStatus(repair string) string {
+	if repair == ScrubRepairQuarantine {
+		return database.BlobHealthQuarantined
+	}
+	return database.BlobHealthDeleted
+}
+
+// repairBlob removes the row of a blob without a valid file. A corrupt file is quarantined or deleted
+func repairBlob(ctx context.Context, db database.Database, fileHandler io.BlossomIO, hash []byte, path string, hasFile bool, repair string) error {
+	err := removeBlobRow(ctx, db, hash)
+	if err != nil {
+		return fmt.Errorf("removeBlobRow(ctx, db, hash). %w", err)
+	}
+
+	if !hasFile {
+		return nil
+	}
+	return repairOrphan(ctx, fileHandler, path, repair)
+}
+
+func repairOrphan(ctx context.Context, fileHandler io.BlossomIO, path string, repair string) error {
+	if repair == ScrubRepairDelete {
+		return fileHandler.RemoveBlob(ctx, path)
+	}
+
+	quarantine, ok := fileHandler.(io.QuarantineIO)
+	if !ok {
+		return ErrNoQuarantine
+	}
+	return quarantine.QuarantineBlob(ctx, path)
+}
+
+// throttle waits so reading size bytes takes at least as long as the limit allows. It stops early when ctx is done
+func throttle(ctx context.Context, size uint64, bytesPerSecond uint64, start time.Time) error {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	wait := time.Duration(float64(size) / float64(bytesPerSecond) * float64(time.Second))
+	elapsed := time.Since(start)
+	if wait <= elapsed {
+		return nil
+	}
+
+	timer := time.NewTimer(wait - elapsed)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// LogScrubReport prints the problems found by a scrub
+func LogScrubReport(ctx context.Context, report ScrubReport) {
+	slog.InfoContext(ctx, "Scrub finished", "checked", report.Checked, "ok", report.Ok, "corrupt", report.Corrupt,
+		"missing", report.Missing, "orphans", report.Orphans, "repaired", report.Repaired, "repair_failed", report.RepairFailed)
+	for _, problem := range report.Problems {
+		slog.WarnContext(ctx, "Scrub problem", "key", problem.Key, "status", problem.Status, "detail", problem.Detail)
+	}
+}
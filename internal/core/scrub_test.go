@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"ratasker/external/blossom"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addScrubTestBlob(t *testing.T, db database.Database, handler io.LocalFSHandler, content []byte, written []byte) string {
+	ctx := context.Background()
+	hash := sha256.Sum256(content)
+	key := hex.EncodeToString(hash[:])
+
+	if written != nil {
+		err := handler.WriteBlob(ctx, key, written)
+		if err != nil {
+			t.Fatalf("handler.WriteBlob(ctx, key, written) %+v", err)
+		}
+	}
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("db.BeginTransaction(ctx) %+v", err)
+	}
+	err = db.AddBlob(ctx, tx, blossom.DBBlobData{Path: key, Sha256: hash[:], Data: blossom.Blob{Size: uint64(len(content))}})
+	if err != nil {
+		t.Fatalf("db.AddBlob(ctx, tx, blob) %+v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+	return key
+}
+
+func TestScrubBlobs(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: filepath.Join(t.TempDir(), "data")}
+
+	addScrubTestBlob(t, sqlite, handler, []byte("good"), []byte("good"))
+	corrupt := addScrubTestBlob(t, sqlite, handler, []byte("corrupt"), []byte("c0rrupt"))
+	missing := addScrubTestBlob(t, sqlite, handler, []byte("missing"), nil)
+
+	orphanHash := sha256.Sum256([]byte("orphan"))
+	orphan := hex.EncodeToString(orphanHash[:])
+	err = handler.WriteBlob(ctx, orphan, []byte("orphan"))
+	if err != nil {
+		t.Fatalf("handler.WriteBlob(ctx, orphan) %+v", err)
+	}
+	old := time.Now().Add(-2 * OrphanGracePeriod)
+	err = os.Chtimes(handler.ShardedPath(orphan), old, old)
+	if err != nil {
+		t.Fatalf("os.Chtimes(orphan) %+v", err)
+	}
+
+	report, err := ScrubBlobs(ctx, sqlite, handler, ScrubOptions{})
+	if err != nil {
+		t.Fatalf("ScrubBlobs(ctx, sqlite, handler, options) %+v", err)
+	}
+	if report.Ok != 1 || report.Corrupt != 1 || report.Missing != 1 || report.Orphans != 1 || report.Repaired != 0 {
+		t.Errorf("wrong scrub report. got: %+v", report)
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	problems, err := sqlite.GetBlobHealthProblems(ctx, tx)
+	tx.Rollback()
+	if err != nil {
+		t.Fatalf("sqlite.GetBlobHealthProblems(ctx, tx) %+v", err)
+	}
+	if len(problems) != 3 {
+		t.Errorf("should record 3 problems. got: %+v", problems)
+	}
+
+	report, err = ScrubBlobs(ctx, sqlite, handler, ScrubOptions{Repair: ScrubRepairQuarantine})
+	if err != nil {
+		t.Fatalf("ScrubBlobs(ctx, sqlite, handler, quarantine) %+v", err)
+	}
+	if report.Repaired != 3 {
+		t.Errorf("should repair 3 problems. got: %+v", report)
+	}
+
+	quarantine := filepath.Join(filepath.Dir(handler.DataPath), "quarantine")
+	for _, key := range []string{corrupt, orphan} {
+		if _, err := os.Stat(filepath.Join(quarantine, key)); err != nil {
+			t.Errorf("%v should be quarantined. %+v", key, err)
+		}
+	}
+
+	hash, _ := hex.DecodeString(missing)
+	_, err = sqlite.GetBlob(ctx, hash)
+	if err == nil {
+		t.Errorf("row without a file should be removed")
+	}
+
+	report, err = ScrubBlobs(ctx, sqlite, handler, ScrubOptions{})
+	if err != nil {
+		t.Fatalf("ScrubBlobs(ctx, sqlite, handler, options) %+v", err)
+	}
+	if report.Checked != 1 || len(report.Problems) != 0 {
+		t.Errorf("repaired storage should be clean. got: %+v", report)
+	}
+}
+
+// failingRemoveDB can't remove the row of one blob
+type failingRemoveDB struct {
+	database.Database
+	failOn string
+}
+
+func (f failingRemoveDB) RemoveBlob(ctx context.Context, tx *sql.Tx, hash []byte) (blossom.DBBlobData, error) {
+	if hex.EncodeToString(hash) == f.failOn {
+		return blossom.DBBlobData{}, errors.New("remove failed")
+	}
+	return f.Database.RemoveBlob(ctx, tx, hash)
+}
+
+func TestScrubBlobsKeepsGoingAfterFailedRepair(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	handler := io.LocalFSHandler{DataPath: filepath.Join(t.TempDir(), "data")}
+
+	failing := addScrubTestBlob(t, sqlite, handler, []byte("missing and stuck"), nil)
+	missing := addScrubTestBlob(t, sqlite, handler, []byte("missing"), nil)
+
+	// files that are not named like a blob are never orphans
+	notBlob := filepath.Join(handler.DataPath, "notes.txt")
+	err = os.MkdirAll(handler.DataPath, 0755)
+	if err != nil {
+		t.Fatalf("os.MkdirAll(handler.DataPath) %+v", err)
+	}
+	err = os.WriteFile(notBlob, []byte("not a blob"), 0644)
+	if err != nil {
+		t.Fatalf("os.WriteFile(notBlob) %+v", err)
+	}
+	old := time.Now().Add(-2 * OrphanGracePeriod)
+	err = os.Chtimes(notBlob, old, old)
+	if err != nil {
+		t.Fatalf("os.Chtimes(notBlob) %+v", err)
+	}
+
+	report, err := ScrubBlobs(ctx, failingRemoveDB{Database: sqlite, failOn: failing}, handler, ScrubOptions{Repair: ScrubRepairDelete})
+	if err != nil {
+		t.Fatalf("ScrubBlobs(ctx, db, handler, delete) %+v", err)
+	}
+	if report.Missing != 2 || report.Repaired != 1 || report.RepairFailed != 1 || report.Orphans != 0 {
+		t.Errorf("wrong scrub report. got: %+v", report)
+	}
+	if _, err := os.Stat(notBlob); err != nil {
+		t.Errorf("a file that is not a blob should be kept. %+v", err)
+	}
+
+	hash, _ := hex.DecodeString(missing)
+	_, err = sqlite.GetBlob(ctx, hash)
+	if err == nil {
+		t.Errorf("row without a file should be removed after the failed repair")
+	}
+
+	for _, problem := range report.Problems {
+		if problem.Key == failing && (problem.Status != database.BlobHealthMissing || !strings.Contains(problem.Detail, "remove failed")) {
+			t.Errorf("the failed repair should be recorded. got: %+v", problem)
+		}
+	}
+}
+
+func TestThrottleStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	started := time.Now()
+	err := throttle(ctx, 1024*1024, 1, time.Now())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("throttle should not wait after the context is done")
+	}
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+)
+
+type StorageMigrationReport struct {
+	Migrated uint64
+	Skipped  uint64
+	Missing  uint64
+}
+
+// MigrateStorageLayout moves every blob into the sharded layout and rewrites its row to use the hash as key.
+// Every blob is committed on its own so the migration can be stopped and run again.
+func MigrateStorageLayout(ctx context.Context, db database.Database, handler io.LocalFSHandler) (StorageMigrationReport, error) {
+	var report StorageMigrationReport
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return report, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	blobs, err := db.ListBlobs(ctx, tx)
+	tx.Rollback()
+	if err != nil {
+		return report, fmt.Errorf("db.ListBlobs(ctx, tx). %w", err)
+	}
+
+	for _, blob := range blobs {
+		key := hex.EncodeToString(blob.Sha256)
+
+		err := handler.MigrateBlob(blob.Path, key)
+		if errors.Is(err, io.ErrBlobFileNotFound) {
+			slog.WarnContext(ctx, "Blob has no file", "sha256", key, "path", blob.Path)
+			report.Missing++
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("handler.MigrateBlob(blob.Path, key). %w", err)
+		}
+
+		if blob.Path == key {
+			report.Skipped++
+			continue
+		}
+
+		tx, err := db.BeginTransaction(ctx)
+		if err != nil {
+			return report, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+		}
+		err = db.UpdateBlobPath(ctx, tx, blob.Sha256, key)
+		if err != nil {
+			tx.Rollback()
+			return report, fmt.Errorf("db.UpdateBlobPath(ctx, tx, blob.Sha256, key). %w", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return report, fmt.Errorf("tx.Commit(). %w", err)
+		}
+		report.Migrated++
+	}
+
+	return report, nil
+}
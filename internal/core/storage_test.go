@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"ratasker/external/blossom"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"testing"
+)
+
+func TestMigrateStorageLayout(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	handler := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	blob := []byte("legacy blob")
+	hash := sha256.Sum256(blob)
+	key := hex.EncodeToString(hash[:])
+
+	// blobs used to be flat in the data dir with the absolute path in the row
+	legacyPath := filepath.Join(handler.DataPath, key)
+	err = os.WriteFile(legacyPath, blob, 0644)
+	if err != nil {
+		t.Fatalf("os.WriteFile(legacyPath) %+v", err)
+	}
+
+	missing := sha256.Sum256([]byte("missing"))
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	err = sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: legacyPath, Sha256: hash[:], Data: blossom.Blob{Size: uint64(len(blob))}})
+	if err != nil {
+		t.Fatalf("sqlite.AddBlob(ctx, tx, blob) %+v", err)
+	}
+	err = sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: "/old/home/data/missing", Sha256: missing[:]})
+	if err != nil {
+		t.Fatalf("sqlite.AddBlob(ctx, tx, missing) %+v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	report, err := MigrateStorageLayout(ctx, sqlite, handler)
+	if err != nil {
+		t.Fatalf("MigrateStorageLayout(ctx, sqlite, handler) %+v", err)
+	}
+	if report.Migrated != 1 || report.Missing != 1 {
+		t.Errorf("should migrate one blob and miss one. got: %+v", report)
+	}
+
+	sharded := filepath.Join(handler.DataPath, key[0:2], key[2:4], key)
+	if _, err := os.Stat(sharded); err != nil {
+		t.Errorf("blob should be in the sharded layout. %+v", err)
+	}
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Errorf("legacy file should be removed")
+	}
+
+	stored, err := sqlite.GetBlob(ctx, hash[:])
+	if err != nil {
+		t.Fatalf("sqlite.GetBlob(ctx, hash) %+v", err)
+	}
+	if stored.Path != key {
+		t.Errorf("row should use the hash as key. got: %v", stored.Path)
+	}
+
+	// running it again does nothing
+	report, err = MigrateStorageLayout(ctx, sqlite, handler)
+	if err != nil {
+		t.Fatalf("MigrateStorageLayout(ctx, sqlite, handler) %+v", err)
+	}
+	if report.Migrated != 0 || report.Skipped != 1 {
+		t.Errorf("second run should skip the migrated blob. got: %+v", report)
+	}
+
+	fileBytes, err := handler.GetBlob(ctx, key)
+	if err != nil || string(fileBytes) != string(blob) {
+		t.Errorf("handler.GetBlob(ctx, key) should read the migrated blob. %+v", err)
+	}
+}
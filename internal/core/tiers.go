@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"sync"
+	"time"
+)
+
+const (
+	HOT_TIER_MIN_DOWNLOADS = "HOT_TIER_MIN_DOWNLOADS"
+	TIER_INTERVAL_MINUTES  = "TIER_INTERVAL_MINUTES"
+
+	DefaultHotTierMinDownloads = 3
+	DefaultTierIntervalMinutes = 10
+
+	// hot blobs nobody downloaded for this long are demoted even if the budget has space
+	HotTierMaxIdle = 7 * 24 * time.Hour
+)
+
+var (
+	ErrNoStorageTiers = errors.New("Storage has no tiers")
+)
+
+type TierReport struct {
+	Promoted uint64
+	Demoted  uint64
+	HotBytes uint64
+}
+
+type pendingAccess struct {
+	size       uint64
+	downloads  uint64
+	lastAccess uint64
+}
+
+// DownloadCounter counts downloads for the storage tiers in memory so a download does not cost a database write.
+// Flush saves them.
+type DownloadCounter struct {
+	mu      sync.Mutex
+	pending map[string]pendingAccess
+}
+
+func NewDownloadCounter() *DownloadCounter {
+	return &DownloadCounter{pending: make(map[string]pendingAccess)}
+}
+
+// Add counts a download of the blob
+func (d *DownloadCounter) Add(key string, size uint64, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	access := d.pending[key]
+	access.size = size
+	access.downloads++
+	access.lastAccess = uint64(now.Unix())
+	d.pending[key] = access
+}
+
+// Flush saves the counted downloads in one transaction. They are kept for the next flush if it fails
+func (d *DownloadCounter) Flush(ctx context.Context, db database.Database) error {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[string]pendingAccess)
+	d.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		for key, access := range pending {
+			err := db.RecordBlobAccess(ctx, tx, key, access.size, access.downloads, access.lastAccess)
+			if err != nil {
+				return fmt.Errorf("db.RecordBlobAccess(ctx, tx, key, size, downloads, lastAccess). %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		d.mu.Lock()
+		for key, access := range pending {
+			newer := d.pending[key]
+			access.downloads += newer.downloads
+			if newer.lastAccess > access.lastAccess {
+				access.size = newer.size
+				access.lastAccess = newer.lastAccess
+			}
+			d.pending[key] = access
+		}
+		d.mu.Unlock()
+		return fmt.Errorf("database.WithTx(ctx, db, recordAccess). %w", err)
+	}
+	return nil
+}
+
+// RebalanceTiers keeps the most downloaded blobs in the hot tier without going over budget bytes.
+// Blobs need minDownloads to be promoted and are demoted when they stop being downloaded.
+func RebalanceTiers(ctx context.Context, db database.Database, fileHandler io.BlossomIO, budget uint64, minDownloads uint64, now time.Time) (TierReport, error) {
+	var report TierReport
+
+	tiers, ok := fileHandler.(io.TierIO)
+	if !ok {
+		return report, ErrNoStorageTiers
+	}
+
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return report, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	ranking, err := db.GetBlobAccessRanking(ctx, tx)
+	tx.Rollback()
+	if err != nil {
+		return report, fmt.Errorf("db.GetBlobAccessRanking(ctx, tx). %w", err)
+	}
+
+	var promote []string
+	var demote []string
+	idleSince := uint64(now.Add(-HotTierMaxIdle).Unix())
+	for _, access := range ranking {
+		wantHot := access.Downloads >= minDownloads &&
+			access.LastAccess >= idleSince &&
+			report.HotBytes+access.Size <= budget
+
+		switch {
+		case wantHot:
+			report.HotBytes += access.Size
+			if !access.Hot {
+				promote = append(promote, access.Key)
+			}
+		case access.Hot:
+			demote = append(demote, access.Key)
+		}
+	}
+
+	// demote first so the hot tier never goes over budget
+	for _, key := range demote {
+		err = tiers.Demote(ctx, key)
+		if err != nil {
+			return report, fmt.Errorf("tiers.Demote(ctx, key). %w", err)
+		}
+		err = setBlobHot(ctx, db, key, false)
+		if err != nil {
+			return report, fmt.Errorf("setBlobHot(ctx, db, key, false). %w", err)
+		}
+		report.Demoted++
+	}
+
+	for _, key := range promote {
+		err = tiers.Promote(ctx, key)
+		if err != nil {
+			return report, fmt.Errorf("tiers.Promote(ctx, key). %w", err)
+		}
+		err = setBlobHot(ctx, db, key, true)
+		if err != nil {
+			return report, fmt.Errorf("setBlobHot(ctx, db, key, true). %w", err)
+		}
+		report.Promoted++
+	}
+
+	return report, nil
+}
+
+func setBlobHot(ctx context.Context, db database.Database, key string, hot bool) error {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+
+	err = db.SetBlobHot(ctx, tx, key, hot)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("db.SetBlobHot(ctx, tx, key, hot). %w", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"os"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"testing"
+	"time"
+)
+
+func TestRebalanceTiers(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	hot := io.LocalFSHandler{DataPath: t.TempDir()}
+	cold := io.LocalFSHandler{DataPath: t.TempDir()}
+	tiered := io.TieredIO{Hot: hot, Cold: cold}
+
+	popular := "aaaa000000000000000000000000000000000000000000000000000000000001"
+	other := "bbbb000000000000000000000000000000000000000000000000000000000002"
+	for _, key := range []string{popular, other} {
+		err = tiered.WriteBlob(ctx, key, []byte("0123456789"))
+		if err != nil {
+			t.Fatalf("tiered.WriteBlob(ctx, key, blob) %+v", err)
+		}
+	}
+
+	now := time.Now()
+	downloads := NewDownloadCounter()
+	for i := 0; i < 3; i++ {
+		downloads.Add(popular, 10, now)
+	}
+	downloads.Add(other, 10, now)
+	err = downloads.Flush(ctx, sqlite)
+	if err != nil {
+		t.Fatalf("downloads.Flush(ctx, sqlite) %+v", err)
+	}
+	if len(downloads.pending) != 0 {
+		t.Errorf("flushed downloads should not be saved again. got: %+v", downloads.pending)
+	}
+
+	report, err := RebalanceTiers(ctx, sqlite, tiered, 10, 1, now)
+	if err != nil {
+		t.Fatalf("RebalanceTiers(ctx, sqlite, tiered, 10, 1, now) %+v", err)
+	}
+	if report.Promoted != 1 || report.HotBytes != 10 {
+		t.Errorf("only the popular blob fits in the budget. got: %+v", report)
+	}
+	if _, err := os.Stat(hot.ShardedPath(popular)); err != nil {
+		t.Errorf("popular blob should be in the hot storage. %+v", err)
+	}
+	if _, err := os.Stat(hot.ShardedPath(other)); !os.IsNotExist(err) {
+		t.Errorf("other blob should not be in the hot storage")
+	}
+
+	// the blob is still read from both tiers
+	part, err := tiered.GetBlobRange(ctx, popular, 2, 3)
+	if err != nil || string(part) != "234" {
+		t.Errorf("tiered.GetBlobRange(ctx, popular, 2, 3) got: %s %+v", part, err)
+	}
+
+	// nobody downloaded it for a while
+	report, err = RebalanceTiers(ctx, sqlite, tiered, 10, 1, now.Add(HotTierMaxIdle+time.Hour))
+	if err != nil {
+		t.Fatalf("RebalanceTiers(ctx, sqlite, tiered, 10, 1, later) %+v", err)
+	}
+	if report.Demoted != 1 {
+		t.Errorf("idle blob should be demoted. got: %+v", report)
+	}
+	if _, err := os.Stat(hot.ShardedPath(popular)); !os.IsNotExist(err) {
+		t.Errorf("demoted blob should leave the hot storage")
+	}
+	if _, err := tiered.GetBlob(ctx, popular); err != nil {
+		t.Errorf("demoted blob should still be in the cold storage. %+v", err)
+	}
+
+	_, err = RebalanceTiers(ctx, sqlite, cold, 10, 1, now)
+	if err != ErrNoStorageTiers {
+		t.Errorf("storage without tiers should fail. got: %+v", err)
+	}
+}
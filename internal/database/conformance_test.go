@@ -0,0 +1,585 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"ratasker/external/blossom"
+	"testing"
+	"time"
+
+	"github.com/elnosh/gonuts/cashu"
+)
+
+// set to a postgres:// url of a local instance to run the conformance suite against Postgres
+const TEST_POSTGRES_DSN = "RATASKER_TEST_POSTGRES_DSN"
+
+func TestSqliteConformance(t *testing.T) {
+	sqlite, err := DatabaseSetup(context.Background(), t.TempDir(), EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+	defer sqlite.Close()
+
+	testDatabaseConformance(t, sqlite)
+}
+
+func TestPostgresConformance(t *testing.T) {
+	dsn := os.Getenv(TEST_POSTGRES_DSN)
+	if dsn == "" {
+		t.Skipf("%v is not set", TEST_POSTGRES_DSN)
+	}
+	ctx := context.Background()
+
+	// every run gets its own schema so it starts empty
+	randomBytes := make([]byte, 6)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		t.Fatalf("rand.Read(randomBytes) %+v", err)
+	}
+	schema := "ratasker_test_" + hex.EncodeToString(randomBytes)
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf(`sql.Open("pgx", dsn) %+v`, err)
+	}
+	defer admin.Close()
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatalf("CREATE SCHEMA %+v", err)
+	}
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("url.Parse(dsn) %+v", err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+
+	postgres, err := PostgresSetup(ctx, parsed.String(), EmbedPostgresMigrations)
+	if err != nil {
+		t.Fatalf("PostgresSetup(ctx, dsn, EmbedPostgresMigrations) %+v", err)
+	}
+	defer postgres.Close()
+
+	testDatabaseConformance(t, postgres)
+}
+
+func testDatabaseConformance(t *testing.T, db Database) {
+	t.Run("blobs", func(t *testing.T) { conformanceBlobs(t, db) })
+	t.Run("pubkeys", func(t *testing.T) { conformancePubkeys(t, db) })
+	t.Run("locked proofs", func(t *testing.T) { conformanceLockedProofs(t, db) })
+	t.Run("swapped proofs", func(t *testing.T) { conformanceSwappedProofs(t, db) })
+	t.Run("counters and mints", func(t *testing.T) { conformanceCountersAndMints(t, db) })
+	t.Run("free usage", func(t *testing.T) { conformanceFreeUsage(t, db) })
+	t.Run("blob health and access", func(t *testing.T) { conformanceBlobHealthAndAccess(t, db) })
+	t.Run("ledger", func(t *testing.T) { conformanceLedger(t, db) })
+	t.Run("health check", func(t *testing.T) { conformanceHealthCheck(t, db) })
+	t.Run("moderation", func(t *testing.T) { conformanceModeration(t, db) })
+	t.Run("blocklist", func(t *testing.T) { conformanceBlocklist(t, db) })
+}
+
+func beginConformanceTx(t *testing.T, db Database) *sql.Tx {
+	ctx := context.Background()
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("db.BeginTransaction(ctx) %+v", err)
+	}
+	return tx
+}
+
+func conformanceBlobs(t *testing.T, db Database) {
+	ctx := context.Background()
+	hash := []byte("conformance blob hash")
+	pubkey := "conformance pubkey"
+
+	_, err := db.GetBlobLength(ctx, hash)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing blob should be sql.ErrNoRows. got: %+v", err)
+	}
+
+	tx := beginConformanceTx(t, db)
+	err = db.AddBlob(ctx, tx, blossom.DBBlobData{Path: "old/path", Sha256: hash, CreatedAt: 10, Pubkey: pubkey, PaidSats: 5, Data: blossom.Blob{Size: 100, Type: "image/png"}})
+	if err != nil {
+		t.Fatalf("db.AddBlob(ctx, tx, blob) %+v", err)
+	}
+	err = db.AddBlob(ctx, tx, blossom.DBBlobData{Path: "anonymous", Sha256: []byte("anonymous blob"), CreatedAt: 11, Data: blossom.Blob{Size: 50}})
+	if err != nil {
+		t.Fatalf("db.AddBlob(ctx, tx, anonymous) %+v", err)
+	}
+	err = db.UpdateBlobPath(ctx, tx, hash, "new-key")
+	if err != nil {
+		t.Fatalf("db.UpdateBlobPath(ctx, tx, hash, new-key) %+v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	blob, err := db.GetBlob(ctx, hash)
+	if err != nil {
+		t.Fatalf("db.GetBlob(ctx, hash) %+v", err)
+	}
+	if blob.Path != "new-key" || blob.Pubkey != pubkey || blob.Data.Type != "image/png" || blob.PaidSats != 5 || blob.Data.Size != 100 {
+		t.Errorf("blob was not stored correctly. got: %+v", blob)
+	}
+	length, err := db.GetBlobLength(ctx, hash)
+	if err != nil || length != 100 {
+		t.Errorf("db.GetBlobLength(ctx, hash) should be 100. got: %v %+v", length, err)
+	}
+
+	tx = beginConformanceTx(t, db)
+	err = db.AddBlob(ctx, tx, blossom.DBBlobData{Path: "again", Sha256: hash, CreatedAt: 12, Pubkey: pubkey, Data: blossom.Blob{Size: 100}})
+	if !IsUniqueViolation(err) {
+		t.Errorf("storing a blob twice should be a unique violation. got: %+v", err)
+	}
+	tx.Rollback()
+
+	tx = beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	blobs, err := db.ListBlobs(ctx, tx)
+	if err != nil || len(blobs) != 2 {
+		t.Fatalf("db.ListBlobs(ctx, tx) should list 2 blobs. got: %v %+v", len(blobs), err)
+	}
+
+	stats, err := db.GetStorageStats(ctx, tx)
+	if err != nil || stats.BlobCount != 2 || stats.StoredBytes != 150 {
+		t.Errorf("db.GetStorageStats(ctx, tx) should count 2 blobs of 150 bytes. got: %+v %+v", stats, err)
+	}
+
+	usage, err := db.GetUsage(ctx, tx, pubkey)
+	if err != nil {
+		t.Fatalf("db.GetUsage(ctx, tx, pubkey) %+v", err)
+	}
+	if usage.TotalBytes != 100 || usage.BlobCount != 1 || usage.TotalSats != 5 {
+		t.Errorf("wrong usage. got: %+v", usage)
+	}
+
+	removed, err := db.RemoveBlob(ctx, tx, hash)
+	if err != nil {
+		t.Fatalf("db.RemoveBlob(ctx, tx, hash) %+v", err)
+	}
+	if removed.Pubkey != pubkey {
+		t.Errorf("removed blob should have the uploader. got: %+v", removed)
+	}
+
+	usage, err = db.GetUsage(ctx, tx, pubkey)
+	if err != nil {
+		t.Fatalf("db.GetUsage(ctx, tx, pubkey) %+v", err)
+	}
+	if usage.TotalBytes != 0 || usage.BlobCount != 0 || usage.TotalSats != 5 {
+		t.Errorf("usage should go down but keep the sats. got: %+v", usage)
+	}
+
+	_, err = db.RemoveBlob(ctx, tx, hash)
+	if err == nil {
+		t.Errorf("removing a missing blob should fail")
+	}
+}
+
+func conformancePubkeys(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	expiration := time.Now().Add(4 * time.Hour).Unix()
+	first, err := db.RotateNewPubkey(ctx, tx, expiration)
+	if err != nil {
+		t.Fatalf("db.RotateNewPubkey(ctx, tx, expiration) %+v", err)
+	}
+	second, err := db.RotateNewPubkey(ctx, tx, expiration)
+	if err != nil {
+		t.Fatalf("db.RotateNewPubkey(ctx, tx, expiration) %+v", err)
+	}
+	if second.VersionNum != first.VersionNum+1 {
+		t.Errorf("versions should go up by one. got: %v then %v", first.VersionNum, second.VersionNum)
+	}
+
+	active, err := db.GetActivePubkey(ctx, tx)
+	if err != nil {
+		t.Fatalf("db.GetActivePubkey(ctx, tx) %+v", err)
+	}
+	if active.VersionNum != second.VersionNum || active.Expiration != uint64(expiration) {
+		t.Errorf("wrong active pubkey. got: %+v", active)
+	}
+}
+
+func conformanceToken(t *testing.T, name string) cashu.Token {
+	proofs := cashu.Proofs{
+		{Id: hex.EncodeToString([]byte("test")), Amount: 2, Secret: name + " secret 1", C: hex.EncodeToString([]byte(name + " C1"))},
+		{Id: hex.EncodeToString([]byte("test")), Amount: 8, Secret: name + " secret 2", C: hex.EncodeToString([]byte(name + " C2"))},
+	}
+	token, err := cashu.NewTokenV4(proofs, TEST_MINT, cashu.Sat, false)
+	if err != nil {
+		t.Fatalf("cashu.NewTokenV4(proofs, TEST_MINT, cashu.Sat, false) %+v", err)
+	}
+	return token
+}
+
+func conformanceLockedProofs(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	current, err := db.RotateNewPubkey(ctx, tx, time.Now().Add(4*time.Hour).Unix())
+	if err != nil {
+		t.Fatalf("db.RotateNewPubkey(ctx, tx, expiration) %+v", err)
+	}
+
+	token := conformanceToken(t, "locked")
+	err = db.AddLockedProofs(ctx, tx, token, current.VersionNum, false, uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("db.AddLockedProofs(ctx, tx, token, version, false, now) %+v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	// the same proofs can never be accepted twice
+	tx = beginConformanceTx(t, db)
+	err = db.AddLockedProofs(ctx, tx, token, current.VersionNum, false, uint64(time.Now().Unix()))
+	tx.Rollback()
+	if !errors.Is(err, ErrProofAlreadyStored) {
+		t.Fatalf("adding the same proofs again should fail with ErrProofAlreadyStored. got: %v", err)
+	}
+
+	tx = beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	C := token.Proofs()[1].C
+	byC, err := db.GetLockedProofsByC(ctx, tx, []string{C, "unknown"})
+	if err != nil || len(byC) != 1 || byC[0].C != C {
+		t.Fatalf("db.GetLockedProofsByC(ctx, tx, Cs) should find one proof. got: %+v %+v", byC, err)
+	}
+
+	byVersion, err := db.GetLockedProofsByPubkeyVersion(ctx, tx, current.VersionNum)
+	if err != nil || len(byVersion) != 2 {
+		t.Fatalf("db.GetLockedProofsByPubkeyVersion(ctx, tx, version) should find two proofs. got: %+v %+v", byVersion, err)
+	}
+
+	stats, err := db.GetStorageStats(ctx, tx)
+	if err != nil {
+		t.Fatalf("db.GetStorageStats(ctx, tx) %+v", err)
+	}
+	if stats.UnswappedProofs != 2 || stats.UnswappedSats != token.Amount() {
+		t.Errorf("wrong unswapped proofs in stats. got: %+v", stats)
+	}
+
+	unredeemed, err := db.GetLockedProofsByRedeemed(ctx, tx, false)
+	if err != nil || len(unredeemed[TEST_MINT]) != 2 {
+		t.Fatalf("db.GetLockedProofsByRedeemed(ctx, tx, false) should find two proofs. got: %+v %+v", unredeemed, err)
+	}
+	if unredeemed[TEST_MINT][0].PubkeyVersion != uint64(current.VersionNum) {
+		t.Errorf("wrong pubkey version. got: %v", unredeemed[TEST_MINT][0].PubkeyVersion)
+	}
+
+	err = db.ChangeLockedProofsRedeem(ctx, tx, []string{C}, true)
+	if err != nil {
+		t.Fatalf("db.ChangeLockedProofsRedeem(ctx, tx, Cs, true) %+v", err)
+	}
+	redeemed, err := db.GetLockedProofsByRedeemed(ctx, tx, true)
+	if err != nil || len(redeemed[TEST_MINT]) != 1 {
+		t.Fatalf("db.GetLockedProofsByRedeemed(ctx, tx, true) should find one proof. got: %+v %+v", redeemed, err)
+	}
+}
+
+func conformanceSwappedProofs(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	proofs := conformanceToken(t, "swapped").Proofs()
+	err := db.AddProofs(ctx, tx, proofs, TEST_MINT)
+	if err != nil {
+		t.Fatalf("db.AddProofs(ctx, tx, proofs, TEST_MINT) %+v", err)
+	}
+
+	unspent, err := db.GetBySpentProofs(ctx, tx, false)
+	if err != nil || len(unspent[TEST_MINT]) != 2 {
+		t.Fatalf("db.GetBySpentProofs(ctx, tx, false) should find two proofs. got: %+v %+v", unspent, err)
+	}
+
+	err = db.ChangeSwappedProofsSpent(ctx, tx, proofs[:1], true)
+	if err != nil {
+		t.Fatalf("db.ChangeSwappedProofsSpent(ctx, tx, proofs, true) %+v", err)
+	}
+	spent, err := db.GetBySpentProofs(ctx, tx, true)
+	if err != nil || len(spent[TEST_MINT]) != 1 {
+		t.Fatalf("db.GetBySpentProofs(ctx, tx, true) should find one proof. got: %+v %+v", spent, err)
+	}
+}
+
+func conformanceCountersAndMints(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	_, err := db.GetKeysetCounter(ctx, tx, "missing keyset")
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("missing counter should be sql.ErrNoRows. got: %+v", err)
+	}
+
+	err = db.SetKeysetCounter(ctx, tx, KeysetCounter{KeysetId: "keyset", Counter: 3})
+	if err != nil {
+		t.Fatalf("db.SetKeysetCounter(ctx, tx, counter) %+v", err)
+	}
+	err = db.ModifyKeysetCounter(ctx, tx, KeysetCounter{KeysetId: "keyset", Counter: 7})
+	if err != nil {
+		t.Fatalf("db.ModifyKeysetCounter(ctx, tx, counter) %+v", err)
+	}
+	counter, err := db.GetKeysetCounter(ctx, tx, "keyset")
+	if err != nil || counter.Counter != 7 {
+		t.Errorf("counter should be 7. got: %+v %+v", counter, err)
+	}
+
+	err = db.AddTrustedMint(ctx, tx, TEST_MINT)
+	if err != nil {
+		t.Fatalf("db.AddTrustedMint(ctx, tx, TEST_MINT) %+v", err)
+	}
+	mints, err := db.GetTrustedMints(ctx, tx)
+	if err != nil || len(mints) != 1 || mints[0] != TEST_MINT {
+		t.Errorf("should have one trusted mint. got: %+v %+v", mints, err)
+	}
+}
+
+func conformanceFreeUsage(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	used, err := db.GetFreeUsage(ctx, tx, "pubkey", "2024-10")
+	if err != nil || used != 0 {
+		t.Errorf("unused month should be 0. got: %v %+v", used, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = db.AddFreeUsage(ctx, tx, "pubkey", "2024-10", 300)
+		if err != nil {
+			t.Fatalf("db.AddFreeUsage(ctx, tx, pubkey, month, 300) %+v", err)
+		}
+	}
+	used, err = db.GetFreeUsage(ctx, tx, "pubkey", "2024-10")
+	if err != nil || used != 600 {
+		t.Errorf("free usage should add up to 600. got: %v %+v", used, err)
+	}
+}
+
+func conformanceBlobHealthAndAccess(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	err := db.SetBlobHealth(ctx, tx, BlobHealth{Key: "healthy", Status: BlobHealthOk, CheckedAt: 5})
+	if err != nil {
+		t.Fatalf("db.SetBlobHealth(ctx, tx, healthy) %+v", err)
+	}
+	err = db.SetBlobHealth(ctx, tx, BlobHealth{Key: "broken", Status: BlobHealthOk, CheckedAt: 5})
+	if err != nil {
+		t.Fatalf("db.SetBlobHealth(ctx, tx, broken) %+v", err)
+	}
+	err = db.SetBlobHealth(ctx, tx, BlobHealth{Key: "broken", Status: BlobHealthCorrupt, Detail: "bad hash", CheckedAt: 20})
+	if err != nil {
+		t.Fatalf("db.SetBlobHealth(ctx, tx, broken) %+v", err)
+	}
+
+	problems, err := db.GetBlobHealthProblems(ctx, tx)
+	if err != nil || len(problems) != 1 || problems[0].Detail != "bad hash" {
+		t.Fatalf("should have one problem. got: %+v %+v", problems, err)
+	}
+
+	err = db.RemoveStaleBlobHealth(ctx, tx, 10)
+	if err != nil {
+		t.Fatalf("db.RemoveStaleBlobHealth(ctx, tx, 10) %+v", err)
+	}
+	problems, err = db.GetBlobHealthProblems(ctx, tx)
+	if err != nil || len(problems) != 1 {
+		t.Errorf("recent problems should be kept. got: %+v %+v", problems, err)
+	}
+
+	for _, key := range []string{"popular", "popular", "other"} {
+		err = db.RecordBlobAccess(ctx, tx, key, 10, 1, 100)
+		if err != nil {
+			t.Fatalf("db.RecordBlobAccess(ctx, tx, key, 10, 1, 100) %+v", err)
+		}
+	}
+	err = db.SetBlobHot(ctx, tx, "popular", true)
+	if err != nil {
+		t.Fatalf("db.SetBlobHot(ctx, tx, popular, true) %+v", err)
+	}
+
+	ranking, err := db.GetBlobAccessRanking(ctx, tx)
+	if err != nil || len(ranking) != 2 {
+		t.Fatalf("db.GetBlobAccessRanking(ctx, tx) should have two blobs. got: %+v %+v", ranking, err)
+	}
+	if ranking[0].Key != "popular" || ranking[0].Downloads != 2 || !ranking[0].Hot {
+		t.Errorf("most downloaded blob should be first. got: %+v", ranking[0])
+	}
+}
+
+func conformanceLedger(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	entries := []LedgerEntry{
+		{CreatedAt: 100, Operation: LedgerUpload, Sha256: "aa", Pubkey: "payer", Mint: "mint", DebitAccount: AccountEcash, CreditAccount: AccountUploadIncome, Amount: 21},
+		{CreatedAt: 200, Operation: LedgerSwap, Mint: "mint", DebitAccount: AccountSwapFees, CreditAccount: AccountEcash, Amount: 1},
+		{CreatedAt: 300, Operation: LedgerDownload, Sha256: "aa", Mint: "mint", DebitAccount: AccountEcash, CreditAccount: AccountDownloadIncome, Amount: 2},
+	}
+	for _, entry := range entries {
+		err := db.AddLedgerEntry(ctx, tx, entry)
+		if err != nil {
+			t.Fatalf("db.AddLedgerEntry(ctx, tx, entry) %+v", err)
+		}
+	}
+
+	stored, err := db.GetLedgerEntries(ctx, tx, 100, 300)
+	if err != nil {
+		t.Fatalf("db.GetLedgerEntries(ctx, tx, 100, 300) %+v", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("until should be exclusive. got: %+v", stored)
+	}
+	if stored[0].Operation != LedgerUpload || stored[0].Pubkey != "payer" || stored[0].Amount != 21 || stored[0].Id == 0 {
+		t.Errorf("entry was not stored correctly. got: %+v", stored[0])
+	}
+	if stored[1].Sha256 != "" || stored[1].DebitAccount != AccountSwapFees {
+		t.Errorf("entries should be ordered by creation. got: %+v", stored[1])
+	}
+}
+
+func conformanceHealthCheck(t *testing.T, db Database) {
+	ctx := context.Background()
+	for _, checkedAt := range []uint64{100, 200} {
+		err := WithTx(ctx, db, func(tx *sql.Tx) error {
+			return db.WriteHealthCheck(ctx, tx, checkedAt)
+		})
+		if err != nil {
+			t.Fatalf("db.WriteHealthCheck(ctx, tx, %v) %+v", checkedAt, err)
+		}
+	}
+}
+
+func conformanceModeration(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	reports := []BlobReport{
+		{EventId: "event1", Sha256: "aa", Reporter: "reporter", ReportType: "illegal", Content: "bad", CreatedAt: 100},
+		{EventId: "event1", Sha256: "aa", Reporter: "reporter", ReportType: "illegal", Content: "bad", CreatedAt: 100},
+		{EventId: "event1", Sha256: "bb", Reporter: "reporter", ReportType: "spam", CreatedAt: 100},
+	}
+	for _, report := range reports {
+		err := db.AddBlobReport(ctx, tx, report)
+		if err != nil {
+			t.Fatalf("db.AddBlobReport(ctx, tx, report) %+v", err)
+		}
+	}
+
+	err := db.ReviewBlobReports(ctx, tx, "aa", ReportBlocked, 200)
+	if err != nil {
+		t.Fatalf("db.ReviewBlobReports(ctx, tx, aa, blocked, 200) %+v", err)
+	}
+	pending, err := db.GetBlobReports(ctx, tx, ReportPending)
+	if err != nil {
+		t.Fatalf("db.GetBlobReports(ctx, tx, pending) %+v", err)
+	}
+	if len(pending) != 1 || pending[0].Sha256 != "bb" || pending[0].ReportType != "spam" {
+		t.Errorf("only the bb report should be pending. got: %+v", pending)
+	}
+	all, err := db.GetBlobReports(ctx, tx, "")
+	if err != nil {
+		t.Fatalf("db.GetBlobReports(ctx, tx, all) %+v", err)
+	}
+	if len(all) != 2 || all[0].Status != ReportBlocked || all[0].ReviewedAt != 200 || all[0].Id == 0 {
+		t.Errorf("duplicated reports should be ignored and the review stored. got: %+v", all)
+	}
+
+	err = db.BlockBlob(ctx, tx, BlockedBlob{Sha256: "aa", Reason: "illegal", CreatedAt: 200})
+	if err != nil {
+		t.Fatalf("db.BlockBlob(ctx, tx, aa) %+v", err)
+	}
+	blocked, err := db.IsBlobBlocked(ctx, tx, "aa")
+	if err != nil || !blocked {
+		t.Errorf("aa should be blocked. got %v %+v", blocked, err)
+	}
+	blockedBlobs, err := db.GetBlockedBlobs(ctx, tx)
+	if err != nil || len(blockedBlobs) != 1 || blockedBlobs[0].Reason != "illegal" {
+		t.Errorf("db.GetBlockedBlobs(ctx, tx) %+v %+v", blockedBlobs, err)
+	}
+
+	err = db.UnblockBlob(ctx, tx, "aa")
+	if err != nil {
+		t.Fatalf("db.UnblockBlob(ctx, tx, aa) %+v", err)
+	}
+	blocked, err = db.IsBlobBlocked(ctx, tx, "aa")
+	if err != nil || blocked {
+		t.Errorf("aa should not be blocked. got %v %+v", blocked, err)
+	}
+}
+
+func conformanceBlocklist(t *testing.T, db Database) {
+	ctx := context.Background()
+	tx := beginConformanceTx(t, db)
+	defer tx.Rollback()
+
+	err := db.BlockPubkey(ctx, tx, BlockedPubkey{Pubkey: "abuser", Reason: "spam", CreatedAt: 100})
+	if err != nil {
+		t.Fatalf("db.BlockPubkey(ctx, tx, abuser) %+v", err)
+	}
+	err = db.BlockPubkey(ctx, tx, BlockedPubkey{Pubkey: "abuser", Reason: "abuse", CreatedAt: 200})
+	if err != nil {
+		t.Fatalf("db.BlockPubkey(ctx, tx, abuser) again %+v", err)
+	}
+	blocked, err := db.IsPubkeyBlocked(ctx, tx, "abuser")
+	if err != nil || !blocked {
+		t.Errorf("abuser should be blocked. got %v %+v", blocked, err)
+	}
+	blocked, err = db.HasBlockedPubkeys(ctx, tx)
+	if err != nil || !blocked {
+		t.Errorf("a pubkey should be blocked. got %v %+v", blocked, err)
+	}
+	blockedPubkeys, err := db.GetBlockedPubkeys(ctx, tx)
+	if err != nil || len(blockedPubkeys) != 1 || blockedPubkeys[0].Reason != "abuse" || blockedPubkeys[0].CreatedAt != 100 {
+		t.Errorf("blocking again should only update the reason. got %+v %+v", blockedPubkeys, err)
+	}
+
+	err = db.UnblockPubkey(ctx, tx, "abuser")
+	if err != nil {
+		t.Fatalf("db.UnblockPubkey(ctx, tx, abuser) %+v", err)
+	}
+	blocked, err = db.IsPubkeyBlocked(ctx, tx, "abuser")
+	if err != nil || blocked {
+		t.Errorf("abuser should not be blocked. got %v %+v", blocked, err)
+	}
+	blocked, err = db.HasBlockedPubkeys(ctx, tx)
+	if err != nil || blocked {
+		t.Errorf("no pubkey should be blocked. got %v %+v", blocked, err)
+	}
+
+	audits := []BlocklistAudit{
+		{Action: AuditBlock, TargetType: BlocklistPubkey, Target: "abuser", Reason: "spam", Actor: "owner", CreatedAt: 100},
+		{Action: AuditUnblock, TargetType: BlocklistPubkey, Target: "abuser", Actor: "cli", CreatedAt: 300},
+		{Action: AuditBlock, TargetType: BlocklistSha256, Target: "aa", Reason: "illegal", Actor: "import list.txt", CreatedAt: 300},
+	}
+	for _, audit := range audits {
+		err = db.AddBlocklistAudit(ctx, tx, audit)
+		if err != nil {
+			t.Fatalf("db.AddBlocklistAudit(ctx, tx, audit) %+v", err)
+		}
+	}
+	stored, err := db.GetBlocklistAudit(ctx, tx, 2)
+	if err != nil {
+		t.Fatalf("db.GetBlocklistAudit(ctx, tx, 2) %+v", err)
+	}
+	if len(stored) != 2 || stored[0].Target != "aa" || stored[0].Actor != "import list.txt" || stored[1].Action != AuditUnblock || stored[0].Id == 0 {
+		t.Errorf("the newest 2 entries should be returned. got: %+v", stored)
+	}
+}
@@ -1,12 +1,18 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"ratasker/external/blossom"
 
 	"github.com/elnosh/gonuts/cashu"
 )
 
+var (
+	ErrProofAlreadyStored = errors.New("Proof already stored")
+)
+
 type CurrentPubkey struct {
 	VersionNum uint
 	Expiration uint64
@@ -22,35 +28,211 @@ type ProofToSwap struct {
 	PubkeyVersion uint64
 }
 
+// storage used by an uploader
+type PubkeyUsage struct {
+	Pubkey     string `json:"pubkey" db:"pubkey"`
+	TotalBytes uint64 `json:"total_bytes" db:"total_bytes"`
+	BlobCount  uint64 `json:"blob_count" db:"blob_count"`
+	TotalSats  uint64 `json:"total_sats" db:"total_sats"`
+	UpdatedAt  uint64 `json:"updated_at" db:"updated_at"`
+}
+
+const (
+	BlobHealthOk          = "ok"
+	BlobHealthCorrupt     = "corrupt"
+	BlobHealthMissing     = "missing"
+	BlobHealthOrphan      = "orphan"
+	BlobHealthQuarantined = "quarantined"
+	BlobHealthDeleted     = "deleted"
+)
+
+// result of the last integrity check of a stored blob
+type BlobHealth struct {
+	Key       string `json:"key" db:"blob_key"`
+	Status    string `json:"status" db:"status"`
+	Detail    string `json:"detail" db:"detail"`
+	CheckedAt uint64 `json:"checked_at" db:"checked_at"`
+}
+
+// download statistics used to pick the blobs kept in the hot storage tier
+type BlobAccess struct {
+	Key        string `json:"key" db:"blob_key"`
+	Size       uint64 `json:"size" db:"size"`
+	Downloads  uint64 `json:"downloads" db:"downloads"`
+	LastAccess uint64 `json:"last_access" db:"last_access"`
+	Hot        bool   `json:"hot" db:"hot"`
+}
+
+// totals exported as metrics
+type StorageStats struct {
+	BlobCount       uint64 `json:"blob_count"`
+	StoredBytes     uint64 `json:"stored_bytes"`
+	UnswappedProofs uint64 `json:"unswapped_proofs"`
+	UnswappedSats   uint64 `json:"unswapped_sats"`
+}
+
+const (
+	LedgerUpload   = "upload"
+	LedgerDownload = "download"
+	LedgerSwap     = "swap"
+)
+
+const (
+	AccountEcash          = "assets:ecash"
+	AccountUploadIncome   = "income:upload"
+	AccountDownloadIncome = "income:download"
+	AccountSwapFees       = "expenses:swap_fees"
+)
+
+// LedgerEntry moves Amount sats from the credit account to the debit account.
+// Payments debit the ecash we hold and credit an income account, swap fees go the other way
+type LedgerEntry struct {
+	Id            uint64 `json:"id" db:"id"`
+	CreatedAt     uint64 `json:"created_at" db:"created_at"`
+	Operation     string `json:"operation" db:"operation"`
+	Sha256        string `json:"sha256,omitempty" db:"sha256"`
+	Pubkey        string `json:"pubkey,omitempty" db:"pubkey"`
+	Mint          string `json:"mint,omitempty" db:"mint"`
+	DebitAccount  string `json:"debit_account" db:"debit_account"`
+	CreditAccount string `json:"credit_account" db:"credit_account"`
+	Amount        uint64 `json:"amount" db:"amount"`
+}
+
+const (
+	ReportPending   = "pending"
+	ReportDismissed = "dismissed"
+	ReportBlocked   = "blocked"
+)
+
+// BlobReport is one blob of a NIP-56 report event. An event that reports many blobs gives many rows
+type BlobReport struct {
+	Id         uint64 `json:"id" db:"id"`
+	EventId    string `json:"event_id" db:"event_id"`
+	Sha256     string `json:"sha256" db:"sha256"`
+	Reporter   string `json:"reporter" db:"reporter"`
+	ReportType string `json:"report_type" db:"report_type"`
+	Content    string `json:"content" db:"content"`
+	CreatedAt  uint64 `json:"created_at" db:"created_at"`
+	Status     string `json:"status" db:"status"`
+	ReviewedAt uint64 `json:"reviewed_at" db:"reviewed_at"`
+}
+
+// blobs that can't be uploaded or downloaded again
+type BlockedBlob struct {
+	Sha256    string `json:"sha256" db:"sha256"`
+	Reason    string `json:"reason" db:"reason"`
+	CreatedAt uint64 `json:"created_at" db:"created_at"`
+}
+
+// pubkeys that can't upload or download
+type BlockedPubkey struct {
+	Pubkey    string `json:"pubkey" db:"pubkey"`
+	Reason    string `json:"reason" db:"reason"`
+	CreatedAt uint64 `json:"created_at" db:"created_at"`
+}
+
+const (
+	AuditBlock   = "block"
+	AuditUnblock = "unblock"
+)
+
+const (
+	BlocklistSha256 = "sha256"
+	BlocklistPubkey = "pubkey"
+)
+
+// BlocklistAudit records every change of the blocklist and who made it
+type BlocklistAudit struct {
+	Id         uint64 `json:"id" db:"id"`
+	Action     string `json:"action" db:"action"`
+	TargetType string `json:"target_type" db:"target_type"`
+	Target     string `json:"target" db:"target"`
+	Reason     string `json:"reason" db:"reason"`
+	Actor      string `json:"actor" db:"actor"`
+	CreatedAt  uint64 `json:"created_at" db:"created_at"`
+}
+
 type Database interface {
-	BeginTransaction() (*sql.Tx, error)
-	GetBlob(hash []byte) (blossom.DBBlobData, error)
-	GetBlobLength(hash []byte) (uint64, error)
+	BeginTransaction(ctx context.Context) (*sql.Tx, error)
+	Close() error
+	GetBlob(ctx context.Context, hash []byte) (blossom.DBBlobData, error)
+	GetBlobLength(ctx context.Context, hash []byte) (uint64, error)
+
+	// AddBlob and RemoveBlob keep the usage of the uploader updated
+	AddBlob(ctx context.Context, tx *sql.Tx, data blossom.DBBlobData) error
+	RemoveBlob(ctx context.Context, tx *sql.Tx, hash []byte) (blossom.DBBlobData, error)
+	GetUsage(ctx context.Context, tx *sql.Tx, pubkey string) (PubkeyUsage, error)
+	GetStorageStats(ctx context.Context, tx *sql.Tx) (StorageStats, error)
+	// ListBlobs only fills sha256, size, path and created_at
+	ListBlobs(ctx context.Context, tx *sql.Tx) ([]blossom.DBBlobData, error)
+	UpdateBlobPath(ctx context.Context, tx *sql.Tx, hash []byte, path string) error
+
+	SetBlobHealth(ctx context.Context, tx *sql.Tx, health BlobHealth) error
+	// returns every blob that did not pass the last check
+	GetBlobHealthProblems(ctx context.Context, tx *sql.Tx) ([]BlobHealth, error)
+	// removes results of blobs that were not seen since checkedBefore
+	RemoveStaleBlobHealth(ctx context.Context, tx *sql.Tx, checkedBefore uint64) error
+
+	// adds downloads to the count of the blob
+	RecordBlobAccess(ctx context.Context, tx *sql.Tx, key string, size uint64, downloads uint64, now uint64) error
+	// most downloaded first, ties are broken by the most recent download
+	GetBlobAccessRanking(ctx context.Context, tx *sql.Tx) ([]BlobAccess, error)
+	SetBlobHot(ctx context.Context, tx *sql.Tx, key string, hot bool) error
 
-	AddBlob(tx *sql.Tx, data blossom.DBBlobData) error
-	// RemoveBlob(data blossom.StoredData) error
+	AddLedgerEntry(ctx context.Context, tx *sql.Tx, entry LedgerEntry) error
+	// entries created in [since, until), oldest first
+	GetLedgerEntries(ctx context.Context, tx *sql.Tx, since uint64, until uint64) ([]LedgerEntry, error)
+
+	// a report that was already stored for the same event and blob is ignored
+	AddBlobReport(ctx context.Context, tx *sql.Tx, report BlobReport) error
+	// oldest first. An empty status returns every report
+	GetBlobReports(ctx context.Context, tx *sql.Tx, status string) ([]BlobReport, error)
+	// changes the pending reports of a blob
+	ReviewBlobReports(ctx context.Context, tx *sql.Tx, sha256 string, status string, reviewedAt uint64) error
+
+	BlockBlob(ctx context.Context, tx *sql.Tx, blocked BlockedBlob) error
+	UnblockBlob(ctx context.Context, tx *sql.Tx, sha256 string) error
+	IsBlobBlocked(ctx context.Context, tx *sql.Tx, sha256 string) (bool, error)
+	GetBlockedBlobs(ctx context.Context, tx *sql.Tx) ([]BlockedBlob, error)
+	BlockPubkey(ctx context.Context, tx *sql.Tx, blocked BlockedPubkey) error
+	UnblockPubkey(ctx context.Context, tx *sql.Tx, pubkey string) error
+	IsPubkeyBlocked(ctx context.Context, tx *sql.Tx, pubkey string) (bool, error)
+	// true when at least one pubkey is blocked
+	HasBlockedPubkeys(ctx context.Context, tx *sql.Tx) (bool, error)
+	GetBlockedPubkeys(ctx context.Context, tx *sql.Tx) ([]BlockedPubkey, error)
+	AddBlocklistAudit(ctx context.Context, tx *sql.Tx, audit BlocklistAudit) error
+	// newest first, at most limit entries
+	GetBlocklistAudit(ctx context.Context, tx *sql.Tx, limit uint64) ([]BlocklistAudit, error)
+
+	// upserts a single row, used by the readiness probe to know the database takes writes
+	WriteHealthCheck(ctx context.Context, tx *sql.Tx, checkedAt uint64) error
 
 	// Database actions for proofs
-	AddLockedProofs(tx *sql.Tx, token cashu.Token, pubkey uint, redeemed bool, created_at uint64) error
-	GetLockedProofsByPubkeyVersion(tx *sql.Tx, pubkey uint) (cashu.Proofs, error)
-	GetLockedProofsByC(tx *sql.Tx, Cs []string) (cashu.Proofs, error)
+	// returns ErrProofAlreadyStored when a proof was stored before
+	AddLockedProofs(ctx context.Context, tx *sql.Tx, token cashu.Token, pubkey uint, redeemed bool, created_at uint64) error
+	GetLockedProofsByPubkeyVersion(ctx context.Context, tx *sql.Tx, pubkey uint) (cashu.Proofs, error)
+	GetLockedProofsByC(ctx context.Context, tx *sql.Tx, Cs []string) (cashu.Proofs, error)
 	// should return proofs separated by the mint that they come from
-	GetLockedProofsByRedeemed(tx *sql.Tx, redeemed bool) (map[string][]ProofToSwap, error)
-	ChangeLockedProofsRedeem(tx *sql.Tx, Cs []string, redeem bool) error
+	GetLockedProofsByRedeemed(ctx context.Context, tx *sql.Tx, redeemed bool) (map[string][]ProofToSwap, error)
+	ChangeLockedProofsRedeem(ctx context.Context, tx *sql.Tx, Cs []string, redeem bool) error
 
 	//For proofs that have already been swapped
-	AddProofs(tx *sql.Tx, proofs cashu.Proofs, mint string) error
-	GetBySpentProofs(tx *sql.Tx, spent bool) (map[string]cashu.Proofs, error)
-	ChangeSwappedProofsSpent(tx *sql.Tx, proofs cashu.Proofs, spent bool) error
+	AddProofs(ctx context.Context, tx *sql.Tx, proofs cashu.Proofs, mint string) error
+	GetBySpentProofs(ctx context.Context, tx *sql.Tx, spent bool) (map[string]cashu.Proofs, error)
+	ChangeSwappedProofsSpent(ctx context.Context, tx *sql.Tx, proofs cashu.Proofs, spent bool) error
 
-	AddTrustedMint(tx *sql.Tx, url string) error
-	GetTrustedMints(tx *sql.Tx) ([]string, error)
+	AddTrustedMint(ctx context.Context, tx *sql.Tx, url string) error
+	GetTrustedMints(ctx context.Context, tx *sql.Tx) ([]string, error)
 
 	// take all pubkeys and turn active off and just make a new one
-	RotateNewPubkey(tx *sql.Tx, expiration int64) (CurrentPubkey, error)
-	GetActivePubkey(tx *sql.Tx) (CurrentPubkey, error)
+	RotateNewPubkey(ctx context.Context, tx *sql.Tx, expiration int64) (CurrentPubkey, error)
+	GetActivePubkey(ctx context.Context, tx *sql.Tx) (CurrentPubkey, error)
+
+	GetKeysetCounter(ctx context.Context, tx *sql.Tx, id string) (KeysetCounter, error)
+	SetKeysetCounter(ctx context.Context, tx *sql.Tx, counter KeysetCounter) error
+	ModifyKeysetCounter(ctx context.Context, tx *sql.Tx, counter KeysetCounter) error
 
-	GetKeysetCounter(tx *sql.Tx, id string) (KeysetCounter, error)
-	SetKeysetCounter(tx *sql.Tx, counter KeysetCounter) error
-	ModifyKeysetCounter(tx *sql.Tx, counter KeysetCounter) error
+	// bytes used for free by a pubkey in a month. month format: 2006-01
+	GetFreeUsage(ctx context.Context, tx *sql.Tx, pubkey string, month string) (uint64, error)
+	AddFreeUsage(ctx context.Context, tx *sql.Tx, pubkey string, month string, bytes uint64) error
 }
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS ledger(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at INTEGER NOT NULL,
+    operation TEXT NOT NULL,
+    sha256 TEXT NOT NULL DEFAULT '',
+    pubkey TEXT NOT NULL DEFAULT '',
+    mint TEXT NOT NULL DEFAULT '',
+    debit_account TEXT NOT NULL,
+    credit_account TEXT NOT NULL,
+    amount INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ledger_created_at ON ledger(created_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS ledger_created_at;
+DROP TABLE IF EXISTS ledger;
@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS health_check(
+    id INTEGER PRIMARY KEY,
+    checked_at INTEGER NOT NULL
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS health_check;
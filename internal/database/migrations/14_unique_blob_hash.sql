@@ -0,0 +1,13 @@
+-- +goose Up
+-- concurrent uploads of the same blob could store it twice. Keep the first row and count the usage again
+DELETE FROM blobs WHERE rowid NOT IN (SELECT MIN(rowid) FROM blobs GROUP BY sha256);
+
+UPDATE pubkey_usage SET
+    total_bytes = (SELECT COALESCE(SUM(size), 0) FROM blobs WHERE blobs.pubkey = pubkey_usage.pubkey),
+    blob_count = (SELECT COUNT(*) FROM blobs WHERE blobs.pubkey = pubkey_usage.pubkey);
+
+CREATE UNIQUE INDEX IF NOT EXISTS blobs_sha256 ON blobs(sha256);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS blobs_sha256;
@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS free_usage(
+    pubkey TEXT NOT NULL,
+    month TEXT NOT NULL,
+    bytes INTEGER NOT NULL,
+    PRIMARY KEY (pubkey, month)
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS free_usage;
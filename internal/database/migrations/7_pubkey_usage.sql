@@ -0,0 +1,20 @@
+-- +goose Up
+ALTER TABLE blobs ADD paid_sats INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS pubkey_usage(
+    pubkey TEXT PRIMARY KEY,
+    total_bytes INTEGER NOT NULL,
+    blob_count INTEGER NOT NULL,
+    total_sats INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+INSERT INTO pubkey_usage (pubkey, total_bytes, blob_count, total_sats, updated_at)
+SELECT pubkey, SUM(size), COUNT(*), 0, strftime('%s', 'now') FROM blobs
+WHERE pubkey IS NOT NULL AND pubkey != ''
+GROUP BY pubkey;
+
+
+-- +goose Down
+DROP TABLE IF EXISTS pubkey_usage;
+ALTER TABLE blobs DROP COLUMN paid_sats;
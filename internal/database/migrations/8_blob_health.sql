@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS blob_health(
+    blob_key TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    checked_at INTEGER NOT NULL
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS blob_health;
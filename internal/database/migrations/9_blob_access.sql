@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS blob_access(
+    blob_key TEXT PRIMARY KEY,
+    size INTEGER NOT NULL,
+    downloads INTEGER NOT NULL,
+    last_access INTEGER NOT NULL,
+    hot BOOL NOT NULL DEFAULT FALSE
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS blob_access;
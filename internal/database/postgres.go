@@ -0,0 +1,769 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"ratasker/external/blossom"
+	"strings"
+	"time"
+
+	"github.com/elnosh/gonuts/cashu"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+)
+
+// PostgresDB lets several ratasker instances share one database.
+// Proofs are locked with FOR UPDATE SKIP LOCKED while they are swapped or spent so two instances never take the same ones,
+// and the unique constraints on locked_proofs stop the same proof from being accepted twice.
+type PostgresDB struct {
+	Db *sql.DB
+}
+
+//go:embed postgres_migrations/*.sql
+var EmbedPostgresMigrations embed.FS
+
+func PostgresSetup(ctx context.Context, dsn string, embedMigrations embed.FS) (PostgresDB, error) {
+	var postgresdb PostgresDB
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return postgresdb, fmt.Errorf(`sql.Open("pgx", dsn). %w`, err)
+	}
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return postgresdb, fmt.Errorf(`db.PingContext(ctx). %w`, err)
+	}
+
+	goose.SetBaseFS(embedMigrations)
+	err = goose.SetDialect("postgres")
+	if err != nil {
+		db.Close()
+		return postgresdb, fmt.Errorf(`goose.SetDialect("postgres"). %w`, err)
+	}
+
+	err = goose.Up(db, "postgres_migrations")
+	if err != nil {
+		db.Close()
+		return postgresdb, fmt.Errorf(`goose.Up(db, "postgres_migrations"). %w`, err)
+	}
+
+	postgresdb.Db = db
+	return postgresdb, nil
+}
+
+func (pg PostgresDB) Close() error {
+	return pg.Db.Close()
+}
+
+func (pg PostgresDB) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := pg.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("pg.Db.BeginTx(ctx, nil). %w", err)
+	}
+
+	return tx, nil
+}
+
+func (pg PostgresDB) AddBlob(ctx context.Context, tx *sql.Tx, data blossom.DBBlobData) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO blobs (sha256, size, path, created_at, pubkey, content_type, paid_sats) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		data.Sha256, data.Data.Size, data.Path, data.CreatedAt, data.Pubkey, data.Data.Type, data.PaidSats)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blobs (sha256, ). %w`, err)
+	}
+
+	// anonymous uploads are not tracked
+	if data.Pubkey == "" {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO pubkey_usage (pubkey, total_bytes, blob_count, total_sats, updated_at) VALUES ($1, $2, 1, $3, $4)
+	ON CONFLICT(pubkey) DO UPDATE SET
+		total_bytes = pubkey_usage.total_bytes + excluded.total_bytes,
+		blob_count = pubkey_usage.blob_count + 1,
+		total_sats = pubkey_usage.total_sats + excluded.total_sats,
+		updated_at = excluded.updated_at`, data.Pubkey, data.Data.Size, data.PaidSats, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO pubkey_usage). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) RemoveBlob(ctx context.Context, tx *sql.Tx, hash []byte) (blossom.DBBlobData, error) {
+	blobData := blossom.DBBlobData{}
+	var pubkey sql.NullString
+	var contentType sql.NullString
+
+	err := tx.QueryRowContext(ctx, "DELETE FROM blobs WHERE sha256 = $1 RETURNING sha256, size, path, created_at, pubkey, content_type, paid_sats", hash).Scan(&blobData.Sha256, &blobData.Data.Size, &blobData.Path, &blobData.CreatedAt, &pubkey, &contentType, &blobData.PaidSats)
+	if err != nil {
+		return blobData, fmt.Errorf(`tx.QueryRowContext(ctx, "DELETE FROM blobs WHERE sha256 = $1 RETURNING). %w`, err)
+	}
+	blobData.Pubkey = pubkey.String
+	blobData.Data.Type = contentType.String
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM blob_access WHERE blob_key = encode($1, 'hex')", hash)
+	if err != nil {
+		return blobData, fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blob_access). %w`, err)
+	}
+
+	if blobData.Pubkey == "" {
+		return blobData, nil
+	}
+
+	// paid sats are kept because they were already paid
+	_, err = tx.ExecContext(ctx, `UPDATE pubkey_usage SET
+		total_bytes = GREATEST(total_bytes - $1, 0),
+		blob_count = GREATEST(blob_count - 1, 0),
+		updated_at = $2
+		WHERE pubkey = $3`, blobData.Data.Size, time.Now().Unix(), blobData.Pubkey)
+	if err != nil {
+		return blobData, fmt.Errorf(`tx.ExecContext(ctx, "UPDATE pubkey_usage). %w`, err)
+	}
+
+	return blobData, nil
+}
+
+func (pg PostgresDB) GetUsage(ctx context.Context, tx *sql.Tx, pubkey string) (PubkeyUsage, error) {
+	usage := PubkeyUsage{Pubkey: pubkey}
+
+	err := tx.QueryRowContext(ctx, "SELECT total_bytes, blob_count, total_sats, updated_at FROM pubkey_usage WHERE pubkey = $1", pubkey).Scan(&usage.TotalBytes, &usage.BlobCount, &usage.TotalSats, &usage.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return usage, nil
+		}
+		return usage, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT total_bytes, blob_count FROM pubkey_usage). %w`, err)
+	}
+
+	return usage, nil
+}
+
+func (pg PostgresDB) GetStorageStats(ctx context.Context, tx *sql.Tx) (StorageStats, error) {
+	var stats StorageStats
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").Scan(&stats.BlobCount, &stats.StoredBytes)
+	if err != nil {
+		return stats, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM blobs"). %w`, err)
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM locked_proofs WHERE redeemed = FALSE").Scan(&stats.UnswappedProofs, &stats.UnswappedSats)
+	if err != nil {
+		return stats, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM locked_proofs"). %w`, err)
+	}
+	return stats, nil
+}
+
+func (pg PostgresDB) ListBlobs(ctx context.Context, tx *sql.Tx) ([]blossom.DBBlobData, error) {
+	blobs := []blossom.DBBlobData{}
+	rows, err := tx.QueryContext(ctx, "SELECT sha256, size, path, created_at FROM blobs ORDER BY created_at")
+	if err != nil {
+		return blobs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT sha256, size, path, created_at FROM blobs"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blob blossom.DBBlobData
+		err = rows.Scan(&blob.Sha256, &blob.Data.Size, &blob.Path, &blob.CreatedAt)
+		if err != nil {
+			return blobs, fmt.Errorf(`rows.Scan(&blob.Sha256, &blob.Data.Size, &blob.Path, &blob.CreatedAt). %w`, err)
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+func (pg PostgresDB) UpdateBlobPath(ctx context.Context, tx *sql.Tx, hash []byte, path string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blobs SET path = $1 WHERE sha256 = $2", path, hash)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE blobs SET path = $1"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) SetBlobHealth(ctx context.Context, tx *sql.Tx, health BlobHealth) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blob_health (blob_key, status, detail, checked_at) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(blob_key) DO UPDATE SET
+		status = excluded.status,
+		detail = excluded.detail,
+		checked_at = excluded.checked_at`, health.Key, health.Status, health.Detail, health.CheckedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blob_health). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetBlobHealthProblems(ctx context.Context, tx *sql.Tx) ([]BlobHealth, error) {
+	problems := []BlobHealth{}
+	rows, err := tx.QueryContext(ctx, "SELECT blob_key, status, detail, checked_at FROM blob_health WHERE status != $1 ORDER BY checked_at", BlobHealthOk)
+	if err != nil {
+		return problems, fmt.Errorf(`tx.QueryContext(ctx, "SELECT blob_key, status FROM blob_health"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var health BlobHealth
+		err = rows.Scan(&health.Key, &health.Status, &health.Detail, &health.CheckedAt)
+		if err != nil {
+			return problems, fmt.Errorf(`rows.Scan(&health.Key, &health.Status, &health.Detail, &health.CheckedAt). %w`, err)
+		}
+		problems = append(problems, health)
+	}
+	return problems, rows.Err()
+}
+
+func (pg PostgresDB) RemoveStaleBlobHealth(ctx context.Context, tx *sql.Tx, checkedBefore uint64) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM blob_health WHERE checked_at < $1", checkedBefore)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blob_health"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) RecordBlobAccess(ctx context.Context, tx *sql.Tx, key string, size uint64, downloads uint64, now uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blob_access (blob_key, size, downloads, last_access) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(blob_key) DO UPDATE SET
+		size = excluded.size,
+		downloads = blob_access.downloads + excluded.downloads,
+		last_access = excluded.last_access`, key, size, downloads, now)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blob_access). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetBlobAccessRanking(ctx context.Context, tx *sql.Tx) ([]BlobAccess, error) {
+	ranking := []BlobAccess{}
+	rows, err := tx.QueryContext(ctx, "SELECT blob_key, size, downloads, last_access, hot FROM blob_access ORDER BY downloads DESC, last_access DESC")
+	if err != nil {
+		return ranking, fmt.Errorf(`tx.QueryContext(ctx, "SELECT blob_key FROM blob_access"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var access BlobAccess
+		err = rows.Scan(&access.Key, &access.Size, &access.Downloads, &access.LastAccess, &access.Hot)
+		if err != nil {
+			return ranking, fmt.Errorf(`rows.Scan(&access.Key, &access.Size, &access.Downloads, &access.LastAccess, &access.Hot). %w`, err)
+		}
+		ranking = append(ranking, access)
+	}
+	return ranking, rows.Err()
+}
+
+func (pg PostgresDB) SetBlobHot(ctx context.Context, tx *sql.Tx, key string, hot bool) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blob_access SET hot = $1 WHERE blob_key = $2", hot, key)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE blob_access SET hot = $1"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) AddLedgerEntry(ctx context.Context, tx *sql.Tx, entry LedgerEntry) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO ledger (created_at, operation, sha256, pubkey, mint, debit_account, credit_account, amount)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, entry.CreatedAt, entry.Operation, entry.Sha256, entry.Pubkey, entry.Mint, entry.DebitAccount, entry.CreditAccount, entry.Amount)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO ledger"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetLedgerEntries(ctx context.Context, tx *sql.Tx, since uint64, until uint64) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	rows, err := tx.QueryContext(ctx, `SELECT id, created_at, operation, sha256, pubkey, mint, debit_account, credit_account, amount FROM ledger
+	WHERE created_at >= $1 AND created_at < $2 ORDER BY created_at, id`, since, until)
+	if err != nil {
+		return entries, fmt.Errorf(`tx.QueryContext(ctx, "SELECT id FROM ledger"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry LedgerEntry
+		err = rows.Scan(&entry.Id, &entry.CreatedAt, &entry.Operation, &entry.Sha256, &entry.Pubkey, &entry.Mint, &entry.DebitAccount, &entry.CreditAccount, &entry.Amount)
+		if err != nil {
+			return entries, fmt.Errorf(`rows.Scan(&entry.Id, &entry.CreatedAt, &entry.Operation). %w`, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (pg PostgresDB) AddBlobReport(ctx context.Context, tx *sql.Tx, report BlobReport) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blob_reports (event_id, sha256, reporter, report_type, content, created_at, status)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT(event_id, sha256) DO NOTHING`, report.EventId, report.Sha256, report.Reporter, report.ReportType, report.Content, report.CreatedAt, ReportPending)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blob_reports"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetBlobReports(ctx context.Context, tx *sql.Tx, status string) ([]BlobReport, error) {
+	reports := []BlobReport{}
+	rows, err := tx.QueryContext(ctx, `SELECT id, event_id, sha256, reporter, report_type, content, created_at, status, reviewed_at FROM blob_reports
+	WHERE $1 = '' OR status = $2 ORDER BY created_at, id`, status, status)
+	if err != nil {
+		return reports, fmt.Errorf(`tx.QueryContext(ctx, "SELECT id FROM blob_reports"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var report BlobReport
+		err = rows.Scan(&report.Id, &report.EventId, &report.Sha256, &report.Reporter, &report.ReportType, &report.Content, &report.CreatedAt, &report.Status, &report.ReviewedAt)
+		if err != nil {
+			return reports, fmt.Errorf(`rows.Scan(&report.Id, &report.EventId, &report.Sha256). %w`, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (pg PostgresDB) ReviewBlobReports(ctx context.Context, tx *sql.Tx, sha256 string, status string, reviewedAt uint64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blob_reports SET status = $1, reviewed_at = $2 WHERE sha256 = $3 AND status = $4", status, reviewedAt, sha256, ReportPending)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE blob_reports SET status"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) BlockBlob(ctx context.Context, tx *sql.Tx, blocked BlockedBlob) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blocked_blobs (sha256, reason, created_at) VALUES ($1, $2, $3)
+	ON CONFLICT(sha256) DO UPDATE SET reason = excluded.reason`, blocked.Sha256, blocked.Reason, blocked.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blocked_blobs"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) UnblockBlob(ctx context.Context, tx *sql.Tx, sha256 string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM blocked_blobs WHERE sha256 = $1", sha256)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blocked_blobs"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) IsBlobBlocked(ctx context.Context, tx *sql.Tx, sha256 string) (bool, error) {
+	var blocked bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_blobs WHERE sha256 = $1)", sha256).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT EXISTS blocked_blobs"). %w`, err)
+	}
+	return blocked, nil
+}
+
+func (pg PostgresDB) GetBlockedBlobs(ctx context.Context, tx *sql.Tx) ([]BlockedBlob, error) {
+	blockedBlobs := []BlockedBlob{}
+	rows, err := tx.QueryContext(ctx, "SELECT sha256, reason, created_at FROM blocked_blobs ORDER BY created_at, sha256")
+	if err != nil {
+		return blockedBlobs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT sha256 FROM blocked_blobs"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blocked BlockedBlob
+		err = rows.Scan(&blocked.Sha256, &blocked.Reason, &blocked.CreatedAt)
+		if err != nil {
+			return blockedBlobs, fmt.Errorf(`rows.Scan(&blocked.Sha256, &blocked.Reason, &blocked.CreatedAt). %w`, err)
+		}
+		blockedBlobs = append(blockedBlobs, blocked)
+	}
+	return blockedBlobs, rows.Err()
+}
+
+func (pg PostgresDB) BlockPubkey(ctx context.Context, tx *sql.Tx, blocked BlockedPubkey) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blocked_pubkeys (pubkey, reason, created_at) VALUES ($1, $2, $3)
+	ON CONFLICT(pubkey) DO UPDATE SET reason = excluded.reason`, blocked.Pubkey, blocked.Reason, blocked.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blocked_pubkeys"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) UnblockPubkey(ctx context.Context, tx *sql.Tx, pubkey string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM blocked_pubkeys WHERE pubkey = $1", pubkey)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blocked_pubkeys"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) IsPubkeyBlocked(ctx context.Context, tx *sql.Tx, pubkey string) (bool, error) {
+	var blocked bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_pubkeys WHERE pubkey = $1)", pubkey).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT EXISTS blocked_pubkeys"). %w`, err)
+	}
+	return blocked, nil
+}
+
+func (pg PostgresDB) HasBlockedPubkeys(ctx context.Context, tx *sql.Tx) (bool, error) {
+	var blocked bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_pubkeys)").Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT EXISTS blocked_pubkeys"). %w`, err)
+	}
+	return blocked, nil
+}
+
+func (pg PostgresDB) GetBlockedPubkeys(ctx context.Context, tx *sql.Tx) ([]BlockedPubkey, error) {
+	blockedPubkeys := []BlockedPubkey{}
+	rows, err := tx.QueryContext(ctx, "SELECT pubkey, reason, created_at FROM blocked_pubkeys ORDER BY created_at, pubkey")
+	if err != nil {
+		return blockedPubkeys, fmt.Errorf(`tx.QueryContext(ctx, "SELECT pubkey FROM blocked_pubkeys"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blocked BlockedPubkey
+		err = rows.Scan(&blocked.Pubkey, &blocked.Reason, &blocked.CreatedAt)
+		if err != nil {
+			return blockedPubkeys, fmt.Errorf(`rows.Scan(&blocked.Pubkey, &blocked.Reason, &blocked.CreatedAt). %w`, err)
+		}
+		blockedPubkeys = append(blockedPubkeys, blocked)
+	}
+	return blockedPubkeys, rows.Err()
+}
+
+func (pg PostgresDB) AddBlocklistAudit(ctx context.Context, tx *sql.Tx, audit BlocklistAudit) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blocklist_audit (action, target_type, target, reason, actor, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		audit.Action, audit.TargetType, audit.Target, audit.Reason, audit.Actor, audit.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blocklist_audit"). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetBlocklistAudit(ctx context.Context, tx *sql.Tx, limit uint64) ([]BlocklistAudit, error) {
+	audits := []BlocklistAudit{}
+	rows, err := tx.QueryContext(ctx, "SELECT id, action, target_type, target, reason, actor, created_at FROM blocklist_audit ORDER BY id DESC LIMIT $1", limit)
+	if err != nil {
+		return audits, fmt.Errorf(`tx.QueryContext(ctx, "SELECT FROM blocklist_audit"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var audit BlocklistAudit
+		err = rows.Scan(&audit.Id, &audit.Action, &audit.TargetType, &audit.Target, &audit.Reason, &audit.Actor, &audit.CreatedAt)
+		if err != nil {
+			return audits, fmt.Errorf(`rows.Scan(&audit). %w`, err)
+		}
+		audits = append(audits, audit)
+	}
+	return audits, rows.Err()
+}
+
+func (pg PostgresDB) WriteHealthCheck(ctx context.Context, tx *sql.Tx, checkedAt uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO health_check (id, checked_at) VALUES (1, $1)
+	ON CONFLICT(id) DO UPDATE SET checked_at = excluded.checked_at`, checkedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO health_check). %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetBlob(ctx context.Context, hash []byte) (blossom.DBBlobData, error) {
+	blobData := blossom.DBBlobData{}
+	var pubkey sql.NullString
+	var contentType sql.NullString
+
+	err := pg.Db.QueryRowContext(ctx, "SELECT sha256, size, path, created_at, pubkey, content_type, paid_sats FROM blobs WHERE sha256 = $1", hash).Scan(&blobData.Sha256, &blobData.Data.Size, &blobData.Path, &blobData.CreatedAt, &pubkey, &contentType, &blobData.PaidSats)
+	if err != nil {
+		return blobData, fmt.Errorf("pg.Db.QueryRowContext(ctx, hash).Scan %w", err)
+	}
+	blobData.Pubkey = pubkey.String
+	blobData.Data.Type = contentType.String
+
+	return blobData, nil
+}
+
+func (pg PostgresDB) GetBlobLength(ctx context.Context, hash []byte) (uint64, error) {
+	var length uint64 = 0
+
+	err := pg.Db.QueryRowContext(ctx, "SELECT size FROM blobs WHERE sha256 = $1", hash).Scan(&length)
+	if err != nil {
+		return length, fmt.Errorf(`pg.Db.QueryRowContext(ctx, "SELECT size FROM blobs WHERE sha256 = $1", hash). %w`, err)
+	}
+	return length, nil
+}
+
+func (pg PostgresDB) AddLockedProofs(ctx context.Context, tx *sql.Tx, token cashu.Token, pubkey_version uint, redeemed bool, created_at uint64) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO locked_proofs (amount, id, secret, C, witness, redeemed, created_at, pubkey_version, mint) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)")
+	if err != nil {
+		return fmt.Errorf(`tx.PrepareContext(ctx, "INSERT INTO locked_proofs (amount, id, s. %w`, err)
+	}
+	defer stmt.Close()
+
+	for _, proof := range token.Proofs() {
+		_, err = stmt.ExecContext(ctx, proof.Amount, proof.Id, proof.Secret, proof.C, proof.Witness, redeemed, created_at, pubkey_version, token.Mint())
+		// a concurrent request can store the same proof after it was checked
+		if IsUniqueViolation(err) {
+			return fmt.Errorf("stmt.ExecContext(ctx): %w. %w", err, ErrProofAlreadyStored)
+		}
+		if err != nil {
+			return fmt.Errorf("stmt.ExecContext(ctx): %w", err)
+		}
+	}
+	return nil
+}
+
+func (pg PostgresDB) GetLockedProofsByPubkeyVersion(ctx context.Context, tx *sql.Tx, pubkey uint) (cashu.Proofs, error) {
+	var proofs cashu.Proofs
+
+	rows, err := tx.QueryContext(ctx, "SELECT amount, id, secret, C, witness FROM locked_proofs WHERE pubkey_version = $1", pubkey)
+	if err != nil {
+		return proofs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT amount, id, secret, C, witness FROM locked_proofs. %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p cashu.Proof
+		err = rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness)
+		if err != nil {
+			return proofs, fmt.Errorf(`rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness) %w`, err)
+		}
+
+		proofs = append(proofs, p)
+	}
+
+	return proofs, nil
+}
+
+// GetLockedProofsByRedeemed locks the rows until the transaction ends. Rows locked by another instance are skipped
+func (pg PostgresDB) GetLockedProofsByRedeemed(ctx context.Context, tx *sql.Tx, redeemed bool) (map[string][]ProofToSwap, error) {
+	proofs := make(map[string][]ProofToSwap)
+
+	rows, err := tx.QueryContext(ctx, "SELECT amount, id, secret, C, witness, mint, pubkey_version FROM locked_proofs WHERE redeemed = $1 FOR UPDATE SKIP LOCKED", redeemed)
+	if err != nil {
+		return proofs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT amount, id, secret, C. %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p cashu.Proof
+		var pubkey_version uint64
+		var mint string
+		err = rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness, &mint, &pubkey_version)
+		if err != nil {
+			return proofs, fmt.Errorf(`rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness, &mint) %w`, err)
+		}
+
+		proofs[mint] = append(proofs[mint], ProofToSwap{
+			Proof:         p,
+			PubkeyVersion: pubkey_version,
+		})
+	}
+
+	return proofs, nil
+}
+
+func (pg PostgresDB) GetLockedProofsByC(ctx context.Context, tx *sql.Tx, Cs []string) (cashu.Proofs, error) {
+	var proofs cashu.Proofs
+
+	placeholders := make([]string, len(Cs))
+	args := make([]interface{}, len(Cs))
+	for i, v := range Cs {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = v
+	}
+
+	query := fmt.Sprintf(
+		"SELECT amount, id, secret, C, witness FROM locked_proofs WHERE C IN (%s)",
+		strings.Join(placeholders, ","),
+	)
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return proofs, fmt.Errorf(`tx.QueryContext(ctx, query, args...). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p cashu.Proof
+		err = rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness)
+		if err != nil {
+			return proofs, fmt.Errorf(`rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness) %w`, err)
+		}
+
+		proofs = append(proofs, p)
+	}
+
+	return proofs, nil
+}
+
+func (pg PostgresDB) ChangeLockedProofsRedeem(ctx context.Context, tx *sql.Tx, Cs []string, redeem bool) error {
+	for i := 0; i < len(Cs); i++ {
+		_, err := tx.ExecContext(ctx, "UPDATE locked_proofs SET redeemed = $1 WHERE C = $2", redeem, Cs[i])
+		if err != nil {
+			return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE locked_proofs SET redeemed = $1"). %w`, err)
+		}
+	}
+
+	return nil
+}
+
+func (pg PostgresDB) RotateNewPubkey(ctx context.Context, tx *sql.Tx, expiration int64) (CurrentPubkey, error) {
+	var currentPubkey CurrentPubkey
+
+	// only one instance rotates at a time
+	_, err := tx.ExecContext(ctx, "LOCK TABLE cashu_pubkey IN EXCLUSIVE MODE")
+	if err != nil {
+		return currentPubkey, fmt.Errorf(`tx.ExecContext(ctx, "LOCK TABLE cashu_pubkey") %w`, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE cashu_pubkey SET active = false WHERE active = true")
+	if err != nil {
+		return currentPubkey, fmt.Errorf(`tx.ExecContext(ctx, "UPDATE cashu_pubkey SET active = false") %w`, err)
+	}
+
+	err = tx.QueryRowContext(ctx, "INSERT INTO cashu_pubkey (created_at, active) VALUES ($1, true) RETURNING version, created_at", expiration).Scan(&currentPubkey.VersionNum, &currentPubkey.Expiration)
+	if err != nil {
+		return currentPubkey, fmt.Errorf(`tx.QueryRowContext(ctx, "INSERT INTO cashu_pubkey", expiration) %w`, err)
+	}
+
+	return currentPubkey, nil
+}
+
+func (pg PostgresDB) GetActivePubkey(ctx context.Context, tx *sql.Tx) (CurrentPubkey, error) {
+	var currentPubkey CurrentPubkey
+
+	err := tx.QueryRowContext(ctx, "SELECT version, created_at FROM cashu_pubkey WHERE active = true").Scan(&currentPubkey.VersionNum, &currentPubkey.Expiration)
+	if err != nil {
+		return currentPubkey, fmt.Errorf("tx.QueryRowContext(ctx, active pubkey).Scan %w", err)
+	}
+
+	return currentPubkey, nil
+}
+
+func (pg PostgresDB) GetTrustedMints(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	var mints []string
+
+	rows, err := tx.QueryContext(ctx, "SELECT url FROM trusted_mints")
+	if err != nil {
+		return mints, fmt.Errorf("SELECT url FROM trusted_mints %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url string = ""
+		err = rows.Scan(&url)
+		if err != nil {
+			return mints, fmt.Errorf(`rows.Scan(&url) %w`, err)
+		}
+
+		mints = append(mints, url)
+	}
+
+	return mints, nil
+}
+
+func (pg PostgresDB) AddTrustedMint(ctx context.Context, tx *sql.Tx, url string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO trusted_mints (url, created_at) VALUES ($1, $2)", url, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO trusted_mints") %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) SetKeysetCounter(ctx context.Context, tx *sql.Tx, counter KeysetCounter) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO counter_table (keyset_id, counter) VALUES ($1, $2)", counter.KeysetId, counter.Counter)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO counter_table") %w`, err)
+	}
+	return nil
+}
+
+// GetKeysetCounter locks the counter so two instances never make the same blinded messages
+func (pg PostgresDB) GetKeysetCounter(ctx context.Context, tx *sql.Tx, id string) (KeysetCounter, error) {
+	var counter KeysetCounter
+
+	err := tx.QueryRowContext(ctx, "SELECT keyset_id, counter FROM counter_table WHERE keyset_id = $1 FOR UPDATE", id).Scan(&counter.KeysetId, &counter.Counter)
+	if err != nil {
+		return counter, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT keyset_id, counter FROM counter_table").Scan %w`, err)
+	}
+
+	return counter, nil
+}
+
+func (pg PostgresDB) ModifyKeysetCounter(ctx context.Context, tx *sql.Tx, counter KeysetCounter) error {
+	_, err := tx.ExecContext(ctx, "UPDATE counter_table SET counter = $1 WHERE keyset_id = $2", counter.Counter, counter.KeysetId)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE counter_table SET counter") %w`, err)
+	}
+	return nil
+}
+
+func (pg PostgresDB) AddProofs(ctx context.Context, tx *sql.Tx, proofs cashu.Proofs, mint string) error {
+	now := time.Now().Unix()
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO swapped_proofs (amount, id, secret, C, witness, spent, created_at, mint) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
+	if err != nil {
+		return fmt.Errorf(`tx.PrepareContext(ctx, "INSERT INTO swapped_proofs (amount, id, s. %w`, err)
+	}
+	defer stmt.Close()
+
+	for _, proof := range proofs {
+		_, err = stmt.ExecContext(ctx, proof.Amount, proof.Id, proof.Secret, proof.C, proof.Witness, false, now, mint)
+		if err != nil {
+			return fmt.Errorf("stmt.ExecContext(ctx): %w", err)
+		}
+	}
+	return nil
+}
+
+// GetBySpentProofs locks the rows until the transaction ends. Rows locked by another instance are skipped
+func (pg PostgresDB) GetBySpentProofs(ctx context.Context, tx *sql.Tx, spent bool) (map[string]cashu.Proofs, error) {
+	proofs := make(map[string]cashu.Proofs)
+
+	rows, err := tx.QueryContext(ctx, "SELECT amount, id, secret, C, witness, mint FROM swapped_proofs WHERE spent = $1 FOR UPDATE SKIP LOCKED", spent)
+	if err != nil {
+		return proofs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT amount, id, secret, C. %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p cashu.Proof
+		var mint string
+		err = rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness, &mint)
+		if err != nil {
+			return proofs, fmt.Errorf(`rows.Scan(&p.Amount, &p.Id, &p.Secret, &p.C, &p.Witness, &mint) %w`, err)
+		}
+
+		proofs[mint] = append(proofs[mint], p)
+	}
+
+	return proofs, nil
+}
+
+func (pg PostgresDB) ChangeSwappedProofsSpent(ctx context.Context, tx *sql.Tx, proofs cashu.Proofs, spent bool) error {
+	for i := 0; i < len(proofs); i++ {
+		_, err := tx.ExecContext(ctx, "UPDATE swapped_proofs SET spent = $1 WHERE C = $2", spent, proofs[i].C)
+		if err != nil {
+			return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE swapped_proofs SET spent = $1"). %w`, err)
+		}
+	}
+
+	return nil
+}
+
+func (pg PostgresDB) GetFreeUsage(ctx context.Context, tx *sql.Tx, pubkey string, month string) (uint64, error) {
+	var bytes uint64
+
+	err := tx.QueryRowContext(ctx, "SELECT bytes FROM free_usage WHERE pubkey = $1 AND month = $2", pubkey, month).Scan(&bytes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return bytes, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT bytes FROM free_usage). %w`, err)
+	}
+
+	return bytes, nil
+}
+
+func (pg PostgresDB) AddFreeUsage(ctx context.Context, tx *sql.Tx, pubkey string, month string, bytes uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO free_usage (pubkey, month, bytes) VALUES ($1, $2, $3)
+	ON CONFLICT(pubkey, month) DO UPDATE SET bytes = free_usage.bytes + excluded.bytes`, pubkey, month, bytes)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO free_usage (pubkey, month, bytes). %w`, err)
+	}
+	return nil
+}
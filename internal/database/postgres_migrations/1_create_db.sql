@@ -0,0 +1,92 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS blobs(
+    sha256 BYTEA PRIMARY KEY,
+    size BIGINT NOT NULL,
+    path TEXT NOT NULL,
+    created_at BIGINT NOT NULL,
+    pubkey TEXT,
+    content_type TEXT,
+    paid_sats BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS cashu_pubkey(
+    version SERIAL PRIMARY KEY,
+    active BOOL NOT NULL,
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS locked_proofs(
+    amount BIGINT NOT NULL,
+    id TEXT NOT NULL,
+    secret TEXT NOT NULL UNIQUE,
+    C TEXT NOT NULL UNIQUE,
+    witness TEXT,
+    redeemed BOOL NOT NULL,
+    created_at BIGINT NOT NULL,
+    pubkey_version INTEGER NOT NULL REFERENCES cashu_pubkey(version),
+    mint TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS swapped_proofs(
+    amount BIGINT NOT NULL,
+    id TEXT NOT NULL,
+    secret TEXT NOT NULL UNIQUE,
+    C TEXT NOT NULL UNIQUE,
+    witness TEXT,
+    spent BOOL NOT NULL,
+    mint TEXT NOT NULL,
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS trusted_mints(
+    url TEXT PRIMARY KEY,
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS counter_table(
+    keyset_id TEXT PRIMARY KEY,
+    counter BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS free_usage(
+    pubkey TEXT NOT NULL,
+    month TEXT NOT NULL,
+    bytes BIGINT NOT NULL,
+    PRIMARY KEY (pubkey, month)
+);
+
+CREATE TABLE IF NOT EXISTS pubkey_usage(
+    pubkey TEXT PRIMARY KEY,
+    total_bytes BIGINT NOT NULL,
+    blob_count BIGINT NOT NULL,
+    total_sats BIGINT NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS blob_health(
+    blob_key TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    checked_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS blob_access(
+    blob_key TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    downloads BIGINT NOT NULL,
+    last_access BIGINT NOT NULL,
+    hot BOOL NOT NULL DEFAULT FALSE
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS blob_access;
+DROP TABLE IF EXISTS blob_health;
+DROP TABLE IF EXISTS pubkey_usage;
+DROP TABLE IF EXISTS free_usage;
+DROP TABLE IF EXISTS counter_table;
+DROP TABLE IF EXISTS trusted_mints;
+DROP TABLE IF EXISTS swapped_proofs;
+DROP TABLE IF EXISTS locked_proofs;
+DROP TABLE IF EXISTS cashu_pubkey;
+DROP TABLE IF EXISTS blobs;
@@ -0,0 +1,27 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS blob_reports(
+    id BIGSERIAL PRIMARY KEY,
+    event_id TEXT NOT NULL,
+    sha256 TEXT NOT NULL,
+    reporter TEXT NOT NULL,
+    report_type TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    reviewed_at BIGINT NOT NULL DEFAULT 0,
+    UNIQUE(event_id, sha256)
+);
+
+CREATE INDEX IF NOT EXISTS blob_reports_status ON blob_reports(status);
+
+CREATE TABLE IF NOT EXISTS blocked_blobs(
+    sha256 TEXT PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS blocked_blobs;
+DROP INDEX IF EXISTS blob_reports_status;
+DROP TABLE IF EXISTS blob_reports;
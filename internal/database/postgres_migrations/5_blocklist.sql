@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS blocked_pubkeys(
+    pubkey TEXT PRIMARY KEY,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS blocklist_audit(
+    id BIGSERIAL PRIMARY KEY,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    actor TEXT NOT NULL,
+    created_at BIGINT NOT NULL
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS blocklist_audit;
+DROP TABLE IF EXISTS blocked_pubkeys;
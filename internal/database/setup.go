@@ -0,0 +1,30 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const DATABASE_URL = "DATABASE_URL"
+
+// SetupFromDSN connects to Postgres for postgres:// urls. Without a url the SQLite database in the home directory is used
+func SetupFromDSN(ctx context.Context, dsn string, homeDir string) (Database, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		postgres, err := PostgresSetup(ctx, dsn, EmbedPostgresMigrations)
+		if err != nil {
+			return nil, fmt.Errorf("PostgresSetup(ctx, dsn, EmbedPostgresMigrations). %w", err)
+		}
+		return postgres, nil
+	}
+
+	if dsn != "" {
+		return nil, fmt.Errorf("unsupported %v. Only postgres:// urls are supported", DATABASE_URL)
+	}
+
+	sqlite, err := DatabaseSetup(ctx, homeDir, EmbedMigrations)
+	if err != nil {
+		return nil, fmt.Errorf("DatabaseSetup(ctx, homeDir, EmbedMigrations). %w", err)
+	}
+	return sqlite, nil
+}
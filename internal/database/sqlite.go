@@ -4,8 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
-	"log"
 	"ratasker/external/blossom"
 	"strings"
 	"time"
@@ -22,109 +22,500 @@ type SqliteDB struct {
 //go:embed migrations/*.sql
 var EmbedMigrations embed.FS
 
-func (sq SqliteDB) BeginTransaction() (*sql.Tx, error) {
-	// sq.Db.BeginTx
-	tx, err := sq.Db.Begin()
+func (sq SqliteDB) Close() error {
+	return sq.Db.Close()
+}
+
+func (sq SqliteDB) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
+	tx, err := sq.Db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("sq.Db.Begin(). %w", err)
+		return nil, fmt.Errorf("sq.Db.BeginTx(ctx, nil). %w", err)
 	}
 
 	return tx, nil
 }
 
-func (sq SqliteDB) AddBlob(tx *sql.Tx, data blossom.DBBlobData) error {
-	stmt, err := tx.Prepare("INSERT INTO blobs (sha256, size, path, created_at, pubkey, content_type) values (?, ?, ?, ?, ?, ?)")
+func (sq SqliteDB) AddBlob(ctx context.Context, tx *sql.Tx, data blossom.DBBlobData) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO blobs (sha256, size, path, created_at, pubkey, content_type, paid_sats) values (?, ?, ?, ?, ?, ?, ?)")
 
 	if err != nil {
-		return fmt.Errorf(`tx.Exec("INSERT INTO blobs (sha256, ). %w`, err)
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blobs (sha256, ). %w`, err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, data.Sha256, data.Data.Size, data.Path, data.CreatedAt, data.Pubkey, data.Data.Type, data.PaidSats)
+	if err != nil {
+		return fmt.Errorf(`stmt.ExecContext(ctx, data.Sha256, data.Data.Size, data.Path, data.CreatedAt, data.Pubkey, data.Data.Type). %w`, err)
+	}
+
+	// anonymous uploads are not tracked
+	if data.Pubkey == "" {
+		return nil
 	}
-	_, err = stmt.Exec(data.Sha256, data.Data.Size, data.Path, data.CreatedAt, data.Pubkey, data.Data.Type)
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO pubkey_usage (pubkey, total_bytes, blob_count, total_sats, updated_at) VALUES (?, ?, 1, ?, ?)
+	ON CONFLICT(pubkey) DO UPDATE SET
+		total_bytes = total_bytes + excluded.total_bytes,
+		blob_count = blob_count + 1,
+		total_sats = total_sats + excluded.total_sats,
+		updated_at = excluded.updated_at`, data.Pubkey, data.Data.Size, data.PaidSats, time.Now().Unix())
 	if err != nil {
-		return fmt.Errorf(`stmt.Exec(data.Sha256, data.Data.Size, data.Path, data.CreatedAt, data.Pubkey, data.Data.Type). %w`, err)
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO pubkey_usage). %w`, err)
 	}
 	return nil
 
 }
 
-func (sq SqliteDB) GetBlob(hash []byte) (blossom.DBBlobData, error) {
+func (sq SqliteDB) RemoveBlob(ctx context.Context, tx *sql.Tx, hash []byte) (blossom.DBBlobData, error) {
 	blobData := blossom.DBBlobData{}
-	tx, err := sq.Db.Begin()
+	var pubkey sql.NullString
+	var contentType sql.NullString
+
+	err := tx.QueryRowContext(ctx, "SELECT sha256, size, path, created_at, pubkey, content_type, paid_sats FROM blobs WHERE sha256 = ?", hash).Scan(&blobData.Sha256, &blobData.Data.Size, &blobData.Path, &blobData.CreatedAt, &pubkey, &contentType, &blobData.PaidSats)
 	if err != nil {
-		return blobData, fmt.Errorf("sq.Db.Begin(). %w", err)
+		return blobData, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT sha256, size, path FROM blobs). %w`, err)
 	}
+	blobData.Pubkey = pubkey.String
+	blobData.Data.Type = contentType.String
 
-	stmt, err := tx.Prepare("SELECT sha256, size, path, created_at, pubkey, content_type FROM blobs WHERE sha256 = ?")
+	_, err = tx.ExecContext(ctx, "DELETE FROM blobs WHERE sha256 = ?", hash)
 	if err != nil {
-		return blobData, fmt.Errorf("sq.Db.Prepare(). %w", err)
+		return blobData, fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blobs WHERE sha256 = ?", hash). %w`, err)
 	}
-	defer stmt.Close()
 
-	// Create a record to hold the result
-	err = stmt.QueryRow(hash).Scan(&blobData.Sha256, &blobData.Data.Size, &blobData.Path, &blobData.CreatedAt, &blobData.Pubkey, &blobData.Data.Type)
+	_, err = tx.ExecContext(ctx, "DELETE FROM blob_access WHERE blob_key = lower(hex(?))", hash)
 	if err != nil {
-		return blobData, fmt.Errorf("stmt.QueryRow(hash).Scan %w", err)
+		return blobData, fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blob_access). %w`, err)
 	}
 
-	err = tx.Commit()
+	if blobData.Pubkey == "" {
+		return blobData, nil
+	}
+
+	// paid sats are kept because they were already paid
+	_, err = tx.ExecContext(ctx, `UPDATE pubkey_usage SET
+		total_bytes = MAX(total_bytes - ?, 0),
+		blob_count = MAX(blob_count - 1, 0),
+		updated_at = ?
+		WHERE pubkey = ?`, blobData.Data.Size, time.Now().Unix(), blobData.Pubkey)
 	if err != nil {
-		tx.Rollback()
-		return blobData, fmt.Errorf(`tx.Commit(). %w`, err)
+		return blobData, fmt.Errorf(`tx.ExecContext(ctx, "UPDATE pubkey_usage). %w`, err)
 	}
 
 	return blobData, nil
+}
+
+func (sq SqliteDB) GetUsage(ctx context.Context, tx *sql.Tx, pubkey string) (PubkeyUsage, error) {
+	usage := PubkeyUsage{Pubkey: pubkey}
+
+	err := tx.QueryRowContext(ctx, "SELECT total_bytes, blob_count, total_sats, updated_at FROM pubkey_usage WHERE pubkey = ?", pubkey).Scan(&usage.TotalBytes, &usage.BlobCount, &usage.TotalSats, &usage.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return usage, nil
+		}
+		return usage, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT total_bytes, blob_count FROM pubkey_usage). %w`, err)
+	}
 
+	return usage, nil
 }
-func (sq SqliteDB) GetBlobLength(hash []byte) (uint64, error) {
-	var length uint64 = 0
 
-	tx, err := sq.Db.Begin()
+func (sq SqliteDB) GetStorageStats(ctx context.Context, tx *sql.Tx) (StorageStats, error) {
+	var stats StorageStats
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").Scan(&stats.BlobCount, &stats.StoredBytes)
+	if err != nil {
+		return stats, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM blobs"). %w`, err)
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM locked_proofs WHERE redeemed = false").Scan(&stats.UnswappedProofs, &stats.UnswappedSats)
+	if err != nil {
+		return stats, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM locked_proofs"). %w`, err)
+	}
+	return stats, nil
+}
+
+func (sq SqliteDB) ListBlobs(ctx context.Context, tx *sql.Tx) ([]blossom.DBBlobData, error) {
+	blobs := []blossom.DBBlobData{}
+	rows, err := tx.QueryContext(ctx, "SELECT sha256, size, path, created_at FROM blobs ORDER BY created_at")
+	if err != nil {
+		return blobs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT sha256, size, path, created_at FROM blobs"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blob blossom.DBBlobData
+		err = rows.Scan(&blob.Sha256, &blob.Data.Size, &blob.Path, &blob.CreatedAt)
+		if err != nil {
+			return blobs, fmt.Errorf(`rows.Scan(&blob.Sha256, &blob.Data.Size, &blob.Path, &blob.CreatedAt). %w`, err)
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+func (sq SqliteDB) UpdateBlobPath(ctx context.Context, tx *sql.Tx, hash []byte, path string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blobs SET path = ? WHERE sha256 = ?", path, hash)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE blobs SET path = ?"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) SetBlobHealth(ctx context.Context, tx *sql.Tx, health BlobHealth) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blob_health (blob_key, status, detail, checked_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT(blob_key) DO UPDATE SET
+		status = excluded.status,
+		detail = excluded.detail,
+		checked_at = excluded.checked_at`, health.Key, health.Status, health.Detail, health.CheckedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blob_health). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) GetBlobHealthProblems(ctx context.Context, tx *sql.Tx) ([]BlobHealth, error) {
+	problems := []BlobHealth{}
+	rows, err := tx.QueryContext(ctx, "SELECT blob_key, status, detail, checked_at FROM blob_health WHERE status != ? ORDER BY checked_at", BlobHealthOk)
+	if err != nil {
+		return problems, fmt.Errorf(`tx.QueryContext(ctx, "SELECT blob_key, status FROM blob_health"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var health BlobHealth
+		err = rows.Scan(&health.Key, &health.Status, &health.Detail, &health.CheckedAt)
+		if err != nil {
+			return problems, fmt.Errorf(`rows.Scan(&health.Key, &health.Status, &health.Detail, &health.CheckedAt). %w`, err)
+		}
+		problems = append(problems, health)
+	}
+	return problems, rows.Err()
+}
+
+func (sq SqliteDB) RemoveStaleBlobHealth(ctx context.Context, tx *sql.Tx, checkedBefore uint64) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM blob_health WHERE checked_at < ?", checkedBefore)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blob_health"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) RecordBlobAccess(ctx context.Context, tx *sql.Tx, key string, size uint64, downloads uint64, now uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blob_access (blob_key, size, downloads, last_access) VALUES (?, ?, ?, ?)
+	ON CONFLICT(blob_key) DO UPDATE SET
+		size = excluded.size,
+		downloads = downloads + excluded.downloads,
+		last_access = excluded.last_access`, key, size, downloads, now)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blob_access). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) GetBlobAccessRanking(ctx context.Context, tx *sql.Tx) ([]BlobAccess, error) {
+	ranking := []BlobAccess{}
+	rows, err := tx.QueryContext(ctx, "SELECT blob_key, size, downloads, last_access, hot FROM blob_access ORDER BY downloads DESC, last_access DESC")
+	if err != nil {
+		return ranking, fmt.Errorf(`tx.QueryContext(ctx, "SELECT blob_key FROM blob_access"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var access BlobAccess
+		err = rows.Scan(&access.Key, &access.Size, &access.Downloads, &access.LastAccess, &access.Hot)
+		if err != nil {
+			return ranking, fmt.Errorf(`rows.Scan(&access.Key, &access.Size, &access.Downloads, &access.LastAccess, &access.Hot). %w`, err)
+		}
+		ranking = append(ranking, access)
+	}
+	return ranking, rows.Err()
+}
+
+func (sq SqliteDB) SetBlobHot(ctx context.Context, tx *sql.Tx, key string, hot bool) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blob_access SET hot = ? WHERE blob_key = ?", hot, key)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE blob_access SET hot = ?"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) AddLedgerEntry(ctx context.Context, tx *sql.Tx, entry LedgerEntry) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO ledger (created_at, operation, sha256, pubkey, mint, debit_account, credit_account, amount)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, entry.CreatedAt, entry.Operation, entry.Sha256, entry.Pubkey, entry.Mint, entry.DebitAccount, entry.CreditAccount, entry.Amount)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO ledger"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) GetLedgerEntries(ctx context.Context, tx *sql.Tx, since uint64, until uint64) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	rows, err := tx.QueryContext(ctx, `SELECT id, created_at, operation, sha256, pubkey, mint, debit_account, credit_account, amount FROM ledger
+	WHERE created_at >= ? AND created_at < ? ORDER BY created_at, id`, since, until)
+	if err != nil {
+		return entries, fmt.Errorf(`tx.QueryContext(ctx, "SELECT id FROM ledger"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry LedgerEntry
+		err = rows.Scan(&entry.Id, &entry.CreatedAt, &entry.Operation, &entry.Sha256, &entry.Pubkey, &entry.Mint, &entry.DebitAccount, &entry.CreditAccount, &entry.Amount)
+		if err != nil {
+			return entries, fmt.Errorf(`rows.Scan(&entry.Id, &entry.CreatedAt, &entry.Operation). %w`, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (sq SqliteDB) AddBlobReport(ctx context.Context, tx *sql.Tx, report BlobReport) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blob_reports (event_id, sha256, reporter, report_type, content, created_at, status)
+	VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(event_id, sha256) DO NOTHING`, report.EventId, report.Sha256, report.Reporter, report.ReportType, report.Content, report.CreatedAt, ReportPending)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blob_reports"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) GetBlobReports(ctx context.Context, tx *sql.Tx, status string) ([]BlobReport, error) {
+	reports := []BlobReport{}
+	rows, err := tx.QueryContext(ctx, `SELECT id, event_id, sha256, reporter, report_type, content, created_at, status, reviewed_at FROM blob_reports
+	WHERE ? = '' OR status = ? ORDER BY created_at, id`, status, status)
+	if err != nil {
+		return reports, fmt.Errorf(`tx.QueryContext(ctx, "SELECT id FROM blob_reports"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var report BlobReport
+		err = rows.Scan(&report.Id, &report.EventId, &report.Sha256, &report.Reporter, &report.ReportType, &report.Content, &report.CreatedAt, &report.Status, &report.ReviewedAt)
+		if err != nil {
+			return reports, fmt.Errorf(`rows.Scan(&report.Id, &report.EventId, &report.Sha256). %w`, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (sq SqliteDB) ReviewBlobReports(ctx context.Context, tx *sql.Tx, sha256 string, status string, reviewedAt uint64) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blob_reports SET status = ?, reviewed_at = ? WHERE sha256 = ? AND status = ?", status, reviewedAt, sha256, ReportPending)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "UPDATE blob_reports SET status"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) BlockBlob(ctx context.Context, tx *sql.Tx, blocked BlockedBlob) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blocked_blobs (sha256, reason, created_at) VALUES (?, ?, ?)
+	ON CONFLICT(sha256) DO UPDATE SET reason = excluded.reason`, blocked.Sha256, blocked.Reason, blocked.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blocked_blobs"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) UnblockBlob(ctx context.Context, tx *sql.Tx, sha256 string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM blocked_blobs WHERE sha256 = ?", sha256)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blocked_blobs"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) IsBlobBlocked(ctx context.Context, tx *sql.Tx, sha256 string) (bool, error) {
+	var blocked bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_blobs WHERE sha256 = ?)", sha256).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT EXISTS blocked_blobs"). %w`, err)
+	}
+	return blocked, nil
+}
+
+func (sq SqliteDB) GetBlockedBlobs(ctx context.Context, tx *sql.Tx) ([]BlockedBlob, error) {
+	blockedBlobs := []BlockedBlob{}
+	rows, err := tx.QueryContext(ctx, "SELECT sha256, reason, created_at FROM blocked_blobs ORDER BY created_at, sha256")
+	if err != nil {
+		return blockedBlobs, fmt.Errorf(`tx.QueryContext(ctx, "SELECT sha256 FROM blocked_blobs"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blocked BlockedBlob
+		err = rows.Scan(&blocked.Sha256, &blocked.Reason, &blocked.CreatedAt)
+		if err != nil {
+			return blockedBlobs, fmt.Errorf(`rows.Scan(&blocked.Sha256, &blocked.Reason, &blocked.CreatedAt). %w`, err)
+		}
+		blockedBlobs = append(blockedBlobs, blocked)
+	}
+	return blockedBlobs, rows.Err()
+}
+
+func (sq SqliteDB) BlockPubkey(ctx context.Context, tx *sql.Tx, blocked BlockedPubkey) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blocked_pubkeys (pubkey, reason, created_at) VALUES (?, ?, ?)
+	ON CONFLICT(pubkey) DO UPDATE SET reason = excluded.reason`, blocked.Pubkey, blocked.Reason, blocked.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blocked_pubkeys"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) UnblockPubkey(ctx context.Context, tx *sql.Tx, pubkey string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM blocked_pubkeys WHERE pubkey = ?", pubkey)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "DELETE FROM blocked_pubkeys"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) IsPubkeyBlocked(ctx context.Context, tx *sql.Tx, pubkey string) (bool, error) {
+	var blocked bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_pubkeys WHERE pubkey = ?)", pubkey).Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT EXISTS blocked_pubkeys"). %w`, err)
+	}
+	return blocked, nil
+}
+
+func (sq SqliteDB) HasBlockedPubkeys(ctx context.Context, tx *sql.Tx) (bool, error) {
+	var blocked bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_pubkeys)").Scan(&blocked)
+	if err != nil {
+		return false, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT EXISTS blocked_pubkeys"). %w`, err)
+	}
+	return blocked, nil
+}
+
+func (sq SqliteDB) GetBlockedPubkeys(ctx context.Context, tx *sql.Tx) ([]BlockedPubkey, error) {
+	blockedPubkeys := []BlockedPubkey{}
+	rows, err := tx.QueryContext(ctx, "SELECT pubkey, reason, created_at FROM blocked_pubkeys ORDER BY created_at, pubkey")
+	if err != nil {
+		return blockedPubkeys, fmt.Errorf(`tx.QueryContext(ctx, "SELECT pubkey FROM blocked_pubkeys"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var blocked BlockedPubkey
+		err = rows.Scan(&blocked.Pubkey, &blocked.Reason, &blocked.CreatedAt)
+		if err != nil {
+			return blockedPubkeys, fmt.Errorf(`rows.Scan(&blocked.Pubkey, &blocked.Reason, &blocked.CreatedAt). %w`, err)
+		}
+		blockedPubkeys = append(blockedPubkeys, blocked)
+	}
+	return blockedPubkeys, rows.Err()
+}
+
+func (sq SqliteDB) AddBlocklistAudit(ctx context.Context, tx *sql.Tx, audit BlocklistAudit) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO blocklist_audit (action, target_type, target, reason, actor, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		audit.Action, audit.TargetType, audit.Target, audit.Reason, audit.Actor, audit.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO blocklist_audit"). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) GetBlocklistAudit(ctx context.Context, tx *sql.Tx, limit uint64) ([]BlocklistAudit, error) {
+	audits := []BlocklistAudit{}
+	rows, err := tx.QueryContext(ctx, "SELECT id, action, target_type, target, reason, actor, created_at FROM blocklist_audit ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return audits, fmt.Errorf(`tx.QueryContext(ctx, "SELECT FROM blocklist_audit"). %w`, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var audit BlocklistAudit
+		err = rows.Scan(&audit.Id, &audit.Action, &audit.TargetType, &audit.Target, &audit.Reason, &audit.Actor, &audit.CreatedAt)
+		if err != nil {
+			return audits, fmt.Errorf(`rows.Scan(&audit). %w`, err)
+		}
+		audits = append(audits, audit)
+	}
+	return audits, rows.Err()
+}
+
+func (sq SqliteDB) WriteHealthCheck(ctx context.Context, tx *sql.Tx, checkedAt uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO health_check (id, checked_at) VALUES (1, ?)
+	ON CONFLICT(id) DO UPDATE SET checked_at = excluded.checked_at`, checkedAt)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO health_check). %w`, err)
+	}
+	return nil
+}
+
+func (sq SqliteDB) GetBlob(ctx context.Context, hash []byte) (blossom.DBBlobData, error) {
+	blobData := blossom.DBBlobData{}
+	var pubkey sql.NullString
+	var contentType sql.NullString
+	tx, err := sq.Db.BeginTx(ctx, nil)
 	if err != nil {
-		return length, fmt.Errorf("sq.Db.Begin(). %w", err)
+		return blobData, fmt.Errorf("sq.Db.BeginTx(ctx, nil). %w", err)
 	}
-	// tx.St
 
-	stmt, err := tx.Prepare("SELECT size FROM blobs WHERE sha256 = ?")
+	stmt, err := tx.PrepareContext(ctx, "SELECT sha256, size, path, created_at, pubkey, content_type, paid_sats FROM blobs WHERE sha256 = ?")
 	if err != nil {
-		return length, fmt.Errorf("sq.Db.Prepare(). %w", err)
+		tx.Rollback()
+		return blobData, fmt.Errorf("sq.Db.PrepareContext(ctx). %w", err)
 	}
 	defer stmt.Close()
 
+	// Create a record to hold the result
+	err = stmt.QueryRowContext(ctx, hash).Scan(&blobData.Sha256, &blobData.Data.Size, &blobData.Path, &blobData.CreatedAt, &pubkey, &contentType, &blobData.PaidSats)
+	if err != nil {
+		tx.Rollback()
+		return blobData, fmt.Errorf("stmt.QueryRowContext(ctx, hash).Scan %w", err)
+	}
+	blobData.Pubkey = pubkey.String
+	blobData.Data.Type = contentType.String
+
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
-		return length, fmt.Errorf(`tx.Commit(). %w`, err)
+		return blobData, fmt.Errorf(`tx.Commit(). %w`, err)
+	}
+
+	return blobData, nil
+
+}
+func (sq SqliteDB) GetBlobLength(ctx context.Context, hash []byte) (uint64, error) {
+	var length uint64 = 0
+
+	err := sq.Db.QueryRowContext(ctx, "SELECT size FROM blobs WHERE sha256 = ?", hash).Scan(&length)
+	if err != nil {
+		return length, fmt.Errorf(`sq.Db.QueryRowContext(ctx, "SELECT size FROM blobs WHERE sha256 = ?", hash). %w`, err)
 	}
 	return length, nil
 }
-func (sq SqliteDB) AddLockedProofs(tx *sql.Tx, token cashu.Token, pubkey_version uint, redeemed bool, created_at uint64) error {
+func (sq SqliteDB) AddLockedProofs(ctx context.Context, tx *sql.Tx, token cashu.Token, pubkey_version uint, redeemed bool, created_at uint64) error {
 
-	stmt, err := tx.Prepare("INSERT INTO locked_proofs (amount, id, secret, C, witness, redeemed, created_at, pubkey_version, mint) values (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO locked_proofs (amount, id, secret, C, witness, redeemed, created_at, pubkey_version, mint) values (?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
-		return fmt.Errorf(`tx.Prepare("INSERT INTO locked_proofs (amount, id, s. %w`, err)
+		return fmt.Errorf(`tx.PrepareContext(ctx, "INSERT INTO locked_proofs (amount, id, s. %w`, err)
 	}
 	defer stmt.Close()
 
 	for _, proof := range token.Proofs() {
-		_, err = stmt.Exec(proof.Amount, proof.Id, proof.Secret, proof.C, proof.Witness, redeemed, created_at, pubkey_version, token.Mint())
+		_, err = stmt.ExecContext(ctx, proof.Amount, proof.Id, proof.Secret, proof.C, proof.Witness, redeemed, created_at, pubkey_version, token.Mint())
+		// a concurrent request can store the same proof after it was checked
+		if IsUniqueViolation(err) {
+			return fmt.Errorf("stmt.ExecContext(ctx): %w. %w", err, ErrProofAlreadyStored)
+		}
 		if err != nil {
-			return fmt.Errorf("stmt.Exec(): %w", err)
+			return fmt.Errorf("stmt.ExecContext(ctx): %w", err)
 		}
 	}
 	return nil
 }
 
-func (sq SqliteDB) GetLockedProofsByPubkeyVersion(tx *sql.Tx, pubkey uint) (cashu.Proofs, error) {
+func (sq SqliteDB) GetLockedProofsByPubkeyVersion(ctx context.Context, tx *sql.Tx, pubkey uint) (cashu.Proofs, error) {
 	var proofs cashu.Proofs
 
-	stmt, err := tx.Prepare("SELECT amount, id, secret, C, witness FROM locked_proofs WHERE pubkey_version = ?")
+	stmt, err := tx.PrepareContext(ctx, "SELECT amount, id, secret, C, witness FROM locked_proofs WHERE pubkey_version = ?")
 	if err != nil {
-		return proofs, fmt.Errorf(`tx.Prepare("SELECT amount, id, secret, C, witness FROM locked_proofs. %w`, err)
+		return proofs, fmt.Errorf(`tx.PrepareContext(ctx, "SELECT amount, id, secret, C, witness FROM locked_proofs. %w`, err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(pubkey)
+	rows, err := stmt.QueryContext(ctx, pubkey)
 	if err != nil {
-		return proofs, fmt.Errorf(`stmt.Query(pubkey). %w`, err)
+		return proofs, fmt.Errorf(`stmt.QueryContext(ctx, pubkey). %w`, err)
 	}
 	defer rows.Close()
 
@@ -141,18 +532,18 @@ func (sq SqliteDB) GetLockedProofsByPubkeyVersion(tx *sql.Tx, pubkey uint) (cash
 	return proofs, nil
 }
 
-func (sq SqliteDB) GetLockedProofsByRedeemed(tx *sql.Tx, redeemed bool) (map[string][]ProofToSwap, error) {
+func (sq SqliteDB) GetLockedProofsByRedeemed(ctx context.Context, tx *sql.Tx, redeemed bool) (map[string][]ProofToSwap, error) {
 	proofs := make(map[string][]ProofToSwap)
 
-	stmt, err := tx.Prepare("SELECT amount, id, secret, C, witness, mint, pubkey_version FROM locked_proofs WHERE redeemed = ?")
+	stmt, err := tx.PrepareContext(ctx, "SELECT amount, id, secret, C, witness, mint, pubkey_version FROM locked_proofs WHERE redeemed = ?")
 	if err != nil {
-		return proofs, fmt.Errorf(`tx.Prepare("SELECT amount, id, secret, C. %w`, err)
+		return proofs, fmt.Errorf(`tx.PrepareContext(ctx, "SELECT amount, id, secret, C. %w`, err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(redeemed)
+	rows, err := stmt.QueryContext(ctx, redeemed)
 	if err != nil {
-		return proofs, fmt.Errorf(`stmt.Query(pubkey). %w`, err)
+		return proofs, fmt.Errorf(`stmt.QueryContext(ctx, pubkey). %w`, err)
 	}
 	defer rows.Close()
 
@@ -174,7 +565,7 @@ func (sq SqliteDB) GetLockedProofsByRedeemed(tx *sql.Tx, redeemed bool) (map[str
 	return proofs, nil
 }
 
-func (sq SqliteDB) GetLockedProofsByC(tx *sql.Tx, Cs []string) (cashu.Proofs, error) {
+func (sq SqliteDB) GetLockedProofsByC(ctx context.Context, tx *sql.Tx, Cs []string) (cashu.Proofs, error) {
 	var proofs cashu.Proofs
 	// Create the placeholders for the IN clause
 	placeholders := make([]string, len(Cs))
@@ -187,9 +578,9 @@ func (sq SqliteDB) GetLockedProofsByC(tx *sql.Tx, Cs []string) (cashu.Proofs, er
 		strings.Join(placeholders, ","),
 	)
 
-	stmt, err := tx.Prepare(query)
+	stmt, err := tx.PrepareContext(ctx, query)
 	if err != nil {
-		return proofs, fmt.Errorf(`tx.Prepare(query). %w`, err)
+		return proofs, fmt.Errorf(`tx.PrepareContext(ctx, query). %w`, err)
 	}
 	defer stmt.Close()
 
@@ -198,9 +589,9 @@ func (sq SqliteDB) GetLockedProofsByC(tx *sql.Tx, Cs []string) (cashu.Proofs, er
 		args[i] = v
 	}
 
-	rows, err := stmt.Query(args...)
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
-		return proofs, fmt.Errorf(`stmt.Query(args...). %w`, err)
+		return proofs, fmt.Errorf(`stmt.QueryContext(ctx, args...). %w`, err)
 	}
 	defer rows.Close()
 
@@ -217,7 +608,7 @@ func (sq SqliteDB) GetLockedProofsByC(tx *sql.Tx, Cs []string) (cashu.Proofs, er
 	return proofs, nil
 }
 
-func (sq SqliteDB) ChangeLockedProofsRedeem(tx *sql.Tx, Cs []string, redeem bool) error {
+func (sq SqliteDB) ChangeLockedProofsRedeem(ctx context.Context, tx *sql.Tx, Cs []string, redeem bool) error {
 	// var proofs cashu.Proofs
 
 	for i := 0; i < len(Cs); i++ {
@@ -226,9 +617,9 @@ func (sq SqliteDB) ChangeLockedProofsRedeem(tx *sql.Tx, Cs []string, redeem bool
 			redeem,
 		)
 
-		_, err := tx.Exec(query, Cs[i])
+		_, err := tx.ExecContext(ctx, query, Cs[i])
 		if err != nil {
-			return fmt.Errorf(`tx.Exec(query). %w`, err)
+			return fmt.Errorf(`tx.ExecContext(ctx, query). %w`, err)
 		}
 
 	}
@@ -236,7 +627,7 @@ func (sq SqliteDB) ChangeLockedProofsRedeem(tx *sql.Tx, Cs []string, redeem bool
 	return nil
 }
 
-func (sq SqliteDB) RotateNewPubkey(tx *sql.Tx, expiration int64) (CurrentPubkey, error) {
+func (sq SqliteDB) RotateNewPubkey(ctx context.Context, tx *sql.Tx, expiration int64) (CurrentPubkey, error) {
 
 	var currentPubkey CurrentPubkey
 
@@ -252,40 +643,40 @@ func (sq SqliteDB) RotateNewPubkey(tx *sql.Tx, expiration int64) (CurrentPubkey,
         RETURNING version, created_at;
     `
 
-	_, err := tx.Exec(updateQuery)
+	_, err := tx.ExecContext(ctx, updateQuery)
 	if err != nil {
-		return currentPubkey, fmt.Errorf(`tx.Exec(updateQuery) %w`, err)
+		return currentPubkey, fmt.Errorf(`tx.ExecContext(ctx, updateQuery) %w`, err)
 	}
 
-	err = tx.QueryRow(insertAndSelectQuery, expiration).Scan(&currentPubkey.VersionNum, &currentPubkey.Expiration)
+	err = tx.QueryRowContext(ctx, insertAndSelectQuery, expiration).Scan(&currentPubkey.VersionNum, &currentPubkey.Expiration)
 	if err != nil {
-		return currentPubkey, fmt.Errorf(`tx.QueryRow(insertAndSelectQuery, now) %w`, err)
+		return currentPubkey, fmt.Errorf(`tx.QueryRowContext(ctx, insertAndSelectQuery, now) %w`, err)
 	}
 
 	return currentPubkey, nil
 }
 
-func (sq SqliteDB) GetActivePubkey(tx *sql.Tx) (CurrentPubkey, error) {
+func (sq SqliteDB) GetActivePubkey(ctx context.Context, tx *sql.Tx) (CurrentPubkey, error) {
 	var currentPubkey CurrentPubkey
 
-	stmt, err := tx.Prepare("SELECT version, created_at FROM cashu_pubkey WHERE active = true")
+	stmt, err := tx.PrepareContext(ctx, "SELECT version, created_at FROM cashu_pubkey WHERE active = true")
 	if err != nil {
-		return currentPubkey, fmt.Errorf("sq.Db.Prepare(). %w", err)
+		return currentPubkey, fmt.Errorf("sq.Db.PrepareContext(ctx). %w", err)
 	}
 	defer stmt.Close()
 
 	// Create a record to hold the result
-	err = stmt.QueryRow().Scan(&currentPubkey.VersionNum, &currentPubkey.Expiration)
+	err = stmt.QueryRowContext(ctx).Scan(&currentPubkey.VersionNum, &currentPubkey.Expiration)
 	if err != nil {
-		return currentPubkey, fmt.Errorf("stmt.QueryRow(hash).Scan %w", err)
+		return currentPubkey, fmt.Errorf("stmt.QueryRowContext(ctx, hash).Scan %w", err)
 	}
 
 	return currentPubkey, nil
 }
-func (sq SqliteDB) GetTrustedMints(tx *sql.Tx) ([]string, error) {
+func (sq SqliteDB) GetTrustedMints(ctx context.Context, tx *sql.Tx) ([]string, error) {
 	var mints []string
 
-	rows, err := tx.Query("SELECT url FROM trusted_mints")
+	rows, err := tx.QueryContext(ctx, "SELECT url FROM trusted_mints")
 
 	// Create a record to hold the result
 	if err != nil {
@@ -304,49 +695,49 @@ func (sq SqliteDB) GetTrustedMints(tx *sql.Tx) ([]string, error) {
 
 	return mints, nil
 }
-func (sq SqliteDB) AddTrustedMint(tx *sql.Tx, url string) error {
+func (sq SqliteDB) AddTrustedMint(ctx context.Context, tx *sql.Tx, url string) error {
 	now := time.Now().Unix()
-	stmt, err := tx.Prepare("INSERT INTO trusted_mints (url, created_at) values (?,?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO trusted_mints (url, created_at) values (?,?)")
 	if err != nil {
-		return fmt.Errorf("sq.Db.Prepare(). %w", err)
+		return fmt.Errorf("sq.Db.PrepareContext(ctx). %w", err)
 	}
 	defer stmt.Close()
 
 	// Create a record to hold the result
-	_, err = stmt.Exec(url, now)
+	_, err = stmt.ExecContext(ctx, url, now)
 	if err != nil {
-		return fmt.Errorf("stmt.Query() %w", err)
+		return fmt.Errorf("stmt.QueryContext(ctx) %w", err)
 	}
 	return nil
 }
 
-func (sq SqliteDB) SetKeysetCounter(tx *sql.Tx, counter KeysetCounter) error {
-	stmt, err := tx.Prepare("INSERT INTO counter_table (keyset_id, counter) values ($1,$2)")
+func (sq SqliteDB) SetKeysetCounter(ctx context.Context, tx *sql.Tx, counter KeysetCounter) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO counter_table (keyset_id, counter) values ($1,$2)")
 	if err != nil {
-		return fmt.Errorf(`tx.Prepare("INSERT INTO counter_table (. %w`, err)
+		return fmt.Errorf(`tx.PrepareContext(ctx, "INSERT INTO counter_table (. %w`, err)
 	}
 	defer stmt.Close()
 
 	// Create a record to hold the result
-	_, err = stmt.Exec(counter.KeysetId, counter.Counter)
+	_, err = stmt.ExecContext(ctx, counter.KeysetId, counter.Counter)
 	if err != nil {
-		return fmt.Errorf("stmt.Query() %w", err)
+		return fmt.Errorf("stmt.QueryContext(ctx) %w", err)
 	}
 	return nil
 }
 
-func (sq SqliteDB) GetKeysetCounter(tx *sql.Tx, id string) (KeysetCounter, error) {
+func (sq SqliteDB) GetKeysetCounter(ctx context.Context, tx *sql.Tx, id string) (KeysetCounter, error) {
 	var counter KeysetCounter
 
-	stmt, err := tx.Prepare("SELECT keyset_id, counter FROM counter_table WHERE keyset_id = $1")
+	stmt, err := tx.PrepareContext(ctx, "SELECT keyset_id, counter FROM counter_table WHERE keyset_id = $1")
 	if err != nil {
 		return counter, fmt.Errorf(`SELECT keyset_id, counter WHERE keyset_id = ?. %w`, err)
 	}
 	defer stmt.Close()
 
-	rows := stmt.QueryRow(id)
+	rows := stmt.QueryRowContext(ctx, id)
 	if err != nil {
-		return counter, fmt.Errorf(`stmt.Query(pubkey). %w`, err)
+		return counter, fmt.Errorf(`stmt.QueryContext(ctx, pubkey). %w`, err)
 	}
 
 	err = rows.Scan(&counter.KeysetId, &counter.Counter)
@@ -356,51 +747,51 @@ func (sq SqliteDB) GetKeysetCounter(tx *sql.Tx, id string) (KeysetCounter, error
 
 	return counter, nil
 }
-func (sq SqliteDB) ModifyKeysetCounter(tx *sql.Tx, counter KeysetCounter) error {
-	stmt, err := tx.Prepare(" UPDATE counter_table SET counter = $1 WHERE keyset_id = $2")
+func (sq SqliteDB) ModifyKeysetCounter(ctx context.Context, tx *sql.Tx, counter KeysetCounter) error {
+	stmt, err := tx.PrepareContext(ctx, " UPDATE counter_table SET counter = $1 WHERE keyset_id = $2")
 	if err != nil {
-		return fmt.Errorf(`tx.Prepare(" UPDATE counter_table SET counter (. %w`, err)
+		return fmt.Errorf(`tx.PrepareContext(ctx, " UPDATE counter_table SET counter (. %w`, err)
 	}
 	defer stmt.Close()
 
 	// Create a record to hold the result
-	_, err = stmt.Exec(counter.Counter, counter.KeysetId)
+	_, err = stmt.ExecContext(ctx, counter.Counter, counter.KeysetId)
 	if err != nil {
-		return fmt.Errorf("stmt.Query() %w", err)
+		return fmt.Errorf("stmt.QueryContext(ctx) %w", err)
 	}
 	return nil
 }
 
-func (sq SqliteDB) AddProofs(tx *sql.Tx, proofs cashu.Proofs, mint string) error {
+func (sq SqliteDB) AddProofs(ctx context.Context, tx *sql.Tx, proofs cashu.Proofs, mint string) error {
 
 	now := time.Now().Unix()
-	stmt, err := tx.Prepare("INSERT INTO swapped_proofs (amount, id, secret, C, witness, spent, created_at, mint) values (?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO swapped_proofs (amount, id, secret, C, witness, spent, created_at, mint) values (?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
-		return fmt.Errorf(`tx.Prepare("INSERT INTO swapped_proofs (amount, id, s. %w`, err)
+		return fmt.Errorf(`tx.PrepareContext(ctx, "INSERT INTO swapped_proofs (amount, id, s. %w`, err)
 	}
 	defer stmt.Close()
 
 	for _, proof := range proofs {
-		_, err = stmt.Exec(proof.Amount, proof.Id, proof.Secret, proof.C, proof.Witness, false, now, mint)
+		_, err = stmt.ExecContext(ctx, proof.Amount, proof.Id, proof.Secret, proof.C, proof.Witness, false, now, mint)
 		if err != nil {
-			return fmt.Errorf("stmt.Exec(): %w", err)
+			return fmt.Errorf("stmt.ExecContext(ctx): %w", err)
 		}
 	}
 	return nil
 }
 
-func (sq SqliteDB) GetBySpentProofs(tx *sql.Tx, spent bool) (map[string]cashu.Proofs, error) {
+func (sq SqliteDB) GetBySpentProofs(ctx context.Context, tx *sql.Tx, spent bool) (map[string]cashu.Proofs, error) {
 	proofs := make(map[string]cashu.Proofs)
 
-	stmt, err := tx.Prepare("SELECT amount, id, secret, C, witness, mint FROM swapped_proofs WHERE spent = ?")
+	stmt, err := tx.PrepareContext(ctx, "SELECT amount, id, secret, C, witness, mint FROM swapped_proofs WHERE spent = ?")
 	if err != nil {
-		return proofs, fmt.Errorf(`tx.Prepare("SELECT amount, id, secret, C. %w`, err)
+		return proofs, fmt.Errorf(`tx.PrepareContext(ctx, "SELECT amount, id, secret, C. %w`, err)
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(spent)
+	rows, err := stmt.QueryContext(ctx, spent)
 	if err != nil {
-		return proofs, fmt.Errorf(`stmt.Query(pubkey). %w`, err)
+		return proofs, fmt.Errorf(`stmt.QueryContext(ctx, pubkey). %w`, err)
 	}
 	defer rows.Close()
 
@@ -418,16 +809,16 @@ func (sq SqliteDB) GetBySpentProofs(tx *sql.Tx, spent bool) (map[string]cashu.Pr
 	return proofs, nil
 }
 
-func (sq SqliteDB) ChangeSwappedProofsSpent(tx *sql.Tx, proofs cashu.Proofs, spent bool) error {
+func (sq SqliteDB) ChangeSwappedProofsSpent(ctx context.Context, tx *sql.Tx, proofs cashu.Proofs, spent bool) error {
 	for i := 0; i < len(proofs); i++ {
 		query := fmt.Sprintf(
 			"UPDATE swapped_proofs SET spent = %v WHERE C = ?",
 			spent,
 		)
 
-		_, err := tx.Exec(query, proofs[i].C)
+		_, err := tx.ExecContext(ctx, query, proofs[i].C)
 		if err != nil {
-			return fmt.Errorf(`tx.Exec(query). %w`, err)
+			return fmt.Errorf(`tx.ExecContext(ctx, query). %w`, err)
 		}
 
 	}
@@ -435,6 +826,29 @@ func (sq SqliteDB) ChangeSwappedProofsSpent(tx *sql.Tx, proofs cashu.Proofs, spe
 	return nil
 }
 
+func (sq SqliteDB) GetFreeUsage(ctx context.Context, tx *sql.Tx, pubkey string, month string) (uint64, error) {
+	var bytes uint64
+
+	err := tx.QueryRowContext(ctx, "SELECT bytes FROM free_usage WHERE pubkey = ? AND month = ?", pubkey, month).Scan(&bytes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return bytes, fmt.Errorf(`tx.QueryRowContext(ctx, "SELECT bytes FROM free_usage). %w`, err)
+	}
+
+	return bytes, nil
+}
+
+func (sq SqliteDB) AddFreeUsage(ctx context.Context, tx *sql.Tx, pubkey string, month string, bytes uint64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO free_usage (pubkey, month, bytes) VALUES (?, ?, ?)
+	ON CONFLICT(pubkey, month) DO UPDATE SET bytes = bytes + excluded.bytes`, pubkey, month, bytes)
+	if err != nil {
+		return fmt.Errorf(`tx.ExecContext(ctx, "INSERT INTO free_usage (pubkey, month, bytes). %w`, err)
+	}
+	return nil
+}
+
 func DatabaseSetup(ctx context.Context, databaseDir string, embedMigrations embed.FS) (SqliteDB, error) {
 	var sqlitedb SqliteDB
 
@@ -445,12 +859,16 @@ func DatabaseSetup(ctx context.Context, databaseDir string, embedMigrations embe
 	}
 	goose.SetBaseFS(embedMigrations)
 
-	if err := goose.SetDialect("sqlite3"); err != nil {
-		log.Fatalf("Error setting dialect: %v", err)
+	err = goose.SetDialect("sqlite3")
+	if err != nil {
+		db.Close()
+		return sqlitedb, fmt.Errorf(`goose.SetDialect("sqlite3"). %w`, err)
 	}
 
-	if err := goose.Up(db, "migrations"); err != nil {
-		log.Fatalf("Error running migrations: %v", err)
+	err = goose.Up(db, "migrations")
+	if err != nil {
+		db.Close()
+		return sqlitedb, fmt.Errorf(`goose.Up(db, "migrations"). %w`, err)
 	}
 	db.SetMaxOpenConns(1)
 
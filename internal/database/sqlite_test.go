@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"encoding/hex"
+	"ratasker/external/blossom"
 	"testing"
 	"time"
 
@@ -18,21 +19,21 @@ func TestRotatePubkey(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not setup db")
 	}
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 	expirations := time.Now().Add(4 * time.Hour)
-	current, err := sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err := sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 1 {
 		t.Errorf("should be version 0. got: %v", current.VersionNum)
 	}
-	current, err = sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err = sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 2 {
 		t.Errorf("should be version 1 got: %v", current.VersionNum)
@@ -50,14 +51,14 @@ func TestAddProofsAndGetForC(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not setup db")
 	}
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 	expirations := time.Now().Add(4 * time.Hour)
-	current, err := sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err := sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 1 {
 		t.Errorf("should be version 0. got: %v", current.VersionNum)
@@ -85,12 +86,12 @@ func TestAddProofsAndGetForC(t *testing.T) {
 	}
 
 	now := time.Now().Unix()
-	err = sqlite.AddLockedProofs(tx, token1, current.VersionNum, false, uint64(now))
+	err = sqlite.AddLockedProofs(ctx, tx, token1, current.VersionNum, false, uint64(now))
 	if err != nil {
-		t.Fatalf("sqlite.AddProofs(proofs,version, false, uint64(now) %+v", err)
+		t.Fatalf("sqlite.AddProofs(ctx, proofs,version, false, uint64(now) %+v", err)
 	}
 
-	newProofs, err := sqlite.GetLockedProofsByC(tx, []string{hex.EncodeToString([]byte("Ctest2"))})
+	newProofs, err := sqlite.GetLockedProofsByC(ctx, tx, []string{hex.EncodeToString([]byte("Ctest2"))})
 	if err != nil {
 		t.Fatalf(`sqlite.GetProofsByC([]string{"Ctest"}) %+v`, err)
 	}
@@ -115,14 +116,14 @@ func TestAddProofsAndGetViaPubkey(t *testing.T) {
 		t.Fatalf("Could not setup db")
 	}
 
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 	expirations := time.Now().Add(4 * time.Hour)
-	current, err := sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err := sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 1 {
 		t.Errorf("should be version 0. got: %v", current.VersionNum)
@@ -150,15 +151,15 @@ func TestAddProofsAndGetViaPubkey(t *testing.T) {
 	}
 
 	now := time.Now().Unix()
-	err = sqlite.AddLockedProofs(tx, token1, current.VersionNum, false, uint64(now))
+	err = sqlite.AddLockedProofs(ctx, tx, token1, current.VersionNum, false, uint64(now))
 	if err != nil {
-		t.Fatalf("sqlite.AddProofs(proofs,version, false, uint64(now) %+v", err)
+		t.Fatalf("sqlite.AddProofs(ctx, proofs,version, false, uint64(now) %+v", err)
 	}
 
 	// rotate pubkey and add proofs with new pubkey
-	current, err = sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err = sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 2 {
 		t.Errorf("should be version 2. got: %v", current.VersionNum)
@@ -184,12 +185,12 @@ func TestAddProofsAndGetViaPubkey(t *testing.T) {
 	}
 
 	now = time.Now().Unix()
-	err = sqlite.AddLockedProofs(tx, token2, current.VersionNum, false, uint64(now))
+	err = sqlite.AddLockedProofs(ctx, tx, token2, current.VersionNum, false, uint64(now))
 	if err != nil {
-		t.Fatalf("sqlite.AddProofs(proofs,version, false, uint64(now) %+v", err)
+		t.Fatalf("sqlite.AddProofs(ctx, proofs,version, false, uint64(now) %+v", err)
 	}
 
-	newProofs, err := sqlite.GetLockedProofsByPubkeyVersion(tx, current.VersionNum)
+	newProofs, err := sqlite.GetLockedProofsByPubkeyVersion(ctx, tx, current.VersionNum)
 	if err != nil {
 		t.Fatalf(`sqlite.GetProofsByC([]string{"Ctest"}) %+v`, err)
 	}
@@ -214,33 +215,33 @@ func TestCheckPubkeyVersion(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not setup db")
 	}
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 	expirations := time.Now().Add(4 * time.Hour)
 
-	current, err := sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err := sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 1 {
 		t.Errorf("should be version 1. got: %v", current.VersionNum)
 	}
-	current, err = sqlite.RotateNewPubkey(tx, expirations.Unix())
+	current, err = sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 2 {
 		t.Errorf("should be version 2. got: %v", current.VersionNum)
 	}
-	_, err = sqlite.RotateNewPubkey(tx, expirations.Unix())
+	_, err = sqlite.RotateNewPubkey(ctx, tx, expirations.Unix())
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
-	current, err = sqlite.GetActivePubkey(tx)
+	current, err = sqlite.GetActivePubkey(ctx, tx)
 	if err != nil {
-		t.Fatalf("sqlite.RotateNewPubkey() %+v", err)
+		t.Fatalf("sqlite.RotateNewPubkey(ctx) %+v", err)
 	}
 	if current.VersionNum != 3 {
 		t.Errorf("should be version 3. got: %v", current.VersionNum)
@@ -260,24 +261,24 @@ func TestAddTrustedMints(t *testing.T) {
 		t.Fatalf("Could not setup db")
 	}
 
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 
-	err = sqlite.AddTrustedMint(tx, "https://localhost.com")
+	err = sqlite.AddTrustedMint(ctx, tx, "https://localhost.com")
 	if err != nil {
-		t.Fatalf(`sqlite.AddTrustedMint("https://localhost.com") %+v`, err)
+		t.Fatalf(`sqlite.AddTrustedMint(ctx, "https://localhost.com") %+v`, err)
 	}
 
-	err = sqlite.AddTrustedMint(tx, "https://localhost2.com")
+	err = sqlite.AddTrustedMint(ctx, tx, "https://localhost2.com")
 	if err != nil {
-		t.Fatalf(`sqlite.AddTrustedMint("https://localhost2.com") %+v`, err)
+		t.Fatalf(`sqlite.AddTrustedMint(ctx, "https://localhost2.com") %+v`, err)
 	}
 
-	trustedMint, err := sqlite.GetTrustedMints(tx)
+	trustedMint, err := sqlite.GetTrustedMints(ctx, tx)
 	if err != nil {
-		t.Fatalf(`sqlite.GetTrustedMints() %+v`, err)
+		t.Fatalf(`sqlite.GetTrustedMints(ctx) %+v`, err)
 	}
 
 	if len(trustedMint) != 2 {
@@ -301,19 +302,19 @@ func TestAddTrustedMintsRollBack(t *testing.T) {
 		t.Fatalf("Could not setup db")
 	}
 
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 
-	err = sqlite.AddTrustedMint(tx, "https://localhost.com")
+	err = sqlite.AddTrustedMint(ctx, tx, "https://localhost.com")
 	if err != nil {
-		t.Fatalf(`sqlite.AddTrustedMint("https://localhost.com") %+v`, err)
+		t.Fatalf(`sqlite.AddTrustedMint(ctx, "https://localhost.com") %+v`, err)
 	}
 
-	trustedMint, err := sqlite.GetTrustedMints(tx)
+	trustedMint, err := sqlite.GetTrustedMints(ctx, tx)
 	if err != nil {
-		t.Fatalf(`sqlite.GetTrustedMints() %+v`, err)
+		t.Fatalf(`sqlite.GetTrustedMints(ctx) %+v`, err)
 	}
 
 	if len(trustedMint) != 1 {
@@ -327,17 +328,89 @@ func TestAddTrustedMintsRollBack(t *testing.T) {
 		t.Fatalf("tx.Rollback() %+v", err)
 	}
 
-	tx, err = sqlite.BeginTransaction()
+	tx, err = sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf("sqlite.BeginTransaction() %+v", err)
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
 	}
 
-	trustedMint, err = sqlite.GetTrustedMints(tx)
+	trustedMint, err = sqlite.GetTrustedMints(ctx, tx)
 	if err != nil {
-		t.Fatalf(`sqlite.GetTrustedMints() %+v`, err)
+		t.Fatalf(`sqlite.GetTrustedMints(ctx) %+v`, err)
 	}
 	if len(trustedMint) != 0 {
 		t.Error("There should be 0 trusted mints")
 	}
 	tx.Commit()
 }
+
+func TestBlobUsageAccounting(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sqlite, err := DatabaseSetup(ctx, dir, EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+
+	pubkey := "9f0cc17023b2cf509e0f1d305793d20e7c72276928fd9bf85536887ac570a280"
+	blobs := []blossom.DBBlobData{
+		{Path: "one", Sha256: []byte("one"), CreatedAt: 1, Pubkey: pubkey, PaidSats: 2, Data: blossom.Blob{Size: 100, Type: "text/plain"}},
+		{Path: "two", Sha256: []byte("two"), CreatedAt: 1, Pubkey: pubkey, PaidSats: 3, Data: blossom.Blob{Size: 50, Type: "text/plain"}},
+		{Path: "three", Sha256: []byte("three"), CreatedAt: 1, Pubkey: "", PaidSats: 1, Data: blossom.Blob{Size: 10}},
+	}
+	for _, blob := range blobs {
+		err = sqlite.AddBlob(ctx, tx, blob)
+		if err != nil {
+			t.Fatalf("sqlite.AddBlob(ctx, tx, blob) %+v", err)
+		}
+	}
+
+	usage, err := sqlite.GetUsage(ctx, tx, pubkey)
+	if err != nil {
+		t.Fatalf("sqlite.GetUsage(ctx, tx, pubkey) %+v", err)
+	}
+	if usage.TotalBytes != 150 || usage.BlobCount != 2 || usage.TotalSats != 5 {
+		t.Errorf("wrong usage after adding blobs. %+v", usage)
+	}
+
+	removed, err := sqlite.RemoveBlob(ctx, tx, []byte("one"))
+	if err != nil {
+		t.Fatalf(`sqlite.RemoveBlob(ctx, tx, []byte("one")) %+v`, err)
+	}
+	if removed.Path != "one" || removed.Pubkey != pubkey {
+		t.Errorf("wrong removed blob. %+v", removed)
+	}
+
+	usage, err = sqlite.GetUsage(ctx, tx, pubkey)
+	if err != nil {
+		t.Fatalf("sqlite.GetUsage(ctx, tx, pubkey) %+v", err)
+	}
+	if usage.TotalBytes != 50 || usage.BlobCount != 1 || usage.TotalSats != 5 {
+		t.Errorf("wrong usage after removing a blob. %+v", usage)
+	}
+
+	empty, err := sqlite.GetUsage(ctx, tx, "")
+	if err != nil {
+		t.Fatalf(`sqlite.GetUsage(ctx, tx, "") %+v`, err)
+	}
+	if empty.BlobCount != 0 {
+		t.Errorf("anonymous uploads should not be tracked. %+v", empty)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	length, err := sqlite.GetBlobLength(ctx, []byte("two"))
+	if err != nil {
+		t.Fatalf(`sqlite.GetBlobLength(ctx, []byte("two")) %+v`, err)
+	}
+	if length != 50 {
+		t.Errorf("wrong blob length. got: %v", length)
+	}
+}
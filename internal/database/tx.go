@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	TxMaxAttempts = 5
+	// TxRetryDelay doubles after every busy attempt
+	TxRetryDelay = 20 * time.Millisecond
+)
+
+var (
+	ErrDatabaseBusy = errors.New("Database is busy")
+	ErrTxPanic      = errors.New("Transaction panicked")
+	ErrTxCommit     = errors.New("Could not commit transaction")
+)
+
+// WithTx runs fn in a transaction. It commits when fn returns nil and rolls back on errors and panics.
+// While SQLite is busy or Postgres can't serialize the transaction the whole fn runs again, so fn must be
+// safe to repeat and must not write the response itself
+func WithTx(ctx context.Context, db Database, fn func(tx *sql.Tx) error) error {
+	delay := TxRetryDelay
+	var err error
+	for attempt := 1; attempt <= TxMaxAttempts; attempt++ {
+		err = RunTx(ctx, db, fn)
+		if !IsBusy(err) {
+			return err
+		}
+		if attempt == TxMaxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w. %w", ErrDatabaseBusy, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return fmt.Errorf("%w after %v attempts. %w", ErrDatabaseBusy, TxMaxAttempts, err)
+}
+
+// RunTx is WithTx without retries. Use it when fn talks to a mint or does anything else that can't be repeated
+func RunTx(ctx context.Context, db Database, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			err = fmt.Errorf("%w: %v", ErrTxPanic, p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%w. %w", ErrTxCommit, err)
+	}
+	return nil
+}
+
+// IsBusy reports if the transaction failed because of other writers and can be tried again
+func IsBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	// serialization_failure and deadlock_detected
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
+
+// IsUniqueViolation reports if the statement failed because the row already exists
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+
+	// unique_violation
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"ratasker/external/blossom"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestWithTx(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := DatabaseSetup(ctx, t.TempDir(), EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	addBlob := func(name string) func(tx *sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			return sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: name, Sha256: []byte(name), CreatedAt: 1, Data: blossom.Blob{Size: 1}})
+		}
+	}
+
+	err = WithTx(ctx, sqlite, addBlob("committed"))
+	if err != nil {
+		t.Fatalf("WithTx(ctx, sqlite, fn) %+v", err)
+	}
+	_, err = sqlite.GetBlob(ctx, []byte("committed"))
+	if err != nil {
+		t.Errorf("the blob should be committed. %+v", err)
+	}
+
+	failure := errors.New("failure")
+	err = WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		err := addBlob("rolled back")(tx)
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("the error of fn should be returned. got %v", err)
+	}
+	_, err = sqlite.GetBlob(ctx, []byte("rolled back"))
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the blob should be rolled back. got %v", err)
+	}
+
+	err = WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		panic("boom")
+	})
+	if !errors.Is(err, ErrTxPanic) {
+		t.Errorf("expected ErrTxPanic. got %v", err)
+	}
+
+	attempts := 0
+	err = WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("db.AddBlob(ctx, tx, blob). %w", sqlite3.Error{Code: sqlite3.ErrBusy})
+		}
+		return addBlob("retried")(tx)
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("busy transactions should be tried again. attempts %v err %v", attempts, err)
+	}
+
+	attempts = 0
+	err = WithTx(ctx, sqlite, func(tx *sql.Tx) error {
+		attempts++
+		return sqlite3.Error{Code: sqlite3.ErrLocked}
+	})
+	if !errors.Is(err, ErrDatabaseBusy) || attempts != TxMaxAttempts {
+		t.Errorf("expected ErrDatabaseBusy after %v attempts. got %v after %v", TxMaxAttempts, err, attempts)
+	}
+}
@@ -0,0 +1,223 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"ratasker/internal/cashu"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"ratasker/internal/jobs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MIN_FREE_STORAGE_BYTES makes the server unready when the storage has less free space. 0 turns the check off
+const MIN_FREE_STORAGE_BYTES = "MIN_FREE_STORAGE_BYTES"
+
+const DefaultMinFreeStorageBytes = 1 << 30
+
+const (
+	// CacheDuration keeps probes from hitting the mints and the storage on every request
+	CacheDuration = 10 * time.Second
+	CheckTimeout  = 5 * time.Second
+	// KeyRotationGrace is how long the active pubkey can stay expired before rotation counts as overdue
+	KeyRotationGrace = 1 * time.Minute
+)
+
+var (
+	ErrNotEnoughFreeSpace  = errors.New("Not enough free space")
+	ErrNoSatKeyset         = errors.New("Mint has no active sat keyset")
+	ErrKeyRotationOverdue  = errors.New("Key rotation is overdue")
+	ErrJobsUnhealthy       = errors.New("Background jobs are failing")
+	ErrStorageNotCheckable = errors.New("Storage can not be checked")
+)
+
+// CheckFunc returns an optional detail for the report. Errors make the server unready
+type CheckFunc func(ctx context.Context) (string, error)
+
+type Check struct {
+	Name       string `json:"name"`
+	Ok         bool   `json:"ok"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type Report struct {
+	Ready     bool      `json:"ready"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []Check   `json:"checks"`
+}
+
+type namedCheck struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs every check concurrently and keeps the report for CacheDuration
+type Checker struct {
+	mu       sync.Mutex
+	checks   []namedCheck
+	cacheFor time.Duration
+	last     Report
+}
+
+func NewChecker(cacheFor time.Duration) *Checker {
+	return &Checker{cacheFor: cacheFor}
+}
+
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, fn: fn})
+}
+
+// Report returns the cached report or runs the checks again. Concurrent callers wait for the same run
+func (c *Checker) Report(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.last.CheckedAt.IsZero() && time.Since(c.last.CheckedAt) < c.cacheFor {
+		return c.last
+	}
+
+	report := Report{Ready: true, CheckedAt: time.Now(), Checks: make([]Check, len(c.checks))}
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = runCheck(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	for _, check := range report.Checks {
+		report.Ready = report.Ready && check.Ok
+	}
+	c.last = report
+	return report
+}
+
+func runCheck(ctx context.Context, check namedCheck) (result Check) {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	result.Name = check.name
+	defer func() {
+		if p := recover(); p != nil {
+			result.Ok = false
+			result.Error = fmt.Sprintf("check panicked: %v", p)
+		}
+		result.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	detail, err := check.fn(ctx)
+	result.Detail = detail
+	result.Ok = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// DatabaseCheck writes a row so a read only or locked database fails
+func DatabaseCheck(db database.Database) CheckFunc {
+	return func(ctx context.Context) (string, error) {
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			return db.WriteHealthCheck(ctx, tx, uint64(time.Now().Unix()))
+		})
+		if err != nil {
+			return "", fmt.Errorf("db.WriteHealthCheck(ctx, tx, now). %w", err)
+		}
+		return "", nil
+	}
+}
+
+// StorageCheck writes a probe and compares the free space with minFreeBytes.
+// Storages that don't know their free space, like S3, only get the write probe
+func StorageCheck(storage io.BlossomIO, minFreeBytes uint64) CheckFunc {
+	return func(ctx context.Context) (string, error) {
+		healthIO, ok := storage.(io.HealthIO)
+		if !ok {
+			return "", fmt.Errorf("%w. %T", ErrStorageNotCheckable, storage)
+		}
+
+		err := healthIO.CheckWritable(ctx)
+		if err != nil {
+			return "", fmt.Errorf("healthIO.CheckWritable(ctx). %w", err)
+		}
+
+		free, err := healthIO.FreeBytes()
+		if errors.Is(err, io.ErrFreeSpaceUnknown) {
+			return "free space unknown", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("healthIO.FreeBytes(). %w", err)
+		}
+
+		detail := fmt.Sprintf("%v bytes free", free)
+		if free < minFreeBytes {
+			return detail, fmt.Errorf("%w. %v bytes free, %v needed", ErrNotEnoughFreeSpace, free, minFreeBytes)
+		}
+		return detail, nil
+	}
+}
+
+// MintCheck asks the mint for its active keysets. Payments can only be verified with a sat keyset
+func MintCheck(mintURL string) CheckFunc {
+	return func(ctx context.Context) (string, error) {
+		keys, err := cashu.GetActiveKeysets(ctx, mintURL)
+		if err != nil {
+			return "", fmt.Errorf("cashu.GetActiveKeysets(ctx, mintURL). %w", err)
+		}
+		for _, keyset := range keys.Keysets {
+			if keyset.Unit == "sat" {
+				return "keyset " + keyset.Id, nil
+			}
+		}
+		return "", ErrNoSatKeyset
+	}
+}
+
+// KeyRotationCheck fails when the active pubkey expired more than KeyRotationGrace ago
+func KeyRotationCheck(db database.Database) CheckFunc {
+	return func(ctx context.Context) (string, error) {
+		var pubkey database.CurrentPubkey
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			pubkey, err = db.GetActivePubkey(ctx, tx)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("db.GetActivePubkey(ctx, tx). %w", err)
+		}
+
+		expiration := time.Unix(int64(pubkey.Expiration), 0)
+		detail := fmt.Sprintf("pubkey %v expires at %v", pubkey.VersionNum, expiration.UTC().Format(time.RFC3339))
+		if time.Now().After(expiration.Add(KeyRotationGrace)) {
+			return detail, ErrKeyRotationOverdue
+		}
+		return detail, nil
+	}
+}
+
+// JobsCheck fails when a background job failed jobs.UnhealthyFailures times in a row
+func JobsCheck(supervisor *jobs.Supervisor) CheckFunc {
+	return func(ctx context.Context) (string, error) {
+		failing := []string{}
+		for _, status := range supervisor.Status() {
+			if status.Failures >= jobs.UnhealthyFailures {
+				failing = append(failing, status.Name)
+			}
+		}
+		if len(failing) > 0 {
+			return "", fmt.Errorf("%w. %v", ErrJobsUnhealthy, strings.Join(failing, ", "))
+		}
+		return "", nil
+	}
+}
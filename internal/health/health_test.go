@@ -0,0 +1,112 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckerCachesReport(t *testing.T) {
+	checker := NewChecker(time.Hour)
+	runs := 0
+	checker.Add("counted", func(ctx context.Context) (string, error) {
+		runs++
+		return "fine", nil
+	})
+	checker.Add("broken", func(ctx context.Context) (string, error) {
+		return "", errors.New("broken")
+	})
+
+	report := checker.Report(context.Background())
+	checker.Report(context.Background())
+	if runs != 1 {
+		t.Errorf("the report should be cached. ran %v times", runs)
+	}
+	if report.Ready || !report.Checks[0].Ok || report.Checks[0].Detail != "fine" || report.Checks[1].Error != "broken" {
+		t.Errorf("a failed check should make the server unready. got %+v", report)
+	}
+}
+
+func TestStorageCheck(t *testing.T) {
+	storage := io.LocalFSHandler{DataPath: t.TempDir()}
+
+	_, err := StorageCheck(storage, 1)(context.Background())
+	if err != nil {
+		t.Fatalf("StorageCheck(storage, 1) %+v", err)
+	}
+
+	_, err = StorageCheck(storage, 1<<62)(context.Background())
+	if !errors.Is(err, ErrNotEnoughFreeSpace) {
+		t.Errorf("expected ErrNotEnoughFreeSpace. got %v", err)
+	}
+
+	_, err = StorageCheck(io.LocalFSHandler{DataPath: storage.DataPath + "/missing"}, 0)(context.Background())
+	if err == nil {
+		t.Errorf("a missing data path should not be writable")
+	}
+}
+
+func TestMintCheck(t *testing.T) {
+	unit := "sat"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/keys" {
+			t.Errorf("unexpected request %v", r.URL.Path)
+		}
+		w.Write([]byte(`{"keysets": [{"id": "00aa", "unit": "` + unit + `", "keys": {}}]}`))
+	}))
+	defer server.Close()
+
+	detail, err := MintCheck(server.URL)(context.Background())
+	if err != nil || !strings.Contains(detail, "00aa") {
+		t.Fatalf("MintCheck(server.URL) %v %+v", detail, err)
+	}
+
+	unit = "usd"
+	_, err = MintCheck(server.URL)(context.Background())
+	if !errors.Is(err, ErrNoSatKeyset) {
+		t.Errorf("expected ErrNoSatKeyset. got %v", err)
+	}
+}
+
+func TestDatabaseAndKeyRotationCheck(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("database.DatabaseSetup(ctx, dir, database.EmbedMigrations) %+v", err)
+	}
+	defer db.Close()
+
+	_, err = DatabaseCheck(db)(ctx)
+	if err != nil {
+		t.Fatalf("DatabaseCheck(db) %+v", err)
+	}
+
+	rotate := func(expiration time.Time) {
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			_, err := db.RotateNewPubkey(ctx, tx, expiration.Unix())
+			return err
+		})
+		if err != nil {
+			t.Fatalf("db.RotateNewPubkey(ctx, tx, expiration) %+v", err)
+		}
+	}
+
+	rotate(time.Now().Add(time.Hour))
+	_, err = KeyRotationCheck(db)(ctx)
+	if err != nil {
+		t.Errorf("KeyRotationCheck(db) %+v", err)
+	}
+
+	rotate(time.Now().Add(-KeyRotationGrace - time.Minute))
+	_, err = KeyRotationCheck(db)(ctx)
+	if !errors.Is(err, ErrKeyRotationOverdue) {
+		t.Errorf("expected ErrKeyRotationOverdue. got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ENCRYPT_BLOBS = "ENCRYPT_BLOBS"
+
+	// plaintext bytes in every encrypted chunk. Range reads decrypt only the chunks they need
+	EncryptedChunkSize = 64 * 1024
+
+	encryptedHeaderSize = 16
+	gcmOverhead         = 16
+	encryptedVersion    = 1
+)
+
+var (
+	encryptedMagic = []byte("RTSE")
+
+	ErrBlobCorrupt     = errors.New("Blob failed authentication")
+	ErrNoEncryptionKey = errors.New("No seed to derive encryption keys")
+)
+
+// EncryptedIO encrypts blobs before handing them to another BlossomIO.
+// Every blob has its own key derived from the seed and its sha256, so the key of a blob is still its plaintext hash.
+//
+// Stored format: a 16 byte header (magic, version, plaintext size) followed by AES-GCM chunks.
+// The header is authenticated with every chunk and the last chunk is marked in its nonce so truncation is detected.
+// Blobs without the header were written before encryption was turned on and are read as plaintext.
+type EncryptedIO struct {
+	inner BlossomIO
+	seed  []byte
+}
+
+func MakeEncryptedIO(inner BlossomIO, seed string) (EncryptedIO, error) {
+	if seed == "" {
+		return EncryptedIO{}, ErrNoEncryptionKey
+	}
+	return EncryptedIO{inner: inner, seed: []byte(seed)}, nil
+}
+
+func (e EncryptedIO) blobCipher(path string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, e.seed, []byte("ratasker blob encryption"), []byte(filepath.Base(path)))
+	_, err := kdf.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("kdf.Read(key). %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher(key). %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM(block). %w", err)
+	}
+	return aead, nil
+}
+
+func chunkCount(size uint64) uint64 {
+	// empty blobs still get one chunk so the header is authenticated
+	if size == 0 {
+		return 1
+	}
+	return (size + EncryptedChunkSize - 1) / EncryptedChunkSize
+}
+
+func chunkNonce(aead cipher.AEAD, index uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func encryptedHeader(size uint64) []byte {
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedMagic)
+	header[4] = encryptedVersion
+	binary.BigEndian.PutUint64(header[8:], size)
+	return header
+}
+
+func parseEncryptedHeader(header []byte) (uint64, bool) {
+	if len(header) < encryptedHeaderSize || !bytes.Equal(header[:4], encryptedMagic) || header[4] != encryptedVersion {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(header[8:encryptedHeaderSize]), true
+}
+
+func (e EncryptedIO) WriteBlob(ctx context.Context, filename string, blob []byte) error {
+	aead, err := e.blobCipher(filename)
+	if err != nil {
+		return fmt.Errorf("e.blobCipher(filename). %w", err)
+	}
+
+	size := uint64(len(blob))
+	chunks := chunkCount(size)
+	header := encryptedHeader(size)
+
+	encrypted := make([]byte, 0, encryptedHeaderSize+size+chunks*uint64(aead.Overhead()))
+	encrypted = append(encrypted, header...)
+	for i := uint64(0); i < chunks; i++ {
+		start := i * EncryptedChunkSize
+		end := min(start+EncryptedChunkSize, size)
+		encrypted = aead.Seal(encrypted, chunkNonce(aead, i, i == chunks-1), blob[start:end], header)
+	}
+
+	err = e.inner.WriteBlob(ctx, filename, encrypted)
+	if err != nil {
+		return fmt.Errorf("e.inner.WriteBlob(ctx, filename, encrypted). %w", err)
+	}
+	return nil
+}
+
+func (e EncryptedIO) GetBlob(ctx context.Context, path string) ([]byte, error) {
+	stored, err := e.inner.GetBlob(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("e.inner.GetBlob(ctx, path). %w", err)
+	}
+
+	size, ok := parseEncryptedHeader(stored)
+	if !ok {
+		return stored, nil
+	}
+
+	plaintext, err := e.decryptChunks(path, stored[:encryptedHeaderSize], stored[encryptedHeaderSize:], 0, size)
+	if err != nil {
+		return nil, fmt.Errorf("e.decryptChunks(path, header, stored, 0, size). %w", err)
+	}
+	if uint64(len(plaintext)) != size {
+		return nil, ErrBlobCorrupt
+	}
+	return plaintext, nil
+}
+
+func (e EncryptedIO) GetBlobRange(ctx context.Context, path string, offset uint64, length uint64) ([]byte, error) {
+	header, err := e.inner.GetBlobRange(ctx, path, 0, encryptedHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("e.inner.GetBlobRange(ctx, path, 0, encryptedHeaderSize). %w", err)
+	}
+
+	size, ok := parseEncryptedHeader(header)
+	if !ok {
+		return e.inner.GetBlobRange(ctx, path, offset, length)
+	}
+	if length == 0 || offset >= size {
+		return []byte{}, nil
+	}
+	end := min(offset+length, size)
+
+	firstChunk := offset / EncryptedChunkSize
+	lastChunk := (end - 1) / EncryptedChunkSize
+	stored, err := e.inner.GetBlobRange(ctx, path,
+		encryptedHeaderSize+firstChunk*(EncryptedChunkSize+gcmOverhead),
+		(lastChunk-firstChunk+1)*(EncryptedChunkSize+gcmOverhead))
+	if err != nil {
+		return nil, fmt.Errorf("e.inner.GetBlobRange(ctx, path, chunks). %w", err)
+	}
+
+	plaintext, err := e.decryptChunks(path, header, stored, firstChunk, size)
+	if err != nil {
+		return nil, fmt.Errorf("e.decryptChunks(path, header, stored, firstChunk, size). %w", err)
+	}
+
+	start := offset - firstChunk*EncryptedChunkSize
+	if uint64(len(plaintext)) < start+end-offset {
+		return nil, ErrBlobCorrupt
+	}
+	return plaintext[start : start+end-offset], nil
+}
+
+// decryptChunks opens consecutive chunks starting at firstChunk
+func (e EncryptedIO) decryptChunks(path string, header []byte, stored []byte, firstChunk uint64, size uint64) ([]byte, error) {
+	aead, err := e.blobCipher(path)
+	if err != nil {
+		return nil, fmt.Errorf("e.blobCipher(path). %w", err)
+	}
+
+	chunks := chunkCount(size)
+	plaintext := []byte{}
+	for i := firstChunk; len(stored) > 0; i++ {
+		if i >= chunks {
+			return nil, ErrBlobCorrupt
+		}
+		chunkLen := min(uint64(len(stored)), EncryptedChunkSize+uint64(aead.Overhead()))
+		plaintext, err = aead.Open(plaintext, chunkNonce(aead, i, i == chunks-1), stored[:chunkLen], header)
+		if err != nil {
+			return nil, ErrBlobCorrupt
+		}
+		stored = stored[chunkLen:]
+	}
+
+	return plaintext, nil
+}
+
+func (e EncryptedIO) RemoveBlob(ctx context.Context, path string) error {
+	return e.inner.RemoveBlob(ctx, path)
+}
+
+func (e EncryptedIO) GetStoragePath() string {
+	return e.inner.GetStoragePath()
+}
+
+func (e EncryptedIO) WalkBlobs(ctx context.Context, fn func(info BlobInfo) error) error {
+	return e.inner.WalkBlobs(ctx, fn)
+}
+
+func (e EncryptedIO) QuarantineBlob(ctx context.Context, path string) error {
+	quarantine, ok := e.inner.(QuarantineIO)
+	if !ok {
+		return fmt.Errorf("%T can not quarantine blobs", e.inner)
+	}
+	return quarantine.QuarantineBlob(ctx, path)
+}
+
+func (e EncryptedIO) CheckWritable(ctx context.Context) error {
+	health, ok := e.inner.(HealthIO)
+	if !ok {
+		return fmt.Errorf("%T can not be checked", e.inner)
+	}
+	return health.CheckWritable(ctx)
+}
+
+func (e EncryptedIO) FreeBytes() (uint64, error) {
+	health, ok := e.inner.(HealthIO)
+	if !ok {
+		return 0, ErrFreeSpaceUnknown
+	}
+	return health.FreeBytes()
+}
+
+func (e EncryptedIO) Promote(ctx context.Context, path string) error {
+	tiers, ok := e.inner.(TierIO)
+	if !ok {
+		return fmt.Errorf("%T has no storage tiers", e.inner)
+	}
+	return tiers.Promote(ctx, path)
+}
+
+func (e EncryptedIO) Demote(ctx context.Context, path string) error {
+	tiers, ok := e.inner.(TierIO)
+	if !ok {
+		return fmt.Errorf("%T has no storage tiers", e.inner)
+	}
+	return tiers.Demote(ctx, path)
+}
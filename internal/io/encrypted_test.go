@@ -0,0 +1,109 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestEncryptedIORoundTrip(t *testing.T) {
+	local := LocalFSHandler{DataPath: t.TempDir()}
+	encrypted, err := MakeEncryptedIO(local, "test seed")
+	if err != nil {
+		t.Fatalf("MakeEncryptedIO(local, seed) %+v", err)
+	}
+
+	blob := make([]byte, 3*EncryptedChunkSize+100)
+	_, err = rand.Read(blob)
+	if err != nil {
+		t.Fatalf("rand.Read(blob) %+v", err)
+	}
+	hash := sha256.Sum256(blob)
+	key := hex.EncodeToString(hash[:])
+
+	err = encrypted.WriteBlob(context.Background(), key, blob)
+	if err != nil {
+		t.Fatalf("encrypted.WriteBlob(context.Background(), key, blob) %+v", err)
+	}
+
+	stored, err := local.GetBlob(context.Background(), key)
+	if err != nil {
+		t.Fatalf("local.GetBlob(context.Background(), key) %+v", err)
+	}
+	if bytes.Contains(stored, blob[:1024]) {
+		t.Fatalf("blob should not be stored in plaintext")
+	}
+
+	fileBytes, err := encrypted.GetBlob(context.Background(), key)
+	if err != nil {
+		t.Fatalf("encrypted.GetBlob(context.Background(), key) %+v", err)
+	}
+	if !bytes.Equal(fileBytes, blob) {
+		t.Errorf("decrypted blob is different")
+	}
+
+	ranges := [][2]uint64{{0, 10}, {EncryptedChunkSize - 5, 10}, {EncryptedChunkSize, EncryptedChunkSize}, {uint64(len(blob)) - 50, 50}, {100, 2 * EncryptedChunkSize}}
+	for _, r := range ranges {
+		part, err := encrypted.GetBlobRange(context.Background(), key, r[0], r[1])
+		if err != nil {
+			t.Fatalf("encrypted.GetBlobRange(context.Background(), key, %v, %v) %+v", r[0], r[1], err)
+		}
+		if !bytes.Equal(part, blob[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v-%v is different", r[0], r[0]+r[1])
+		}
+	}
+
+	// a flipped bit fails authentication
+	stored[len(stored)-20] ^= 1
+	err = local.WriteBlob(context.Background(), key, stored)
+	if err != nil {
+		t.Fatalf("local.WriteBlob(context.Background(), key, stored) %+v", err)
+	}
+	_, err = encrypted.GetBlob(context.Background(), key)
+	if !errors.Is(err, ErrBlobCorrupt) {
+		t.Errorf("tampered blob should fail. got: %+v", err)
+	}
+
+	// so does a truncated one
+	err = os.Truncate(local.ShardedPath(key), int64(len(stored)-EncryptedChunkSize/2))
+	if err != nil {
+		t.Fatalf("os.Truncate(path) %+v", err)
+	}
+	_, err = encrypted.GetBlob(context.Background(), key)
+	if !errors.Is(err, ErrBlobCorrupt) {
+		t.Errorf("truncated blob should fail. got: %+v", err)
+	}
+}
+
+func TestEncryptedIOReadsPlaintextBlobs(t *testing.T) {
+	local := LocalFSHandler{DataPath: t.TempDir()}
+	encrypted, err := MakeEncryptedIO(local, "test seed")
+	if err != nil {
+		t.Fatalf("MakeEncryptedIO(local, seed) %+v", err)
+	}
+
+	blob := []byte("written before encryption was turned on")
+	err = local.WriteBlob(context.Background(), "plain", blob)
+	if err != nil {
+		t.Fatalf("local.WriteBlob(context.Background(), plain, blob) %+v", err)
+	}
+
+	fileBytes, err := encrypted.GetBlob(context.Background(), "plain")
+	if err != nil || !bytes.Equal(fileBytes, blob) {
+		t.Errorf("plaintext blob should be readable. %+v", err)
+	}
+	part, err := encrypted.GetBlobRange(context.Background(), "plain", 8, 6)
+	if err != nil || string(part) != "before" {
+		t.Errorf("plaintext range should be readable. got: %s %+v", part, err)
+	}
+
+	_, err = MakeEncryptedIO(local, "")
+	if !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("should need a seed. got: %+v", err)
+	}
+}
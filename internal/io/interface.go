@@ -1,8 +1,124 @@
 package io
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"ratasker/internal/utils"
+	"strconv"
+	"time"
+)
+
+// BlossomIO stores blobs by key. The key is what gets saved in blobs.path
 type BlossomIO interface {
-	WriteBlob(filename string, blob []byte) error
-	GetBlob(path string) ([]byte, error)
-	RemoveBlob(path string) error
+	WriteBlob(ctx context.Context, filename string, blob []byte) error
+	GetBlob(ctx context.Context, path string) ([]byte, error)
+	// reads length bytes starting at offset. Used for range requests
+	GetBlobRange(ctx context.Context, path string, offset uint64, length uint64) ([]byte, error)
+	RemoveBlob(ctx context.Context, path string) error
 	GetStoragePath() string
+	// calls fn for every stored blob. Used to find files without a row
+	WalkBlobs(ctx context.Context, fn func(info BlobInfo) error) error
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    uint64
+	ModTime time.Time
+}
+
+// QuarantineIO is implemented by storages that can set a blob aside instead of deleting it
+type QuarantineIO interface {
+	QuarantineBlob(ctx context.Context, path string) error
+}
+
+// RedirectIO is implemented by storages that can serve a download directly to the client
+type RedirectIO interface {
+	// returns false if downloads should be streamed by ratasker
+	DownloadURL(ctx context.Context, path string, expiry time.Duration) (string, bool, error)
+}
+
+// HealthIO is implemented by storages that can be checked by the readiness probe
+type HealthIO interface {
+	// writes and removes a small probe
+	CheckWritable(ctx context.Context) error
+	// returns ErrFreeSpaceUnknown when the storage can't tell
+	FreeBytes() (uint64, error)
+}
+
+// MakeBlossomIOFromOsEnv selects the storage backend set in STORAGE_BACKEND. Defaults to the local filesystem.
+// Blobs are encrypted with keys derived from the seed if ENCRYPT_BLOBS is true
+func MakeBlossomIOFromOsEnv(seed string) (BlossomIO, error) {
+	storage, err := makeStorageFromOsEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// a local hot tier goes in front of the configured storage when it has a budget
+	hotBytes := os.Getenv(HOT_STORAGE_BYTES)
+	if hotBytes != "" && hotBytes != "0" {
+		hot, err := makeHotStorageFromOsEnv()
+		if err != nil {
+			return nil, fmt.Errorf("makeHotStorageFromOsEnv(). %w", err)
+		}
+		storage = TieredIO{Hot: hot, Cold: storage}
+	}
+
+	encrypt := os.Getenv(ENCRYPT_BLOBS)
+	if encrypt == "" {
+		return storage, nil
+	}
+	value, err := strconv.ParseBool(encrypt)
+	if err != nil {
+		return nil, fmt.Errorf("strconv.ParseBool(encrypt). %w", err)
+	}
+	if !value {
+		return storage, nil
+	}
+
+	encrypted, err := MakeEncryptedIO(storage, seed)
+	if err != nil {
+		return nil, fmt.Errorf("MakeEncryptedIO(storage, seed). %w", err)
+	}
+	return encrypted, nil
+}
+
+func makeHotStorageFromOsEnv() (LocalFSHandler, error) {
+	path := os.Getenv(HOT_STORAGE_PATH)
+	if path == "" {
+		homeDir, err := utils.GetRastaskerHomeDirectory()
+		if err != nil {
+			return LocalFSHandler{}, fmt.Errorf("utils.GetRastaskerHomeDirectory(). %w", err)
+		}
+		path = homeDir + "/" + "hot"
+	}
+
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return LocalFSHandler{}, fmt.Errorf("os.MkdirAll(path, 0755). %w", err)
+	}
+	return LocalFSHandler{DataPath: path}, nil
+}
+
+func makeStorageFromOsEnv() (BlossomIO, error) {
+	switch os.Getenv(STORAGE_BACKEND) {
+	case "", LocalBackend:
+		handler, err := MakeFileSystemHandler()
+		if err != nil {
+			return nil, fmt.Errorf("MakeFileSystemHandler(). %w", err)
+		}
+		return handler, nil
+	case S3Backend:
+		config, err := S3ConfigFromOsEnv()
+		if err != nil {
+			return nil, fmt.Errorf("S3ConfigFromOsEnv(). %w", err)
+		}
+		handler, err := MakeS3Handler(config)
+		if err != nil {
+			return nil, fmt.Errorf("MakeS3Handler(config). %w", err)
+		}
+		return handler, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %v", os.Getenv(STORAGE_BACKEND))
+	}
 }
@@ -1,11 +1,25 @@
 package io
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"ratasker/internal/utils"
+	"strings"
 )
 
+var (
+	ErrBlobFileNotFound = errors.New("Blob file not found")
+	ErrBlobFileMismatch = errors.New("Blob files do not match")
+	ErrFreeSpaceUnknown = errors.New("Free space unknown")
+)
+
+// LocalFSHandler stores blobs in a sharded layout derived from the hash: data/ab/cd/abcd...
 type LocalFSHandler struct {
 	DataPath string
 }
@@ -29,24 +43,84 @@ func MakeFileSystemHandler() (LocalFSHandler, error) {
 	return handler, nil
 }
 
-func (l LocalFSHandler) WriteBlob(filename string, blob []byte) error {
-	err := os.WriteFile(l.DataPath+"/"+filename, blob, 0764)
+// ShardedPath is where a blob key lives: two levels of directories named after the first 4 characters
+func (l LocalFSHandler) ShardedPath(key string) string {
+	if len(key) < 4 {
+		return filepath.Join(l.DataPath, key)
+	}
+	return filepath.Join(l.DataPath, key[0:2], key[2:4], key)
+}
+
+// legacyPaths are the places a blob could be before running the storage migration.
+// Old rows have the absolute path of a flat data directory, which breaks if the home moved.
+func (l LocalFSHandler) legacyPaths(path string) []string {
+	key := filepath.Base(path)
+	paths := []string{filepath.Join(l.DataPath, key)}
+	if filepath.IsAbs(path) {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// blobPath finds the file of a key. It falls back to the legacy locations so blobs can be served during the migration
+func (l LocalFSHandler) blobPath(path string) string {
+	sharded := l.ShardedPath(filepath.Base(path))
+	if _, err := os.Stat(sharded); err == nil {
+		return sharded
+	}
+
+	for _, legacy := range l.legacyPaths(path) {
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return sharded
+}
+
+// WriteBlob never leaves a partial file in the final path. The blob is written and synced to a temp file
+// in the same directory and then renamed over.
+func (l LocalFSHandler) WriteBlob(ctx context.Context, filename string, blob []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := l.ShardedPath(filename)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf(`os.MkdirAll(filepath.Dir(path), 0755). %w`, err)
+	}
+
+	err = writeFileAtomic(path, bytes.NewReader(blob))
 	if err != nil {
-		return fmt.Errorf(`os.WriteFile(l.DataPath, blob, 0764). %w`, err)
+		return fmt.Errorf(`writeFileAtomic(path, blob). %w`, err)
 	}
 	return nil
 }
 
-func (l LocalFSHandler) GetBlob(path string) ([]byte, error) {
-	fileBytes, err := os.ReadFile(path)
+func (l LocalFSHandler) GetBlob(ctx context.Context, path string) ([]byte, error) {
+	fileBytes, err := os.ReadFile(l.blobPath(path))
 	if err != nil {
 		return fileBytes, fmt.Errorf(`os.ReadFile(path). %w`, err)
 	}
 	return fileBytes, nil
 }
 
-func (l LocalFSHandler) RemoveBlob(path string) error {
-	err := os.Remove(path)
+func (l LocalFSHandler) GetBlobRange(ctx context.Context, path string, offset uint64, length uint64) ([]byte, error) {
+	file, err := os.Open(l.blobPath(path))
+	if err != nil {
+		return nil, fmt.Errorf(`os.Open(path). %w`, err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, length)
+	n, err := file.ReadAt(buf, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf(`file.ReadAt(buf, int64(offset)). %w`, err)
+	}
+	return buf[:n], nil
+}
+
+func (l LocalFSHandler) RemoveBlob(ctx context.Context, path string) error {
+	err := os.Remove(l.blobPath(path))
 	if err != nil {
 		return fmt.Errorf(`os.Remove(path) %w`, err)
 	}
@@ -57,3 +131,241 @@ func (l LocalFSHandler) RemoveBlob(path string) error {
 func (l LocalFSHandler) GetStoragePath() string {
 	return l.DataPath
 }
+
+func (l LocalFSHandler) WalkBlobs(ctx context.Context, fn func(info BlobInfo) error) error {
+	err := filepath.WalkDir(l.DataPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// a long walk stops when the caller gives up
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// unfinished writes are not blobs yet
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("entry.Info(). %w", err)
+		}
+		return fn(BlobInfo{Key: entry.Name(), Size: uint64(info.Size()), ModTime: info.ModTime()})
+	})
+	if err != nil {
+		return fmt.Errorf("filepath.WalkDir(l.DataPath). %w", err)
+	}
+	return nil
+}
+
+// CheckWritable writes a temp file in the data directory. WalkBlobs skips it like any unfinished write
+func (l LocalFSHandler) CheckWritable(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(l.DataPath, ".tmp-health-*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(l.DataPath). %w", err)
+	}
+	defer os.Remove(probe.Name())
+
+	_, err = probe.Write([]byte("ok"))
+	if err == nil {
+		err = probe.Sync()
+	}
+	closeErr := probe.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing probe %v. %w", probe.Name(), err)
+	}
+	return nil
+}
+
+// FreeBytes is the space left for unprivileged users in the file system of the data directory
+func (l LocalFSHandler) FreeBytes() (uint64, error) {
+	return freeDiskBytes(l.DataPath)
+}
+
+// QuarantineBlob moves the blob next to the data directory so it is not served or walked
+func (l LocalFSHandler) QuarantineBlob(ctx context.Context, path string) error {
+	quarantine := filepath.Join(filepath.Dir(l.DataPath), "quarantine")
+	err := os.MkdirAll(quarantine, 0755)
+	if err != nil {
+		return fmt.Errorf("os.MkdirAll(quarantine, 0755). %w", err)
+	}
+
+	err = os.Rename(l.blobPath(path), filepath.Join(quarantine, filepath.Base(path)))
+	if err != nil {
+		return fmt.Errorf("os.Rename(path, quarantine). %w", err)
+	}
+	return nil
+}
+
+// MigrateBlob moves a blob from its legacy location to the sharded layout.
+// It is safe to run again after being interrupted: a blob already in place is left alone.
+func (l LocalFSHandler) MigrateBlob(path string, key string) error {
+	dest := l.ShardedPath(key)
+
+	source := ""
+	for _, legacy := range l.legacyPaths(path) {
+		if legacy == dest {
+			continue
+		}
+		if _, err := os.Stat(legacy); err == nil {
+			source = legacy
+			break
+		}
+	}
+
+	_, err := os.Stat(dest)
+	destExists := err == nil
+
+	switch {
+	case destExists && source == "":
+		return nil
+	case !destExists && source == "":
+		return ErrBlobFileNotFound
+	case destExists:
+		// an earlier copy finished but the source was not removed
+		err = checkSameFile(dest, source)
+		if err != nil {
+			return fmt.Errorf("checkSameFile(dest, source). %w", err)
+		}
+		err = os.Remove(source)
+		if err != nil {
+			return fmt.Errorf("os.Remove(source). %w", err)
+		}
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return fmt.Errorf("os.MkdirAll(filepath.Dir(dest), 0755). %w", err)
+	}
+
+	err = os.Rename(source, dest)
+	if err == nil {
+		return nil
+	}
+
+	// the old data directory can be on another device, copy it instead
+	err = copyFile(source, dest)
+	if err != nil {
+		return fmt.Errorf("copyFile(source, dest). %w", err)
+	}
+	err = checkSameFile(dest, source)
+	if err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("checkSameFile(dest, source). %w", err)
+	}
+	err = os.Remove(source)
+	if err != nil {
+		return fmt.Errorf("os.Remove(source). %w", err)
+	}
+	return nil
+}
+
+func copyFile(source string, dest string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("os.Open(source). %w", err)
+	}
+	defer in.Close()
+
+	err = writeFileAtomic(dest, in)
+	if err != nil {
+		return fmt.Errorf("writeFileAtomic(dest, in). %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic makes sure a crash leaves either the whole file or nothing in path
+func writeFileAtomic(path string, content io.Reader) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(dir). %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	_, err = io.Copy(tmp, content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("writing temp file %v. %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("os.Rename(tmpPath, path). %w", err)
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return fmt.Errorf("syncDir(dir). %w", err)
+	}
+	return nil
+}
+
+// syncDir persists the rename in the directory entry
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("os.Open(dir). %w", err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("d.Sync(). %w", err)
+	}
+	return nil
+}
+
+// checkSameFile compares the files byte by byte. Blobs can be encrypted so their hash is not checked here
+func checkSameFile(path string, other string) error {
+	a, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os.Open(path). %w", err)
+	}
+	defer a.Close()
+	b, err := os.Open(other)
+	if err != nil {
+		return fmt.Errorf("os.Open(other). %w", err)
+	}
+	defer b.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, errB := io.ReadFull(b, bufB)
+		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return ErrBlobFileMismatch
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			if errB != errA {
+				return ErrBlobFileMismatch
+			}
+			return nil
+		}
+		if errA != nil {
+			return fmt.Errorf("io.ReadFull(a, bufA). %w", errA)
+		}
+		if errB != nil {
+			return fmt.Errorf("io.ReadFull(b, bufB). %w", errB)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package io
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalFSWriteBlob(t *testing.T) {
+	handler := LocalFSHandler{DataPath: t.TempDir()}
+	key := "ffa63583dfa6706b87d284b86b0d693a161e4840aad2c5cf6b5d27c3b9621f7d"
+
+	err := handler.WriteBlob(context.Background(), key, []byte("first"))
+	if err != nil {
+		t.Fatalf("handler.WriteBlob(context.Background(), key, blob) %+v", err)
+	}
+	// writing again replaces the whole file
+	err = handler.WriteBlob(context.Background(), key, []byte("second"))
+	if err != nil {
+		t.Fatalf("handler.WriteBlob(context.Background(), key, blob) %+v", err)
+	}
+
+	path := filepath.Join(handler.DataPath, "ff", "a6", key)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(path) %+v", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("blob should have 0644 permissions. got: %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("os.ReadDir(dir) %+v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temp files should not be left behind. got: %v entries", len(entries))
+	}
+
+	fileBytes, err := handler.GetBlob(context.Background(), key)
+	if err != nil {
+		t.Fatalf("handler.GetBlob(context.Background(), key) %+v", err)
+	}
+	if string(fileBytes) != "second" {
+		t.Errorf("blob should be the last write. got: %s", fileBytes)
+	}
+}
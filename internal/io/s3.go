@@ -0,0 +1,278 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	STORAGE_BACKEND       = "STORAGE_BACKEND"
+	S3_ENDPOINT           = "S3_ENDPOINT"
+	S3_BUCKET             = "S3_BUCKET"
+	S3_ACCESS_KEY         = "S3_ACCESS_KEY"
+	S3_SECRET_KEY         = "S3_SECRET_KEY"
+	S3_REGION             = "S3_REGION"
+	S3_USE_SSL            = "S3_USE_SSL"
+	S3_REDIRECT_DOWNLOADS = "S3_REDIRECT_DOWNLOADS"
+	// every object is stored under this prefix so the bucket can be shared. Empty uses the whole bucket
+	S3_KEY_PREFIX = "S3_KEY_PREFIX"
+
+	LocalBackend = "local"
+	S3Backend    = "s3"
+
+	// blobs bigger than this are uploaded in multiple parts
+	S3PartSize = 16 * 1024 * 1024
+
+	S3QuarantinePrefix = "quarantine/"
+
+	// written and removed by the readiness probe
+	S3HealthProbeKey = ".ratasker-health"
+)
+
+var (
+	ErrNoS3Bucket   = errors.New("No S3 bucket set")
+	ErrNoS3Endpoint = errors.New("No S3 endpoint set")
+)
+
+type S3Config struct {
+	Endpoint          string
+	Bucket            string
+	AccessKey         string
+	SecretKey         string
+	Region            string
+	UseSSL            bool
+	RedirectDownloads bool
+	KeyPrefix         string
+}
+
+func S3ConfigFromOsEnv() (S3Config, error) {
+	config := S3Config{
+		Endpoint:  os.Getenv(S3_ENDPOINT),
+		Bucket:    os.Getenv(S3_BUCKET),
+		AccessKey: os.Getenv(S3_ACCESS_KEY),
+		SecretKey: os.Getenv(S3_SECRET_KEY),
+		Region:    os.Getenv(S3_REGION),
+		UseSSL:    true,
+		KeyPrefix: os.Getenv(S3_KEY_PREFIX),
+	}
+
+	if config.Endpoint == "" {
+		return config, ErrNoS3Endpoint
+	}
+	if config.Bucket == "" {
+		return config, ErrNoS3Bucket
+	}
+
+	useSSL := os.Getenv(S3_USE_SSL)
+	if useSSL != "" {
+		value, err := strconv.ParseBool(useSSL)
+		if err != nil {
+			return config, fmt.Errorf("strconv.ParseBool(useSSL). %w", err)
+		}
+		config.UseSSL = value
+	}
+
+	redirect := os.Getenv(S3_REDIRECT_DOWNLOADS)
+	if redirect != "" {
+		value, err := strconv.ParseBool(redirect)
+		if err != nil {
+			return config, fmt.Errorf("strconv.ParseBool(redirect). %w", err)
+		}
+		config.RedirectDownloads = value
+	}
+
+	return config, nil
+}
+
+// S3Handler stores blobs in any S3 compatible object storage. The object name is KeyPrefix and the blob key
+type S3Handler struct {
+	client            *minio.Client
+	Bucket            string
+	Endpoint          string
+	RedirectDownloads bool
+	KeyPrefix         string
+}
+
+func MakeS3Handler(config S3Config) (S3Handler, error) {
+	var handler S3Handler
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return handler, fmt.Errorf("minio.New(config.Endpoint). %w", err)
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return handler, fmt.Errorf("client.BucketExists(ctx, config.Bucket). %w", err)
+	}
+
+	if !exists {
+		err = client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region})
+		if err != nil {
+			return handler, fmt.Errorf("client.MakeBucket(ctx, config.Bucket). %w", err)
+		}
+	}
+
+	handler.client = client
+	handler.Bucket = config.Bucket
+	handler.Endpoint = config.Endpoint
+	handler.RedirectDownloads = config.RedirectDownloads
+	handler.KeyPrefix = config.KeyPrefix
+	if handler.KeyPrefix != "" && !strings.HasSuffix(handler.KeyPrefix, "/") {
+		handler.KeyPrefix += "/"
+	}
+
+	return handler, nil
+}
+
+func (s S3Handler) object(key string) string {
+	return s.KeyPrefix + key
+}
+
+func (s S3Handler) WriteBlob(ctx context.Context, filename string, blob []byte) error {
+	// parts are checked with Content-MD5 instead of chunked streaming signatures so every S3 implementation accepts them
+	_, err := s.client.PutObject(ctx, s.Bucket, s.object(filename), bytes.NewReader(blob), int64(len(blob)), minio.PutObjectOptions{
+		PartSize:             S3PartSize,
+		SendContentMd5:       true,
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return fmt.Errorf("s.client.PutObject(ctx, s.Bucket, filename). %w", err)
+	}
+	return nil
+}
+
+func (s S3Handler) GetBlob(ctx context.Context, path string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, s.Bucket, s.object(path), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("s.client.GetObject(ctx, s.Bucket, path). %w", err)
+	}
+	defer object.Close()
+
+	fileBytes, err := io.ReadAll(object)
+	if err != nil {
+		// missing objects look the same as missing local files
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("io.ReadAll(object). %w", fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("io.ReadAll(object). %w", err)
+	}
+	return fileBytes, nil
+}
+
+func (s S3Handler) GetBlobRange(ctx context.Context, path string, offset uint64, length uint64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	err := opts.SetRange(int64(offset), int64(offset+length-1))
+	if err != nil {
+		return nil, fmt.Errorf("opts.SetRange(offset, offset+length-1). %w", err)
+	}
+
+	object, err := s.client.GetObject(ctx, s.Bucket, s.object(path), opts)
+	if err != nil {
+		return nil, fmt.Errorf("s.client.GetObject(ctx, s.Bucket, path). %w", err)
+	}
+	defer object.Close()
+
+	fileBytes, err := io.ReadAll(object)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll(object). %w", err)
+	}
+	return fileBytes, nil
+}
+
+func (s S3Handler) RemoveBlob(ctx context.Context, path string) error {
+	err := s.client.RemoveObject(ctx, s.Bucket, s.object(path), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("s.client.RemoveObject(ctx, s.Bucket, path). %w", err)
+	}
+	return nil
+}
+
+func (s S3Handler) GetStoragePath() string {
+	return "s3://" + s.Endpoint + "/" + s.Bucket + "/" + s.KeyPrefix
+}
+
+func (s S3Handler) WalkBlobs(ctx context.Context, fn func(info BlobInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: s.KeyPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("s.client.ListObjects(ctx, s.Bucket). %w", object.Err)
+		}
+		key := strings.TrimPrefix(object.Key, s.KeyPrefix)
+		if strings.HasPrefix(key, S3QuarantinePrefix) || key == S3HealthProbeKey {
+			continue
+		}
+
+		err := fn(BlobInfo{Key: key, Size: uint64(object.Size), ModTime: object.LastModified})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s S3Handler) CheckWritable(ctx context.Context) error {
+	_, err := s.client.PutObject(ctx, s.Bucket, s.object(S3HealthProbeKey), strings.NewReader("ok"), 2, minio.PutObjectOptions{SendContentMd5: true})
+	if err != nil {
+		return fmt.Errorf("s.client.PutObject(ctx, s.Bucket, S3HealthProbeKey). %w", err)
+	}
+
+	err = s.client.RemoveObject(ctx, s.Bucket, s.object(S3HealthProbeKey), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("s.client.RemoveObject(ctx, s.Bucket, S3HealthProbeKey). %w", err)
+	}
+	return nil
+}
+
+// FreeBytes is unknown, buckets have no size limit we can read
+func (s S3Handler) FreeBytes() (uint64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
+
+// QuarantineBlob copies the object under the quarantine prefix and removes the original
+func (s S3Handler) QuarantineBlob(ctx context.Context, path string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.Bucket, Object: s.object(S3QuarantinePrefix + path)},
+		minio.CopySrcOptions{Bucket: s.Bucket, Object: s.object(path)})
+	if err != nil {
+		return fmt.Errorf("s.client.CopyObject(ctx, quarantine, path). %w", err)
+	}
+
+	err = s.client.RemoveObject(ctx, s.Bucket, s.object(path), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("s.client.RemoveObject(ctx, s.Bucket, path). %w", err)
+	}
+	return nil
+}
+
+// DownloadURL gives a pre-signed url so the client downloads from the storage directly.
+// The url serves the whole object, so it is only used for downloads of the whole blob
+func (s S3Handler) DownloadURL(ctx context.Context, path string, expiry time.Duration) (string, bool, error) {
+	if !s.RedirectDownloads {
+		return "", false, nil
+	}
+
+	url, err := s.client.PresignedGetObject(ctx, s.Bucket, s.object(path), expiry, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("s.client.PresignedGetObject(ctx, s.Bucket, path, expiry, nil). %w", err)
+	}
+	return url.String(), true, nil
+}
@@ -0,0 +1,145 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func setupFakeS3(t *testing.T, redirect bool) S3Handler {
+	backend := s3mem.New()
+	faker := gofakes3.New(backend)
+	server := httptest.NewServer(faker.Server())
+	t.Cleanup(server.Close)
+
+	config := S3Config{
+		Endpoint:          strings.TrimPrefix(server.URL, "http://"),
+		Bucket:            "ratasker",
+		AccessKey:         "access",
+		SecretKey:         "secret",
+		Region:            "us-east-1",
+		UseSSL:            false,
+		RedirectDownloads: redirect,
+	}
+
+	handler, err := MakeS3Handler(config)
+	if err != nil {
+		t.Fatalf("MakeS3Handler(config) %+v", err)
+	}
+	return handler
+}
+
+func TestS3WriteAndGetBlob(t *testing.T) {
+	handler := setupFakeS3(t, false)
+
+	blob := []byte("hello blossom from s3")
+	err := handler.WriteBlob(context.Background(), "blobkey", blob)
+	if err != nil {
+		t.Fatalf(`handler.WriteBlob(context.Background(), "blobkey", blob) %+v`, err)
+	}
+
+	stored, err := handler.GetBlob(context.Background(), "blobkey")
+	if err != nil {
+		t.Fatalf(`handler.GetBlob(context.Background(), "blobkey") %+v`, err)
+	}
+	if !bytes.Equal(stored, blob) {
+		t.Errorf("wrong blob. got: %s", stored)
+	}
+
+	part, err := handler.GetBlobRange(context.Background(), "blobkey", 6, 7)
+	if err != nil {
+		t.Fatalf(`handler.GetBlobRange(context.Background(), "blobkey", 6, 7) %+v`, err)
+	}
+	if string(part) != "blossom" {
+		t.Errorf("wrong range. got: %s", part)
+	}
+
+	_, redirect, err := handler.DownloadURL(context.Background(), "blobkey", time.Minute)
+	if err != nil || redirect {
+		t.Errorf("downloads should not be redirected. %+v", err)
+	}
+
+	err = handler.RemoveBlob(context.Background(), "blobkey")
+	if err != nil {
+		t.Fatalf(`handler.RemoveBlob(context.Background(), "blobkey") %+v`, err)
+	}
+
+	_, err = handler.GetBlob(context.Background(), "blobkey")
+	if err == nil {
+		t.Error("blob should be removed")
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	handler := setupFakeS3(t, true)
+
+	blob := bytes.Repeat([]byte("ratasker"), (S3PartSize/8)+1024)
+	err := handler.WriteBlob(context.Background(), "bigblob", blob)
+	if err != nil {
+		t.Fatalf(`handler.WriteBlob(context.Background(), "bigblob", blob) %+v`, err)
+	}
+
+	stored, err := handler.GetBlob(context.Background(), "bigblob")
+	if err != nil {
+		t.Fatalf(`handler.GetBlob(context.Background(), "bigblob") %+v`, err)
+	}
+	if !bytes.Equal(stored, blob) {
+		t.Errorf("multipart blob is different. got length: %v", len(stored))
+	}
+
+	url, redirect, err := handler.DownloadURL(context.Background(), "bigblob", time.Minute)
+	if err != nil || !redirect {
+		t.Fatalf(`handler.DownloadURL(context.Background(), "bigblob", time.Minute) %+v`, err)
+	}
+	if !strings.Contains(url, "bigblob") || !strings.Contains(url, "X-Amz-Signature") {
+		t.Errorf("url is not pre-signed. got: %v", url)
+	}
+}
+
+func TestS3KeyPrefix(t *testing.T) {
+	shared := setupFakeS3(t, false)
+	config := S3Config{
+		Endpoint:  shared.Endpoint,
+		Bucket:    shared.Bucket,
+		AccessKey: "access",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+		KeyPrefix: "ratasker",
+	}
+	handler, err := MakeS3Handler(config)
+	if err != nil {
+		t.Fatalf("MakeS3Handler(config) %+v", err)
+	}
+
+	err = shared.WriteBlob(context.Background(), "backups/db.sql", []byte("not ours"))
+	if err != nil {
+		t.Fatalf(`shared.WriteBlob(context.Background(), "backups/db.sql") %+v`, err)
+	}
+	err = handler.WriteBlob(context.Background(), "blobkey", []byte("ours"))
+	if err != nil {
+		t.Fatalf(`handler.WriteBlob(context.Background(), "blobkey") %+v`, err)
+	}
+
+	stored, err := shared.GetBlob(context.Background(), "ratasker/blobkey")
+	if err != nil || string(stored) != "ours" {
+		t.Errorf("blob should be stored under the prefix. %+v", err)
+	}
+
+	var keys []string
+	err = handler.WalkBlobs(context.Background(), func(info BlobInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("handler.WalkBlobs(context.Background()) %+v", err)
+	}
+	if len(keys) != 1 || keys[0] != "blobkey" {
+		t.Errorf("only keys under the prefix should be listed. got: %v", keys)
+	}
+}
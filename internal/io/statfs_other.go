@@ -0,0 +1,7 @@
+//go:build !unix
+
+package io
+
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
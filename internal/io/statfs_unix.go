@@ -0,0 +1,17 @@
+//go:build unix
+
+package io
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func freeDiskBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("syscall.Statfs(path). %w", err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,147 @@
+package io
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	HOT_STORAGE_BYTES = "HOT_STORAGE_BYTES"
+	HOT_STORAGE_PATH  = "HOT_STORAGE_PATH"
+)
+
+// TierIO is implemented by storages that keep a copy of popular blobs in faster storage
+type TierIO interface {
+	Promote(ctx context.Context, path string) error
+	Demote(ctx context.Context, path string) error
+}
+
+// TieredIO keeps every blob in the cold storage and a copy of the popular ones in the hot storage.
+// Reads go to the hot copy when there is one. Which blobs are hot is decided outside with Promote and Demote.
+type TieredIO struct {
+	Hot  BlossomIO
+	Cold BlossomIO
+}
+
+func (t TieredIO) WriteBlob(ctx context.Context, filename string, blob []byte) error {
+	err := t.Cold.WriteBlob(ctx, filename, blob)
+	if err != nil {
+		return fmt.Errorf("t.Cold.WriteBlob(ctx, filename, blob). %w", err)
+	}
+	return nil
+}
+
+func (t TieredIO) GetBlob(ctx context.Context, path string) ([]byte, error) {
+	fileBytes, err := t.Hot.GetBlob(ctx, path)
+	if err == nil {
+		return fileBytes, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("t.Hot.GetBlob(ctx, path). %w", err)
+	}
+
+	fileBytes, err = t.Cold.GetBlob(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("t.Cold.GetBlob(ctx, path). %w", err)
+	}
+	return fileBytes, nil
+}
+
+func (t TieredIO) GetBlobRange(ctx context.Context, path string, offset uint64, length uint64) ([]byte, error) {
+	fileBytes, err := t.Hot.GetBlobRange(ctx, path, offset, length)
+	if err == nil {
+		return fileBytes, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("t.Hot.GetBlobRange(ctx, path, offset, length). %w", err)
+	}
+
+	fileBytes, err = t.Cold.GetBlobRange(ctx, path, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("t.Cold.GetBlobRange(ctx, path, offset, length). %w", err)
+	}
+	return fileBytes, nil
+}
+
+func (t TieredIO) RemoveBlob(ctx context.Context, path string) error {
+	err := t.Demote(ctx, path)
+	if err != nil {
+		return fmt.Errorf("t.Demote(ctx, path). %w", err)
+	}
+
+	err = t.Cold.RemoveBlob(ctx, path)
+	if err != nil {
+		return fmt.Errorf("t.Cold.RemoveBlob(ctx, path). %w", err)
+	}
+	return nil
+}
+
+func (t TieredIO) GetStoragePath() string {
+	return t.Hot.GetStoragePath() + " -> " + t.Cold.GetStoragePath()
+}
+
+// WalkBlobs lists the cold storage, it has every blob
+func (t TieredIO) WalkBlobs(ctx context.Context, fn func(info BlobInfo) error) error {
+	return t.Cold.WalkBlobs(ctx, fn)
+}
+
+func (t TieredIO) QuarantineBlob(ctx context.Context, path string) error {
+	quarantine, ok := t.Cold.(QuarantineIO)
+	if !ok {
+		return fmt.Errorf("%T can not quarantine blobs", t.Cold)
+	}
+
+	err := t.Demote(ctx, path)
+	if err != nil {
+		return fmt.Errorf("t.Demote(ctx, path). %w", err)
+	}
+	return quarantine.QuarantineBlob(ctx, path)
+}
+
+// CheckWritable checks both tiers, uploads go to the cold one and promotions to the hot one
+func (t TieredIO) CheckWritable(ctx context.Context) error {
+	for _, tier := range []BlossomIO{t.Cold, t.Hot} {
+		health, ok := tier.(HealthIO)
+		if !ok {
+			return fmt.Errorf("%T can not be checked", tier)
+		}
+		err := health.CheckWritable(ctx)
+		if err != nil {
+			return fmt.Errorf("%T.CheckWritable(ctx). %w", tier, err)
+		}
+	}
+	return nil
+}
+
+// FreeBytes is the space of the cold storage, the one that keeps every blob
+func (t TieredIO) FreeBytes() (uint64, error) {
+	health, ok := t.Cold.(HealthIO)
+	if !ok {
+		return 0, ErrFreeSpaceUnknown
+	}
+	return health.FreeBytes()
+}
+
+// Promote copies the stored bytes as they are, encrypted blobs stay encrypted in the hot storage
+func (t TieredIO) Promote(ctx context.Context, path string) error {
+	fileBytes, err := t.Cold.GetBlob(ctx, path)
+	if err != nil {
+		return fmt.Errorf("t.Cold.GetBlob(ctx, path). %w", err)
+	}
+
+	err = t.Hot.WriteBlob(ctx, path, fileBytes)
+	if err != nil {
+		return fmt.Errorf("t.Hot.WriteBlob(ctx, path, fileBytes). %w", err)
+	}
+	return nil
+}
+
+func (t TieredIO) Demote(ctx context.Context, path string) error {
+	err := t.Hot.RemoveBlob(ctx, path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("t.Hot.RemoveBlob(ctx, path). %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// MaxBackoff caps the wait after repeated failures
+const MaxBackoff = 1 * time.Hour
+
+// UnhealthyFailures is the number of failed runs in a row that makes a job unhealthy
+const UnhealthyFailures = 3
+
+var (
+	ErrJobPanicked     = errors.New("Job panicked")
+	ErrInvalidInterval = errors.New("Job interval has to be positive")
+)
+
+type Job struct {
+	Name     string
+	Interval time.Duration
+	// RunAtStart runs the job right away instead of waiting for the first interval
+	RunAtStart bool
+	// FinishOnShutdown lets a run that already started finish after the shutdown. Use it for jobs
+	// that can't stop half way, like swapping proofs with a mint. The job has to bound its own run time
+	FinishOnShutdown bool
+	Run              func(ctx context.Context) error
+}
+
+// Status of a job. Failures is the number of failed runs since the last success
+type Status struct {
+	Name        string    `json:"name"`
+	Running     bool      `json:"running"`
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    uint64    `json:"failures"`
+	NextRun     time.Time `json:"next_run"`
+}
+
+// Supervisor runs the background jobs until its context ends. Failed runs are tried again with
+// an exponential backoff and panics are turned into errors
+type Supervisor struct {
+	mu     sync.Mutex
+	jobs   []Job
+	status map[string]*Status
+	wg     sync.WaitGroup
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{status: make(map[string]*Status)}
+}
+
+// Add registers a job. Jobs added after Start are not run
+func (s *Supervisor) Add(job Job) error {
+	if job.Interval <= 0 {
+		return fmt.Errorf("%w. job: %v", ErrInvalidInterval, job.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+	s.status[job.Name] = &Status{Name: job.Name}
+	return nil
+}
+
+func (s *Supervisor) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, job)
+	}
+}
+
+// Wait blocks until every job stopped or ctx ends
+func (s *Supervisor) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("jobs still running. %w", ctx.Err())
+	}
+}
+
+// Status returns the state of every job in the order they were added
+func (s *Supervisor) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []Status{}
+	for _, job := range s.jobs {
+		statuses = append(statuses, *s.status[job.Name])
+	}
+	return statuses
+}
+
+// Healthy is false when a job failed UnhealthyFailures times in a row
+func (s *Supervisor) Healthy() bool {
+	for _, status := range s.Status() {
+		if status.Failures >= UnhealthyFailures {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Supervisor) loop(ctx context.Context, job Job) {
+	defer s.wg.Done()
+
+	wait := job.Interval
+	if job.RunAtStart {
+		wait = 0
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	s.update(job.Name, func(status *Status) { status.NextRun = time.Now().Add(wait) })
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		runCtx := ctx
+		if job.FinishOnShutdown {
+			runCtx = context.WithoutCancel(ctx)
+		}
+
+		s.update(job.Name, func(status *Status) {
+			status.Running = true
+			status.LastRun = time.Now()
+		})
+		err := runJob(runCtx, job)
+
+		var failures uint64
+		s.update(job.Name, func(status *Status) {
+			status.Running = false
+			if err != nil {
+				status.Failures++
+				status.LastError = err.Error()
+			} else {
+				status.Failures = 0
+				status.LastError = ""
+				status.LastSuccess = time.Now()
+			}
+			failures = status.Failures
+		})
+
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Job failed", "job", job.Name, "failures", failures, "error", err)
+		}
+
+		wait = Backoff(job.Interval, failures)
+		s.update(job.Name, func(status *Status) { status.NextRun = time.Now().Add(wait) })
+		timer.Reset(wait)
+	}
+}
+
+func (s *Supervisor) update(name string, fn func(status *Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.status[name])
+}
+
+func runJob(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.ErrorContext(ctx, "Job panicked", "job", job.Name, "panic", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("%w: %v", ErrJobPanicked, p)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+// Backoff is the wait before the next run. It doubles the interval for every failure in a row up to MaxBackoff
+func Backoff(interval time.Duration, failures uint64) time.Duration {
+	wait := interval
+	for i := uint64(0); i < failures && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	if failures > 0 && wait > MaxBackoff {
+		return max(MaxBackoff, interval)
+	}
+	return wait
+}
@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	if wait := Backoff(time.Minute, 0); wait != time.Minute {
+		t.Errorf("no failures should wait the interval. got %v", wait)
+	}
+	if wait := Backoff(time.Minute, 3); wait != 8*time.Minute {
+		t.Errorf("expected 8m. got %v", wait)
+	}
+	if wait := Backoff(time.Minute, 100); wait != MaxBackoff {
+		t.Errorf("expected MaxBackoff. got %v", wait)
+	}
+	if wait := Backoff(24*time.Hour, 2); wait != 24*time.Hour {
+		t.Errorf("intervals longer than MaxBackoff are kept. got %v", wait)
+	}
+}
+
+func TestSupervisorRecoversPanics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	supervisor := NewSupervisor()
+
+	runs := make(chan struct{}, 10)
+	err := supervisor.Add(Job{Name: "panics", Interval: time.Millisecond, RunAtStart: true, Run: func(ctx context.Context) error {
+		runs <- struct{}{}
+		panic("boom")
+	}})
+	if err != nil {
+		t.Fatalf("supervisor.Add(job) %+v", err)
+	}
+	supervisor.Start(ctx)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-runs:
+		case <-time.After(time.Second):
+			t.Fatalf("the job should run again after a panic")
+		}
+	}
+	cancel()
+
+	err = supervisor.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("supervisor.Wait(ctx) %+v", err)
+	}
+
+	status := supervisor.Status()[0]
+	if status.Failures < 3 || status.LastError == "" || supervisor.Healthy() {
+		t.Errorf("the failures should be in the status. got %+v", status)
+	}
+}
+
+func TestSupervisorFinishOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	supervisor := NewSupervisor()
+
+	started := make(chan struct{})
+	var runErr error
+	finished := false
+	err := supervisor.Add(Job{Name: "swap", Interval: time.Hour, RunAtStart: true, FinishOnShutdown: true, Run: func(ctx context.Context) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		runErr = ctx.Err()
+		finished = true
+		return nil
+	}})
+	if err != nil {
+		t.Fatalf("supervisor.Add(job) %+v", err)
+	}
+	supervisor.Start(ctx)
+
+	<-started
+	cancel()
+	err = supervisor.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("supervisor.Wait(ctx) %+v", err)
+	}
+	if !finished || runErr != nil {
+		t.Errorf("the run should finish without a cancelled context. finished %v err %v", finished, runErr)
+	}
+	if !supervisor.Healthy() {
+		t.Errorf("the supervisor should be healthy")
+	}
+
+	err = supervisor.Add(Job{Name: "no interval", Run: func(ctx context.Context) error { return nil }})
+	if !errors.Is(err, ErrInvalidInterval) {
+		t.Errorf("expected ErrInvalidInterval. got %v", err)
+	}
+}
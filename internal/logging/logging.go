@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const LOG_LEVEL = "LOG_LEVEL"
+
+// RequestIDHeader is read from the client or proxy when present and always sent back
+const RequestIDHeader = "X-Request-Id"
+
+const redacted = "[redacted]"
+
+var ErrUnknownLogLevel = errors.New("Unknown log level. Use debug, info, warn or error")
+
+type requestIDKey struct{}
+
+var (
+	// serialized cashu tokens, also the ones inside x-cashu headers
+	tokenPattern = regexp.MustCompile(`cashu[AB][A-Za-z0-9_\-+/=]{8,}`)
+	// proofs printed with %+v and proofs marshaled as json
+	proofSecretPattern = regexp.MustCompile(`Secret:\S*`)
+	jsonSecretPattern  = regexp.MustCompile(`"secret"\s*:\s*"(?:[^"\\]|\\.)*"`)
+	witnessPattern     = regexp.MustCompile(`Witness:\S*`)
+)
+
+// Redact removes cashu tokens and proof secrets from a log line
+func Redact(s string) string {
+	if !strings.Contains(s, "cashu") && !strings.Contains(s, "ecret") && !strings.Contains(s, "Witness") {
+		return s
+	}
+	s = tokenPattern.ReplaceAllString(s, "cashu"+redacted)
+	s = proofSecretPattern.ReplaceAllString(s, "Secret:"+redacted)
+	s = witnessPattern.ReplaceAllString(s, "Witness:"+redacted)
+	s = jsonSecretPattern.ReplaceAllString(s, `"secret":"`+redacted+`"`)
+	return s
+}
+
+// ParseLevel reads LOG_LEVEL values. Empty means info
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("%w: %v", ErrUnknownLogLevel, level)
+	}
+}
+
+// NewLogger writes JSON lines to w. Messages and attributes are redacted and the request id
+// of the context is added to every record
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	json := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr})
+	return slog.New(handler{inner: json})
+}
+
+// Setup makes the JSON logger the default one. The log package also goes through it
+func Setup(level string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(NewLogger(os.Stderr, parsed))
+	return nil
+}
+
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(Redact(attr.Value.String()))
+	case slog.KindAny:
+		value := attr.Value.Any()
+		if err, ok := value.(error); ok {
+			attr.Value = slog.StringValue(Redact(err.Error()))
+			return attr
+		}
+		// structs like proofs and tokens are only replaced by their text when they have something to hide
+		text := fmt.Sprintf("%+v", value)
+		if clean := Redact(text); clean != text {
+			attr.Value = slog.StringValue(clean)
+		}
+	}
+	return attr
+}
+
+type handler struct {
+	inner slog.Handler
+}
+
+func (h handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h handler) Handle(ctx context.Context, record slog.Record) error {
+	redactedRecord := slog.NewRecord(record.Time, record.Level, Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redactedRecord.AddAttrs(attr)
+		return true
+	})
+	if id := RequestID(ctx); id != "" {
+		redactedRecord.AddAttrs(slog.String("request_id", id))
+	}
+	return h.inner.Handle(ctx, redactedRecord)
+}
+
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler{inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{inner: h.inner.WithGroup(name)}
+}
+
+// WithRequestID stores the id so logs made with the context include it
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// GinMiddleware gives every request an id, puts it in the request context and logs the request when it ends.
+// It replaces gin's default logger
+func GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"bytes", c.Writer.Size(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
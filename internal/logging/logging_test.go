@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/gin-gonic/gin"
+)
+
+const token = "cashuBo2FteCJodHRwczovL21pbnQuZXhhbXBsZS5jb21hdWNzYXRhdIGiYWlIAJofKTJT5B5hcIGjYWEBYXN4QDQwN2Y"
+
+func TestRedact(t *testing.T) {
+	line := Redact("xcashu.ParseTokenHeader(" + token + ") failed")
+	if strings.Contains(line, token[10:]) || !strings.Contains(line, "cashu[redacted]") {
+		t.Errorf("token was not redacted. %v", line)
+	}
+
+	proof := cashu.Proof{Amount: 2, Id: "009a1f293253e41e", Secret: "407915bc212be61a77e3e6d2aeb4c727980bda51cd06a6afc29e2861768a7837", C: "02bc9097997d81afb2cc7346b5e4345a9346bd2a506eb7958598a72f0cf85163ea"}
+	line = Redact(fmt.Sprintf("proof: %+v", proof))
+	if strings.Contains(line, proof.Secret) || !strings.Contains(line, "Amount:2") {
+		t.Errorf("proof secret was not redacted. %v", line)
+	}
+
+	marshaled, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatalf("json.Marshal(proof) %+v", err)
+	}
+	line = Redact(string(marshaled))
+	if strings.Contains(line, proof.Secret) || !strings.Contains(line, `"secret":"[redacted]"`) {
+		t.Errorf("json secret was not redacted. %v", line)
+	}
+
+	if Redact("nothing to hide") != "nothing to hide" {
+		t.Errorf("clean lines should not change")
+	}
+}
+
+func TestLoggerRedactsAttributes(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, slog.LevelDebug)
+	secret := "407915bc212be61a77e3e6d2aeb4c727980bda51cd06a6afc29e2861768a7837"
+
+	logger.Error("token "+token, "error", errors.New("bad token "+token), "proof", cashu.Proof{Amount: 1, Secret: secret}, "amount", 1)
+
+	if strings.Contains(out.String(), token[10:]) || strings.Contains(out.String(), secret) {
+		t.Errorf("secrets reached the log. %v", out.String())
+	}
+
+	var record map[string]any
+	err := json.Unmarshal(out.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(out.Bytes(), &record) %+v", err)
+	}
+	if record["amount"] != float64(1) {
+		t.Errorf("clean attributes should keep their type. got %v", record["amount"])
+	}
+}
+
+func TestGinMiddlewareRequestID(t *testing.T) {
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(NewLogger(&out, slog.LevelInfo))
+	defer slog.SetDefault(previous)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(GinMiddleware())
+	var handlerID string
+	r.GET("/:sha", func(c *gin.Context) {
+		handlerID = RequestID(c.Request.Context())
+		slog.InfoContext(c.Request.Context(), "inside handler")
+		c.Status(200)
+	})
+
+	req := httptest.NewRequest("GET", "/aaaa", nil)
+	req.Header.Set(RequestIDHeader, "abc123")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if handlerID != "abc123" || w.Header().Get(RequestIDHeader) != "abc123" {
+		t.Errorf("the client request id should be kept. handler: %v, header: %v", handlerID, w.Header().Get(RequestIDHeader))
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected the handler line and the request line. got %v", out.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"request_id":"abc123"`) {
+			t.Errorf("line without request id. %v", line)
+		}
+	}
+	if !strings.Contains(lines[1], `"route":"/:sha"`) || !strings.Contains(lines[1], `"status":200`) {
+		t.Errorf("wrong request line. %v", lines[1])
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/bbbb", nil))
+	if len(w.Header().Get(RequestIDHeader)) != 16 {
+		t.Errorf("a request id should be generated. got %v", w.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("")
+	if err != nil || level != slog.LevelInfo {
+		t.Errorf("empty level should be info. got %v %v", level, err)
+	}
+	level, err = ParseLevel("DEBUG")
+	if err != nil || level != slog.LevelDebug {
+		t.Errorf("wrong level %v %v", level, err)
+	}
+	_, err = ParseLevel("loud")
+	if !errors.Is(err, ErrUnknownLogLevel) {
+		t.Errorf("expected ErrUnknownLogLevel. got %v", err)
+	}
+}
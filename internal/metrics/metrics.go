@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"ratasker/internal/cashu"
+	"ratasker/internal/database"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ratasker"
+
+const (
+	METRICS_ADDR = "METRICS_ADDR"
+	// metrics include revenue numbers, by default only the host can scrape them
+	DefaultMetricsAddr = "127.0.0.1:8071"
+	MetricsOff         = "off"
+)
+
+// StatsTimeout bounds the database query made on every scrape
+const StatsTimeout = 5 * time.Second
+
+const (
+	RotationSuccess = "success"
+	RotationError   = "error"
+	RotationPanic   = "panic"
+)
+
+// Registry holds every ratasker metric plus the go runtime and process ones
+var Registry = prometheus.NewRegistry()
+
+var (
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	PaymentRequiredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_required_total",
+		Help:      "402 responses by route.",
+	}, []string{"route"})
+
+	BytesUploaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of the blobs stored.",
+	})
+
+	BytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "served_bytes_total",
+		Help:      "Bytes of blobs sent to clients. Redirected downloads are not included.",
+	})
+
+	SatsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "received_sats_total",
+		Help:      "Sats of the accepted payments by mint and operation.",
+	}, []string{"mint", "operation"})
+
+	VerificationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_verification_failures_total",
+		Help:      "Rejected tokens by reason.",
+	}, []string{"reason"})
+
+	KeyRotationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "key_rotation_duration_seconds",
+		Help:      "Duration of the key rotations by outcome.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	}, []string{"outcome"})
+
+	LastKeyRotation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "key_rotation_last_timestamp_seconds",
+		Help:      "Unix time of the last key rotation by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestsTotal,
+		RequestDuration,
+		PaymentRequiredTotal,
+		BytesUploaded,
+		BytesServed,
+		SatsReceived,
+		VerificationFailures,
+		KeyRotationDuration,
+		LastKeyRotation,
+	)
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ServerFromOsEnv serves Handler on METRICS_ADDR, apart from the public blossom routes.
+// Returns nil when METRICS_ADDR is off
+func ServerFromOsEnv() *http.Server {
+	addr := os.Getenv(METRICS_ADDR)
+	switch addr {
+	case MetricsOff:
+		return nil
+	case "":
+		addr = DefaultMetricsAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// GinMiddleware counts every request. Routes are the gin templates so blob hashes don't become labels
+func GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+
+		RequestsTotal.WithLabelValues(route, c.Request.Method, strconv.Itoa(status)).Inc()
+		RequestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+		if status == http.StatusPaymentRequired {
+			PaymentRequiredTotal.WithLabelValues(route).Inc()
+		}
+	}
+}
+
+var verificationReasons = []struct {
+	err    error
+	reason string
+}{
+	{cashu.ErrProofAlreadySeen, "proof_already_seen"},
+	{cashu.ErrNotTrustedMint, "not_trusted_mint"},
+	{cashu.ErrProofIsNotP2PK, "proof_not_p2pk"},
+	{cashu.ErrNotLockedToPubkey, "not_locked_to_pubkey"},
+	{cashu.ErrKeysetIdNotFound, "keyset_id_not_found"},
+	{cashu.ErrCouldNotFindMintPubkey, "mint_pubkey_not_found"},
+	{cashu.ErrCouldNotVerifyDLEQ, "dleq_not_verified"},
+	{cashu.ErrKeysetUnitNotSat, "keyset_unit_not_sat"},
+	{cashu.ErrNoTrustedMint, "no_trusted_mint"},
+}
+
+// VerificationFailureReason names the error returned by CashuWallet.VerifyToken
+func VerificationFailureReason(err error) string {
+	for _, v := range verificationReasons {
+		if errors.Is(err, v.err) {
+			return v.reason
+		}
+	}
+	return "other"
+}
+
+func CountVerificationFailure(err error) {
+	VerificationFailures.WithLabelValues(VerificationFailureReason(err)).Inc()
+}
+
+func ObserveKeyRotation(outcome string, duration time.Duration) {
+	KeyRotationDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+	LastKeyRotation.WithLabelValues(outcome).SetToCurrentTime()
+}
+
+// storageCollector reads the stored bytes and the proofs waiting for a swap when scraped
+type storageCollector struct {
+	db              database.Database
+	blobs           *prometheus.Desc
+	storedBytes     *prometheus.Desc
+	unswappedProofs *prometheus.Desc
+	unswappedSats   *prometheus.Desc
+}
+
+// RegisterStorageCollector adds the database totals to the registry
+func RegisterStorageCollector(db database.Database) error {
+	return Registry.Register(storageCollector{
+		db:              db,
+		blobs:           prometheus.NewDesc(namespace+"_blobs", "Blobs stored.", nil, nil),
+		storedBytes:     prometheus.NewDesc(namespace+"_stored_bytes", "Bytes of all the stored blobs.", nil, nil),
+		unswappedProofs: prometheus.NewDesc(namespace+"_unswapped_locked_proofs", "Locked proofs not swapped with the mint yet.", nil, nil),
+		unswappedSats:   prometheus.NewDesc(namespace+"_unswapped_locked_sats", "Sats of the locked proofs not swapped yet.", nil, nil),
+	})
+}
+
+func (s storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.blobs
+	ch <- s.storedBytes
+	ch <- s.unswappedProofs
+	ch <- s.unswappedSats
+}
+
+func (s storageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), StatsTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTransaction(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "s.db.BeginTransaction(ctx)", "error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	stats, err := s.db.GetStorageStats(ctx, tx)
+	if err != nil {
+		slog.ErrorContext(ctx, "s.db.GetStorageStats(ctx, tx)", "error", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(s.blobs, prometheus.GaugeValue, float64(stats.BlobCount))
+	ch <- prometheus.MustNewConstMetric(s.storedBytes, prometheus.GaugeValue, float64(stats.StoredBytes))
+	ch <- prometheus.MustNewConstMetric(s.unswappedProofs, prometheus.GaugeValue, float64(stats.UnswappedProofs))
+	ch <- prometheus.MustNewConstMetric(s.unswappedSats, prometheus.GaugeValue, float64(stats.UnswappedSats))
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"ratasker/external/blossom"
+	"ratasker/internal/cashu"
+	"ratasker/internal/database"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerificationFailureReason(t *testing.T) {
+	wrapped := fmt.Errorf("proof: %v, %w", "proof", cashu.ErrProofAlreadySeen)
+	if reason := VerificationFailureReason(wrapped); reason != "proof_already_seen" {
+		t.Errorf("wrong reason %v", reason)
+	}
+	if reason := VerificationFailureReason(fmt.Errorf("MintTried: %w", cashu.ErrNotTrustedMint)); reason != "not_trusted_mint" {
+		t.Errorf("wrong reason %v", reason)
+	}
+	if reason := VerificationFailureReason(fmt.Errorf("something else")); reason != "other" {
+		t.Errorf("wrong reason %v", reason)
+	}
+}
+
+func TestGinMiddlewareUsesRouteTemplates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(GinMiddleware())
+	r.GET("/:sha", func(c *gin.Context) {
+		c.Status(402)
+	})
+
+	before := testutil.ToFloat64(PaymentRequiredTotal.WithLabelValues("/:sha"))
+	for _, path := range []string{"/aaaa", "/bbbb"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if got := testutil.ToFloat64(RequestsTotal.WithLabelValues("/:sha", "GET", "402")); got < 2 {
+		t.Errorf("requests should be counted under the route template. got %v", got)
+	}
+	if got := testutil.ToFloat64(PaymentRequiredTotal.WithLabelValues("/:sha")) - before; got != 2 {
+		t.Errorf("expected 2 payment required responses. got %v", got)
+	}
+}
+
+func TestStorageCollector(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := database.DatabaseSetup(ctx, t.TempDir(), database.EmbedMigrations)
+	if err != nil {
+		t.Fatalf("Could not setup db")
+	}
+
+	tx, err := sqlite.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("sqlite.BeginTransaction(ctx) %+v", err)
+	}
+	err = sqlite.AddBlob(ctx, tx, blossom.DBBlobData{Path: "key", Sha256: []byte("hash"), CreatedAt: 1, Data: blossom.Blob{Size: 42}})
+	if err != nil {
+		t.Fatalf("sqlite.AddBlob(ctx, tx, blob) %+v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("tx.Commit() %+v", err)
+	}
+
+	err = RegisterStorageCollector(sqlite)
+	if err != nil {
+		t.Fatalf("RegisterStorageCollector(sqlite) %+v", err)
+	}
+
+	expected := `
+# HELP ratasker_stored_bytes Bytes of all the stored blobs.
+# TYPE ratasker_stored_bytes gauge
+ratasker_stored_bytes 42
+# HELP ratasker_unswapped_locked_proofs Locked proofs not swapped with the mint yet.
+# TYPE ratasker_unswapped_locked_proofs gauge
+ratasker_unswapped_locked_proofs 0
+`
+	err = testutil.GatherAndCompare(Registry, strings.NewReader(expected), "ratasker_stored_bytes", "ratasker_unswapped_locked_proofs")
+	if err != nil {
+		t.Errorf("testutil.GatherAndCompare(Registry, expected) %+v", err)
+	}
+}
+
+func TestServerFromOsEnv(t *testing.T) {
+	t.Setenv(METRICS_ADDR, "")
+	server := ServerFromOsEnv()
+	if server == nil || server.Addr != DefaultMetricsAddr {
+		t.Fatalf("metrics should listen on %v by default. got: %+v", DefaultMetricsAddr, server)
+	}
+
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "go_goroutines") {
+		t.Errorf("expected the metrics. got: %v %v", w.Code, w.Body.String())
+	}
+
+	t.Setenv(METRICS_ADDR, MetricsOff)
+	if server := ServerFromOsEnv(); server != nil {
+		t.Errorf("metrics should be off. got: %+v", server)
+	}
+}
@@ -0,0 +1,23 @@
+package routes
+
+import (
+	"ratasker/internal/health"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthRoutes serves the probes. /healthz only tells the process answers, /readyz checks what requests need
+func HealthRoutes(r *gin.Engine, checker *health.Checker) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	r.GET("/readyz", func(c *gin.Context) {
+		report := checker.Report(c.Request.Context())
+		if !report.Ready {
+			c.JSON(503, report)
+			return
+		}
+		c.JSON(200, report)
+	})
+}
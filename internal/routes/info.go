@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"fmt"
+	"ratasker/internal/cashu"
+	"ratasker/internal/core"
+	"ratasker/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InfoRoutes serves the server information document at GET /
+func InfoRoutes(r *gin.Engine, wallet cashu.CashuWallet, uploadCost uint64, downloadCost uint64, policy core.PaymentPolicy) {
+	r.GET("/", func(c *gin.Context) {
+		info, err := core.NewServerInfo(wallet, uploadCost, downloadCost, policy)
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.NewServerInfo(wallet, uploadCost, downloadCost, policy). %w", err))
+			return
+		}
+		c.JSON(200, info)
+	})
+}
@@ -0,0 +1,46 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	n "ratasker/external/nostr"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"ratasker/internal/utils"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LedgerRoutes serves the revenue report. Only the owner can read it, with an admin event made for the request
+func LedgerRoutes(r *gin.Engine, db database.Database, domain string, ownerPubkey string) {
+	r.GET("/ledger/report", utils.NostrAuthMiddleware(n.ADMIN), ownerOnly(domain, ownerPubkey), func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		since, until, err := core.ParseReportPeriod(c.Query("since"), c.Query("until"), time.Now())
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "since and until must be dates like 2006-01-02", err))
+			return
+		}
+
+		report, err := core.LoadRevenueReport(ctx, db, since, until)
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.LoadRevenueReport(ctx, db, since, until). %w", err))
+			return
+		}
+
+		switch c.DefaultQuery("format", core.ReportFormatJSON) {
+		case core.ReportFormatJSON:
+			c.JSON(200, report)
+		case core.ReportFormatCSV:
+			c.Header("Content-Type", "text/csv")
+			c.Status(200)
+			err = core.WriteRevenueReportCSV(c.Writer, report)
+			if err != nil {
+				slog.ErrorContext(ctx, "core.WriteRevenueReportCSV(c.Writer, report)", "error", err)
+			}
+		default:
+			utils.AbortWithError(c, utils.NewHTTPError(400, core.ErrUnknownReportFormat.Error(), nil))
+		}
+	})
+}
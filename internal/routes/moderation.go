@@ -0,0 +1,267 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"ratasker/external/blossom"
+	n "ratasker/external/nostr"
+	"ratasker/internal/core"
+	"ratasker/internal/database"
+	"ratasker/internal/io"
+	"ratasker/internal/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ownerOnly answers 401 or 403 when the auth event is not an admin event from the owner made for this
+// method and url on this domain
+func ownerOnly(domain string, ownerPubkey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		event, ok := utils.GetNostrAuthEvent(c)
+		if !ok {
+			utils.AbortWithError(c, utils.NewHTTPError(401, "Missing auth event", nil))
+			return
+		}
+		url := strings.TrimSuffix(domain, "/") + c.Request.URL.RequestURI()
+		err := n.ValidateAdminRequest(event, c.Request.Method, url)
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(401, "Auth event is not for this request", fmt.Errorf("n.ValidateAdminRequest(event, method, url). %w", err)))
+			return
+		}
+		if event.PubKey != ownerPubkey {
+			utils.AbortWithError(c, utils.NewHTTPError(403, "Only the owner can use this route", nil))
+			return
+		}
+		c.Next()
+	}
+}
+
+// ModerationRoutes takes BUD-09 reports from anyone. Reviewing them and managing the blocklist is only for the owner
+func ModerationRoutes(r *gin.Engine, db database.Database, fileHandler io.BlossomIO, domain string, ownerPubkey string) {
+	r.PUT("/report", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		body, err := readLimited(c, core.MaxReportBytes)
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(413, "Report is too large", err))
+			return
+		}
+
+		reports, err := core.ParseReportEvent(body)
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid report event", err))
+			return
+		}
+
+		_, err = core.StoreReports(ctx, db, reports)
+		if err != nil {
+			if errors.Is(err, core.ErrReportedBlobsNotHere) {
+				utils.AbortWithError(c, utils.NewHTTPError(404, "Blob not found", err))
+				return
+			}
+			utils.AbortWithError(c, fmt.Errorf("core.StoreReports(ctx, db, reports). %w", err))
+			return
+		}
+		c.JSON(200, n.NotifMessage{Message: "Report received"})
+	})
+
+	admin := r.Group("/admin", utils.NostrAuthMiddleware(n.ADMIN), ownerOnly(domain, ownerPubkey))
+
+	admin.GET("/reports", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		status := c.DefaultQuery("status", database.ReportPending)
+		var reports []database.BlobReport
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			reports, err = db.GetBlobReports(ctx, tx, status)
+			return err
+		})
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("db.GetBlobReports(ctx, tx, status). %w", err))
+			return
+		}
+		c.JSON(200, reports)
+	})
+
+	admin.POST("/reports/:sha/dismiss", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sha, _, err := blossom.ParseBlobPath(c.Param("sha"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
+			return
+		}
+
+		err = core.DismissReports(ctx, db, sha, uint64(time.Now().Unix()))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.DismissReports(ctx, db, sha, now). %w", err))
+			return
+		}
+		c.JSON(200, n.NotifMessage{Message: "Reports dismissed"})
+	})
+
+	admin.GET("/blocked", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var blocked []database.BlockedBlob
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			blocked, err = db.GetBlockedBlobs(ctx, tx)
+			return err
+		})
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("db.GetBlockedBlobs(ctx, tx). %w", err))
+			return
+		}
+		c.JSON(200, blocked)
+	})
+
+	// blocks the hash and deletes the blob. The reason is taken from the query
+	admin.PUT("/blocked/:sha", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sha, _, err := blossom.ParseBlobPath(c.Param("sha"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
+			return
+		}
+
+		deleted, err := core.BlockBlob(ctx, db, fileHandler, sha, c.Query("reason"), ownerPubkey, uint64(time.Now().Unix()))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.BlockBlob(ctx, db, fileHandler, sha, reason, owner, now). %w", err))
+			return
+		}
+		c.JSON(200, gin.H{"sha256": sha, "deleted": deleted})
+	})
+
+	admin.DELETE("/blocked/:sha", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sha, _, err := blossom.ParseBlobPath(c.Param("sha"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
+			return
+		}
+
+		err = core.UnblockBlob(ctx, db, sha, ownerPubkey, uint64(time.Now().Unix()))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.UnblockBlob(ctx, db, sha, owner, now). %w", err))
+			return
+		}
+		c.JSON(200, n.NotifMessage{Message: "Blob unblocked"})
+	})
+
+	admin.GET("/blocked-pubkeys", func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var blocked []database.BlockedPubkey
+		err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			blocked, err = db.GetBlockedPubkeys(ctx, tx)
+			return err
+		})
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("db.GetBlockedPubkeys(ctx, tx). %w", err))
+			return
+		}
+		c.JSON(200, blocked)
+	})
+
+	// the pubkey can be hex or an npub. The reason is taken from the query
+	admin.PUT("/blocked-pubkeys/:pubkey", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		pubkey, err := core.PubkeyToHex(c.Param("pubkey"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid pubkey", err))
+			return
+		}
+
+		err = core.BlockPubkey(ctx, db, pubkey, c.Query("reason"), ownerPubkey, uint64(time.Now().Unix()))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.BlockPubkey(ctx, db, pubkey, reason, owner, now). %w", err))
+			return
+		}
+		c.JSON(200, n.NotifMessage{Message: "Pubkey blocked"})
+	})
+
+	admin.DELETE("/blocked-pubkeys/:pubkey", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		pubkey, err := core.PubkeyToHex(c.Param("pubkey"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid pubkey", err))
+			return
+		}
+
+		err = core.UnblockPubkey(ctx, db, pubkey, ownerPubkey, uint64(time.Now().Unix()))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.UnblockPubkey(ctx, db, pubkey, owner, now). %w", err))
+			return
+		}
+		c.JSON(200, n.NotifMessage{Message: "Pubkey unblocked"})
+	})
+
+	// imports a blocklist file sent as the body. See core.ParseBlocklist for the format
+	admin.POST("/blocklist", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		body, err := readLimited(c, core.MaxBlocklistBytes)
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(413, "Blocklist is too large", err))
+			return
+		}
+		// the url does not cover the body, without this the event could be replayed with another list
+		event, _ := utils.GetNostrAuthEvent(c)
+		payload := sha256.Sum256(body)
+		if !event.Tags.ContainsAny(n.PayloadTag, []string{hex.EncodeToString(payload[:])}) {
+			utils.AbortWithError(c, utils.NewHTTPError(401, "Auth event does not include the blocklist hash", n.ErrRequestNotAuthorized))
+			return
+		}
+
+		entries, err := core.ParseBlocklist(body)
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, err.Error(), err))
+			return
+		}
+
+		result, err := core.ImportBlocklist(ctx, db, fileHandler, entries, ownerPubkey, uint64(time.Now().Unix()))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.ImportBlocklist(ctx, db, fileHandler, entries, owner, now). %w", err))
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	admin.GET("/blocklist/audit", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		limit, err := strconv.ParseUint(c.DefaultQuery("limit", "100"), 10, 64)
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid limit", err))
+			return
+		}
+
+		var audits []database.BlocklistAudit
+		err = database.WithTx(ctx, db, func(tx *sql.Tx) error {
+			var err error
+			audits, err = db.GetBlocklistAudit(ctx, tx, limit)
+			return err
+		})
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("db.GetBlocklistAudit(ctx, tx, limit). %w", err))
+			return
+		}
+		c.JSON(200, audits)
+	})
+}
+
+// readLimited reads the body and fails when it is longer than limit
+func readLimited(c *gin.Context, limit int64) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, fmt.Errorf("c.GetRawData(). %w", err)
+	}
+	return body, nil
+}
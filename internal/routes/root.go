@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
@@ -8,207 +9,440 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"ratasker/external/blossom"
+	n "ratasker/external/nostr"
 	"ratasker/external/xcashu"
 	"ratasker/internal/cashu"
+	"ratasker/internal/core"
 	"ratasker/internal/database"
 	"ratasker/internal/io"
+	"ratasker/internal/metrics"
+	"ratasker/internal/utils"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func RootRoutes(r *gin.Engine, wallet cashu.CashuWallet, db database.Database, fileHandler io.BlossomIO, cost uint64) {
-	r.GET("/", func(c *gin.Context) {
+// payForDownload checks and stores the x-cashu payment. A missing or invalid payment is an HTTPError with the x-cashu header already set
+func payForDownload(c *gin.Context, tx *sql.Tx, wallet cashu.CashuWallet, db database.Database, sha string, amountToPay uint64) (uint64, string, error) {
+	ctx := c.Request.Context()
+	paymentResponse, err := core.NewPaymentQuote(wallet, amountToPay)
+	if err != nil {
+		return 0, "", fmt.Errorf("core.NewPaymentQuote(wallet, amountToPay). %w", err)
+	}
 
-		c.JSON(200, nil)
-	})
+	jsonBytes, err := json.Marshal(paymentResponse)
+	if err != nil {
+		return 0, "", fmt.Errorf("json.Marshal(paymentResponse). %w", err)
+	}
+
+	// In case you need to 402
+	encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
+
+	cashu_header := c.GetHeader(xcashu.Xcashu)
+	if cashu_header == "" {
+		c.Header(xcashu.Xcashu, encodedPayReq)
+		return 0, "", utils.NewHTTPError(402, "Payment required", xcashu.ErrPaymentRequired)
+	}
+
+	token, err := xcashu.ParseTokenHeader(cashu_header, amountToPay)
+	if err != nil {
+		c.Header(xcashu.Xcashu, encodedPayReq)
+		return 0, "", utils.NewHTTPError(402, "Payment required", fmt.Errorf(`xcashu.ParseTokenHeader(cashu_header, amountToPay) %w`, err))
+	}
+	// Check Token is valid
+	_, err = wallet.VerifyToken(ctx, token, tx, db)
+	if err != nil {
+		c.Header(xcashu.Xcashu, encodedPayReq)
+		metrics.CountVerificationFailure(err)
+		return 0, "", utils.NewHTTPError(400, "Invalid token", fmt.Errorf(`wallet.VerifyToken(ctx, token, tx, db) %w`, err))
+	}
+
+	err = wallet.StoreEcash(ctx, token, tx, db)
+	if errors.Is(err, cashu.ErrProofAlreadySeen) {
+		return 0, "", utils.NewHTTPError(400, "Invalid token", fmt.Errorf(`wallet.StoreEcash(ctx, proofs, tx, db) %w`, err))
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf(`wallet.StoreEcash(ctx, proofs, tx, db) %w`, err)
+	}
+
+	err = core.RecordPayment(ctx, db, tx, database.LedgerDownload, sha, utils.GetNostrAuthPubkey(c), token)
+	if err != nil {
+		return 0, "", fmt.Errorf(`core.RecordPayment(ctx, db, tx, database.LedgerDownload, sha, pubkey, token) %w`, err)
+	}
+
+	return token.Amount(), token.Mint(), nil
+}
+
+// issueAccessGrant sends the grant as a header and a cookie. Failing to sign it only loses the grant
+func issueAccessGrant(c *gin.Context, grantSigner *core.AccessGrantSigner, sha string, activePubkey string) {
+	newGrant, err := grantSigner.Issue(sha, activePubkey)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "grantSigner.Issue(sha, activePubkey)", "error", err)
+		return
+	}
+	secure := strings.HasPrefix(os.Getenv(utils.DOMAIN), "https://")
+	if secure {
+		c.SetSameSite(http.SameSiteNoneMode)
+	}
+	c.Header(core.AccessGrantHeader, newGrant)
+	c.SetCookie(core.AccessGrantCookieName(sha), newGrant, int(grantSigner.Duration().Seconds()), "/", "", secure, true)
+}
+
+// freeBytesLeft reads the free quota left of a pubkey for quoting
+func freeBytesLeft(ctx context.Context, db database.Database, policy core.PaymentPolicy, pubkey string) (uint64, error) {
+	if pubkey == "" || policy.FreeMonthlyBytes == 0 {
+		return 0, nil
+	}
 
-	r.GET("/:sha", func(c *gin.Context) {
-		sha := c.Param("sha")
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	defer tx.Rollback()
+
+	left, err := policy.FreeBytesLeft(ctx, tx, db, pubkey, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("policy.FreeBytesLeft(ctx, tx, db, pubkey, time.Now()). %w", err)
+	}
+	return left, nil
+}
+
+// downloads is nil when the storage has no tiers, then downloads are not counted
+func RootRoutes(r *gin.Engine, wallet cashu.CashuWallet, db database.Database, fileHandler io.BlossomIO, cost uint64, grantSigner *core.AccessGrantSigner, policy core.PaymentPolicy, downloads *core.DownloadCounter) {
+	rangeGrants := core.NewRangeGrants(core.RangePaymentWindow)
+
+	r.GET("/:sha", utils.NostrAuthMiddleware(n.GET), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sha, ext, err := blossom.ParseBlobPath(c.Param("sha"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
+			return
+		}
+		err = core.CheckNotBlocked(ctx, db, sha, utils.GetNostrAuthPubkey(c))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.CheckNotBlocked(ctx, db, sha, pubkey). %w", err))
+			return
+		}
 
 		// try to get blob
 		hash, err := hex.DecodeString(sha)
 		if err != nil {
-			log.Printf(`hex.DecodeString(sha) %+v`, err)
-			c.JSON(500, "Opps! Server error")
+			utils.AbortWithError(c, fmt.Errorf("hex.DecodeString(sha). %w", err))
 			return
 		}
 
-		blob, err := db.GetBlob(hash)
+		blob, err := db.GetBlob(ctx, hash)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				c.JSON(404, nil)
+				utils.AbortWithError(c, utils.NewHTTPError(404, "Blob not found", nil))
+				return
 			}
-			log.Printf(`sqlite.GetBlob(hash) %+v`, err)
-			c.JSON(500, "Opps! Server error")
+			utils.AbortWithError(c, fmt.Errorf("sqlite.GetBlob(ctx, hash). %w", err))
 			return
 		}
 
-		tx, err := db.BeginTransaction()
-		if err != nil {
-			c.JSON(500, "Opps! Server error")
+		etag := core.BlobETag(sha)
+		c.Header("ETag", etag)
+		c.Header("Accept-Ranges", "bytes")
+
+		// client already has the blob
+		if core.ETagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(304)
 			return
 		}
 
-		// Ensure that the transaction is rolled back in case of a panic or error
-		defer func() {
-			if p := recover(); p != nil {
-				tx.Rollback()
-				log.Fatalf("Panic occurred: %v\n", p)
-			} else if err != nil {
-				log.Println("Rolling back transaction due to error.")
-				tx.Rollback()
+		servedRange := core.FullRange(blob.Data.Size)
+		partial := false
+		ifRange := c.GetHeader("If-Range")
+		if ifRange == "" || core.ETagMatches(ifRange, etag) {
+			rng, ok, err := core.ParseRangeHeader(c.GetHeader("Range"), blob.Data.Size)
+			if err != nil && errors.Is(err, core.ErrRangeNotSatisfiable) {
+				c.Header("Content-Range", fmt.Sprintf("bytes */%d", blob.Data.Size))
+				utils.AbortWithError(c, utils.NewHTTPError(416, "Range not satisfiable", err))
+				return
+			}
+			if ok {
+				servedRange = rng
+				partial = true
+			}
+		}
+
+		// look for an access grant given by a previous payment
+		granted := false
+		accessGrant := c.GetHeader(core.AccessGrantHeader)
+		if accessGrant == "" {
+			accessGrant, _ = c.Cookie(core.AccessGrantCookieName(sha))
+		}
+		if accessGrant != "" {
+			// every response uses the bytes it serves, so seeking doesn't use a whole download
+			grantErr := grantSigner.Redeem(accessGrant, sha, wallet.GetActivePubkey(), servedRange.Length(), blob.Data.Size)
+			if grantErr != nil {
+				slog.ErrorContext(ctx, "grantSigner.Redeem(accessGrant, sha, pubkey, servedRange.Length(), blob.Data.Size)", "error", grantErr)
 			} else {
-				err = tx.Commit()
+				granted = true
+			}
+		}
+
+		cashu_header := c.GetHeader(xcashu.Xcashu)
+
+		// token already paid for this range recently
+		if !granted && !rangeGrants.Covers(cashu_header, sha, servedRange) {
+			var paid uint64
+			var paidMint string
+			var free bool
+
+			// the payment is committed before any byte is served
+			err = database.WithTx(ctx, db, func(tx *sql.Tx) error {
+				paid, paidMint = 0, ""
+
+				// only charge for the bytes that are going to be served. A cost of 0 does not use the free quota
+				amountToPay := xcashu.QuoteAmountToPay(servedRange.Length(), cost)
+				free = amountToPay == 0
+				if free {
+					return nil
+				}
+
+				// allowlisted pubkeys and free quota don't need to pay, if the event names this blob
+				var err error
+				free, err = policy.CoversRequest(ctx, tx, db, utils.GetNostrAuthPubkeyFor(c, sha), servedRange.Length(), time.Now())
+				if err != nil {
+					return fmt.Errorf("policy.CoversRequest(ctx, tx, db, pubkey, servedRange.Length(), time.Now()). %w", err)
+				}
+				if free {
+					return nil
+				}
+
+				paid, paidMint, err = payForDownload(c, tx, wallet, db, sha, amountToPay)
 				if err != nil {
-					log.Fatalf("Failed to commit transaction: %v\n", err)
+					return fmt.Errorf("payForDownload(c, tx, wallet, db, sha, amountToPay). %w", err)
 				}
-				log.Println("Got Content successfully")
+				return nil
+			})
+			if err != nil {
+				utils.AbortWithError(c, err)
+				return
 			}
-		}()
+			if paid > 0 {
+				metrics.SatsReceived.WithLabelValues(paidMint, database.LedgerDownload).Add(float64(paid))
+			}
+			slog.InfoContext(ctx, "Got Content successfully", "sha256", sha, "paid_sats", paid)
 
-		mints, err := cashu.GetTrustedMintFromOsEnv()
-		if err != nil {
-			c.JSON(400, "Malformed request")
-			return
+			// free requests only used quota for the bytes served, so they unlock nothing else
+			if !free {
+				// paying for the whole blob unlocks every range of it
+				grantedRange := servedRange
+				if paid >= xcashu.QuoteAmountToPay(blob.Data.Size, cost) {
+					grantedRange = core.FullRange(blob.Data.Size)
+				}
+				rangeGrants.Add(cashu_header, sha, grantedRange)
+
+				// let the client download the blob again without paying. Only a payment for the whole blob gets a grant
+				if servedRange == core.FullRange(blob.Data.Size) {
+					issueAccessGrant(c, grantSigner, sha, wallet.GetActivePubkey())
+				}
+			}
 		}
 
-		amountToPay := xcashu.QuoteAmountToPay(uint64(blob.Data.Size), cost)
-		paymentResponse := xcashu.PaymentQuoteResponse{
-			Amount: amountToPay,
-			Unit:   xcashu.Sat,
-			Mints:  []string{mints},
-			Pubkey: wallet.GetActivePubkey(),
+		contentType := core.BlobContentType(blob.Data.Type, ext)
+
+		// count downloads for the storage tiers
+		if downloads != nil && servedRange.Start == 0 {
+			downloads.Add(sha, blob.Data.Size, time.Now())
 		}
 
-		jsonBytes, err := json.Marshal(paymentResponse)
-		if err != nil {
-			c.JSON(500, "Error request")
+		// storages like S3 can serve the blob directly. The url gives the whole object,
+		// so ranges paid at the range price are streamed from here
+		redirectIO, canRedirect := fileHandler.(io.RedirectIO)
+		if canRedirect && servedRange == core.FullRange(blob.Data.Size) {
+			var url string
+			var redirect bool
+			url, redirect, err = redirectIO.DownloadURL(ctx, blob.Path, core.PresignedURLExpiry)
+			if err != nil {
+				utils.AbortWithError(c, fmt.Errorf("redirectIO.DownloadURL(ctx, blob.Path, core.PresignedURLExpiry). %w", err))
+				return
+			}
+			if redirect {
+				c.Redirect(307, url)
+				return
+			}
+		}
+
+		var fileBytes []byte
+		if partial {
+			fileBytes, err = fileHandler.GetBlobRange(ctx, blob.Path, servedRange.Start, servedRange.Length())
+			if err != nil {
+				utils.AbortWithError(c, fmt.Errorf("fileHandler.GetBlobRange(ctx, blob.Path, servedRange.Start, servedRange.Length()). %w", err))
+				return
+			}
+
+			c.Header("Content-Range", servedRange.ContentRange(blob.Data.Size))
+			c.Header("Content-Length", strconv.Itoa(len(fileBytes)))
+			c.Data(206, contentType, fileBytes)
+			metrics.BytesServed.Add(float64(len(fileBytes)))
 			return
 		}
 
-		// In case you need to 402
-		encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
+		fileBytes, err = fileHandler.GetBlob(ctx, blob.Path)
 
-		// check for 50 sats payment
-		cashu_header := c.GetHeader(xcashu.Xcashu)
-		if cashu_header == "" {
-			log.Println("cashu header not available")
-			c.Header(xcashu.Xcashu, encodedPayReq)
-			c.JSON(402, "payment required")
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("fileHandler.GetBlob(ctx, blob.Path). %w", err))
 			return
 		}
 
-		token, err := xcashu.ParseTokenHeader(cashu_header, amountToPay)
+		// check if sha256 is the same
+		fileHash := sha256.Sum256(fileBytes)
+		if sha != hex.EncodeToString(fileHash[:]) {
+			utils.AbortWithError(c, fmt.Errorf("HASHes are different. path: %v", blob.Path))
+			return
+		}
+
+		c.Header("Content-Length", strconv.Itoa(len(fileBytes)))
+		c.Data(200, contentType, fileBytes)
+		metrics.BytesServed.Add(float64(len(fileBytes)))
+	})
+
+	r.HEAD("/:sha", utils.NostrAuthMiddleware(n.GET), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sha, ext, err := blossom.ParseBlobPath(c.Param("sha"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
+			return
+		}
+		err = core.CheckNotBlocked(ctx, db, sha, utils.GetNostrAuthPubkey(c))
 		if err != nil {
-			log.Printf(`xcashu.ParseTokenHeader(cashu_header, amountToPay) %+v`, err)
-			c.Header(xcashu.Xcashu, encodedPayReq)
-			c.JSON(402, "payment required")
+			utils.AbortWithError(c, fmt.Errorf("core.CheckNotBlocked(ctx, db, sha, pubkey). %w", err))
 			return
 		}
-		// Check Token is valid
-		_, err = wallet.VerifyToken(token, tx, db)
+
+		hash, err := hex.DecodeString(sha)
 		if err != nil {
-			log.Printf(`wallet.VerifyToken(token, tx, db) %+v`, err)
-			c.Header(xcashu.Xcashu, encodedPayReq)
-			c.JSON(400, "payment required")
+			utils.AbortWithError(c, fmt.Errorf("hex.DecodeString(sha). %w", err))
 			return
 		}
 
-		err = wallet.StoreEcash(token, tx, db)
+		blob, err := db.GetBlob(ctx, hash)
 		if err != nil {
-			log.Printf(`wallet.StoreEcash(proofs, tx, db) %+v`, err)
-			c.JSON(400, "payment required")
+			if errors.Is(err, sql.ErrNoRows) {
+				c.Status(404)
+				return
+			}
+			utils.AbortWithError(c, fmt.Errorf("db.GetBlob(ctx, hash). %w", err))
 			return
 		}
 
-		fileBytes, err := fileHandler.GetBlob(blob.Path)
+		c.Header("ETag", core.BlobETag(sha))
+		c.Header("Accept-Ranges", "bytes")
+		c.Header("Content-Type", core.BlobContentType(blob.Data.Type, ext))
+
+		// quote only the requested range
+		length := blob.Data.Size
+		rng, ok, err := core.ParseRangeHeader(c.GetHeader("Range"), blob.Data.Size)
+		if err != nil && errors.Is(err, core.ErrRangeNotSatisfiable) {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", blob.Data.Size))
+			c.Status(416)
+			return
+		}
+		if ok {
+			length = rng.Length()
+		}
 
+		amount := xcashu.QuoteAmountToPay(length, cost)
+		pubkey := utils.GetNostrAuthPubkeyFor(c, sha)
+		if amount == 0 || policy.IsAllowed(pubkey) {
+			c.Status(200)
+			return
+		}
+
+		freeBytes, err := freeBytesLeft(ctx, db, policy, pubkey)
 		if err != nil {
-			log.Printf(`fileHandler.GetBlob(blob.Path) %+v`, err)
-			c.JSON(500, "Opps! Server error")
+			utils.AbortWithError(c, fmt.Errorf("freeBytesLeft(ctx, db, policy, pubkey). %w", err))
+			return
+		}
+		if freeBytes >= length {
+			c.Status(200)
 			return
 		}
 
-		// check if sha256 is the same
-		fileHash := sha256.Sum256(fileBytes)
-		if sha != hex.EncodeToString(fileHash[:]) {
-			log.Printf("HASHes are different")
-			c.JSON(500, "Opps! Server error")
+		slog.DebugContext(ctx, "Quoted download", "sha256", sha, "amount", amount)
+		paymentResponse, err := core.NewPaymentQuote(wallet, amount)
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.NewPaymentQuote(wallet, amount). %w", err))
 			return
 		}
 
-		_, err = c.Writer.Write(fileBytes)
+		jsonBytes, err := json.Marshal(paymentResponse)
 		if err != nil {
-			log.Printf(`c.Writer.Write(fileBytes) %+v`, err)
-			c.JSON(500, "Opps! Server error")
+			utils.AbortWithError(c, fmt.Errorf("json.Marshal(paymentResponse). %w", err))
 			return
 		}
-		c.Header("Content-Type", blob.Data.Type)
+
+		encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
+
+		c.Header(xcashu.Xcashu, encodedPayReq)
+		c.JSON(402, nil)
+		return
 	})
 
-	r.HEAD("/:sha", func(c *gin.Context) {
-		sha := c.Param("sha")
+	r.DELETE("/:sha", utils.NostrAuthMiddleware(n.DELETE), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		sha, _, err := blossom.ParseBlobPath(c.Param("sha"))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
+			return
+		}
+
+		pubkey := utils.GetNostrAuthPubkey(c)
+		if pubkey == "" {
+			utils.AbortWithError(c, utils.NewHTTPError(401, "Missing auth event", nil))
+			return
+		}
+
 		hash, err := hex.DecodeString(sha)
 		if err != nil {
-			log.Printf(`hex.DecodeString(sha) %+v`, err)
-			c.JSON(500, "Opps! Server error")
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Invalid blob hash", err))
 			return
 		}
 
-		length, err := db.GetBlobLength(hash)
+		tx, err := db.BeginTransaction(ctx)
 		if err != nil {
-			log.Printf(`hex.DecodeString(sha) %+v`, err)
-			c.JSON(500, "Opps! Server error")
+			utils.AbortWithError(c, fmt.Errorf("db.BeginTransaction(ctx). %w", err))
 			return
 		}
-		// tx, err := db.BeginTransaction()
-		// if err != nil {
-		// 	log.Fatalf("Failed to begin transaction: %v\n", err)
-		// }
-		//
-		// // Ensure that the transaction is rolled back in case of a panic or error
-		// defer func() {
-		// 	if p := recover(); p != nil {
-		// 		tx.Rollback()
-		// 		log.Fatalf("Panic occurred: %v\n", p)
-		// 	} else if err != nil {
-		// 		log.Println("Rolling back transaction due to error.")
-		// 		tx.Rollback()
-		// 	} else {
-		// 		err = tx.Commit()
-		// 		if err != nil {
-		// 			log.Fatalf("Failed to commit transaction: %v\n", err)
-		// 		}
-		// 		log.Println("Quoted content successfully")
-		// 	}
-		// }()
-		mints, err := cashu.GetTrustedMintFromOsEnv()
+		defer tx.Rollback()
+
+		blob, err := db.RemoveBlob(ctx, tx, hash)
 		if err != nil {
-			c.JSON(400, "Malformed request")
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.AbortWithError(c, utils.NewHTTPError(404, "Blob not found", nil))
+				return
+			}
+			utils.AbortWithError(c, fmt.Errorf("db.RemoveBlob(ctx, tx, hash). %w", err))
 			return
 		}
 
-		amount := xcashu.QuoteAmountToPay(length, cost)
-		fmt.Println("amount: ", amount)
-		paymentResponse := xcashu.PaymentQuoteResponse{
-			Amount: amount,
-			Unit:   xcashu.Sat,
-			Mints:  []string{mints},
-			Pubkey: wallet.GetActivePubkey(),
+		// only the uploader can delete a blob
+		if blob.Pubkey != pubkey {
+			utils.AbortWithError(c, utils.NewHTTPError(403, "Not the owner of the blob", nil))
+			return
 		}
 
-		jsonBytes, err := json.Marshal(paymentResponse)
+		err = tx.Commit()
 		if err != nil {
-			c.JSON(500, "Error request")
+			utils.AbortWithError(c, fmt.Errorf("tx.Commit(). %w", err))
 			return
 		}
 
-		encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
+		err = fileHandler.RemoveBlob(ctx, blob.Path)
+		if err != nil {
+			slog.ErrorContext(ctx, "fileHandler.RemoveBlob(ctx, blob.Path)", "error", err)
+		}
 
-		c.Header(xcashu.Xcashu, encodedPayReq)
-		c.JSON(402, nil)
-		return
+		c.JSON(200, n.NotifMessage{Message: "Blob deleted"})
 	})
-
 }
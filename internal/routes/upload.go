@@ -1,12 +1,14 @@
 package routes
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"ratasker/external/blossom"
 	n "ratasker/external/nostr"
 	"ratasker/external/xcashu"
@@ -14,32 +16,68 @@ import (
 	"ratasker/internal/core"
 	"ratasker/internal/database"
 	"ratasker/internal/io"
+	"ratasker/internal/utils"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
-func UploadRoutes(r *gin.Engine, wallet cashu.CashuWallet, db database.Database, fileHandler io.BlossomIO, cost uint64) {
-	r.HEAD("/upload", func(c *gin.Context) {
+func UploadRoutes(r *gin.Engine, wallet cashu.CashuWallet, db database.Database, fileHandler io.BlossomIO, cost uint64, policy core.PaymentPolicy, publisher *core.NIP94Publisher) {
+	r.HEAD("/upload", utils.NostrAuthMiddleware(n.UPLOAD), func(c *gin.Context) {
+		ctx := c.Request.Context()
 		sha256Header := c.GetHeader(blossom.XSHA256)
 		hash, err := hex.DecodeString(sha256Header)
 		if err != nil {
-			c.JSON(400, "No X-SHA-256 Header available")
+			utils.AbortWithError(c, utils.NewHTTPError(400, "No X-SHA-256 Header available", err))
+			return
+		}
+		err = core.CheckUploadAuth(ctx, db, policy, utils.GetNostrAuthPubkey(c))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.CheckUploadAuth(ctx, db, policy, pubkey). %w", err))
+			return
+		}
+		err = core.CheckNotBlocked(ctx, db, sha256Header, utils.GetNostrAuthPubkey(c))
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.CheckNotBlocked(ctx, db, sha256Header, pubkey). %w", err))
 			return
 		}
 
-		_, err = db.GetBlobLength(hash)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			log.Printf("Chunk already exists %x. %+v", hash[:], err)
+		_, err = db.GetBlobLength(ctx, hash)
+		if err == nil {
+			slog.InfoContext(ctx, "Chunk already exists", "sha256", hex.EncodeToString(hash[:]))
 			c.JSON(201, n.NotifMessage{Message: "chuck exists"})
 			return
-
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			utils.AbortWithError(c, fmt.Errorf("db.GetBlobLength(ctx, hash). %w", err))
+			return
 		}
 
 		quoteReq := c.GetHeader(blossom.XContentLength)
 		contentLenght, err := strconv.ParseInt(quoteReq, 10, 64)
 		if err != nil {
-			c.JSON(400, "No X-Content-Length Header available")
+			utils.AbortWithError(c, utils.NewHTTPError(400, "No X-Content-Length Header available", err))
+			return
+		}
+		if contentLenght <= 0 {
+			utils.AbortWithError(c, utils.NewHTTPError(400, "Blob is empty", core.ErrEmptyBlob))
+			return
+		}
+		err = policy.CheckBlobSize(uint64(contentLenght))
+		if err != nil {
+			utils.AbortWithError(c, utils.NewHTTPError(413, "Blob is too large", err))
+			return
+		}
+
+		// check storage limit before asking for a payment
+		pubkey := utils.GetNostrAuthPubkey(c)
+		err = checkStorageQuota(ctx, db, policy, pubkey, uint64(contentLenght))
+		if err != nil {
+			if errors.Is(err, core.ErrStorageQuotaExceeded) {
+				utils.AbortWithError(c, utils.NewHTTPError(413, "storage quota exceeded", nil))
+				return
+			}
+			utils.AbortWithError(c, fmt.Errorf("checkStorageQuota(ctx, db, policy, pubkey, contentLenght). %w", err))
 			return
 		}
 
@@ -65,22 +103,31 @@ func UploadRoutes(r *gin.Engine, wallet cashu.CashuWallet, db database.Database,
 		// 	}
 		// }()
 		//
-		mints, err := cashu.GetTrustedMintFromOsEnv()
+
+		amount := xcashu.QuoteAmountToPay(uint64(contentLenght), cost)
+		if amount == 0 || policy.IsAllowed(pubkey) {
+			c.Status(200)
+			return
+		}
+
+		freeBytes, err := freeBytesLeft(ctx, db, policy, pubkey)
 		if err != nil {
-			c.JSON(400, "Malformed request")
+			utils.AbortWithError(c, fmt.Errorf("freeBytesLeft(ctx, db, policy, pubkey). %w", err))
+			return
+		}
+		if freeBytes >= uint64(contentLenght) {
+			c.Status(200)
 			return
 		}
 
-		amount := xcashu.QuoteAmountToPay(uint64(contentLenght), cost)
-		paymentResponse := xcashu.PaymentQuoteResponse{
-			Amount: amount,
-			Unit:   xcashu.Sat,
-			Mints:  []string{mints},
-			Pubkey: wallet.GetActivePubkey(),
+		paymentResponse, err := core.NewPaymentQuote(wallet, amount)
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.NewPaymentQuote(wallet, amount). %w", err))
+			return
 		}
 		jsonBytes, err := json.Marshal(paymentResponse)
 		if err != nil {
-			c.JSON(500, "Error request")
+			utils.AbortWithError(c, fmt.Errorf("json.Marshal(paymentResponse). %w", err))
 			return
 		}
 		encodedPayReq := base64.URLEncoding.EncodeToString(jsonBytes)
@@ -89,14 +136,53 @@ func UploadRoutes(r *gin.Engine, wallet cashu.CashuWallet, db database.Database,
 		return
 	})
 
-	r.PUT("/upload", func(c *gin.Context) {
-		err := core.WriteBlobAndCharge(c, wallet, db, fileHandler, cost)
+	r.GET("/usage", utils.NostrAuthMiddleware(n.GET), func(c *gin.Context) {
+		ctx := c.Request.Context()
+		pubkey := utils.GetNostrAuthPubkey(c)
+		if pubkey == "" {
+			utils.AbortWithError(c, utils.NewHTTPError(401, "Missing auth event", nil))
+			return
+		}
 
+		tx, err := db.BeginTransaction(ctx)
 		if err != nil {
-			log.Printf("core.WriteBlobAndCharge(). %+v", err)
+			utils.AbortWithError(c, fmt.Errorf("db.BeginTransaction(ctx). %w", err))
+			return
+		}
+		defer tx.Rollback()
 
-			c.JSON(400, "Opps!")
+		usage, err := db.GetUsage(ctx, tx, pubkey)
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("db.GetUsage(ctx, tx, pubkey). %w", err))
+			return
 		}
 
+		type UsageResponse struct {
+			database.PubkeyUsage
+			MaxBytes uint64 `json:"max_bytes"`
+		}
+		c.JSON(200, UsageResponse{PubkeyUsage: usage, MaxBytes: policy.MaxStorageBytes})
+	})
+
+	r.PUT("/upload", utils.NostrAuthMiddleware(n.UPLOAD), func(c *gin.Context) {
+		err := core.WriteBlobAndCharge(c, wallet, db, fileHandler, cost, policy, publisher)
+		if err != nil {
+			utils.AbortWithError(c, fmt.Errorf("core.WriteBlobAndCharge(). %w", err))
+		}
 	})
 }
+
+// checkStorageQuota reads the usage of a pubkey outside of a payment transaction
+func checkStorageQuota(ctx context.Context, db database.Database, policy core.PaymentPolicy, pubkey string, bytes uint64) error {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		return fmt.Errorf("db.BeginTransaction(ctx). %w", err)
+	}
+	defer tx.Rollback()
+
+	err = policy.CheckStorageQuota(ctx, tx, db, pubkey, bytes)
+	if err != nil {
+		return fmt.Errorf("policy.CheckStorageQuota(ctx, tx, db, pubkey, bytes). %w", err)
+	}
+	return nil
+}
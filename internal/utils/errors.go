@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"ratasker/external/nostr"
+	"ratasker/internal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// XReason carries the error message as BUD-01 asks
+const XReason = "X-Reason"
+
+const (
+	ReasonServerError = "Server error"
+	ReasonServerBusy  = "Server busy, try again"
+)
+
+// HTTPError is what a handler answers when something fails. Reason goes to the client, Err is only logged
+type HTTPError struct {
+	Status int
+	Reason string
+	Err    error
+}
+
+func NewHTTPError(status int, reason string, err error) *HTTPError {
+	return &HTTPError{Status: status, Reason: reason, Err: err}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return fmt.Sprintf("%v. %v", e.Reason, e.Err)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// AsHTTPError gives the response for any error. Busy databases are 503 and unknown errors 500
+func AsHTTPError(err error) *HTTPError {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	if errors.Is(err, database.ErrDatabaseBusy) || database.IsBusy(err) || errors.Is(err, context.DeadlineExceeded) {
+		return NewHTTPError(503, ReasonServerBusy, err)
+	}
+	return NewHTTPError(500, ReasonServerError, err)
+}
+
+// AbortWithError logs err and writes the JSON body and the X-Reason header
+func AbortWithError(c *gin.Context, err error) {
+	httpErr := AsHTTPError(err)
+	ctx := c.Request.Context()
+	if httpErr.Status >= 500 {
+		slog.ErrorContext(ctx, httpErr.Reason, "status", httpErr.Status, "error", httpErr.Err)
+	} else if httpErr.Err != nil {
+		slog.InfoContext(ctx, httpErr.Reason, "status", httpErr.Status, "error", httpErr.Err)
+	}
+
+	if httpErr.Status == 503 {
+		c.Header("Retry-After", "1")
+	}
+	c.Header(XReason, httpErr.Reason)
+	c.AbortWithStatusJSON(httpErr.Status, nostr.NotifMessage{Message: httpErr.Reason})
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"ratasker/internal/database"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAbortWithError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		err    error
+		status int
+		reason string
+	}{
+		{NewHTTPError(413, "Storage quota exceeded", errors.New("quota")), 413, "Storage quota exceeded"},
+		{fmt.Errorf("core.WriteBlobAndCharge(). %w", NewHTTPError(402, "Payment required", nil)), 402, "Payment required"},
+		{fmt.Errorf("database.WithTx(ctx, db, fn). %w", database.ErrDatabaseBusy), 503, ReasonServerBusy},
+		{errors.New("disk on fire"), 500, ReasonServerError},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/", nil)
+
+		AbortWithError(c, tc.err)
+
+		if w.Code != tc.status || w.Header().Get(XReason) != tc.reason {
+			t.Errorf("%v: expected %v %v. got %v %v", tc.err, tc.status, tc.reason, w.Code, w.Header().Get(XReason))
+		}
+		if w.Body.String() != fmt.Sprintf(`{"message":"%v"}`, tc.reason) {
+			t.Errorf("wrong body %v", w.Body.String())
+		}
+		if !c.IsAborted() {
+			t.Errorf("the request should be aborted")
+		}
+	}
+}
@@ -1,4 +1,75 @@
 package utils
 
+import (
+	"fmt"
+	"ratasker/external/blossom"
+	"ratasker/external/nostr"
+
+	"github.com/gin-gonic/gin"
+	n "github.com/nbd-wtf/go-nostr"
+)
+
 const NOSTRAUTH = "NOSTRAUTH"
 const DOMAIN = "DOMAIN"
+
+// NostrAuthMiddleware validates the BUD-01 auth event if the request has one.
+// Requests without an Authorization header are let through as anonymous.
+func NostrAuthMiddleware(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.Next()
+			return
+		}
+
+		event, err := nostr.ParseNostrHeader(authHeader)
+		if err != nil {
+			AbortWithError(c, NewHTTPError(401, "Missing auth event", fmt.Errorf("nostr.ParseNostrHeader(authHeader). %w", err)))
+			return
+		}
+
+		// the hash comes in the url for downloads and in a header for uploads
+		sha, _, _ := blossom.ParseBlobPath(c.Param("sha"))
+		if sha == "" {
+			sha = c.GetHeader(blossom.XSHA256)
+		}
+
+		err = nostr.ValidateAuthEventFor(event, action, sha)
+		if err != nil {
+			AbortWithError(c, NewHTTPError(401, "Invalid nostr event", fmt.Errorf("nostr.ValidateAuthEventFor(event, action, sha). %w", err)))
+			return
+		}
+
+		c.Set(NOSTRAUTH, event)
+		c.Next()
+	}
+}
+
+// GetNostrAuthEvent returns the validated auth event. false for anonymous requests
+func GetNostrAuthEvent(c *gin.Context) (n.Event, bool) {
+	value, exists := c.Get(NOSTRAUTH)
+	if !exists {
+		return n.Event{}, false
+	}
+	event, ok := value.(n.Event)
+	return event, ok
+}
+
+// GetNostrAuthPubkeyFor returns the pubkey only when the auth event has the x tag of the blob.
+// Free and allowlisted downloads use it, a leaked event without x tags must not download every blob for free
+func GetNostrAuthPubkeyFor(c *gin.Context, sha string) string {
+	event, ok := GetNostrAuthEvent(c)
+	if !ok || !event.Tags.ContainsAny("x", []string{sha}) {
+		return ""
+	}
+	return event.PubKey
+}
+
+// GetNostrAuthPubkey returns the hex pubkey of the auth event or an empty string for anonymous requests
+func GetNostrAuthPubkey(c *gin.Context) string {
+	event, ok := GetNostrAuthEvent(c)
+	if !ok {
+		return ""
+	}
+	return event.PubKey
+}
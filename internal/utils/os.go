@@ -30,9 +30,9 @@ func MakeSureFilePathExists(dirPath string, filename string) error {
 	_, err := os.Stat(dirPath)
 
 	if os.IsNotExist(err) {
-		err = os.MkdirAll(dirPath, 0764)
+		err = os.MkdirAll(dirPath, 0755)
 		if err != nil {
-			return fmt.Errorf("os.MkdirAll(pathToProjectDir, 0764) %w", err)
+			return fmt.Errorf("os.MkdirAll(pathToProjectDir, 0755) %w", err)
 		}
 	}
 
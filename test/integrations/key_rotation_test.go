@@ -29,9 +29,9 @@ func TestKeyRotation(t *testing.T) {
 		t.Fatalf("Could not setup db")
 	}
 
-	nativeWallet, err := cashu.NewDBLocalWallet(TEST_SEED, sqlite)
+	nativeWallet, err := cashu.NewDBLocalWallet(ctx, TEST_SEED, sqlite)
 	if err != nil {
-		t.Fatalf("cashu.NewDBLocalWallet(TEST_SEED, sqlite). %+v", err)
+		t.Fatalf("cashu.NewDBLocalWallet(ctx, TEST_SEED, sqlite). %+v", err)
 	}
 
 	// setup wallet to get proofs for storing into locked proofs
@@ -66,20 +66,20 @@ func TestKeyRotation(t *testing.T) {
 		t.Fatalf(" \n c.NewTokenV4(proofs, senderWallet.CurrentMint(), c.Sat, true ) %+v", err)
 	}
 
-	tx, err := sqlite.BeginTransaction()
+	tx, err := sqlite.BeginTransaction(ctx)
 	if err != nil {
-		t.Fatalf(" \n sqlite.BeginTransaction() %+v", err)
+		t.Fatalf(" \n sqlite.BeginTransaction(ctx) %+v", err)
 	}
 
 	// Store locked Proofs
-	err = nativeWallet.StoreEcash(tokenForProofs, tx, sqlite)
+	err = nativeWallet.StoreEcash(ctx, tokenForProofs, tx, sqlite)
 	if err != nil {
-		t.Fatalf(" \n nativeWallet.StoreEcash(tokenForProofs, tx, sqlite) %+v", err)
+		t.Fatalf(" \n nativeWallet.StoreEcash(ctx, tokenForProofs, tx, sqlite) %+v", err)
 	}
 
-	err = core.RotateLockedProofs(&nativeWallet, sqlite, tx)
+	err = core.RotateLockedProofs(ctx, &nativeWallet, sqlite, tx)
 	if err != nil {
-		t.Fatalf(" \n core.RotateLockedProofs(&nativeWallet, sqlite) %+v", err)
+		t.Fatalf(" \n core.RotateLockedProofs(ctx, &nativeWallet, sqlite) %+v", err)
 	}
 
 	err = tx.Commit()